@@ -0,0 +1,168 @@
+package phantomjs
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// Default annotation settings.
+const (
+	DefaultAnnotationFont   = "bold 12px sans-serif"
+	DefaultAnnotationStroke = 2
+)
+
+// DefaultAnnotationColor is the color of annotations which do not set one.
+var DefaultAnnotationColor color.Color = color.RGBA{R: 0xE0, A: 0xFF}
+
+// Annotation represents a box drawn around every element matching Selector
+// on a rendered image, such as to highlight a broken layout in a bug report
+// or the elements a scraper extracts.
+type Annotation struct {
+	Selector string
+
+	// Text drawn above the top-left corner of each box, or inside it if the
+	// box is at the top of the image. Labels are rendered by PhantomJS in
+	// white on Color with the CSS Font, which defaults to
+	// DefaultAnnotationFont. No label is drawn if blank.
+	Label string
+	Font  string
+
+	// Color of the box and label background. Defaults to
+	// DefaultAnnotationColor.
+	Color color.Color
+
+	// Width of the box's outline in CSS pixels. Defaults to
+	// DefaultAnnotationStroke. A negative width fills the box with Color
+	// instead, which is useful with a translucent color.
+	Stroke int
+}
+
+// color returns the annotation's color, applying the default.
+func (a *Annotation) color() color.Color {
+	if a.Color == nil {
+		return DefaultAnnotationColor
+	}
+	return a.Color
+}
+
+// annotationLabels returns an image of each annotation's label, or nil for
+// annotations without one. All labels are rendered in a single pass with a
+// temporary page.
+func (p *WebPage) annotationLabels(annotations []Annotation, scale float64) ([]image.Image, error) {
+	var buf strings.Builder
+	var n int
+	for _, a := range annotations {
+		if a.Label == "" {
+			continue
+		}
+		font := a.Font
+		if font == "" {
+			font = DefaultAnnotationFont
+		}
+		c := color.NRGBAModel.Convert(a.color()).(color.NRGBA)
+		fmt.Fprintf(&buf, `<div><span class="label" style="display:inline-block;white-space:nowrap;padding:2px 4px;color:#fff;font:%s;background:rgba(%d,%d,%d,%.3f)">%s</span></div>`,
+			html.EscapeString(font), c.R, c.G, c.B, float64(c.A)/0xFF, html.EscapeString(a.Label))
+		n++
+	}
+
+	labels := make([]image.Image, len(annotations))
+	if n == 0 {
+		return labels, nil
+	}
+
+	page, err := p.ref.process.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err := page.SetContent(`<html><body style="margin:0;background:transparent">` + buf.String() + `</body></html>`); err != nil {
+		return nil, err
+	}
+	rects, err := page.BoundingRects(".label")
+	if err != nil {
+		return nil, err
+	} else if len(rects) != n {
+		return nil, ErrElementNotFound
+	}
+	img, err := page.RenderImage(RenderOptions{Format: "png", Scale: scale})
+	if err != nil {
+		return nil, err
+	}
+
+	// Crop each label from the rendered page.
+	for i, a := range annotations {
+		if a.Label == "" {
+			continue
+		}
+		r := scaleRect(rects[0], Rect{}, scale).Intersect(img.Bounds())
+		rects = rects[1:]
+
+		label := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(label, label.Bounds(), img, r.Min, draw.Src)
+		labels[i] = label
+	}
+	return labels, nil
+}
+
+// drawAnnotations returns a copy of img with a box and label drawn for each
+// rect. Rects are in page coordinates and are offset by the clip rect and
+// scaled to the density of img.
+func drawAnnotations(img image.Image, annotations []Annotation, rects [][]Rect, labels []image.Image, clip Rect, scale float64) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	for i, a := range annotations {
+		src := image.NewUniform(a.color())
+		stroke := a.Stroke
+		if stroke == 0 {
+			stroke = DefaultAnnotationStroke
+		}
+		width := max1(int(math.Round(float64(stroke) * scale)))
+
+		for _, rect := range rects[i] {
+			r := scaleRect(rect, clip, scale).Add(b.Min)
+			if stroke < 0 {
+				draw.Draw(out, r, src, image.ZP, draw.Over)
+			} else {
+				for _, edge := range []image.Rectangle{
+					image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+width),
+					image.Rect(r.Min.X, r.Max.Y-width, r.Max.X, r.Max.Y),
+					image.Rect(r.Min.X, r.Min.Y+width, r.Min.X+width, r.Max.Y-width),
+					image.Rect(r.Max.X-width, r.Min.Y+width, r.Max.X, r.Max.Y-width),
+				} {
+					draw.Draw(out, edge, src, image.ZP, draw.Over)
+				}
+			}
+
+			// Place the label above the box, or inside it if there is
+			// no room above.
+			if label := labels[i]; label != nil {
+				size := label.Bounds().Size()
+				pt := image.Pt(r.Min.X, r.Min.Y-size.Y)
+				if pt.Y < b.Min.Y {
+					pt.Y = r.Min.Y
+				}
+				draw.Draw(out, image.Rectangle{Min: pt, Max: pt.Add(size)}, label, label.Bounds().Min, draw.Over)
+			}
+		}
+	}
+	return out
+}
+
+// scaleRect converts rect from page coordinates to the pixels of an image
+// rendered with clip at scale.
+func scaleRect(rect, clip Rect, scale float64) image.Rectangle {
+	return image.Rect(
+		int(math.Floor((rect.Left-clip.Left)*scale)),
+		int(math.Floor((rect.Top-clip.Top)*scale)),
+		int(math.Ceil((rect.Left-clip.Left+rect.Width)*scale)),
+		int(math.Ceil((rect.Top-clip.Top+rect.Height)*scale)),
+	)
+}
@@ -0,0 +1,278 @@
+package phantomjs
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pageResource is a subresource loaded by a page, such as an image or
+// stylesheet.
+type pageResource struct {
+	URL         string
+	ContentType string
+	Data        []byte
+}
+
+// resources returns the subresources loaded by the page since it was last
+// opened. Bodies captured by the process' capture proxy are used when
+// available and other resources are re-fetched the same as Downloads().
+// Resources which failed to load or cannot be re-fetched are skipped.
+func (p *WebPage) resources() ([]*pageResource, error) {
+	pageURL, err := p.URL()
+	if err != nil {
+		return nil, err
+	}
+	har, err := p.HAR()
+	if err != nil {
+		return nil, err
+	}
+	client, jar, err := p.ref.process.downloadClient()
+	if err != nil {
+		return nil, err
+	}
+
+	captured := make(map[string]*CapturedResponse)
+	for _, resp := range p.Responses() {
+		if resp.Method == "GET" && resp.Status == http.StatusOK && !resp.Truncated {
+			captured[resp.URL] = resp
+		}
+	}
+
+	var a []*pageResource
+	seen := map[string]bool{pageURL: true}
+	for _, e := range har.Log.Entries {
+		u := e.Request.URL
+		if seen[u] || e.Request.Method != "GET" || e.Response.Status != http.StatusOK || e.Error != "" {
+			continue
+		} else if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			continue
+		}
+		seen[u] = true
+
+		r := &pageResource{URL: u, ContentType: e.Response.Content.MimeType}
+		if resp := captured[u]; resp != nil {
+			r.Data = resp.Body
+		} else {
+			header := make(http.Header)
+			for _, h := range e.Request.Headers {
+				header.Add(h.Name, h.Value)
+			}
+			if r.Data, err = fetchResource(client, jar, u, header); err != nil {
+				continue
+			}
+		}
+		a = append(a, r)
+	}
+	return a, nil
+}
+
+// SaveMHTML writes the page's rendered content and the resources it loaded,
+// such as images and stylesheets, to w as a single MHTML archive. Archives
+// can be opened by browsers for offline viewing or kept as an audit trail.
+//
+// Resources are taken from the responses captured for the page, if any, and
+// are otherwise re-fetched the same as Downloads(). Resources which cannot
+// be fetched are left out of the archive.
+func (p *WebPage) SaveMHTML(w io.Writer) error {
+	pageURL, err := p.URL()
+	if err != nil {
+		return err
+	}
+	title, err := p.Title()
+	if err != nil {
+		return err
+	}
+	content, err := p.Content()
+	if err != nil {
+		return err
+	}
+	resources, err := p.resources()
+	if err != nil {
+		return err
+	}
+	return writeMHTML(w, pageURL, title, content, resources, time.Now())
+}
+
+// writeMHTML writes an MHTML archive of a document and its resources to w.
+func writeMHTML(w io.Writer, pageURL, title, content string, resources []*pageResource, t time.Time) error {
+	bw := bufio.NewWriter(w)
+	mw := multipart.NewWriter(bw)
+
+	fmt.Fprintf(bw, "From: <Saved by PhantomJS>\r\n")
+	fmt.Fprintf(bw, "Snapshot-Content-Location: %s\r\n", pageURL)
+	fmt.Fprintf(bw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", title))
+	fmt.Fprintf(bw, "Date: %s\r\n", t.Format(time.RFC1123Z))
+	fmt.Fprintf(bw, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(bw, "Content-Type: multipart/related; type=\"text/html\"; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	// Write the document as quoted-printable so it stays readable.
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+		"Content-Location":          {pageURL},
+	})
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(part)
+	if _, err := io.WriteString(qw, content); err != nil {
+		return err
+	} else if err := qw.Close(); err != nil {
+		return err
+	}
+
+	// Write resources as base64 in lines of 76 characters.
+	for _, r := range resources {
+		contentType := r.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Location":          {r.URL},
+		})
+		if err != nil {
+			return err
+		}
+
+		data := base64.StdEncoding.EncodeToString(r.Data)
+		for len(data) > 0 {
+			n := 76
+			if len(data) < n {
+				n = len(data)
+			}
+			if _, err := io.WriteString(part, data[:n]+"\r\n"); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// SaveComplete writes the page's rendered content to dir/index.html and the
+// resources it loaded to dir/files so the page can be browsed offline. Links
+// in src and href attributes and in CSS url() references which point to a
+// saved resource are rewritten to the local copy. The directory is created
+// if it does not exist.
+//
+// Resources are collected the same as SaveMHTML().
+func (p *WebPage) SaveComplete(dir string) error {
+	pageURL, err := p.URL()
+	if err != nil {
+		return err
+	}
+	content, err := p.Content()
+	if err != nil {
+		return err
+	}
+	resources, err := p.resources()
+	if err != nil {
+		return err
+	}
+
+	// Assign each resource a unique file name.
+	filenames := make(map[string]string, len(resources))
+	for i, r := range resources {
+		filenames[r.URL] = resourceFilename(i, r.URL)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0777); err != nil {
+		return err
+	}
+	for _, r := range resources {
+		data := r.Data
+		if strings.HasPrefix(r.ContentType, "text/css") {
+			data = []byte(rewriteCSSLinks(string(data), r.URL, "", filenames))
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "files", filenames[r.URL]), data, 0666); err != nil {
+			return err
+		}
+	}
+
+	content = rewriteHTMLLinks(content, pageURL, "files/", filenames)
+	return ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0666)
+}
+
+var (
+	htmlLinkRegexp = regexp.MustCompile(`(?i)(\s(?:src|href|poster)\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+	cssLinkRegexp  = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")\s]*))\s*\)`)
+	unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// resourceFilename returns the local file name of the i-th resource. The
+// index keeps names unique and the URL's base name keeps its extension.
+func resourceFilename(i int, rawurl string) string {
+	name := "resource"
+	if u, err := url.Parse(rawurl); err == nil {
+		if base := unsafeFilename.ReplaceAllString(path.Base(u.Path), "_"); base != "" && base != "." && base != "_" {
+			name = base
+		}
+	}
+	return fmt.Sprintf("%d-%s", i, name)
+}
+
+// localLink returns the local path of ref, relative to base, if it was saved.
+func localLink(ref, base, prefix string, filenames map[string]string) (string, bool) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", false
+	}
+	u, err := b.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", false
+	}
+	u.Fragment = ""
+	name, ok := filenames[u.String()]
+	if !ok {
+		return "", false
+	}
+	return prefix + name, true
+}
+
+// rewriteHTMLLinks rewrites links in attributes and inline CSS of content
+// which point to saved resources.
+func rewriteHTMLLinks(content, base, prefix string, filenames map[string]string) string {
+	content = htmlLinkRegexp.ReplaceAllStringFunc(content, func(s string) string {
+		m := htmlLinkRegexp.FindStringSubmatch(s)
+		ref := m[2] + m[3]
+		if local, ok := localLink(html.UnescapeString(ref), base, prefix, filenames); ok {
+			return m[1] + `"` + html.EscapeString(local) + `"`
+		}
+		return s
+	})
+	return rewriteCSSLinks(content, base, prefix, filenames)
+}
+
+// rewriteCSSLinks rewrites url() references in content which point to saved
+// resources.
+func rewriteCSSLinks(content, base, prefix string, filenames map[string]string) string {
+	return cssLinkRegexp.ReplaceAllStringFunc(content, func(s string) string {
+		m := cssLinkRegexp.FindStringSubmatch(s)
+		if local, ok := localLink(m[1]+m[2]+m[3], base, prefix, filenames); ok {
+			return "url(" + local + ")"
+		}
+		return s
+	})
+}
@@ -0,0 +1,95 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DefaultReadabilityURL is the URL Mozilla's Readability is loaded from by
+// Article() when the page does not already define it.
+const DefaultReadabilityURL = "https://cdn.jsdelivr.net/npm/@mozilla/readability@0.4.4/Readability.js"
+
+var (
+	// ErrReadabilityNotLoaded is returned by Article() when Readability is
+	// not available in the page after injecting it.
+	ErrReadabilityNotLoaded = errors.New("readability not loaded")
+
+	// ErrNoArticle is returned by Article() when no article content could
+	// be found in the page.
+	ErrNoArticle = errors.New("no article found")
+)
+
+// Article represents the main content of a page as extracted by Readability.
+type Article struct {
+	Title    string `json:"title"`
+	Byline   string `json:"byline"`
+	SiteName string `json:"siteName"`
+	Excerpt  string `json:"excerpt"`
+
+	// Cleaned HTML of the article and its text content.
+	HTML string `json:"content"`
+	Text string `json:"textContent"`
+}
+
+// Article extracts the main content of the page, such as a news story or
+// blog post, with Mozilla's Readability. The page's document is not modified.
+//
+// Readability is loaded from DefaultReadabilityURL unless the page already
+// defines it, such as after injecting a local copy with InjectJS(). Returns
+// ErrNoArticle if no content could be extracted.
+func (p *WebPage) Article() (*Article, error) {
+	if err := p.injectReadability(); err != nil {
+		return nil, err
+	}
+
+	// Readability modifies the document it parses so parse a copy. Results
+	// are returned as JSON so they decode directly into an Article.
+	v, err := p.Evaluate(`function() {
+		var article = new Readability(document.cloneNode(true)).parse();
+		return article ? JSON.stringify(article) : null;
+	}`)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := v.(string)
+	if s == "" {
+		return nil, ErrNoArticle
+	}
+
+	var article Article
+	if err := json.Unmarshal([]byte(s), &article); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid article: %s", err)
+	}
+	return &article, nil
+}
+
+// injectReadability loads Readability into the page unless it is defined.
+func (p *WebPage) injectReadability() error {
+	if loaded, err := p.readabilityLoaded(); err != nil {
+		return err
+	} else if loaded {
+		return nil
+	}
+
+	if err := p.IncludeJS(DefaultReadabilityURL); err != nil {
+		return err
+	}
+
+	if loaded, err := p.readabilityLoaded(); err != nil {
+		return err
+	} else if !loaded {
+		return ErrReadabilityNotLoaded
+	}
+	return nil
+}
+
+// readabilityLoaded returns true if Readability is defined in the page.
+func (p *WebPage) readabilityLoaded() (bool, error) {
+	v, err := p.Evaluate(`function() { return typeof Readability === "function" }`)
+	if err != nil {
+		return false, err
+	}
+	loaded, _ := v.(bool)
+	return loaded, nil
+}
@@ -0,0 +1,190 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultAuditTimeout is the default time allowed for an audit to complete.
+const DefaultAuditTimeout = 30 * time.Second
+
+var (
+	// ErrAxeNotLoaded is returned by Audit() when axe-core is not available
+	// in the page after injecting it.
+	ErrAxeNotLoaded = errors.New("axe-core not loaded")
+
+	// ErrAxeRequired is returned by Audit() when the page does not define
+	// axe-core and no script is given in AuditOptions.
+	ErrAxeRequired = errors.New("axe-core source, path, or url required")
+)
+
+// AuditOptions represents options for an accessibility audit.
+//
+// The axe-core script is taken from the first of Source, Path, and URL which
+// is set. It is not injected if the page already defines "axe". No script is
+// bundled so one must be given unless the page loads axe-core itself. Version
+// 3.5 is the last release which runs on PhantomJS' ES5 engine.
+type AuditOptions struct {
+	// JavaScript source of axe-core, such as a bundled copy of axe.min.js.
+	Source string
+
+	// Path of axe.min.js on the local filesystem. Relative paths are
+	// resolved the same as in WebPage.InjectJS().
+	Path string
+
+	// URL axe-core is loaded from. The page fetches the script itself so
+	// this adds a request to a third party, such as a CDN, to every audit.
+	URL string
+
+	// CSS selector of the element to audit. Defaults to the whole document.
+	Context string
+
+	// Rule IDs or tags, such as "wcag2aa", to run. Runs all rules if empty.
+	RunOnly []string
+
+	// Maximum time to wait for the audit. Defaults to DefaultAuditTimeout.
+	Timeout time.Duration
+}
+
+// AuditResult represents the results of an accessibility audit.
+type AuditResult struct {
+	URL        string      `json:"url"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Violations []AuditRule `json:"violations"`
+	Incomplete []AuditRule `json:"incomplete"`
+	Passes     []AuditRule `json:"passes"`
+}
+
+// AuditRule represents the result of a single axe-core rule.
+type AuditRule struct {
+	ID          string      `json:"id"`
+	Impact      string      `json:"impact"` // "minor", "moderate", "serious", or "critical"
+	Description string      `json:"description"`
+	Help        string      `json:"help"`
+	HelpURL     string      `json:"helpUrl"`
+	Tags        []string    `json:"tags"`
+	Nodes       []AuditNode `json:"nodes"`
+}
+
+// AuditNode represents an element checked by a rule.
+type AuditNode struct {
+	HTML           string   `json:"html"`
+	Target         []string `json:"target"`
+	Impact         string   `json:"impact"`
+	FailureSummary string   `json:"failureSummary"`
+}
+
+// Audit injects axe-core into the page, runs it against the current
+// document, and returns the results. Returns ErrTimeout if the audit does
+// not finish within the timeout.
+func (p *WebPage) Audit(opt AuditOptions) (*AuditResult, error) {
+	if opt.Timeout == 0 {
+		opt.Timeout = DefaultAuditTimeout
+	}
+
+	if err := p.injectAxe(opt); err != nil {
+		return nil, err
+	}
+
+	// Start the audit. Results are stored on the window as axe.run() is async.
+	runOnly := "null"
+	if len(opt.RunOnly) > 0 {
+		buf, _ := json.Marshal(opt.RunOnly)
+		runOnly = string(buf)
+	}
+	context := "document"
+	if opt.Context != "" {
+		buf, _ := json.Marshal(opt.Context)
+		context = string(buf)
+	}
+	if _, err := p.Evaluate(fmt.Sprintf(`function() {
+		window.__phantomjsAudit = null;
+		var options = {};
+		var runOnly = %s;
+		if (runOnly) { options.runOnly = runOnly; }
+		axe.run(%s, options, function(err, results) {
+			window.__phantomjsAudit = err ? {error: String(err)} : {results: results};
+		});
+	}`, runOnly, context)); err != nil {
+		return nil, err
+	}
+
+	if err := p.WaitForFunction(`function() { return window.__phantomjsAudit !== null }`, opt.Timeout, 0); err != nil {
+		return nil, err
+	}
+
+	// Retrieve results as JSON so they decode directly into typed results.
+	v, err := p.Evaluate(`function() {
+		var audit = window.__phantomjsAudit;
+		delete window.__phantomjsAudit;
+		return JSON.stringify(audit);
+	}`)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := v.(string)
+
+	var resp struct {
+		Error   string       `json:"error"`
+		Results *AuditResult `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(s), &resp); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid audit results: %s", err)
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	} else if resp.Results == nil {
+		return nil, errors.New("phantomjs: missing audit results")
+	}
+	return resp.Results, nil
+}
+
+// injectAxe loads axe-core into the page unless it is already defined.
+func (p *WebPage) injectAxe(opt AuditOptions) error {
+	if loaded, err := p.axeLoaded(); err != nil {
+		return err
+	} else if loaded {
+		return nil
+	}
+
+	switch {
+	case opt.Source != "":
+		// Evaluate source through a script element so it runs in global scope.
+		source, _ := json.Marshal(opt.Source)
+		if _, err := p.Evaluate(fmt.Sprintf(`function() {
+			var script = document.createElement("script");
+			script.text = %s;
+			(document.head || document.documentElement).appendChild(script);
+		}`, source)); err != nil {
+			return err
+		}
+	case opt.Path != "":
+		if err := p.InjectJS(opt.Path); err != nil {
+			return err
+		}
+	case opt.URL != "":
+		if err := p.IncludeJS(opt.URL); err != nil {
+			return err
+		}
+	default:
+		return ErrAxeRequired
+	}
+
+	if loaded, err := p.axeLoaded(); err != nil {
+		return err
+	} else if !loaded {
+		return ErrAxeNotLoaded
+	}
+	return nil
+}
+
+// axeLoaded returns true if axe-core is defined in the page.
+func (p *WebPage) axeLoaded() (bool, error) {
+	v, err := p.Evaluate(`function() { return typeof axe !== "undefined" && typeof axe.run === "function" }`)
+	if err != nil {
+		return false, err
+	}
+	loaded, _ := v.(bool)
+	return loaded, nil
+}
@@ -0,0 +1,64 @@
+package phantomjs
+
+// pageProperties holds the cached property values of a page. Nil fields have
+// not been cached.
+type pageProperties struct {
+	settings    *WebPageSettings
+	viewport    *sizeJSON
+	libraryPath *string
+}
+
+// loadProperties returns the cached properties of the page with id and the
+// page's cache generation, which must be passed to storeProperties().
+func (p *Process) loadProperties(id string) (pageProperties, int) {
+	p.propMu.Lock()
+	defer p.propMu.Unlock()
+	if !p.CacheProperties || p.props[id] == nil {
+		return pageProperties{}, p.propGen[id]
+	}
+	return *p.props[id], p.propGen[id]
+}
+
+// storeProperties updates the cached properties of the page with id. The
+// update is dropped if caching is disabled or the page's properties were
+// invalidated since gen was loaded, as the value may be stale.
+func (p *Process) storeProperties(id string, gen int, fn func(*pageProperties)) {
+	p.propMu.Lock()
+	defer p.propMu.Unlock()
+	if !p.CacheProperties || p.propGen[id] != gen {
+		return
+	}
+
+	if p.props == nil {
+		p.props = make(map[string]*pageProperties)
+	}
+	if p.props[id] == nil {
+		p.props[id] = &pageProperties{}
+	}
+	fn(p.props[id])
+}
+
+// invalidateProperties removes the cached properties of the page with id.
+func (p *Process) invalidateProperties(id string) {
+	p.propMu.Lock()
+	defer p.propMu.Unlock()
+	delete(p.props, id)
+	if p.propGen == nil {
+		p.propGen = make(map[string]int)
+	}
+	p.propGen[id]++
+}
+
+// forgetProperties removes the cache of a page which has been closed.
+func (p *Process) forgetProperties(id string) {
+	p.propMu.Lock()
+	defer p.propMu.Unlock()
+	delete(p.props, id)
+	delete(p.propGen, id)
+}
+
+// invalidateProperties removes the page's cached properties. It is deferred
+// by setters and navigation methods so it runs after the change is made.
+func (p *WebPage) invalidateProperties() {
+	p.ref.process.invalidateProperties(p.ref.id)
+}
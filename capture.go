@@ -0,0 +1,356 @@
+package phantomjs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureHeader is the request header added by the shim to requests whose
+// responses should be captured. Its value is "<ref>:<request id>".
+const captureHeader = "X-Phantomjs-Capture"
+
+// pageHeader is the request header added by the shim to requests from pages
+// with network conditions. Its value is the page's ref.
+const pageHeader = "X-Phantomjs-Page"
+
+// Capture limits.
+const (
+	// Maximum size of a captured response body. Larger bodies are truncated.
+	maxCaptureBodySize = 10 << 20
+
+	// Maximum number of responses retained per page.
+	maxCapturedResponses = 1000
+)
+
+// CapturedResponse represents a response whose body was captured by the
+// process' capture proxy.
+type CapturedResponse struct {
+	RequestID int // matches ResourceRequest.ID
+	Method    string
+	URL       string
+	Status    int
+	Header    http.Header
+	Body      []byte
+
+	// True if the body exceeded the capture limit and was truncated.
+	Truncated bool
+}
+
+// captureProxy is an HTTP proxy which records response bodies and simulates
+// network conditions for requests tagged by the shim. HTTPS requests are
+// tunneled so they cannot be captured and are throttled per connection.
+type captureProxy struct {
+	mu         sync.Mutex
+	ln         net.Listener
+	responses  map[string][]*CapturedResponse
+	conditions map[string]*pageThrottle
+
+	// Closed and replaced each time a response is captured.
+	added chan struct{}
+
+	// Returns the ref of the page which opened a tunnel to a host.
+	owner func(host string) string
+
+	transport *http.Transport
+}
+
+// newCaptureProxy returns a new capture proxy.
+func newCaptureProxy() *captureProxy {
+	return &captureProxy{
+		responses:  make(map[string][]*CapturedResponse),
+		conditions: make(map[string]*pageThrottle),
+		added:      make(chan struct{}),
+		transport:  &http.Transport{Proxy: nil},
+	}
+}
+
+// Open starts listening on a random local port.
+func (p *captureProxy) Open() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+
+	go http.Serve(ln, p)
+	return nil
+}
+
+// Close stops the proxy.
+func (p *captureProxy) Close() error {
+	if p.ln != nil {
+		return p.ln.Close()
+	}
+	return nil
+}
+
+// Addr returns the network address of the proxy.
+func (p *captureProxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Responses returns a copy of the responses captured for a page.
+func (p *captureProxy) Responses(id string) []*CapturedResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*CapturedResponse(nil), p.responses[id]...)
+}
+
+// Wait returns the response captured for a page's request, waiting until it
+// is captured. Returns nil if it is not captured within timeout.
+func (p *captureProxy) Wait(id string, requestID int, timeout time.Duration) *CapturedResponse {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		for _, r := range p.responses[id] {
+			if r.RequestID == requestID {
+				p.mu.Unlock()
+				return r
+			}
+		}
+		added := p.added
+		p.mu.Unlock()
+
+		select {
+		case <-added:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// Clear removes the responses captured for a page.
+func (p *captureProxy) Clear(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.responses, id)
+}
+
+// Conditions returns the network conditions of a page.
+func (p *captureProxy) Conditions(id string) (NetworkConditions, bool) {
+	if t := p.throttle(id); t != nil {
+		return t.NetworkConditions, true
+	}
+	return NetworkConditions{}, false
+}
+
+// SetConditions sets the network conditions of a page. Zero conditions are
+// removed. Connections already open keep the previous limits.
+func (p *captureProxy) SetConditions(id string, c NetworkConditions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c == (NetworkConditions{}) {
+		delete(p.conditions, id)
+		return
+	}
+	p.conditions[id] = newPageThrottle(c)
+}
+
+// throttle returns the throttle of a page or nil if it has no conditions.
+func (p *captureProxy) throttle(id string) *pageThrottle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conditions[id]
+}
+
+// throttled returns true if any page has network conditions.
+func (p *captureProxy) throttled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conditions) > 0
+}
+
+// add records a captured response for a page.
+func (p *captureProxy) add(id string, resp *CapturedResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := append(p.responses[id], resp)
+	if len(a) > maxCapturedResponses {
+		a = a[len(a)-maxCapturedResponses:]
+	}
+	p.responses[id] = a
+
+	// Wake any waiters.
+	close(p.added)
+	p.added = make(chan struct{})
+}
+
+// ServeHTTP proxies a request and captures the response body if tagged.
+func (p *captureProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		p.tunnel(w, r)
+		return
+	}
+
+	// Remove capture and page tags before forwarding.
+	tag := r.Header.Get(captureHeader)
+	r.Header.Del(captureHeader)
+	throttle := p.throttle(r.Header.Get(pageHeader))
+	r.Header.Del(pageHeader)
+
+	// Simulate latency and throttle the upload of the request body.
+	if throttle == nil {
+		throttle = &pageThrottle{}
+	}
+	time.Sleep(throttle.Latency)
+	if r.Body != nil && throttle.up != nil {
+		r.Body = ioutil.NopCloser(throttle.up.Reader(r.Body))
+	}
+
+	// Forward request upstream.
+	r.RequestURI = ""
+	removeHopHeaders(r.Header)
+	resp, err := p.transport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	body := throttle.down.Reader(resp.Body)
+
+	// Copy response to the client, teeing the body if it is being captured.
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if tag == "" {
+		io.Copy(w, body)
+		return
+	}
+
+	var buf bytes.Buffer
+	io.Copy(w, io.TeeReader(body, &limitedWriter{w: &buf, n: maxCaptureBodySize + 1}))
+
+	id, requestID := parseCaptureTag(tag)
+	captured := &CapturedResponse{
+		RequestID: requestID,
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Status:    resp.StatusCode,
+		Header:    resp.Header,
+		Body:      buf.Bytes(),
+	}
+	if len(captured.Body) > maxCaptureBodySize {
+		captured.Body, captured.Truncated = captured.Body[:maxCaptureBodySize], true
+	}
+	p.add(id, captured)
+}
+
+// hopHeaders are the headers which only apply to a single connection and
+// are not forwarded by proxies. See RFC 7230, section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers from h, including any headers
+// named by the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// tunnel connects the client to the requested host for CONNECT requests.
+// If the tunnel belongs to a page with network conditions then it is delayed
+// by the page's latency and both directions share the page's limiters.
+func (p *captureProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	throttle := &pageThrottle{}
+	if p.owner != nil && p.throttled() {
+		if t := p.throttle(p.owner(r.Host)); t != nil {
+			throttle = t
+		}
+	}
+	time.Sleep(throttle.Latency)
+
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	go func() {
+		defer upstream.Close()
+		defer conn.Close()
+		io.Copy(upstream, throttle.up.Reader(conn))
+	}()
+	go func() {
+		defer upstream.Close()
+		defer conn.Close()
+		io.Copy(conn, throttle.down.Reader(upstream))
+	}()
+}
+
+// parseCaptureTag splits a capture tag into its ref and request id.
+func parseCaptureTag(tag string) (id string, requestID int) {
+	if i := strings.LastIndex(tag, ":"); i != -1 {
+		requestID, _ = strconv.Atoi(tag[i+1:])
+		return tag[:i], requestID
+	}
+	return tag, 0
+}
+
+// limitedWriter writes up to n bytes to w and silently discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return len(p), nil
+	}
+
+	b := p
+	if len(b) > w.n {
+		b = b[:w.n]
+	}
+	n, err := w.w.Write(b)
+	w.n -= n
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
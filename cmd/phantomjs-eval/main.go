@@ -0,0 +1,161 @@
+// Command phantomjs-eval evaluates JavaScript within a web page and prints
+// the result as JSON.
+//
+// Usage:
+//
+//	phantomjs-eval [arguments] URL EXPRESSION
+//
+// The expression is evaluated in the context of the page after it loads.
+// Function source, such as "function() { return document.title }", is
+// called and its return value is printed instead.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+func main() {
+	m := NewMain()
+	if err := m.Run(os.Args[1:]...); err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(m.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Main represents the program execution.
+type Main struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewMain returns a new instance of Main.
+func NewMain() *Main {
+	return &Main{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Options represents the command line options.
+type Options struct {
+	URL    string
+	Script string
+
+	// Wait conditions, applied after the page has loaded.
+	WaitSelector string
+	WaitTimeout  time.Duration
+
+	// If true, the result is indented.
+	Pretty bool
+
+	// Process settings.
+	BinPath string
+	Port    int
+}
+
+// ParseFlags parses the command line arguments into options.
+func (m *Main) ParseFlags(args []string) (*Options, error) {
+	var opt Options
+
+	fs := flag.NewFlagSet("phantomjs-eval", flag.ContinueOnError)
+	fs.SetOutput(m.Stderr)
+	fs.StringVar(&opt.WaitSelector, "wait-selector", "", "wait for an element matching selector")
+	fs.DurationVar(&opt.WaitTimeout, "wait-timeout", 30*time.Second, "maximum time to wait")
+	fs.BoolVar(&opt.Pretty, "pretty", false, "indent JSON output")
+	fs.StringVar(&opt.BinPath, "bin", phantomjs.DefaultBinPath, "path to phantomjs binary")
+	fs.IntVar(&opt.Port, "port", phantomjs.DefaultPort, "port used to communicate with phantomjs")
+	fs.Usage = func() {
+		fmt.Fprintln(m.Stderr, "usage: phantomjs-eval [arguments] URL EXPRESSION")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Read URL & expression from remaining arguments.
+	if fs.NArg() < 2 {
+		return nil, errors.New("url and expression required")
+	} else if fs.NArg() > 2 {
+		return nil, errors.New("too many arguments")
+	}
+	opt.URL = fs.Arg(0)
+	opt.Script = Script(fs.Arg(1))
+
+	return &opt, nil
+}
+
+// Run executes the program.
+func (m *Main) Run(args ...string) error {
+	opt, err := m.ParseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	// Start the process.
+	p := phantomjs.NewProcess()
+	p.BinPath, p.Port = opt.BinPath, opt.Port
+	p.Stdout, p.Stderr = m.Stderr, m.Stderr
+	if err := p.Open(); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	v, err := m.eval(p, opt)
+	if err != nil {
+		return err
+	}
+
+	// Write result as JSON.
+	var buf []byte
+	if opt.Pretty {
+		buf, err = json.MarshalIndent(v, "", "\t")
+	} else {
+		buf, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(m.Stdout, string(buf))
+	return err
+}
+
+// eval opens the page, waits for it to be ready, and evaluates the script.
+func (m *Main) eval(p *phantomjs.Process, opt *Options) (interface{}, error) {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err := page.Open(opt.URL); err != nil {
+		return nil, err
+	}
+
+	if opt.WaitSelector != "" {
+		if err := page.WaitForSelector(opt.WaitSelector, opt.WaitTimeout); err != nil {
+			return nil, fmt.Errorf("wait for selector: %s", err)
+		}
+	}
+
+	return page.Evaluate(opt.Script)
+}
+
+// Script returns the function source used to evaluate expr. Function source
+// is returned as-is and other expressions are wrapped in a function.
+func Script(expr string) string {
+	if strings.HasPrefix(strings.TrimSpace(expr), "function") {
+		return expr
+	}
+	return "function() { return (" + expr + "\n) }"
+}
@@ -0,0 +1,39 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	main "github.com/benbjohnson/phantomjs/cmd/phantomjs-eval"
+)
+
+// Ensure command line arguments are parsed into options.
+func TestMain_ParseFlags(t *testing.T) {
+	m := main.NewMain()
+	m.Stderr = ioutil.Discard
+
+	opt, err := m.ParseFlags([]string{"-wait-selector", "h1", "-pretty", "http://localhost/", "document.title"})
+	if err != nil {
+		t.Fatal(err)
+	} else if opt.URL != "http://localhost/" {
+		t.Fatalf("unexpected url: %s", opt.URL)
+	} else if opt.Script != "function() { return (document.title\n) }" {
+		t.Fatalf("unexpected script: %q", opt.Script)
+	} else if opt.WaitSelector != "h1" || !opt.Pretty {
+		t.Fatalf("unexpected options: %#v", opt)
+	}
+
+	// An expression is required.
+	if _, err := m.ParseFlags([]string{"http://localhost/"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure function source is passed through unchanged.
+func TestScript(t *testing.T) {
+	if s := main.Script(" function() { return 1 }"); s != " function() { return 1 }" {
+		t.Fatalf("unexpected script: %q", s)
+	} else if s := main.Script("1 + 2"); s != "function() { return (1 + 2\n) }" {
+		t.Fatalf("unexpected script: %q", s)
+	}
+}
@@ -0,0 +1,305 @@
+// Command phantomjs-pdf converts a web page or local HTML file to PDF.
+//
+// Usage:
+//
+//	phantomjs-pdf [arguments] URL|FILE
+//
+// Header and footer contents are HTML in which "{{pageNum}}" and
+// "{{numPages}}" are replaced with the page number and page count. Cookies
+// can be loaded from a Netscape-format cookie file, such as one written by
+// curl. Use "-" as the output path to write the PDF to stdout.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+func main() {
+	m := NewMain()
+	if err := m.Run(os.Args[1:]...); err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(m.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Main represents the program execution.
+type Main struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewMain returns a new instance of Main.
+func NewMain() *Main {
+	return &Main{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Options represents the command line options.
+type Options struct {
+	URL string
+
+	// Paper settings.
+	PaperSize phantomjs.PaperSize
+
+	// Cookies set before the page is opened.
+	Cookies []*http.Cookie
+
+	// Wait conditions, applied after the page has loaded.
+	WaitSelector string
+	WaitTimeout  time.Duration
+	Delay        time.Duration
+
+	// Output path, or "-" for stdout.
+	Output string
+
+	// Process settings.
+	BinPath string
+	Port    int
+}
+
+// ParseFlags parses the command line arguments into options.
+func (m *Main) ParseFlags(args []string) (*Options, error) {
+	var opt Options
+	var margin, header, footer, headerHeight, footerHeight, cookieFile string
+
+	fs := flag.NewFlagSet("phantomjs-pdf", flag.ContinueOnError)
+	fs.SetOutput(m.Stderr)
+	fs.StringVar(&opt.PaperSize.Format, "format", "A4", "paper format: A3, A4, A5, Legal, Letter, or Tabloid")
+	fs.StringVar(&opt.PaperSize.Width, "width", "", "paper width, overrides format (e.g. 8.5in)")
+	fs.StringVar(&opt.PaperSize.Height, "height", "", "paper height, overrides format (e.g. 11in)")
+	fs.StringVar(&opt.PaperSize.Orientation, "orientation", "portrait", "paper orientation: portrait or landscape")
+	fs.StringVar(&margin, "margin", "1cm", "margins as ALL, VERTICAL,HORIZONTAL, or TOP,RIGHT,BOTTOM,LEFT")
+	fs.StringVar(&header, "header", "", "header HTML")
+	fs.StringVar(&headerHeight, "header-height", "1cm", "header height")
+	fs.StringVar(&footer, "footer", "", "footer HTML")
+	fs.StringVar(&footerHeight, "footer-height", "1cm", "footer height")
+	fs.StringVar(&cookieFile, "cookie-file", "", "path to Netscape-format cookie file")
+	fs.StringVar(&opt.WaitSelector, "wait-selector", "", "wait for an element matching selector")
+	fs.DurationVar(&opt.WaitTimeout, "wait-timeout", 30*time.Second, "maximum time to wait")
+	fs.DurationVar(&opt.Delay, "delay", 0, "additional delay before rendering")
+	fs.StringVar(&opt.Output, "o", "output.pdf", "output path, or - for stdout")
+	fs.StringVar(&opt.BinPath, "bin", phantomjs.DefaultBinPath, "path to phantomjs binary")
+	fs.IntVar(&opt.Port, "port", phantomjs.DefaultPort, "port used to communicate with phantomjs")
+	fs.Usage = func() {
+		fmt.Fprintln(m.Stderr, "usage: phantomjs-pdf [arguments] URL|FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Read URL from remaining arguments.
+	if fs.NArg() == 0 {
+		return nil, errors.New("url or file required")
+	} else if fs.NArg() > 1 {
+		return nil, errors.New("too many arguments")
+	}
+	u, err := parseURL(fs.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	opt.URL = u
+
+	// Explicit dimensions take precedence over the format.
+	if opt.PaperSize.Width != "" || opt.PaperSize.Height != "" {
+		if opt.PaperSize.Width == "" || opt.PaperSize.Height == "" {
+			return nil, errors.New("width and height must be specified together")
+		}
+		opt.PaperSize.Format, opt.PaperSize.Orientation = "", ""
+	}
+
+	if opt.PaperSize.Margin, err = parseMargin(margin); err != nil {
+		return nil, err
+	}
+	if header != "" {
+		opt.PaperSize.Header = &phantomjs.PaperSizeSection{Height: headerHeight, Contents: header}
+	}
+	if footer != "" {
+		opt.PaperSize.Footer = &phantomjs.PaperSizeSection{Height: footerHeight, Contents: footer}
+	}
+
+	// Load cookies, if specified.
+	if cookieFile != "" {
+		f, err := os.Open(cookieFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if opt.Cookies, err = ReadCookies(f); err != nil {
+			return nil, fmt.Errorf("cookie file: %s", err)
+		}
+	}
+
+	return &opt, nil
+}
+
+// Run executes the program.
+func (m *Main) Run(args ...string) error {
+	opt, err := m.ParseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	// Start the process.
+	p := phantomjs.NewProcess()
+	p.BinPath, p.Port = opt.BinPath, opt.Port
+	p.Stdout, p.Stderr = m.Stderr, m.Stderr
+	if err := p.Open(); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	// PhantomJS writes the file itself so render to a temporary file when
+	// writing to stdout.
+	if opt.Output == "-" {
+		path := filepath.Join(p.Path(), "output.pdf")
+		if err := m.render(p, opt, path); err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(m.Stdout, f)
+		return err
+	}
+
+	path, err := filepath.Abs(opt.Output)
+	if err != nil {
+		return err
+	}
+	return m.render(p, opt, path)
+}
+
+// render opens the page, waits for it to be ready, and renders it to path.
+func (m *Main) render(p *phantomjs.Process, opt *Options, path string) error {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return err
+	}
+	defer page.Close()
+
+	if len(opt.Cookies) > 0 {
+		if err := page.SetCookies(opt.Cookies); err != nil {
+			return err
+		}
+	}
+	if err := page.SetPaperSize(opt.PaperSize); err != nil {
+		return err
+	} else if err := page.Open(opt.URL); err != nil {
+		return err
+	}
+
+	if opt.WaitSelector != "" {
+		if err := page.WaitForSelector(opt.WaitSelector, opt.WaitTimeout); err != nil {
+			return fmt.Errorf("wait for selector: %s", err)
+		}
+	}
+	time.Sleep(opt.Delay)
+
+	return page.Render(path, "pdf", 0)
+}
+
+// parseURL returns s as a URL. Paths to existing files are returned as
+// file URLs.
+func parseURL(s string) (string, error) {
+	if _, err := os.Stat(s); err == nil {
+		path, err := filepath.Abs(s)
+		if err != nil {
+			return "", err
+		}
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	} else if u.Scheme == "" {
+		return "", fmt.Errorf("file not found: %s", s)
+	}
+	return s, nil
+}
+
+// parseMargin parses margins using the CSS shorthand order.
+func parseMargin(s string) (*phantomjs.PaperSizeMargin, error) {
+	a := strings.Split(s, ",")
+	for i := range a {
+		a[i] = strings.TrimSpace(a[i])
+	}
+
+	switch len(a) {
+	case 1:
+		return &phantomjs.PaperSizeMargin{Top: a[0], Right: a[0], Bottom: a[0], Left: a[0]}, nil
+	case 2:
+		return &phantomjs.PaperSizeMargin{Top: a[0], Right: a[1], Bottom: a[0], Left: a[1]}, nil
+	case 4:
+		return &phantomjs.PaperSizeMargin{Top: a[0], Right: a[1], Bottom: a[2], Left: a[3]}, nil
+	default:
+		return nil, fmt.Errorf("invalid margin: %s", s)
+	}
+}
+
+// ReadCookies reads cookies in the Netscape cookie file format.
+func ReadCookies(r io.Reader) ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Cookies marked HttpOnly are prefixed but otherwise look like comments.
+		var httpOnly bool
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line, httpOnly = strings.TrimPrefix(line, "#HttpOnly_"), true
+		} else if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 fields, got %d", lineNo, len(fields))
+		}
+
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiration: %s", lineNo, fields[4])
+		}
+
+		cookie := &http.Cookie{
+			Domain:   fields[0],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0).UTC()
+		}
+		cookies = append(cookies, cookie)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
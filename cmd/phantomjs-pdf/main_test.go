@@ -0,0 +1,159 @@
+package main_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+	main "github.com/benbjohnson/phantomjs/cmd/phantomjs-pdf"
+)
+
+// Ensure command line arguments are parsed into options.
+func TestMain_ParseFlags(t *testing.T) {
+	m := main.NewMain()
+	m.Stderr = ioutil.Discard
+
+	opt, err := m.ParseFlags([]string{
+		"-format", "Letter",
+		"-margin", "1in,2in",
+		"-footer", "{{pageNum}}/{{numPages}}",
+		"http://localhost/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if opt.URL != "http://localhost/" {
+		t.Fatalf("unexpected url: %s", opt.URL)
+	} else if !reflect.DeepEqual(opt.PaperSize, phantomjs.PaperSize{
+		Format:      "Letter",
+		Orientation: "portrait",
+		Margin:      &phantomjs.PaperSizeMargin{Top: "1in", Right: "2in", Bottom: "1in", Left: "2in"},
+		Footer:      &phantomjs.PaperSizeSection{Height: "1cm", Contents: "{{pageNum}}/{{numPages}}"},
+	}) {
+		t.Fatalf("unexpected paper size: %#v", opt.PaperSize)
+	}
+}
+
+// Ensure local files are converted to file URLs.
+func TestMain_ParseFlags_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phantomjs-pdf-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(path, []byte("<html></html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := main.NewMain()
+	m.Stderr = ioutil.Discard
+	if opt, err := m.ParseFlags([]string{path}); err != nil {
+		t.Fatal(err)
+	} else if opt.URL != "file://"+filepath.ToSlash(path) {
+		t.Fatalf("unexpected url: %s", opt.URL)
+	}
+
+	// Missing files without a scheme are an error.
+	if _, err := m.ParseFlags([]string{filepath.Join(dir, "missing.html")}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a local file is converted to a PDF with a header on each page.
+func TestMain_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phantomjs-pdf-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(path, []byte(`<html><body><div id="main" style="height:2000px">BODY</div></body></html>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render with and without a header, writing the PDF to stdout.
+	render := func(args ...string) []byte {
+		var stdout bytes.Buffer
+		m := main.NewMain()
+		m.Stdout, m.Stderr = &stdout, ioutil.Discard
+		if err := m.Run(append(args, "-wait-selector", "#main", "-o", "-", path)...); err != nil {
+			t.Fatal(err)
+		} else if !bytes.HasPrefix(stdout.Bytes(), []byte("%PDF-")) {
+			t.Fatal("expected pdf data")
+		}
+		return stdout.Bytes()
+	}
+	plain := render()
+	buf := render("-header", "<span>QXZ</span>")
+
+	// Glyphs depend on the installed fonts so verify the page count and that
+	// each page has an additional text object for the header.
+	if n := countPages(buf); n != 2 || n != countPages(plain) {
+		t.Fatalf("unexpected page count: %d", n)
+	} else if n, m := countTextObjects(buf), countTextObjects(plain); n < m+2 {
+		t.Fatalf("expected header text objects: %d <= %d", n, m)
+	}
+}
+
+// Ensure cookies can be read from a Netscape-format cookie file.
+func TestReadCookies(t *testing.T) {
+	cookies, err := main.ReadCookies(strings.NewReader("" +
+		"# Netscape HTTP Cookie File\n" +
+		"\n" +
+		".example.com\tTRUE\t/\tFALSE\t1700000000\tsession\tabc\n" +
+		"#HttpOnly_example.com\tFALSE\t/app\tTRUE\t0\ttoken\txyz\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 2 {
+		t.Fatalf("unexpected cookie count: %d", len(cookies))
+	}
+
+	if c := cookies[0]; c.Domain != ".example.com" || c.Name != "session" || c.Value != "abc" || !c.Expires.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected cookie: %#v", c)
+	} else if c := cookies[1]; c.Path != "/app" || !c.Secure || !c.HttpOnly || !c.Expires.IsZero() {
+		t.Fatalf("unexpected cookie: %#v", c)
+	}
+
+	// Malformed lines are an error.
+	if _, err := main.ReadCookies(strings.NewReader("example.com\tTRUE\n")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// countPages returns the page count from the page tree of a PDF.
+func countPages(data []byte) int {
+	m := regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)`).FindSubmatch(data)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// countTextObjects returns the number of text objects drawn by the
+// compressed content streams of a PDF.
+func countTextObjects(data []byte) int {
+	var n int
+	for _, part := range bytes.Split(data, []byte("stream"))[1:] {
+		r, err := zlib.NewReader(bytes.NewReader(bytes.TrimLeft(part, "\r\n")))
+		if err != nil {
+			continue
+		}
+		buf, _ := ioutil.ReadAll(r)
+		r.Close()
+		n += len(regexp.MustCompile(`\bBT\b`).FindAll(buf, -1))
+	}
+	return n
+}
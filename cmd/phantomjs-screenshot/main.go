@@ -0,0 +1,249 @@
+// Command phantomjs-screenshot renders a web page to an image.
+//
+// Usage:
+//
+//	phantomjs-screenshot [arguments] URL
+//
+// The image format is determined by the -format flag or, if blank, by the
+// extension of the output path. Use "-" as the output path to write the
+// image to stdout.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+func main() {
+	m := NewMain()
+	if err := m.Run(os.Args[1:]...); err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(m.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Main represents the program execution.
+type Main struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewMain returns a new instance of Main.
+func NewMain() *Main {
+	return &Main{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Options represents the command line options.
+type Options struct {
+	URL string
+
+	// Viewport size, in pixels.
+	Width  int
+	Height int
+
+	// Wait conditions, applied after the page has loaded.
+	WaitSelector string
+	WaitFunction string
+	WaitTimeout  time.Duration
+	Delay        time.Duration
+
+	// Output settings.
+	Output   string
+	Format   string
+	Quality  int
+	Scale    float64
+	Selector string
+	Hide     []string
+
+	// Process settings.
+	BinPath string
+	Port    int
+}
+
+// ParseFlags parses the command line arguments into options.
+func (m *Main) ParseFlags(args []string) (*Options, error) {
+	var opt Options
+	var viewport, hide string
+
+	fs := flag.NewFlagSet("phantomjs-screenshot", flag.ContinueOnError)
+	fs.SetOutput(m.Stderr)
+	fs.StringVar(&viewport, "viewport", "1280x800", "viewport size, WIDTHxHEIGHT")
+	fs.StringVar(&opt.WaitSelector, "wait-selector", "", "wait for an element matching selector")
+	fs.StringVar(&opt.WaitFunction, "wait-function", "", "wait for a JavaScript function to return a truthy value")
+	fs.DurationVar(&opt.WaitTimeout, "wait-timeout", 30*time.Second, "maximum time to wait")
+	fs.DurationVar(&opt.Delay, "delay", 0, "additional delay before rendering")
+	fs.StringVar(&opt.Output, "o", "screenshot.png", "output path, or - for stdout")
+	fs.StringVar(&opt.Format, "format", "", "image format: png, jpeg, or gif")
+	fs.IntVar(&opt.Quality, "quality", 90, "jpeg quality")
+	fs.Float64Var(&opt.Scale, "scale", 1, "device pixel ratio")
+	fs.StringVar(&opt.Selector, "selector", "", "render only the element matching selector")
+	fs.StringVar(&hide, "hide", "", "comma-separated selectors of elements to hide")
+	fs.StringVar(&opt.BinPath, "bin", phantomjs.DefaultBinPath, "path to phantomjs binary")
+	fs.IntVar(&opt.Port, "port", phantomjs.DefaultPort, "port used to communicate with phantomjs")
+	fs.Usage = func() {
+		fmt.Fprintln(m.Stderr, "usage: phantomjs-screenshot [arguments] URL")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Read URL from remaining arguments.
+	if fs.NArg() == 0 {
+		return nil, errors.New("url required")
+	} else if fs.NArg() > 1 {
+		return nil, errors.New("too many arguments")
+	}
+	opt.URL = fs.Arg(0)
+
+	// Parse viewport size.
+	width, height, err := parseSize(viewport)
+	if err != nil {
+		return nil, err
+	}
+	opt.Width, opt.Height = width, height
+
+	// Determine format from output extension, if not specified.
+	if opt.Format == "" {
+		opt.Format = strings.TrimPrefix(strings.ToLower(filepath.Ext(opt.Output)), ".")
+	}
+	switch opt.Format {
+	case "", "png":
+		opt.Format = "png"
+	case "jpg", "jpeg":
+		opt.Format = "jpeg"
+	case "gif":
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", opt.Format)
+	}
+
+	if hide != "" {
+		opt.Hide = strings.Split(hide, ",")
+	}
+
+	return &opt, nil
+}
+
+// Run executes the program.
+func (m *Main) Run(args ...string) error {
+	opt, err := m.ParseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	// Start the process.
+	p := phantomjs.NewProcess()
+	p.BinPath, p.Port = opt.BinPath, opt.Port
+	p.Stdout, p.Stderr = m.Stderr, m.Stderr
+	if err := p.Open(); err != nil {
+		return err
+	}
+	defer p.Close()
+
+	img, err := m.screenshot(p, opt)
+	if err != nil {
+		return err
+	}
+
+	// Write to stdout or to the output file.
+	if opt.Output == "-" {
+		return encode(m.Stdout, img, opt)
+	}
+
+	f, err := os.Create(opt.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := encode(f, img, opt); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// screenshot opens the page, waits for it to be ready, and renders it.
+func (m *Main) screenshot(p *phantomjs.Process, opt *Options) (image.Image, error) {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err := page.SetViewportSize(opt.Width, opt.Height); err != nil {
+		return nil, err
+	} else if err := page.Open(opt.URL); err != nil {
+		return nil, err
+	}
+
+	if opt.WaitSelector != "" {
+		if err := page.WaitForSelector(opt.WaitSelector, opt.WaitTimeout); err != nil {
+			return nil, fmt.Errorf("wait for selector: %s", err)
+		}
+	}
+	if opt.WaitFunction != "" {
+		if err := page.WaitForFunction(opt.WaitFunction, opt.WaitTimeout, 0); err != nil {
+			return nil, fmt.Errorf("wait for function: %s", err)
+		}
+	}
+	time.Sleep(opt.Delay)
+
+	if opt.Selector != "" {
+		if err := page.SetClipRectToElement(opt.Selector); err != nil {
+			return nil, err
+		}
+	}
+
+	return page.RenderImage(phantomjs.RenderOptions{
+		Format:        "png",
+		Scale:         opt.Scale,
+		HideSelectors: opt.Hide,
+		WaitForAssets: true,
+		AssetTimeout:  opt.WaitTimeout,
+	})
+}
+
+// encode writes img to w in the format specified by opt.
+func encode(w io.Writer, img image.Image, opt *Options) error {
+	switch opt.Format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opt.Quality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// parseSize parses a size in the form "WIDTHxHEIGHT".
+func parseSize(s string) (width, height int, err error) {
+	a := strings.SplitN(strings.ToLower(s), "x", 2)
+	if len(a) != 2 {
+		return 0, 0, fmt.Errorf("invalid size: %s", s)
+	}
+	if width, err = strconv.Atoi(a[0]); err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid width: %s", s)
+	}
+	if height, err = strconv.Atoi(a[1]); err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid height: %s", s)
+	}
+	return width, height, nil
+}
@@ -0,0 +1,53 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	main "github.com/benbjohnson/phantomjs/cmd/phantomjs-screenshot"
+)
+
+// Ensure command line arguments are parsed into options.
+func TestMain_ParseFlags(t *testing.T) {
+	m := main.NewMain()
+	m.Stderr = ioutil.Discard
+
+	opt, err := m.ParseFlags([]string{
+		"-viewport", "800x600",
+		"-wait-selector", "#ready",
+		"-hide", ".banner,.chat",
+		"-o", "out.jpg",
+		"http://localhost/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if opt.URL != "http://localhost/" {
+		t.Fatalf("unexpected url: %s", opt.URL)
+	} else if opt.Width != 800 || opt.Height != 600 {
+		t.Fatalf("unexpected viewport: %dx%d", opt.Width, opt.Height)
+	} else if opt.WaitSelector != "#ready" || opt.WaitTimeout != 30*time.Second {
+		t.Fatalf("unexpected wait: %s %s", opt.WaitSelector, opt.WaitTimeout)
+	} else if opt.Format != "jpeg" {
+		t.Fatalf("unexpected format: %s", opt.Format)
+	} else if !reflect.DeepEqual(opt.Hide, []string{".banner", ".chat"}) {
+		t.Fatalf("unexpected hide: %#v", opt.Hide)
+	}
+}
+
+// Ensure invalid arguments return an error.
+func TestMain_ParseFlags_Err(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-viewport", "800", "http://localhost/"},
+		{"-format", "bmp", "http://localhost/"},
+		{"http://localhost/", "http://localhost/"},
+	} {
+		m := main.NewMain()
+		m.Stderr = ioutil.Discard
+		if _, err := m.ParseFlags(args); err == nil {
+			t.Fatalf("expected error: %v", args)
+		}
+	}
+}
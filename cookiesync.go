@@ -0,0 +1,92 @@
+package phantomjs
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CookieSyncer copies cookies between a process' cookie store and a Go
+// cookie jar, such as a *cookiejar.Jar used by an http.Client. This allows a
+// session established in a page, such as by logging in, to be used for
+// requests made directly with net/http and vice versa.
+//
+// Syncing is done on demand. Cookies are only copied when SyncToJar() or
+// SyncFromJar() is called.
+type CookieSyncer struct {
+	process *Process
+	jar     http.CookieJar
+}
+
+// NewCookieSyncer returns a syncer between the cookies of p and jar.
+func NewCookieSyncer(p *Process, jar http.CookieJar) *CookieSyncer {
+	return &CookieSyncer{process: p, jar: jar}
+}
+
+// SyncToJar copies all cookies from the process into the jar.
+func (s *CookieSyncer) SyncToJar() error {
+	cookies, err := s.process.Cookies()
+	if err != nil {
+		return err
+	}
+
+	for _, cookie := range cookies {
+		u := cookieURL(cookie)
+		if u == nil {
+			continue
+		}
+
+		// The jar treats cookies without a domain as host-only, which is how
+		// PhantomJS stores cookies whose domain has no leading dot.
+		if !strings.HasPrefix(cookie.Domain, ".") {
+			cookie.Domain = ""
+		}
+		s.jar.SetCookies(u, []*http.Cookie{cookie})
+	}
+	return nil
+}
+
+// SyncFromJar copies the jar's cookies for each URL into the process.
+//
+// A jar cannot list its cookies and only returns their names and values so
+// cookies are added as host-only session cookies for the URL's host with a
+// path of "/". Cookies for https URLs are marked as secure.
+func (s *CookieSyncer) SyncFromJar(urls ...string) error {
+	for _, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return err
+		}
+
+		for _, cookie := range s.jar.Cookies(u) {
+			if _, err := s.process.AddCookie(&http.Cookie{
+				Name:   cookie.Name,
+				Value:  cookie.Value,
+				Domain: u.Hostname(),
+				Path:   "/",
+				Secure: u.Scheme == "https",
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cookieURL returns a URL the cookie would be sent to, or nil if the cookie
+// has no domain.
+func cookieURL(cookie *http.Cookie) *url.URL {
+	host := strings.TrimPrefix(cookie.Domain, ".")
+	if host == "" {
+		return nil
+	}
+
+	u := &url.URL{Scheme: "http", Host: host, Path: cookie.Path}
+	if cookie.Secure {
+		u.Scheme = "https"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u
+}
@@ -0,0 +1,136 @@
+package phantomjs
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// ErrImageSizeMismatch is returned when comparing images of different sizes.
+var ErrImageSizeMismatch = errors.New("image size mismatch")
+
+// DefaultDiffThreshold is the default perceptual color distance threshold.
+const DefaultDiffThreshold = 0.1
+
+// maxColorDelta is the largest possible YIQ color distance between two pixels.
+const maxColorDelta = 35215.0
+
+// DiffOptions represents options for comparing images.
+type DiffOptions struct {
+	// Perceptual color distance, from 0 to 1, above which two pixels are
+	// considered different. Smaller values are more sensitive.
+	// Defaults to DefaultDiffThreshold.
+	Threshold float64
+
+	// Color used to highlight differing pixels in the diff image.
+	// Defaults to red.
+	HighlightColor color.Color
+}
+
+// ImageDiff represents the result of comparing two images.
+type ImageDiff struct {
+	// Number of differing pixels and total number of pixels compared.
+	Pixels int
+	Total  int
+
+	// Smallest rectangle containing all differing pixels. Empty if the
+	// images match.
+	Bounds image.Rectangle
+
+	// Image of the expected image faded to grayscale with the differing
+	// pixels highlighted.
+	Image *image.RGBA
+}
+
+// Ratio returns the fraction of pixels which differ, from 0 to 1.
+func (d *ImageDiff) Ratio() float64 {
+	if d.Total == 0 {
+		return 0
+	}
+	return float64(d.Pixels) / float64(d.Total)
+}
+
+// DiffImages compares expected and actual pixel by pixel. Pixels are compared
+// by their perceived difference in the YIQ color space so that changes the eye
+// cannot see, such as slight anti-aliasing shifts, can be ignored with a
+// threshold.
+//
+// Returns ErrImageSizeMismatch if the images are not the same size.
+func DiffImages(expected, actual image.Image, opt DiffOptions) (*ImageDiff, error) {
+	eb, ab := expected.Bounds(), actual.Bounds()
+	if eb.Dx() != ab.Dx() || eb.Dy() != ab.Dy() {
+		return nil, ErrImageSizeMismatch
+	}
+
+	threshold := opt.Threshold
+	if threshold <= 0 {
+		threshold = DefaultDiffThreshold
+	}
+	maxDelta := maxColorDelta * threshold * threshold
+
+	highlight := opt.HighlightColor
+	if highlight == nil {
+		highlight = color.RGBA{R: 0xFF, A: 0xFF}
+	}
+
+	diff := &ImageDiff{
+		Total: eb.Dx() * eb.Dy(),
+		Image: image.NewRGBA(image.Rect(0, 0, eb.Dx(), eb.Dy())),
+	}
+	for y := 0; y < eb.Dy(); y++ {
+		for x := 0; x < eb.Dx(); x++ {
+			c0 := expected.At(eb.Min.X+x, eb.Min.Y+y)
+			c1 := actual.At(ab.Min.X+x, ab.Min.Y+y)
+
+			if colorDelta(c0, c1) <= maxDelta {
+				diff.Image.Set(x, y, fadedGray(c0))
+				continue
+			}
+
+			diff.Pixels++
+			diff.Bounds = diff.Bounds.Union(image.Rect(x, y, x+1, y+1))
+			diff.Image.Set(x, y, highlight)
+		}
+	}
+	return diff, nil
+}
+
+// colorDelta returns the squared YIQ distance between two colors after
+// blending them onto a white background.
+func colorDelta(c0, c1 color.Color) float64 {
+	r0, g0, b0 := blendWhite(c0)
+	r1, g1, b1 := blendWhite(c1)
+
+	y := rgbToY(r0, g0, b0) - rgbToY(r1, g1, b1)
+	i := rgbToI(r0, g0, b0) - rgbToI(r1, g1, b1)
+	q := rgbToQ(r0, g0, b0) - rgbToQ(r1, g1, b1)
+	return 0.5053*y*y + 0.299*i*i + 0.1957*q*q
+}
+
+// blendWhite returns the 8-bit color channels of c composited onto white.
+func blendWhite(c color.Color) (r, g, b float64) {
+	cr, cg, cb, ca := c.RGBA()
+	bg := float64(0xFFFF - ca)
+	return (float64(cr) + bg) / 0x101, (float64(cg) + bg) / 0x101, (float64(cb) + bg) / 0x101
+}
+
+func rgbToY(r, g, b float64) float64 { return r*0.29889531 + g*0.58662247 + b*0.11448223 }
+func rgbToI(r, g, b float64) float64 { return r*0.59597799 - g*0.27417610 - b*0.32180189 }
+func rgbToQ(r, g, b float64) float64 { return r*0.21147017 - g*0.52261711 + b*0.31114694 }
+
+// fadedGray returns c as a light gray so highlighted pixels stand out.
+func fadedGray(c color.Color) color.Color {
+	r, g, b := blendWhite(c)
+	v := 0xFF + 0.1*(rgbToY(r, g, b)-0xFF)
+	return color.Gray{Y: uint8(v)}
+}
+
+// DiffImage renders the web page with opt and compares it to expected.
+// See DiffImages().
+func (p *WebPage) DiffImage(expected image.Image, opt RenderOptions, diffOpt DiffOptions) (*ImageDiff, error) {
+	img, err := p.RenderImage(opt)
+	if err != nil {
+		return nil, err
+	}
+	return DiffImages(expected, img, diffOpt)
+}
@@ -0,0 +1,148 @@
+package phantomjs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"time"
+)
+
+// Download represents a file which a page navigated to but PhantomJS could
+// not save. See WebPage.SetDownloadCapture().
+type Download struct {
+	URL         string
+	Filename    string // from Content-Disposition or the URL's path
+	ContentType string
+	Time        time.Time // time the navigation's response was received
+	Data        []byte
+
+	// Error re-fetching the file, if any. Data is nil if set.
+	Err error
+}
+
+type downloadJSON struct {
+	URL             string       `json:"url"`
+	Method          string       `json:"method"`
+	Headers         []headerJSON `json:"headers"`
+	ResponseHeaders []headerJSON `json:"responseHeaders"`
+	ContentType     string       `json:"contentType"`
+	Time            time.Time    `json:"time"`
+}
+
+// downloadFilename returns the filename suggested by the response's
+// Content-Disposition header, falling back to the last segment of the URL.
+func downloadFilename(rawurl string, header http.Header) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if u, err := url.Parse(rawurl); err == nil {
+		if name := path.Base(u.Path); name != "/" && name != "." {
+			return name
+		}
+	}
+	return ""
+}
+
+// DownloadCapture returns true if navigations to downloads are captured.
+func (p *WebPage) DownloadCapture() (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/DownloadCapture", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Value, nil
+}
+
+// SetDownloadCapture enables capturing of downloads. PhantomJS cannot save
+// files so navigations to attachments or to content types it cannot display,
+// such as application/pdf or application/zip, are recorded and re-fetched by
+// Downloads() instead.
+func (p *WebPage) SetDownloadCapture(v bool) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetDownloadCapture", map[string]interface{}{"ref": p.ref.id, "value": v}, nil)
+}
+
+// Downloads returns the downloads captured since the last call. Each file is
+// re-fetched with the process' DownloadClient using the headers of the
+// page's original request and the process' cookies for the URL.
+//
+// Downloads are always re-fetched with a GET request so files returned in
+// response to a form submission may differ from what the page received.
+func (p *WebPage) Downloads() ([]*Download, error) {
+	var resp struct {
+		Downloads []downloadJSON `json:"downloads"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/Downloads", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	} else if len(resp.Downloads) == 0 {
+		return nil, nil
+	}
+
+	client, jar, err := p.ref.process.downloadClient()
+	if err != nil {
+		return nil, err
+	}
+
+	a := make([]*Download, len(resp.Downloads))
+	for i, v := range resp.Downloads {
+		a[i] = &Download{
+			URL:         v.URL,
+			Filename:    downloadFilename(v.URL, decodeHeaderJSON(v.ResponseHeaders)),
+			ContentType: v.ContentType,
+			Time:        v.Time,
+		}
+		a[i].Data, a[i].Err = fetchResource(client, jar, v.URL, decodeHeaderJSON(v.Headers))
+	}
+	return a, nil
+}
+
+// downloadClient returns the client used to re-fetch resources loaded by
+// pages and a jar holding a copy of the process' cookies.
+func (p *Process) downloadClient() (*http.Client, http.CookieJar, error) {
+	// Copy the process' cookies so they are matched against each URL.
+	jar, _ := cookiejar.New(nil)
+	if err := NewCookieSyncer(p, jar).SyncToJar(); err != nil {
+		return nil, nil, err
+	}
+
+	client := p.DownloadClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client, jar, nil
+}
+
+// fetchResource requests rawurl with the headers of the page's original
+// request and the jar's cookies and returns the response body.
+func fetchResource(client *http.Client, jar http.CookieJar, rawurl string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		switch key {
+		case "Accept-Encoding", "Content-Length", "Content-Type", "Cookie", "Host":
+			// Let the client negotiate encoding and cookies are set below.
+			continue
+		}
+		req.Header[key] = values
+	}
+	for _, cookie := range jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: %s", rawurl, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
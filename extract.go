@@ -0,0 +1,118 @@
+package phantomjs
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// Link represents a link in a page.
+type Link struct {
+	URL   string `json:"url"`  // absolute URL
+	Text  string `json:"text"` // anchor text, or alt text for image map areas
+	Title string `json:"title"`
+	Rel   string `json:"rel"`
+}
+
+// Image represents an image in a page.
+type Image struct {
+	URL    string `json:"url"` // absolute URL
+	Alt    string `json:"alt"`
+	Title  string `json:"title"`
+	Width  int    `json:"width"`  // natural width, or zero if not loaded
+	Height int    `json:"height"` // natural height, or zero if not loaded
+}
+
+// Links returns the links in the page in document order. URLs are resolved
+// against the page's base URL. Links to "javascript:" URLs are excluded.
+func (p *WebPage) Links() ([]Link, error) {
+	var resp struct {
+		Value []Link `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/Links", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// Images returns the images in the page in document order. URLs are
+// resolved against the page's base URL.
+func (p *WebPage) Images() ([]Image, error) {
+	var resp struct {
+		Value []Image `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/Images", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// Metadata represents the metadata of a page used for link previews and
+// search engines. Fields are blank if the page does not specify them.
+type Metadata struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Canonical   string    `json:"canonical"` // absolute URL of rel="canonical"
+	OpenGraph   OpenGraph `json:"openGraph"`
+	Twitter     Twitter   `json:"twitter"`
+}
+
+// OpenGraph represents a page's OpenGraph ("og:") properties.
+type OpenGraph struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	URL         string `json:"url"`   // absolute URL
+	Image       string `json:"image"` // absolute URL
+	SiteName    string `json:"siteName"`
+	Locale      string `json:"locale"`
+}
+
+// Twitter represents a page's Twitter card ("twitter:") properties.
+type Twitter struct {
+	Card        string `json:"card"`
+	Site        string `json:"site"`
+	Creator     string `json:"creator"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Image       string `json:"image"` // absolute URL
+}
+
+// Metadata returns the page's title, description, canonical URL, and its
+// OpenGraph and Twitter card properties. Relative URLs are resolved against
+// the page's base URL.
+func (p *WebPage) Metadata() (*Metadata, error) {
+	var resp struct {
+		Value Metadata `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/Metadata", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Value, nil
+}
+
+// ExtractTable returns the rendered text of each cell of the table matching
+// selector, by row. Whitespace within cells is collapsed. Cells which span
+// multiple rows or columns are repeated in each so columns stay aligned.
+//
+// Returns ErrElementNotFound if selector does not match a table.
+func (p *WebPage) ExtractTable(selector string) ([][]string, error) {
+	var resp struct {
+		Value *[][]string `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/ExtractTable", map[string]interface{}{"ref": p.ref.id, "selector": selector}, &resp); err != nil {
+		return nil, err
+	} else if resp.Value == nil {
+		return nil, ErrElementNotFound
+	}
+	return *resp.Value, nil
+}
+
+// ExtractTableCSV writes the table matching selector to w as CSV. Tables are
+// extracted the same as ExtractTable().
+func (p *WebPage) ExtractTableCSV(w io.Writer, selector string) error {
+	rows, err := p.ExtractTable(selector)
+	if err != nil {
+		return err
+	}
+	return csv.NewWriter(w).WriteAll(rows)
+}
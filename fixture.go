@@ -0,0 +1,65 @@
+package phantomjs
+
+import (
+	"fmt"
+)
+
+// FixtureServer represents an HTTP server run inside PhantomJS by its
+// webserver module, such as to serve test fixtures to pages without
+// external infrastructure. The server listens on the loopback interface of
+// the PhantomJS host so its URL is reachable by pages even when PhantomJS runs
+// remotely.
+type FixtureServer struct {
+	process *Process
+	id      string
+	port    int
+}
+
+// Port returns the port the server is listening on.
+func (s *FixtureServer) Port() int { return s.port }
+
+// URL returns the base URL of the server as seen from pages.
+func (s *FixtureServer) URL() string {
+	return fmt.Sprintf("http://127.0.0.1:%d", s.port)
+}
+
+// Close stops the server.
+func (s *FixtureServer) Close() error {
+	return s.process.doJSON("POST", "/process/CloseServer", map[string]interface{}{"id": s.id}, nil)
+}
+
+// ServeStatic starts a server in PhantomJS which serves the files in dir on
+// the PhantomJS host. Requests for missing files or paths outside of dir
+// return 404.
+func (p *Process) ServeStatic(dir string) (*FixtureServer, error) {
+	return p.startServer(map[string]interface{}{"dir": dir})
+}
+
+// ServeHandlerJS starts a server in PhantomJS which handles requests with a
+// JavaScript function in the form of the webserver module's callback:
+//
+//	function(request, response) {
+//		response.statusCode = 200;
+//		response.write("<html><body>" + request.url + "</body></html>");
+//		response.close();
+//	}
+//
+// The script is evaluated in the PhantomJS context, not a page, so it has
+// access to modules such as fs. Like every shim route, the request which
+// starts the server must carry the process' token so pages cannot start
+// servers themselves.
+func (p *Process) ServeHandlerJS(script string) (*FixtureServer, error) {
+	return p.startServer(map[string]interface{}{"script": script})
+}
+
+// startServer starts a server in PhantomJS on the first available port.
+func (p *Process) startServer(req map[string]interface{}) (*FixtureServer, error) {
+	var resp struct {
+		ID   string `json:"id"`
+		Port int    `json:"port"`
+	}
+	if err := p.doJSON("POST", "/process/Serve", req, &resp); err != nil {
+		return nil, err
+	}
+	return &FixtureServer{process: p, id: resp.ID, port: resp.Port}, nil
+}
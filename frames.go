@@ -0,0 +1,87 @@
+package phantomjs
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+// Frame represents an image of a page captured by CaptureFrames().
+type Frame struct {
+	Image image.Image
+
+	// Time since the capture started.
+	Time time.Duration
+}
+
+// CaptureFrames renders the page every interval until duration has passed,
+// such as to record a page loading or an animation. A frame is captured
+// immediately, and only that frame if interval is not positive. Rendering
+// takes time so frames may be captured less often than interval; each frame
+// records when it was captured.
+//
+// Frames are rendered with opt so they can be resized or clipped. Frames can
+// be assembled into an animated GIF with EncodeGIF().
+func (p *WebPage) CaptureFrames(interval, duration time.Duration, opt RenderOptions) ([]*Frame, error) {
+	var frames []*Frame
+	start := time.Now()
+	for {
+		t := time.Since(start)
+		img, err := p.RenderImage(opt)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, &Frame{Image: img, Time: t})
+
+		// Wait for the next frame, skipping any which were missed.
+		if interval <= 0 {
+			return frames, nil
+		}
+		now := time.Since(start)
+		next := now + interval - now%interval
+		if next > duration {
+			return frames, nil
+		}
+		time.Sleep(next - time.Since(start))
+	}
+}
+
+// EncodeGIF writes frames to w as an animated GIF which loops forever. Each
+// frame is shown until the time of the next frame. The last frame is shown
+// as long as the frame before it, or for a second if there is only one.
+//
+// Frames are reduced to a 256 color palette with dithering so photographs
+// and gradients lose some quality.
+func EncodeGIF(w io.Writer, frames []*Frame) error {
+	g := &gif.GIF{Config: image.Config{ColorModel: color.Palette(palette.Plan9)}}
+	for i, f := range frames {
+		b := f.Image.Bounds()
+		img := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette.Plan9)
+		draw.FloydSteinberg.Draw(img, img.Bounds(), f.Image, b.Min)
+
+		// Delays are in hundredths of a second.
+		var delay time.Duration
+		switch {
+		case i+1 < len(frames):
+			delay = frames[i+1].Time - f.Time
+		case i > 0:
+			delay = f.Time - frames[i-1].Time
+		default:
+			delay = time.Second
+		}
+
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, int(delay/(10*time.Millisecond)))
+		if b.Dx() > g.Config.Width {
+			g.Config.Width = b.Dx()
+		}
+		if b.Dy() > g.Config.Height {
+			g.Config.Height = b.Dy()
+		}
+	}
+	return gif.EncodeAll(w, g)
+}
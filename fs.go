@@ -0,0 +1,82 @@
+package phantomjs
+
+import (
+	"encoding/base64"
+	"os"
+)
+
+// FS provides access to the filesystem of the host PhantomJS runs on through
+// its fs module. This is useful when PhantomJS runs on another machine or in
+// a container, such as to retrieve and remove files written by Render().
+//
+// Relative paths are resolved against the working directory of PhantomJS.
+// Like every shim route, the fs routes require the process' token so pages
+// loaded by PhantomJS cannot read or modify files themselves.
+type FS struct {
+	process *Process
+}
+
+// FS returns the filesystem of the host the process runs on.
+func (p *Process) FS() *FS {
+	return &FS{process: p}
+}
+
+// ReadFile returns the contents of the file at path.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	var resp struct {
+		Exists bool   `json:"exists"`
+		Data   string `json:"data"`
+	}
+	if err := fs.process.doJSON("POST", "/fs/Read", map[string]interface{}{"path": path}, &resp); err != nil {
+		return nil, err
+	} else if !resp.Exists {
+		return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+	}
+	return base64.StdEncoding.DecodeString(resp.Data)
+}
+
+// WriteFile writes data to the file at path, replacing any existing file.
+// Parent directories are created as needed.
+func (fs *FS) WriteFile(path string, data []byte) error {
+	req := map[string]interface{}{"path": path, "data": base64.StdEncoding.EncodeToString(data)}
+	return fs.process.doJSON("POST", "/fs/Write", req, nil)
+}
+
+// Exists returns true if a file or directory exists at path.
+func (fs *FS) Exists(path string) (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
+	}
+	if err := fs.process.doJSON("POST", "/fs/Exists", map[string]interface{}{"path": path}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Value, nil
+}
+
+// List returns the names of the entries in the directory at path.
+func (fs *FS) List(path string) ([]string, error) {
+	var resp struct {
+		Exists bool     `json:"exists"`
+		Value  []string `json:"value"`
+	}
+	if err := fs.process.doJSON("POST", "/fs/List", map[string]interface{}{"path": path}, &resp); err != nil {
+		return nil, err
+	} else if !resp.Exists {
+		return nil, &os.PathError{Op: "list", Path: path, Err: os.ErrNotExist}
+	}
+	return resp.Value, nil
+}
+
+// Remove removes the file or directory at path. Directories are removed
+// along with their contents.
+func (fs *FS) Remove(path string) error {
+	var resp struct {
+		Exists bool `json:"exists"`
+	}
+	if err := fs.process.doJSON("POST", "/fs/Remove", map[string]interface{}{"path": path}, &resp); err != nil {
+		return err
+	} else if !resp.Exists {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	return nil
+}
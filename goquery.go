@@ -0,0 +1,37 @@
+//go:build goquery
+// +build goquery
+
+package phantomjs
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Document parses the page's current content into a goquery document so the
+// rendered DOM can be queried with CSS selectors from Go. The document's URL
+// is set to the page's URL.
+//
+// Document is only available when building with the "goquery" tag, such as
+// "go build -tags goquery", so the package does not depend on goquery.
+func (p *WebPage) Document() (*goquery.Document, error) {
+	content, err := p.Content()
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	rawurl, err := p.URL()
+	if err != nil {
+		return nil, err
+	} else if doc.Url, err = url.Parse(rawurl); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,34 @@
+//go:build goquery
+// +build goquery
+
+package phantomjs_test
+
+import (
+	"testing"
+
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+// Ensure the page's content can be queried as a goquery document.
+func TestWebPage_Document(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleValue("/webpage/Content", `<html><body><ul><li class="item">A</li><li class="item">B</li></ul></body></html>`)
+	s.HandleValue("/webpage/URL", "http://example.com/list")
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := page.Document()
+	if err != nil {
+		t.Fatal(err)
+	} else if n := doc.Find("li.item").Length(); n != 2 {
+		t.Fatalf("unexpected item count: %d", n)
+	} else if text := doc.Find("li.item").Last().Text(); text != "B" {
+		t.Fatalf("unexpected text: %q", text)
+	} else if doc.Url == nil || doc.Url.String() != "http://example.com/list" {
+		t.Fatalf("unexpected url: %v", doc.Url)
+	}
+}
@@ -0,0 +1,260 @@
+package phantomjs
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HAR represents an HTTP Archive (HAR) 1.2 document.
+//
+// See http://www.softwareishard.com/blog/har-12-spec/ for the specification.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the root of the exported data.
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Pages   []HARPage   `json:"pages"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+// HARCreator identifies the application which created the log.
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HARPage represents an exported page.
+type HARPage struct {
+	StartedDateTime time.Time      `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     HARPageTimings `json:"pageTimings"`
+}
+
+// HARPageTimings contains page load timings in milliseconds.
+// A value of -1 means the timing is not available.
+type HARPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+// HAREntry represents a single request and its response.
+type HAREntry struct {
+	Pageref         string      `json:"pageref"`
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+
+	// Error is set if the resource failed to load or timed out.
+	Error string `json:"_error,omitempty"`
+}
+
+// HARRequest contains details about a request.
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARResponse contains details about a response.
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARCookie represents a cookie sent with a request or response.
+type HARCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARNameValue represents a header or query string parameter.
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARContent describes the response body. PhantomJS does not expose
+// response bodies so only the size and MIME type are set.
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// HARTimings contains the phases of a request in milliseconds.
+// A value of -1 means the phase is not available.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harJSON is a struct for decoding the network log from the shim.
+type harJSON struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Title   string `json:"title"`
+	Started string `json:"started"`
+	Loaded  string `json:"loaded"`
+	Entries []struct {
+		Request resourceRequestJSON   `json:"request"`
+		Start   *resourceResponseJSON `json:"start"`
+		End     *resourceResponseJSON `json:"end"`
+		Error   *resourceErrorJSON    `json:"error"`
+	} `json:"entries"`
+}
+
+func decodeHARJSON(v harJSON) *HAR {
+	const pageID = "page_1"
+
+	started, _ := time.Parse(time.RFC3339Nano, v.Started)
+	page := HARPage{
+		StartedDateTime: started,
+		ID:              pageID,
+		Title:           v.Title,
+		PageTimings:     HARPageTimings{OnContentLoad: -1, OnLoad: -1},
+	}
+	if loaded, err := time.Parse(time.RFC3339Nano, v.Loaded); err == nil {
+		page.PageTimings.OnLoad = millis(loaded.Sub(started))
+	}
+
+	entries := make([]*HAREntry, 0, len(v.Entries))
+	for _, e := range v.Entries {
+		t, _ := time.Parse(time.RFC3339Nano, e.Request.Time)
+		entry := &HAREntry{
+			Pageref:         pageID,
+			StartedDateTime: t,
+			Request: HARRequest{
+				Method:      e.Request.Method,
+				URL:         e.Request.URL,
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []HARCookie{},
+				Headers:     decodeHARHeaders(e.Request.Headers),
+				QueryString: decodeHARQueryString(e.Request.URL),
+				HeadersSize: -1,
+				BodySize:    -1,
+			},
+			Response: HARResponse{
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []HARCookie{},
+				Headers:     []HARNameValue{},
+				HeadersSize: -1,
+				BodySize:    -1,
+			},
+			Timings: HARTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: -1, Receive: -1, SSL: -1},
+		}
+
+		// Use the final stage of the response for headers and status.
+		resp := e.End
+		if resp == nil {
+			resp = e.Start
+		}
+		if resp != nil {
+			entry.Response.Status = resp.Status
+			entry.Response.StatusText = resp.StatusText
+			entry.Response.Headers = decodeHARHeaders(resp.Headers)
+			entry.Response.Content.MimeType = resp.ContentType
+			entry.Response.RedirectURL = resp.RedirectURL
+
+			// The start stage only reports the first chunk of a chunked body
+			// so the size at the end stage is used once it is reported.
+			entry.Response.Content.Size = resp.BodySize
+			if entry.Response.Content.Size == 0 && e.Start != nil {
+				entry.Response.Content.Size = e.Start.BodySize
+			}
+		}
+		if e.Start != nil {
+			if start := decodeResourceResponseJSON(*e.Start); !start.Time.IsZero() {
+				entry.Timings.Wait = millis(start.Time.Sub(t))
+				if e.End != nil {
+					entry.Timings.Receive = millis(decodeResourceResponseJSON(*e.End).Time.Sub(start.Time))
+				} else {
+					entry.Timings.Receive = 0
+				}
+			}
+		}
+
+		if e.Error != nil {
+			err := decodeResourceErrorJSON(*e.Error)
+			entry.Error = err.ErrorString
+			if entry.Response.Status == 0 {
+				entry.Response.Status = err.Status
+				entry.Response.StatusText = err.StatusText
+			}
+		}
+
+		// Total time is the sum of all known phases.
+		for _, d := range []float64{entry.Timings.Send, entry.Timings.Wait, entry.Timings.Receive} {
+			if d > 0 {
+				entry.Time += d
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return &HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{Name: "PhantomJS", Version: v.Version},
+			Pages:   []HARPage{page},
+			Entries: entries,
+		},
+	}
+}
+
+func decodeHARHeaders(a []headerJSON) []HARNameValue {
+	other := make([]HARNameValue, len(a))
+	for i := range a {
+		other[i] = HARNameValue{Name: a[i].Name, Value: a[i].Value}
+	}
+	return other
+}
+
+func decodeHARQueryString(rawurl string) []HARNameValue {
+	a := []HARNameValue{}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return a
+	}
+
+	// Parse manually to preserve parameter order.
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		kv := strings.SplitN(pair, "=", 2)
+		name, _ := url.QueryUnescape(kv[0])
+		var value string
+		if len(kv) == 2 {
+			value, _ = url.QueryUnescape(kv[1])
+		}
+		a = append(a, HARNameValue{Name: name, Value: value})
+	}
+	return a
+}
+
+// millis returns d in fractional milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
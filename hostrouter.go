@@ -0,0 +1,97 @@
+package phantomjs
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrNoHost is returned by a HostRouter for URLs without a hostname.
+	ErrNoHost = errors.New("url has no host")
+
+	// ErrNoProcesses is returned by a HostRouter without any processes.
+	ErrNoProcesses = errors.New("no processes")
+)
+
+// HostRouter spreads pages across processes by the hostname of the URL they
+// open. Each hostname is always routed to the same process so a site's
+// cookies and cache stay together, and a site which crashes PhantomJS only
+// affects the pages of the hostnames sharing its process.
+//
+// Hostnames are assigned with rendezvous hashing so adding processes to the
+// end of the list only moves the hostnames which are assigned to the new
+// processes. Removing or reordering processes can move any hostname.
+type HostRouter struct {
+	processes []*Process
+}
+
+// NewHostRouter returns a router across processes. Routing returns
+// ErrNoProcesses if there are none.
+func NewHostRouter(processes []*Process) *HostRouter {
+	return &HostRouter{processes: processes}
+}
+
+// ProcessFor returns the process which pages for rawurl are routed to.
+// Hostnames are case-insensitive and the scheme, port and path are ignored.
+func (r *HostRouter) ProcessFor(rawurl string) (*Process, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return nil, ErrNoHost
+	} else if len(r.processes) == 0 {
+		return nil, ErrNoProcesses
+	}
+
+	// Choose the process with the highest score for the host. The host's
+	// hash is mixed with each index so scores are independent per process.
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	sum := h.Sum64()
+
+	var best *Process
+	var bestScore uint64
+	for i, p := range r.processes {
+		if score := splitmix64(sum ^ uint64(i)); best == nil || score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best, nil
+}
+
+// splitmix64 returns the SplitMix64 finalizer of x, which spreads every bit
+// of x across the result.
+func splitmix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// CreateWebPage creates a page on the process rawurl is routed to. The page
+// is not opened.
+func (r *HostRouter) CreateWebPage(rawurl string) (*WebPage, error) {
+	p, err := r.ProcessFor(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return p.CreateWebPage()
+}
+
+// Open creates a page on the process rawurl is routed to and opens rawurl.
+// The page is closed if it cannot be opened.
+func (r *HostRouter) Open(rawurl string) (*WebPage, error) {
+	page, err := r.CreateWebPage(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if err := page.Open(rawurl); err != nil {
+		page.Close()
+		return nil, err
+	}
+	return page, nil
+}
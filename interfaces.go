@@ -0,0 +1,252 @@
+package phantomjs
+
+import (
+	"context"
+	"image"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Ensure the concrete types implement the interfaces.
+var (
+	_ WebPager   = (*WebPage)(nil)
+	_ Processor  = (*Process)(nil)
+	_ FileSystem = (*FS)(nil)
+)
+
+// WebPager represents the public method set of a WebPage. Code which accepts
+// a WebPager can be tested with the in-memory fakes in the phantomjsmock
+// package instead of a running PhantomJS process.
+//
+// Methods which return concrete child pages, such as Pages() and Page(),
+// Paginate(), which passes the concrete page to its callback, and Ref() are
+// only available on WebPage.
+type WebPager interface {
+	Open(url string) error
+	OpenContext(ctx context.Context, url string) error
+	Close() error
+	Reset() error
+	Reload() error
+	Stop() error
+
+	CanGoBack() (bool, error)
+	CanGoForward() (bool, error)
+	GoBack() error
+	GoForward() error
+	Go(index int) error
+
+	ClipRect() (Rect, error)
+	SetClipRect(rect Rect) error
+	SetClipRectInt(top, left, width, height int) error
+	SetClipRectToElement(selector string) error
+	ClearClipRect() error
+	BoundingRect(selector string) (Rect, error)
+	BoundingRects(selector string) ([]Rect, error)
+	ExtractTable(selector string) ([][]string, error)
+	ExtractTableCSV(w io.Writer, selector string) error
+	Links() ([]Link, error)
+	Images() ([]Image, error)
+	Metadata() (*Metadata, error)
+	Article() (*Article, error)
+	Markdown(selector ...string) (string, error)
+
+	Content() (string, error)
+	ContentReader() (io.ReadCloser, error)
+	SetContent(content string) error
+	SetContentAndURL(content, url string) error
+	PlainText() (string, error)
+	Snapshot() (*Snapshot, error)
+	Title() (string, error)
+	URL() (string, error)
+
+	Cookies() ([]*http.Cookie, error)
+	SetCookies(cookies []*http.Cookie) error
+	AddCookie(cookie *http.Cookie) (bool, error)
+	DeleteCookie(name string) (bool, error)
+	ClearCookies() error
+
+	LocalStorage() (map[string]string, error)
+	SessionStorage() (map[string]string, error)
+	SetLocalStorageItem(key, value string) error
+	SetSessionStorageItem(key, value string) error
+	ClearStorage() error
+
+	CustomHeaders() (http.Header, error)
+	SetCustomHeaders(header http.Header) error
+
+	FocusedFrameName() (string, error)
+	FrameContent() (string, error)
+	SetFrameContent(content string) error
+	FrameName() (string, error)
+	FramePlainText() (string, error)
+	FrameTitle() (string, error)
+	FrameURL() (string, error)
+	FrameCount() (int, error)
+	FrameNames() ([]string, error)
+	SwitchToFocusedFrame() error
+	SwitchToFrameName(name string) error
+	SwitchToFramePosition(pos int) error
+	SwitchToMainFrame() error
+	SwitchToParentFrame() error
+
+	LibraryPath() (string, error)
+	SetLibraryPath(path string) error
+	NavigationLocked() (bool, error)
+	SetNavigationLocked(value bool) error
+	OfflineStoragePath() (string, error)
+	OfflineStorageQuota() (int, error)
+
+	NavigationRules() ([]NavigationRule, error)
+	SetNavigationRules(rules []NavigationRule) error
+	InterceptRules() ([]InterceptRule, error)
+	SetInterceptRules(rules []InterceptRule) error
+	AddInterceptRule(rule InterceptRule) error
+	BlockResourceTypes(images, stylesheets, fonts, media bool) error
+	Mock(pattern string, resp *MockResponse) error
+
+	SetCapturePatterns(patterns []string) error
+	Responses() []*CapturedResponse
+	ClearResponses()
+	SetNetworkConditions(latency time.Duration, downloadKbps, uploadKbps int) error
+	NetworkConditions() NetworkConditions
+
+	OwnsPages() (bool, error)
+	SetOwnsPages(v bool) error
+	PageWindowNames() ([]string, error)
+	WindowName() (string, error)
+
+	PaperSize() (PaperSize, error)
+	SetPaperSize(size PaperSize) error
+	ScrollPosition() (Position, error)
+	SetScrollPosition(pos Position) error
+	Settings() (WebPageSettings, error)
+	SetSettings(settings WebPageSettings) error
+	ViewportSize() (width, height int, err error)
+	SetViewportSize(width, height int) error
+	ZoomFactor() (float64, error)
+	SetZoomFactor(factor float64) error
+	MediaType() (string, error)
+	SetMediaType(mediaType string) error
+	SetLocale(locale string) error
+	SetTimezoneOffset(minutes int) error
+	EnableStealth() error
+	RotatedUserAgent() string
+	Offline() (bool, error)
+	SetOffline(v bool) error
+	XHROnly() (bool, error)
+	SetXHROnly(v bool) error
+	DownloadCapture() (bool, error)
+	SetDownloadCapture(v bool) error
+	Downloads() ([]*Download, error)
+
+	EvaluateAsync(script string, delay time.Duration) error
+	EvaluateJavaScript(script string) (interface{}, error)
+	Evaluate(script string) (interface{}, error)
+	EvaluateContext(ctx context.Context, script string) (interface{}, error)
+	EvaluateOnNewDocument(script string) error
+	ClearNewDocumentScripts() error
+	IncludeJS(url string) error
+	InjectJS(filename string) error
+
+	RenderBase64(format string) (string, error)
+	Render(filename, format string, quality int) error
+	RenderBytes(format string, quality int) ([]byte, error)
+	PDFInfo() *PDFInfo
+	SetPDFInfo(info *PDFInfo)
+	PDFWatermark() *Watermark
+	SetPDFWatermark(wm *Watermark)
+	RenderImage(opt RenderOptions) (image.Image, error)
+	DiffImage(expected image.Image, opt RenderOptions, diffOpt DiffOptions) (*ImageDiff, error)
+	CaptureFrames(interval, duration time.Duration, opt RenderOptions) ([]*Frame, error)
+	SaveMHTML(w io.Writer) error
+	SaveComplete(dir string) error
+
+	SendMouseEvent(eventType string, mouseX, mouseY int, button string) error
+	SendKeyboardEvent(eventType string, key string, modifier int) error
+	UploadFile(selector, filename string) error
+
+	WaitForFunction(script string, timeout, interval time.Duration) error
+	WaitForFunctionContext(ctx context.Context, script string, timeout, interval time.Duration) error
+	WaitForSelector(selector string, timeout time.Duration) error
+	WaitForNavigation(timeout time.Duration) (status string, err error)
+	WaitForResponse(pattern string, timeout time.Duration) (*ResourceResponse, error)
+	WaitForNetworkIdle(idle, timeout time.Duration) error
+	WaitForURL(pattern string, timeout time.Duration) error
+	WaitForTitle(pattern string, timeout time.Duration) error
+	ScrollToBottomUntilStable(maxScrolls int, idle time.Duration) error
+
+	Events() <-chan Event
+	SetNetworkLog(w io.Writer)
+	LastErrors() ([]*PageError, error)
+	HAR() (*HAR, error)
+	Audit(opt AuditOptions) (*AuditResult, error)
+	Login(spec LoginSpec) ([]*http.Cookie, error)
+	Timing() (*Timing, error)
+	ResourceTimings() ([]*ResourceTiming, error)
+
+	OnConfirm(fn func(message string) bool) error
+	ConfirmDefault() (bool, error)
+	SetConfirmDefault(value bool) error
+	OnPrompt(fn func(message, defaultValue string) string) error
+	PromptDefault() (string, error)
+	SetPromptDefault(value string) error
+}
+
+// Processor represents the public method set of a Process. Pages are created
+// with CreateWebPager() so that fakes can return their own WebPager.
+type Processor interface {
+	Open() error
+	Close() error
+	Path() string
+	URL() string
+	CallbackURL() string
+	CreateWebPager() (WebPager, error)
+	Events() <-chan Event
+	SystemInfo() (*SystemInfo, error)
+	Spawn(name string, args ...string) (*SpawnResult, error)
+	FileSystem() FileSystem
+	Proxy() Proxy
+	SetProxy(proxy Proxy) error
+	RenderPDFMulti(urls []string, opt PDFOptions) ([]byte, error)
+	Screenshots(reqs []ScreenshotRequest, concurrency int) ([]*ScreenshotResult, error)
+	RenderSVG(svg []byte, opt SVGOptions) (image.Image, error)
+
+	Cookies() ([]*http.Cookie, error)
+	AddCookie(cookie *http.Cookie) (bool, error)
+	DeleteCookie(name string) (bool, error)
+	ClearCookies() error
+	CookiesEnabled() (bool, error)
+	SetCookiesEnabled(value bool) error
+
+	InjectJS(filename string) error
+	LibraryPath() (string, error)
+	SetLibraryPath(path string) error
+	ClearCaches() error
+
+	Refs() ([]*RefInfo, error)
+	ReleaseRef(id string) error
+	Sweep() (int, error)
+}
+
+// FileSystem represents the public method set of an FS.
+type FileSystem interface {
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte) error
+	Exists(path string) (bool, error)
+	List(path string) ([]string, error)
+	Remove(path string) error
+}
+
+// FileSystem returns the filesystem of the host the process runs on as a
+// FileSystem.
+func (p *Process) FileSystem() FileSystem { return p.FS() }
+
+// CreateWebPager returns a new web page as a WebPager.
+func (p *Process) CreateWebPager() (WebPager, error) {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
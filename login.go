@@ -0,0 +1,112 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultLoginTimeout is the default time allowed for a login to succeed.
+const DefaultLoginTimeout = 30 * time.Second
+
+// ErrLoginFailed is returned by Login() when the success condition is not
+// met within the timeout, such as when the credentials are rejected.
+var ErrLoginFailed = errors.New("login failed")
+
+// LoginSpec describes a login form and how to tell that logging in worked.
+type LoginSpec struct {
+	// URL of the login page. If blank, the form on the current page is used.
+	URL string
+
+	// CSS selectors of the username and password fields.
+	UserSelector string
+	PassSelector string
+
+	// CSS selector of the element clicked to submit the form. If blank, the
+	// password field's form is submitted directly.
+	SubmitSelector string
+
+	// Credentials entered into the form.
+	Username string
+	Password string
+
+	// JavaScript function which returns a truthy value once logged in, such
+	// as "function() { return !!document.querySelector('.logout') }". If
+	// blank, the login succeeds once the password field is no longer present.
+	SuccessCondition string
+
+	// Maximum time to wait for the login to succeed after submitting the
+	// form. Defaults to DefaultLoginTimeout.
+	Timeout time.Duration
+}
+
+// Login fills in and submits a login form and waits for the spec's success
+// condition. Returns the page's cookies once logged in so the session can be
+// reused, such as with Session.Cookies.
+//
+// Returns ErrElementNotFound if a selector does not match and ErrLoginFailed
+// if the success condition is not met within the timeout.
+func (p *WebPage) Login(spec LoginSpec) ([]*http.Cookie, error) {
+	if spec.Timeout == 0 {
+		spec.Timeout = DefaultLoginTimeout
+	}
+
+	if spec.URL != "" {
+		if err := p.Open(spec.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill in the fields, firing the events frameworks listen for, and then
+	// submit the form. Returns false if an element is missing.
+	args, _ := json.Marshal([]string{spec.UserSelector, spec.PassSelector, spec.SubmitSelector, spec.Username, spec.Password})
+	v, err := p.Evaluate(fmt.Sprintf(`function() {
+		var args = %s;
+		var user = document.querySelector(args[0]), pass = document.querySelector(args[1]);
+		var submit = args[2] ? document.querySelector(args[2]) : null;
+		if (!user || !pass || (args[2] && !submit) || (!submit && !pass.form)) {
+			return false;
+		}
+
+		function fire(el, type) {
+			var e = document.createEvent('HTMLEvents');
+			e.initEvent(type, true, true);
+			el.dispatchEvent(e);
+		}
+		[[user, args[3]], [pass, args[4]]].forEach(function(field) {
+			field[0].focus();
+			field[0].value = field[1];
+			fire(field[0], 'input');
+			fire(field[0], 'change');
+		});
+
+		if (submit) {
+			var click = document.createEvent('MouseEvents');
+			click.initMouseEvent('click', true, true, window, 1, 0, 0, 0, 0, false, false, false, false, 0, null);
+			submit.dispatchEvent(click);
+		} else {
+			pass.form.submit();
+		}
+		return true;
+	}`, args))
+	if err != nil {
+		return nil, err
+	} else if ok, _ := v.(bool); !ok {
+		return nil, ErrElementNotFound
+	}
+
+	cond := spec.SuccessCondition
+	if cond == "" {
+		selector, _ := json.Marshal(spec.PassSelector)
+		cond = fmt.Sprintf(`function() { return document.readyState === "complete" && !document.querySelector(%s) }`, selector)
+	}
+	if err := p.WaitForFunction(cond, spec.Timeout, 0); err == ErrTimeout {
+		return nil, ErrLoginFailed
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p.Cookies()
+}
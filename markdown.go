@@ -0,0 +1,277 @@
+package phantomjs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// markdownNode is an element or text node of the rendered document as
+// serialized by the shim.
+type markdownNode struct {
+	Tag      string            `json:"tag"`
+	Text     string            `json:"text"`
+	Attrs    map[string]string `json:"attrs"`
+	Children []*markdownNode   `json:"children"`
+}
+
+// Markdown converts the rendered content of the page to Markdown. If a
+// selector is passed then only the first element it matches is converted.
+// Elements which are not displayed, such as scripts and hidden elements, are
+// excluded. Link and image URLs are absolute.
+//
+// Returns ErrElementNotFound if the selector does not match an element.
+func (p *WebPage) Markdown(selector ...string) (string, error) {
+	req := map[string]interface{}{"ref": p.ref.id}
+	if len(selector) > 0 {
+		req["selector"] = selector[0]
+	}
+
+	var resp struct {
+		Value *markdownNode `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/Markdown", req, &resp); err != nil {
+		return "", err
+	} else if resp.Value == nil {
+		return "", ErrElementNotFound
+	}
+
+	md := strings.Join(markdownBlocks([]*markdownNode{resp.Value}), "\n\n")
+	if md == "" {
+		return "", nil
+	}
+	return md + "\n", nil
+}
+
+// markdownBlockTags are the elements converted as blocks. All other elements
+// are converted inline.
+var markdownBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"body": true, "center": true, "details": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "fieldset": true, "figcaption": true,
+	"figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "html": true, "li": true, "main": true, "nav": true,
+	"ol": true, "p": true, "pre": true, "section": true, "summary": true,
+	"table": true, "ul": true,
+}
+
+// markdownBlocks converts nodes to Markdown blocks. Consecutive inline nodes
+// are joined into a single paragraph.
+func markdownBlocks(nodes []*markdownNode) []string {
+	var blocks []string
+	var inline strings.Builder
+	flush := func() {
+		lines := strings.Split(strings.TrimSpace(inline.String()), "\n")
+		for i := range lines {
+			lines[i] = strings.TrimLeft(lines[i], " ")
+		}
+		if s := strings.Join(lines, "\n"); s != "" {
+			blocks = append(blocks, s)
+		}
+		inline.Reset()
+	}
+
+	for _, n := range nodes {
+		if n.Tag != "" && markdownBlockTags[n.Tag] {
+			flush()
+			if s := markdownBlock(n); s != "" {
+				blocks = append(blocks, s)
+			}
+			continue
+		}
+		inline.WriteString(markdownInline(n))
+	}
+	flush()
+	return blocks
+}
+
+// markdownBlock converts a block element to Markdown.
+func markdownBlock(n *markdownNode) string {
+	switch n.Tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := strings.TrimSpace(markdownInlineChildren(n))
+		if text == "" {
+			return ""
+		}
+		return strings.Repeat("#", int(n.Tag[1]-'0')) + " " + strings.Replace(text, "\n", " ", -1)
+
+	case "hr":
+		return "---"
+
+	case "pre":
+		return "```\n" + strings.TrimRight(markdownText(n), "\n") + "\n```"
+
+	case "blockquote":
+		return markdownPrefix(strings.Join(markdownBlocks(n.Children), "\n\n"), "> ", "> ")
+
+	case "ul", "ol":
+		var items []string
+		for _, child := range n.Children {
+			if child.Tag != "li" {
+				continue
+			}
+			marker := "- "
+			if n.Tag == "ol" {
+				marker = fmt.Sprintf("%d. ", len(items)+1)
+			}
+			item := strings.Join(markdownBlocks(child.Children), "\n\n")
+			items = append(items, markdownPrefix(item, marker, strings.Repeat(" ", len(marker))))
+		}
+		return strings.Join(items, "\n")
+
+	case "table":
+		return markdownTable(n)
+
+	default:
+		return strings.Join(markdownBlocks(n.Children), "\n\n")
+	}
+}
+
+// markdownPrefix prefixes the first line of s with first and all other
+// non-blank lines with rest.
+func markdownPrefix(s, first, rest string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = first + line
+		} else if line != "" {
+			lines[i] = rest + line
+		} else {
+			lines[i] = strings.TrimRight(rest, " ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownTable converts a table to a GitHub-flavored Markdown table using
+// its first row as the header.
+func markdownTable(n *markdownNode) string {
+	var rows [][]string
+	var walk func(n *markdownNode)
+	walk = func(n *markdownNode) {
+		for _, child := range n.Children {
+			switch child.Tag {
+			case "thead", "tbody", "tfoot":
+				walk(child)
+			case "tr":
+				var row []string
+				for _, cell := range child.Children {
+					if cell.Tag == "td" || cell.Tag == "th" {
+						text := strings.TrimSpace(markdownInlineChildren(cell))
+						text = strings.Replace(text, "\n", " ", -1)
+						row = append(row, strings.Replace(text, "|", `\|`, -1))
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	walk(n)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	// Pad rows to the same number of columns.
+	cols := 0
+	for _, row := range rows {
+		if len(row) > cols {
+			cols = len(row)
+		}
+	}
+	if cols == 0 {
+		return ""
+	}
+
+	var lines []string
+	for i, row := range rows {
+		for len(row) < cols {
+			row = append(row, "")
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", cols))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownInlineChildren converts the children of n as inline content.
+func markdownInlineChildren(n *markdownNode) string {
+	var buf strings.Builder
+	for _, child := range n.Children {
+		buf.WriteString(markdownInline(child))
+	}
+	return buf.String()
+}
+
+// markdownInline converts a text node or inline element to Markdown.
+func markdownInline(n *markdownNode) string {
+	switch n.Tag {
+	case "":
+		return markdownEscape(markdownSpace.ReplaceAllString(n.Text, " "))
+	case "br":
+		return "  \n"
+	case "a":
+		text := strings.TrimSpace(markdownInlineChildren(n))
+		if href := n.Attrs["href"]; href != "" && text != "" {
+			return "[" + text + "](" + href + ")"
+		}
+		return text
+	case "img":
+		if src := n.Attrs["src"]; src != "" {
+			return "![" + markdownEscape(n.Attrs["alt"]) + "](" + src + ")"
+		}
+		return ""
+	case "strong", "b":
+		return markdownWrap(markdownInlineChildren(n), "**")
+	case "em", "i":
+		return markdownWrap(markdownInlineChildren(n), "*")
+	case "del", "s", "strike":
+		return markdownWrap(markdownInlineChildren(n), "~~")
+	case "code", "kbd", "samp", "tt":
+		return markdownWrap(markdownSpace.ReplaceAllString(markdownText(n), " "), "`")
+	default:
+		if markdownBlockTags[n.Tag] {
+			return " " + markdownInlineChildren(n) + " "
+		}
+		return markdownInlineChildren(n)
+	}
+}
+
+// markdownWrap wraps s in marker, keeping surrounding whitespace outside of
+// the markers so the emphasis is valid Markdown.
+func markdownWrap(s, marker string) string {
+	text := strings.TrimSpace(s)
+	if text == "" {
+		return s
+	}
+	i := strings.Index(s, text)
+	return s[:i] + marker + text + marker + s[i+len(text):]
+}
+
+// markdownText returns the concatenated text of n and its descendants.
+func markdownText(n *markdownNode) string {
+	if n.Tag == "" {
+		return n.Text
+	} else if n.Tag == "br" {
+		return "\n"
+	}
+	var buf strings.Builder
+	for _, child := range n.Children {
+		buf.WriteString(markdownText(child))
+	}
+	return buf.String()
+}
+
+var markdownSpace = regexp.MustCompile(`\s+`)
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+)
+
+// markdownEscape escapes characters in text which Markdown would treat as
+// formatting.
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
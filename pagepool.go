@@ -0,0 +1,260 @@
+package phantomjs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned when acquiring a page from a closed pool.
+var ErrPoolClosed = errors.New("pool closed")
+
+// WebPageCreator represents an object which can create web pages, such as a
+// Process.
+type WebPageCreator interface {
+	CreateWebPage() (*WebPage, error)
+}
+
+// PagePool maintains a set of pre-created web pages which are handed out by
+// Acquire() and returned by Release(). Released pages are reset to a blank
+// page before being reused so callers do not pay page creation latency.
+//
+// All pages of a PhantomJS process share one cookie jar. Resetting a page
+// only clears the cookies visible to its current URL, so cookies set by other
+// domains the previous user visited remain and are sent by the next user of
+// any page. Set ClearCookies if pages are handed to users who must not see
+// each other's cookies, or give each user their own process.
+type PagePool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   []*WebPage
+	n      int   // total pages owned by the pool
+	err    error // last error creating a replacement page
+	closed bool
+
+	creator WebPageCreator
+	size    int
+	created map[*WebPage]time.Time // creation time of each page owned by the pool
+
+	// If set, returns the user agent applied to each page as it is acquired
+	// so that crawls vary their fingerprint. The user agent is recorded on
+	// the page and returned by its RotatedUserAgent() method.
+	UserAgent func() string
+
+	// If set, released pages are closed and replaced with a new page once
+	// they have navigated RecycleAfter times or are older than RecycleAge.
+	// This limits the memory PhantomJS accumulates per page over long
+	// crawls. Cookies are stored by the process so they are kept, and the
+	// replacement has the creator's settings the same as a reset page.
+	// Navigations are counted through methods such as Open() and Reload().
+	RecycleAfter int
+	RecycleAge   time.Duration
+
+	// If true, the cookie jar of the page's process is cleared as each page
+	// is released. As the jar is shared, this also removes the cookies of
+	// pages which are acquired at the time, so it only isolates users who
+	// hold pages one at a time.
+	ClearCookies bool
+}
+
+// RotateUserAgents returns a function for PagePool.UserAgent which returns
+// each of a in turn.
+func RotateUserAgents(a []string) func() string {
+	var mu sync.Mutex
+	var i int
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		ua := a[i%len(a)]
+		i++
+		return ua
+	}
+}
+
+// NewPagePool returns a new pool of size pages created by creator.
+func NewPagePool(creator WebPageCreator, size int) *PagePool {
+	p := &PagePool{creator: creator, size: size, created: make(map[*WebPage]time.Time)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Open creates the pool's pages.
+func (p *PagePool) Open() error {
+	for i := 0; i < p.size; i++ {
+		page, err := p.creator.CreateWebPage()
+		if err != nil {
+			p.Close()
+			return err
+		}
+
+		p.mu.Lock()
+		p.idle = append(p.idle, page)
+		p.created[page] = time.Now()
+		p.n++
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// Close closes all idle pages. Pages which are currently acquired are closed
+// when they are released.
+func (p *PagePool) Close() (err error) {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.n -= len(idle)
+	for _, page := range idle {
+		delete(p.created, page)
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	for _, page := range idle {
+		if e := page.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Acquire returns an idle page from the pool. Blocks until a page is
+// available. Returns ErrPoolClosed if the pool is closed.
+//
+// If the pool has no pages left because replacements could not be created,
+// such as after the process has exited, the error from creating the last
+// replacement is returned and replacements are attempted again.
+func (p *PagePool) Acquire() (*WebPage, error) {
+	p.mu.Lock()
+	for len(p.idle) == 0 && !p.closed {
+		if p.n == 0 && p.err != nil {
+			err := p.err
+			p.err = nil
+			p.mu.Unlock()
+
+			for i := 0; i < p.size; i++ {
+				go p.replace()
+			}
+			return nil, err
+		}
+		p.cond.Wait()
+	}
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+
+	page := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	p.mu.Unlock()
+
+	// Apply the next user agent, if rotating.
+	if p.UserAgent != nil {
+		if err := page.setRotatedUserAgent(p.UserAgent()); err != nil {
+			p.Discard(page)
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Release resets page and returns it to the pool. If the page cannot be
+// reset then it is closed and replaced with a new page in the background.
+func (p *PagePool) Release(page *WebPage) {
+	if p.expired(page) {
+		p.Discard(page)
+		return
+	} else if err := p.reset(page); err != nil {
+		p.Discard(page)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.n--
+		delete(p.created, page)
+		page.Close()
+		return
+	}
+	p.idle = append(p.idle, page)
+	p.cond.Signal()
+}
+
+// expired returns true if page should be recycled instead of reused.
+func (p *PagePool) expired(page *WebPage) bool {
+	if p.RecycleAfter > 0 && page.navigationCount() >= p.RecycleAfter {
+		return true
+	}
+
+	p.mu.Lock()
+	created, ok := p.created[page]
+	p.mu.Unlock()
+	return p.RecycleAge > 0 && ok && time.Since(created) >= p.RecycleAge
+}
+
+// Discard closes an acquired page instead of returning it to the pool, such
+// as when the page has become unresponsive. A replacement page is created
+// in the background.
+func (p *PagePool) Discard(page *WebPage) {
+	page.Close()
+
+	p.mu.Lock()
+	p.n--
+	delete(p.created, page)
+	closed := p.closed
+	p.mu.Unlock()
+
+	if !closed {
+		go p.replace()
+	}
+}
+
+// replace creates a new page to restore the pool to its size. On failure,
+// the error is recorded and waiters are woken so Acquire() can return it
+// instead of waiting for a page which will never arrive.
+func (p *PagePool) replace() {
+	page, err := p.creator.CreateWebPage()
+	if err != nil {
+		p.mu.Lock()
+		p.err = err
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.n >= p.size {
+		page.Close()
+		return
+	}
+	p.idle = append(p.idle, page)
+	p.created[page] = time.Now()
+	p.n++
+	p.err = nil
+	p.cond.Signal()
+}
+
+// reset clears state left on a page by its previous user.
+func (p *PagePool) reset(page *WebPage) error {
+	if p.ClearCookies {
+		if err := page.ref.process.ClearCookies(); err != nil {
+			return err
+		}
+	}
+	return page.Reset()
+}
+
+// countNavigation records a navigation made through the page.
+func (p *WebPage) countNavigation() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.navigations++
+}
+
+// navigationCount returns the number of navigations made through the page.
+func (p *WebPage) navigationCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.navigations
+}
@@ -0,0 +1,85 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPaginateTimeout is the default time Paginate() waits for the next
+// page to load.
+const DefaultPaginateTimeout = 30 * time.Second
+
+// ErrStopPagination can be returned by the function passed to Paginate() to
+// stop after the current page without an error.
+var ErrStopPagination = errors.New("stop pagination")
+
+// Paginate calls perPage for each page of a paginated listing, visiting at
+// most maxPages pages.
+//
+// If next contains "%d" then the first "%d" is replaced with the page number
+// to build the URL of each page, such as "http://example.com/list?page=%d",
+// with pages numbered from 1. Other percent-escapes in the URL are kept. Pagination stops at the first page which returns 404 Not Found.
+//
+// Otherwise next is the CSS selector of the "next page" link or button. The
+// current page is passed to perPage first. The element is then clicked and
+// the next page is waited for, up to DefaultPaginateTimeout. Pagination stops
+// when the element is missing or disabled.
+func (p *WebPage) Paginate(next string, maxPages int, perPage func(*WebPage) error) error {
+	for i := 1; i <= maxPages; i++ {
+		if strings.Contains(next, "%d") {
+			if err := p.Open(strings.Replace(next, "%d", strconv.Itoa(i), 1)); err != nil {
+				if e, ok := err.(*ResourceError); ok && e.Status == http.StatusNotFound {
+					return nil
+				}
+				return err
+			}
+		} else if i > 1 {
+			if ok, err := p.clickNext(next); err != nil {
+				return err
+			} else if !ok {
+				return nil
+			}
+		}
+
+		if err := perPage(p); err == ErrStopPagination {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clickNext clicks the element matching selector and waits for the page it
+// navigates to. Returns false if the element is missing or disabled.
+func (p *WebPage) clickNext(selector string) (bool, error) {
+	// Mark the current document so the new document can be told apart.
+	buf, _ := json.Marshal(selector)
+	v, err := p.Evaluate(fmt.Sprintf(`function() {
+		var el = document.querySelector(%s);
+		if (!el || el.disabled || el.getAttribute("aria-disabled") === "true" || /(^|\s)disabled(\s|$)/.test(el.className)) {
+			return false;
+		}
+		window.__phantomjsPaginating = true;
+
+		var click = document.createEvent("MouseEvents");
+		click.initMouseEvent("click", true, true, window, 1, 0, 0, 0, 0, false, false, false, false, 0, null);
+		el.dispatchEvent(click);
+		return true;
+	}`, buf))
+	if err != nil {
+		return false, err
+	} else if ok, _ := v.(bool); !ok {
+		return false, nil
+	}
+
+	if err := p.WaitForFunction(`function() { return !window.__phantomjsPaginating && document.readyState === "complete" }`, DefaultPaginateTimeout, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,589 @@
+package phantomjs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ErrUnsupportedPDF is returned by MergePDF() for documents it cannot parse,
+// such as documents using cross-reference streams.
+var ErrUnsupportedPDF = errors.New("unsupported pdf")
+
+// PDFOptions represents options used when rendering several pages to a
+// single PDF with RenderPDFMulti().
+type PDFOptions struct {
+	// Paper settings shared by every page.
+	PaperSize PaperSize
+
+	// Time to wait after each page loads before it is rendered, such as for
+	// scripts which draw charts.
+	Delay time.Duration
+
+	// If set, the metadata of the merged document.
+	Info *PDFInfo
+
+	// If set, the watermark drawn over every page of the merged document.
+	Watermark *Watermark
+}
+
+// PDFInfo represents the metadata of a PDF document, which PhantomJS leaves
+// empty. See ApplyPDFInfo().
+type PDFInfo struct {
+	Title    string
+	Author   string
+	Subject  string
+	Keywords string
+	Creator  string // application which created the original content
+
+	// Defaults to the current time.
+	CreationDate time.Time
+}
+
+// RenderPDFMulti opens each URL in turn with the same paper settings and
+// returns the rendered PDFs merged into a single document, in order. This is
+// useful for bundling several reports into one file.
+func (p *Process) RenderPDFMulti(urls []string, opt PDFOptions) ([]byte, error) {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err := page.SetPaperSize(opt.PaperSize); err != nil {
+		return nil, err
+	}
+
+	docs := make([][]byte, 0, len(urls))
+	for _, u := range urls {
+		if err := page.Open(u); err != nil {
+			return nil, err
+		}
+		time.Sleep(opt.Delay)
+
+		buf, err := page.RenderBytes("pdf", 0)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, buf)
+	}
+
+	buf, err := MergePDF(docs)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Watermark != nil {
+		mark, err := page.watermarkImage(opt.Watermark, pdfWatermarkScale)
+		if err != nil {
+			return nil, err
+		} else if buf, err = stampPDF(buf, mark, opt.Watermark, pdfWatermarkScale); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Info != nil {
+		return ApplyPDFInfo(buf, *opt.Info)
+	}
+	return buf, nil
+}
+
+var (
+	pdfRefRegexp     = regexp.MustCompile(`(\d+)\s+(\d+)\s+R\b`)
+	pdfRefPrefix     = regexp.MustCompile(`^(\d+)\s+(\d+)\s+R\b`)
+	pdfObjRegexp     = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+obj`)
+	pdfRootRegexp    = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R`)
+	pdfPrevRegexp    = regexp.MustCompile(`/Prev\s+(\d+)`)
+	pdfSizeRegexp    = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfInfoRegexp    = regexp.MustCompile(`/Info\s+(\d+\s+\d+\s+R)`)
+	pdfPagesRegexp   = regexp.MustCompile(`/Pages\s+(\d+)\s+\d+\s+R`)
+	pdfCountRegexp   = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfVersionRegexp = regexp.MustCompile(`^%PDF-(\d+\.\d+)`)
+)
+
+// MergePDF merges PDF documents into a single document containing the pages
+// of each document in order. The page tree of each document is kept intact
+// under a new root so inherited page attributes are preserved.
+//
+// Only documents with classic cross-reference tables, such as those written
+// by PhantomJS, are supported.
+func MergePDF(docs [][]byte) ([]byte, error) {
+	parsed := make([]*pdfDocument, len(docs))
+	version, size := "1.4", 0
+	for i, data := range docs {
+		doc, err := parsePDF(data)
+		if err != nil {
+			return nil, fmt.Errorf("pdf %d: %s", i, err)
+		}
+		if doc.version > version {
+			version = doc.version
+		}
+		parsed[i], size = doc, size+doc.size
+	}
+	pagesNum, catalogNum := size+1, size+2
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", version)
+
+	// Copy the objects of each document, renumbered after the objects of
+	// the documents before it.
+	offsets := make([]int, 0, size+2)
+	gens := make([]int, 0, size+2)
+	var kids []int
+	var count int
+	for i, doc := range parsed {
+		base := len(offsets)
+		renumber := func(b []byte) []byte {
+			return pdfRefRegexp.ReplaceAllFunc(b, func(ref []byte) []byte {
+				m := pdfRefRegexp.FindSubmatch(ref)
+				n, _ := strconv.Atoi(string(m[1]))
+				return []byte(fmt.Sprintf("%d %s R", n+base, m[2]))
+			})
+		}
+
+		// Find the root of the page tree to add to the new root.
+		catalog, ok := doc.objects[doc.root]
+		if !ok {
+			return nil, fmt.Errorf("pdf %d: %s", i, ErrUnsupportedPDF)
+		}
+		m := pdfPagesRegexp.FindSubmatch(catalog.head)
+		if m == nil {
+			return nil, fmt.Errorf("pdf %d: %s", i, ErrUnsupportedPDF)
+		}
+		pages, _ := strconv.Atoi(string(m[1]))
+		obj, ok := doc.objects[pages]
+		if !ok {
+			return nil, fmt.Errorf("pdf %d: %s", i, ErrUnsupportedPDF)
+		} else if m := pdfCountRegexp.FindSubmatch(obj.head); m != nil {
+			n, _ := strconv.Atoi(string(m[1]))
+			count += n
+		}
+		kids = append(kids, pages+base)
+
+		for n := 1; n <= doc.size; n++ {
+			obj, ok := doc.objects[n]
+			if !ok {
+				offsets, gens = append(offsets, -1), append(gens, 0)
+				continue
+			}
+
+			head := renumber(obj.head)
+			if n == pages {
+				head = bytes.Replace(head, []byte("<<"), []byte(fmt.Sprintf("<< /Parent %d 0 R", pagesNum)), 1)
+			}
+			offsets, gens = append(offsets, buf.Len()), append(gens, obj.gen)
+			fmt.Fprintf(&buf, "%d %d obj", n+base, obj.gen)
+			buf.Write(head)
+			buf.Write(obj.tail)
+			buf.WriteString("endobj\n")
+		}
+	}
+
+	// Write the new page tree root and catalog.
+	offsets, gens = append(offsets, buf.Len()), append(gens, 0)
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Pages /Kids [", pagesNum)
+	for i, kid := range kids {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		fmt.Fprintf(&buf, "%d 0 R", kid)
+	}
+	fmt.Fprintf(&buf, "] /Count %d >>\nendobj\n", count)
+	offsets, gens = append(offsets, buf.Len()), append(gens, 0)
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", catalogNum, pagesNum)
+
+	// Write the cross-reference table and trailer.
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for i, offset := range offsets {
+		if offset < 0 {
+			buf.WriteString("0000000000 00000 f \n")
+			continue
+		}
+		fmt.Fprintf(&buf, "%010d %05d n \n", offset, gens[i])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, catalogNum, xref)
+
+	return buf.Bytes(), nil
+}
+
+// ApplyPDFInfo returns data with its metadata replaced by info. The metadata
+// is appended as an incremental update so the original document is left
+// byte-for-byte intact. Returns ErrUnsupportedPDF for documents which cannot
+// be parsed, the same as MergePDF().
+func ApplyPDFInfo(data []byte, info PDFInfo) ([]byte, error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	created := info.CreationDate
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<<")
+	for _, field := range []struct{ key, value string }{
+		{"Title", info.Title},
+		{"Author", info.Author},
+		{"Subject", info.Subject},
+		{"Keywords", info.Keywords},
+		{"Creator", info.Creator},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&buf, " /%s %s", field.key, pdfString(field.value))
+		}
+	}
+	fmt.Fprintf(&buf, " /Producer (PhantomJS) /CreationDate %s /ModDate %s >>", pdfString(pdfDate(created)), pdfString(pdfDate(created)))
+
+	num := doc.size + 1
+	doc.info = fmt.Sprintf("%d 0 R", num)
+	return appendPDFUpdate(data, doc, map[int][]byte{num: buf.Bytes()}), nil
+}
+
+// appendPDFUpdate returns data with objects appended as an incremental
+// update. Objects are keyed by number and replace existing objects of the
+// same number. The trailer refers to the document's root and information.
+func appendPDFUpdate(data []byte, doc *pdfDocument, objects map[int][]byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(data)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	nums := make([]int, 0, len(objects))
+	for num := range objects {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	size := doc.size
+	offsets := make([]int, len(nums))
+	gens := make([]int, len(nums))
+	for i, num := range nums {
+		if obj := doc.objects[num]; obj != nil {
+			gens[i] = obj.gen
+		}
+		if num > size {
+			size = num
+		}
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d %d obj\n", num, gens[i])
+		buf.Write(objects[num])
+		buf.WriteString("\nendobj\n")
+	}
+
+	// Write a subsection for each object as they are not contiguous.
+	xref := buf.Len()
+	buf.WriteString("xref\n")
+	for i, num := range nums {
+		fmt.Fprintf(&buf, "%d 1\n%010d %05d n \n", num, offsets[i], gens[i])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R", size+1, doc.root)
+	if doc.info != "" {
+		fmt.Fprintf(&buf, " /Info %s", doc.info)
+	}
+	fmt.Fprintf(&buf, " /Prev %d >>\nstartxref\n%d\n%%%%EOF\n", doc.xref, xref)
+	return buf.Bytes()
+}
+
+// pdfString encodes s as a PDF literal string, or as a UTF-16 hex string if
+// it contains characters outside of ASCII.
+func pdfString(s string) string {
+	for _, r := range s {
+		if r > 0x7e || (r < 0x20 && r != '\n' && r != '\t') {
+			var buf strings.Builder
+			buf.WriteString("<FEFF")
+			for _, c := range utf16.Encode([]rune(s)) {
+				fmt.Fprintf(&buf, "%04X", c)
+			}
+			buf.WriteString(">")
+			return buf.String()
+		}
+	}
+	return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s) + ")"
+}
+
+// pdfDate formats t as a PDF date, such as "D:20200102030405+01'00'".
+func pdfDate(t time.Time) string {
+	_, offset := t.Zone()
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("D:%s%s%02d'%02d'", t.Format("20060102150405"), sign, offset/3600, offset%3600/60)
+}
+
+// pdfDocument is a PDF parsed just enough to copy its objects.
+type pdfDocument struct {
+	version string
+	root    int
+	size    int    // highest object number
+	xref    int    // offset of the newest cross-reference table
+	info    string // reference to the document information, if any
+	objects map[int]*pdfObject
+}
+
+// pdfObject is an indirect object split into its dictionary or value, in
+// which references are renumbered, and its stream, which is copied as-is.
+type pdfObject struct {
+	gen  int
+	head []byte
+	tail []byte
+}
+
+// parsePDF locates the objects of data through its cross-reference tables.
+func parsePDF(data []byte) (*pdfDocument, error) {
+	m := pdfVersionRegexp.FindSubmatch(data)
+	if m == nil {
+		return nil, ErrUnsupportedPDF
+	}
+	doc := &pdfDocument{version: string(m[1]), objects: make(map[int]*pdfObject)}
+
+	i := bytes.LastIndex(data, []byte("startxref"))
+	if i == -1 {
+		return nil, ErrUnsupportedPDF
+	}
+	fields := bytes.Fields(data[i+len("startxref"):])
+	if len(fields) == 0 {
+		return nil, ErrUnsupportedPDF
+	}
+	xref, err := strconv.Atoi(string(fields[0]))
+	if err != nil {
+		return nil, ErrUnsupportedPDF
+	}
+	doc.xref = xref
+
+	// Read each table, newest first, so newer entries take precedence.
+	offsets := make(map[int]int)
+	gens := make(map[int]int)
+	bounds := []int{xref}
+	for seen := map[int]bool{}; !seen[xref]; {
+		seen[xref] = true
+		if xref < 0 || xref >= len(data) || !bytes.HasPrefix(data[xref:], []byte("xref")) {
+			return nil, ErrUnsupportedPDF
+		}
+
+		end := bytes.Index(data[xref:], []byte("trailer"))
+		if end == -1 {
+			return nil, ErrUnsupportedPDF
+		}
+		fields := bytes.Fields(data[xref+len("xref") : xref+end])
+		for len(fields) >= 2 {
+			start, err0 := strconv.Atoi(string(fields[0]))
+			n, err1 := strconv.Atoi(string(fields[1]))
+			if err0 != nil || err1 != nil || len(fields) < 2+3*n {
+				return nil, ErrUnsupportedPDF
+			}
+			for j := 0; j < n; j++ {
+				entry := fields[2+3*j : 5+3*j]
+				num := start + j
+				offset, _ := strconv.Atoi(string(entry[0]))
+				gen, _ := strconv.Atoi(string(entry[1]))
+
+				// Replaced objects still bound the objects before them.
+				if string(entry[2]) == "n" {
+					bounds = append(bounds, offset)
+				}
+				if _, ok := offsets[num]; ok {
+					continue
+				} else if string(entry[2]) != "n" {
+					offsets[num] = -1
+					continue
+				}
+				offsets[num], gens[num] = offset, gen
+			}
+			fields = fields[2+3*n:]
+		}
+
+		trailer := data[xref+end:]
+		if j := bytes.Index(trailer, []byte("startxref")); j != -1 {
+			trailer = trailer[:j]
+		}
+		if m := pdfRootRegexp.FindSubmatch(trailer); m != nil && doc.root == 0 {
+			doc.root, _ = strconv.Atoi(string(m[1]))
+		}
+		if m := pdfInfoRegexp.FindSubmatch(trailer); m != nil && doc.info == "" {
+			doc.info = string(m[1])
+		}
+		if m := pdfSizeRegexp.FindSubmatch(trailer); m != nil {
+			if n, _ := strconv.Atoi(string(m[1])); n-1 > doc.size {
+				doc.size = n - 1
+			}
+		}
+		if m := pdfPrevRegexp.FindSubmatch(trailer); m != nil {
+			xref, _ = strconv.Atoi(string(m[1]))
+			bounds = append(bounds, xref)
+		}
+	}
+	if doc.root == 0 {
+		return nil, ErrUnsupportedPDF
+	}
+
+	// Each object ends before the next object or table in the file.
+	sort.Ints(bounds)
+
+	for num, offset := range offsets {
+		if offset < 0 {
+			continue
+		}
+		if num > doc.size {
+			doc.size = num
+		}
+
+		end := len(data)
+		if j := sort.SearchInts(bounds, offset+1); j < len(bounds) {
+			end = bounds[j]
+		}
+		if offset > end {
+			return nil, ErrUnsupportedPDF
+		}
+		b := data[offset:end]
+		j := bytes.LastIndex(b, []byte("endobj"))
+		if j == -1 {
+			return nil, ErrUnsupportedPDF
+		}
+		b = b[:j]
+
+		m := pdfObjRegexp.FindSubmatchIndex(b)
+		if m == nil || string(b[m[2]:m[3]]) != strconv.Itoa(num) {
+			return nil, ErrUnsupportedPDF
+		}
+		b = b[m[1]:]
+
+		obj := &pdfObject{gen: gens[num], head: b}
+		if j := bytes.Index(b, []byte("stream")); j != -1 {
+			obj.head, obj.tail = b[:j], b[j:]
+		}
+		doc.objects[num] = obj
+	}
+	return doc, nil
+}
+
+// pdfSkipSpace returns the offset of the first token in b at or after i,
+// skipping whitespace and comments.
+func pdfSkipSpace(b []byte, i int) int {
+	for i < len(b) {
+		switch b[i] {
+		case ' ', '\t', '\r', '\n', '\f', 0:
+			i++
+		case '%':
+			for i < len(b) && b[i] != '\r' && b[i] != '\n' {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// pdfTokenEnd returns the end offset of the object starting at i in b. A
+// reference such as "12 0 R" is three objects.
+func pdfTokenEnd(b []byte, i int) int {
+	if i >= len(b) {
+		return i
+	}
+	switch b[i] {
+	case '<':
+		if i+1 < len(b) && b[i+1] == '<' {
+			for j := pdfSkipSpace(b, i+2); j < len(b); j = pdfSkipSpace(b, j) {
+				if bytes.HasPrefix(b[j:], []byte(">>")) {
+					return j + 2
+				}
+				j = pdfTokenEnd(b, j)
+			}
+			return len(b)
+		}
+		if j := bytes.IndexByte(b[i:], '>'); j != -1 {
+			return i + j + 1
+		}
+		return len(b)
+	case '[':
+		for j := pdfSkipSpace(b, i+1); j < len(b); j = pdfSkipSpace(b, j) {
+			if b[j] == ']' {
+				return j + 1
+			}
+			j = pdfTokenEnd(b, j)
+		}
+		return len(b)
+	case '(':
+		depth := 0
+		for j := i; j < len(b); j++ {
+			switch b[j] {
+			case '\\':
+				j++
+			case '(':
+				depth++
+			case ')':
+				if depth--; depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return len(b)
+	case ']', '>', ')', '{', '}':
+		return i + 1
+	}
+
+	// Names, numbers, and keywords end at a delimiter or whitespace.
+	j := i + 1
+	for j < len(b) && !bytes.ContainsRune([]byte(" \t\r\n\f\x00()<>[]{}/%"), rune(b[j])) {
+		j++
+	}
+	return j
+}
+
+// pdfValueEnd returns the end offset of the value starting at i in b,
+// including all three parts of a reference.
+func pdfValueEnd(b []byte, i int) int {
+	if m := pdfRefPrefix.FindIndex(b[i:]); m != nil {
+		return i + m[1]
+	}
+	return pdfTokenEnd(b, i)
+}
+
+// pdfLookup returns the offsets of the value of key in the dictionary which
+// starts at the first token of b. Returns false if the key is not set.
+func pdfLookup(b []byte, key string) (start, end int, ok bool) {
+	i := pdfSkipSpace(b, 0)
+	if !bytes.HasPrefix(b[i:], []byte("<<")) {
+		return 0, 0, false
+	}
+	for i = pdfSkipSpace(b, i+2); i < len(b) && !bytes.HasPrefix(b[i:], []byte(">>")); {
+		keyEnd := pdfTokenEnd(b, i)
+		start := pdfSkipSpace(b, keyEnd)
+		end := pdfValueEnd(b, start)
+		if string(b[i:keyEnd]) == "/"+key {
+			return start, end, true
+		}
+		i = pdfSkipSpace(b, end)
+	}
+	return 0, 0, false
+}
+
+// pdfRefNum returns the object number of a reference such as "12 0 R".
+// Returns false if v is not a reference.
+func pdfRefNum(v []byte) (int, bool) {
+	v = bytes.TrimSpace(v)
+	m := pdfRefPrefix.FindSubmatch(v)
+	if m == nil || len(m[0]) != len(v) {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n, true
+}
+
+// pdfSet returns the dictionary b with key set to value.
+func pdfSet(b []byte, key, value string) []byte {
+	if start, end, ok := pdfLookup(b, key); ok {
+		return bytes.Join([][]byte{b[:start], []byte(value), b[end:]}, nil)
+	}
+	i := pdfSkipSpace(b, 0) + 2
+	return bytes.Join([][]byte{b[:i], []byte(" /" + key + " " + value), b[i:]}, nil)
+}
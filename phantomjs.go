@@ -2,21 +2,64 @@ package phantomjs
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"  // register GIF decoder
+	_ "image/jpeg" // register JPEG decoder
+	_ "image/png"  // register PNG decoder
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// ErrInjectionFailed is returned by InjectJS when injection fails.
 	ErrInjectionFailed = errors.New("injection failed")
+
+	// ErrElementNotFound is returned when a selector does not match any element.
+	ErrElementNotFound = errors.New("element not found")
+
+	// ErrTimeout is returned when a wait operation does not complete in time.
+	ErrTimeout = errors.New("timeout")
+
+	// ErrCallbackServerDisabled is returned when registering a handler which
+	// requires the process' callback server while it is not running.
+	ErrCallbackServerDisabled = errors.New("callback server disabled")
+
+	// ErrCaptureDisabled is returned when capturing responses on a process
+	// which does not have CaptureResponses enabled.
+	ErrCaptureDisabled = errors.New("response capture disabled")
+
+	// ErrNetworkSimulationDisabled is returned when setting network
+	// conditions on a process which does not have SimulateNetwork enabled.
+	ErrNetworkSimulationDisabled = errors.New("network simulation disabled")
+
+	// ErrPageClosed is returned when using a page which has been closed,
+	// such as by the process after exceeding its PageTTL.
+	ErrPageClosed = errors.New("page closed")
+
+	// ErrWebPUnsupported is returned when rendering to WebP without building
+	// with the "webp" tag.
+	ErrWebPUnsupported = errors.New("webp support requires the webp build tag")
+
+	// ErrSpawnDisabled is returned by Spawn() when the process does not have
+	// AllowSpawn set.
+	ErrSpawnDisabled = errors.New("spawn disabled")
 )
 
 // Keyboard modifiers.
@@ -30,21 +73,150 @@ const (
 
 // Default settings.
 const (
-	DefaultPort    = 20202
-	DefaultBinPath = "phantomjs"
+	DefaultPort          = 20202
+	DefaultBinPath       = "phantomjs"
+	DefaultPollInterval  = 100 * time.Millisecond
+	DefaultAssetTimeout  = 10 * time.Second
+	DefaultDialogTimeout = 5 * time.Second
+	DefaultScrollTimeout = 10 * time.Second
+	DefaultWebPQuality   = 80
 )
 
 // Process represents a PhantomJS process.
 type Process struct {
+	// Last ID assigned to a request. Accessed atomically so it is first
+	// to keep it 64-bit aligned.
+	requestID uint64
+
 	path string
 	cmd  *exec.Cmd
 
+	// Secret sent with every request so that pages loaded by PhantomJS
+	// cannot call the shim's API themselves.
+	token string
+
+	// Requests waiting to be sent, if MaxInFlight is set.
+	queue requestQueue
+
+	// Callback server state.
+	ln              net.Listener
+	mu              sync.Mutex
+	queues          map[string][]*eventQueue
+	confirmHandlers map[string]func(string) bool
+	promptHandlers  map[string]func(string, string) string
+
+	// Proxy last set with SetProxy().
+	proxy Proxy
+
+	// Response capture proxy, if enabled.
+	capture *captureProxy
+
+	// Process-level events, if requested.
+	events        chan Event
+	eventsClosing chan struct{}
+
+	// Cached page properties and their generations by ref ID, if
+	// CacheProperties is set.
+	propMu  sync.Mutex
+	props   map[string]*pageProperties
+	propGen map[string]int
+
+	// Live page handles by ref ID, refs whose handles were collected, and
+	// the number of requests in flight by ref ID.
+	refMu        sync.Mutex
+	handles      map[string]int
+	collected    []string
+	busy         map[string]int
+	sweepClosing chan struct{}
+
 	// Path to the 'phantomjs' binary.
 	BinPath string
 
+	// Additional command line arguments passed to the binary, such as
+	// "--local-storage-path=/tmp/storage".
+	Args []string
+
 	// HTTP port used to communicate with phantomjs.
 	Port int
 
+	// Directory localStorage is persisted to and the maximum size of each
+	// origin's localStorage, in KB. PhantomJS' defaults are used if unset.
+	LocalStoragePath  string
+	LocalStorageQuota int
+
+	// If set, responses are cached on disk in this directory. Otherwise
+	// PhantomJS only caches responses in memory.
+	DiskCachePath string
+
+	// If true, a local HTTP server is started which PhantomJS pushes page
+	// events to as they occur instead of the client polling for them.
+	CallbackServer bool
+
+	// Time to wait for a dialog handler, such as WebPage.OnConfirm(), to
+	// return before the page's default answer is used.
+	DialogTimeout time.Duration
+
+	// If true, PhantomJS is started with a local proxy which can capture
+	// response bodies for pages. See WebPage.SetCapturePatterns().
+	CaptureResponses bool
+
+	// If true, commands can be run on the host with Spawn(). Disabled by
+	// default as it allows anyone who can call the process to run commands.
+	AllowSpawn bool
+
+	// If true, PhantomJS is started with a local proxy which can throttle
+	// the network of pages. See WebPage.SetNetworkConditions().
+	SimulateNetwork bool
+
+	// If true, console messages and uncaught JavaScript errors from every
+	// page are written to Stdout and Stderr, respectively, prefixed with the
+	// page's ref and URL.
+	ForwardConsole bool
+
+	// If set, pages which have not been used for the duration are closed
+	// by PhantomJS to release their memory. Methods called on a closed page
+	// return ErrPageClosed. Waiting for events does not count as use.
+	PageTTL time.Duration
+
+	// If set, pages whose WebPage handles have been garbage collected
+	// without being closed are released at this interval. See Sweep().
+	SweepInterval time.Duration
+
+	// If true, page settings, viewport sizes, and library paths are cached
+	// after they are first read to reduce requests to PhantomJS. Cached
+	// values are invalidated by their setters and by navigation through
+	// methods such as Open() and Reload(). Changes made from page scripts or
+	// navigation initiated by the page itself are not observed.
+	CacheProperties bool
+
+	// Configuration applied to every page created by CreateWebPage().
+	// Reset() restores pages to these defaults.
+	DefaultPageSettings *PageDefaults
+
+	// Client used by WebPage.Downloads() to re-fetch captured downloads.
+	// Uses http.DefaultClient if nil.
+	DownloadClient *http.Client
+
+	// Transport used to send requests to the shim. Uses
+	// http.DefaultTransport if nil. See Recorder and Replayer.
+	Transport http.RoundTripper
+
+	// If set, responses from the shim larger than this many bytes, such as
+	// the content of a huge page, return a *ResponseTooLargeError instead of
+	// being read into memory. Streams, such as WebPage.ContentReader(), are
+	// not limited.
+	MaxResponseBytes int64
+
+	// If set, at most this many requests are sent to the shim at once so
+	// bursts of calls do not overwhelm it. Further requests wait in a queue
+	// of up to QueueDepth requests and QueuePolicy determines what happens
+	// when it is full. Event polling and waits such as WaitForNavigation()
+	// bypass the queue so they cannot block the requests which complete
+	// them.
+	MaxInFlight int
+	QueueDepth  int
+	QueuePolicy QueuePolicy
+
 	// Output from the process.
 	Stdout io.Writer
 	Stderr io.Writer
@@ -53,10 +225,11 @@ type Process struct {
 // NewProcess returns a new instance of Process.
 func NewProcess() *Process {
 	return &Process{
-		BinPath: DefaultBinPath,
-		Port:    DefaultPort,
-		Stdout:  os.Stdout,
-		Stderr:  os.Stderr,
+		BinPath:       DefaultBinPath,
+		Port:          DefaultPort,
+		DialogTimeout: DefaultDialogTimeout,
+		Stdout:        os.Stdout,
+		Stderr:        os.Stderr,
 	}
 }
 
@@ -81,9 +254,61 @@ func (p *Process) Open() error {
 			return err
 		}
 
+		// Generate the token which authenticates requests to the shim.
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		p.token = hex.EncodeToString(token)
+
+		// Pick a port for the shim's mock server, which is kept separate
+		// from the API so mocked documents cannot call it.
+		mockPort, err := freePort()
+		if err != nil {
+			return err
+		}
+
+		// Start callback server, if enabled.
+		env := []string{fmt.Sprintf("PORT=%d", p.Port), fmt.Sprintf("MOCK_PORT=%d", mockPort), "TOKEN=" + p.token}
+		if p.CallbackServer {
+			if err := p.openCallbackServer(); err != nil {
+				return err
+			}
+			env = append(env, "CALLBACK_URL="+p.CallbackURL())
+		}
+		if p.ForwardConsole {
+			env = append(env, "FORWARD_CONSOLE=1")
+		}
+		if p.AllowSpawn {
+			env = append(env, "ALLOW_SPAWN=1")
+		}
+		if p.PageTTL > 0 {
+			env = append(env, fmt.Sprintf("PAGE_TTL=%d", p.PageTTL/time.Millisecond))
+		}
+
+		// Start capture proxy, if enabled. It also simulates network conditions.
+		args := append([]string{}, p.Args...)
+		if p.CaptureResponses || p.SimulateNetwork {
+			p.capture = newCaptureProxy()
+			p.capture.owner = p.tunnelOwner
+			if err := p.capture.Open(); err != nil {
+				return err
+			}
+			args = append(args, "--proxy="+p.capture.Addr(), "--proxy-type=http")
+		}
+		if p.LocalStoragePath != "" {
+			args = append(args, "--local-storage-path="+p.LocalStoragePath)
+		}
+		if p.LocalStorageQuota > 0 {
+			args = append(args, fmt.Sprintf("--local-storage-quota=%d", p.LocalStorageQuota))
+		}
+		if p.DiskCachePath != "" {
+			args = append(args, "--disk-cache=true", "--disk-cache-path="+p.DiskCachePath)
+		}
+
 		// Start external process.
-		cmd := exec.Command(p.BinPath, scriptPath)
-		cmd.Env = []string{fmt.Sprintf("PORT=%d", p.Port)}
+		cmd := exec.Command(p.BinPath, append(args, scriptPath)...)
+		cmd.Env = env
 		cmd.Stdout = p.Stdout
 		cmd.Stderr = p.Stderr
 		if err := cmd.Start(); err != nil {
@@ -95,6 +320,12 @@ func (p *Process) Open() error {
 		if err := p.wait(); err != nil {
 			return err
 		}
+
+		// Start releasing collected pages, if enabled.
+		if p.SweepInterval > 0 {
+			p.sweepClosing = make(chan struct{})
+			go p.runSweep(p.sweepClosing)
+		}
 		return nil
 
 	}(); err != nil {
@@ -107,6 +338,20 @@ func (p *Process) Open() error {
 
 // Close stops the process.
 func (p *Process) Close() (err error) {
+	// Stop sweeping collected pages.
+	if p.sweepClosing != nil {
+		close(p.sweepClosing)
+		p.sweepClosing = nil
+	}
+
+	// Stop polling process events.
+	p.mu.Lock()
+	if p.eventsClosing != nil {
+		close(p.eventsClosing)
+		p.eventsClosing, p.events = nil, nil
+	}
+	p.mu.Unlock()
+
 	// Kill process.
 	if p.cmd != nil {
 		if e := p.cmd.Process.Kill(); e != nil && err == nil {
@@ -115,6 +360,22 @@ func (p *Process) Close() (err error) {
 		p.cmd.Wait()
 	}
 
+	// Stop callback server.
+	if p.ln != nil {
+		if e := p.ln.Close(); e != nil && err == nil {
+			err = e
+		}
+		p.ln = nil
+	}
+
+	// Stop capture proxy.
+	if p.capture != nil {
+		if e := p.capture.Close(); e != nil && err == nil {
+			err = e
+		}
+		p.capture = nil
+	}
+
 	// Remove shim file.
 	if p.path != "" {
 		if e := os.RemoveAll(p.path); e != nil && err == nil {
@@ -127,7 +388,179 @@ func (p *Process) Close() (err error) {
 
 // URL returns the process' API URL.
 func (p *Process) URL() string {
-	return fmt.Sprintf("http://localhost:%d", p.Port)
+	return fmt.Sprintf("http://127.0.0.1:%d", p.Port)
+}
+
+// CallbackURL returns the URL of the callback server.
+// Returns a blank string if the callback server is not running.
+func (p *Process) CallbackURL() string {
+	if p.ln == nil {
+		return ""
+	}
+	return "http://" + p.ln.Addr().String()
+}
+
+// freePort returns a local port which is not currently in use.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// openCallbackServer starts an HTTP server on a random local port which
+// receives callbacks from the shim.
+func (p *Process) openCallbackServer() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/event", p.handleEventCallback)
+	mux.HandleFunc("/confirm", p.handleConfirmCallback)
+	mux.HandleFunc("/prompt", p.handlePromptCallback)
+	go http.Serve(ln, mux)
+
+	return nil
+}
+
+// handleEventCallback receives an event pushed from the shim and adds it to
+// the queues subscribed to the page.
+func (p *Process) handleEventCallback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ref    string    `json:"ref"`
+		Event  eventJSON `json:"event"`
+		Closed bool      `json:"closed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	queues := p.queues[req.Ref]
+	if req.Closed {
+		delete(p.queues, req.Ref)
+	}
+	p.mu.Unlock()
+
+	for _, q := range queues {
+		if req.Closed {
+			q.close()
+		} else {
+			q.push(req.Event)
+		}
+	}
+	w.Write([]byte(`{}`))
+}
+
+// handleConfirmCallback answers a confirm() dialog using the page's handler.
+// If the handler does not return within the dialog timeout then the response
+// is marked as unhandled and the shim uses the page's default answer.
+func (p *Process) handleConfirmCallback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ref     string `json:"ref"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	fn := p.confirmHandlers[req.Ref]
+	p.mu.Unlock()
+
+	var resp struct {
+		Handled bool `json:"handled"`
+		Value   bool `json:"value"`
+	}
+	if fn != nil {
+		ch := make(chan bool, 1)
+		go func() { ch <- fn(req.Message) }()
+		select {
+		case resp.Value = <-ch:
+			resp.Handled = true
+		case <-time.After(p.dialogTimeout()):
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handlePromptCallback answers a prompt() dialog using the page's handler.
+// Unanswered prompts fall back to the page's default response in the shim.
+func (p *Process) handlePromptCallback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ref          string `json:"ref"`
+		Message      string `json:"message"`
+		DefaultValue string `json:"defaultValue"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	fn := p.promptHandlers[req.Ref]
+	p.mu.Unlock()
+
+	var resp struct {
+		Handled bool   `json:"handled"`
+		Value   string `json:"value"`
+	}
+	if fn != nil {
+		ch := make(chan string, 1)
+		go func() { ch <- fn(req.Message, req.DefaultValue) }()
+		select {
+		case resp.Value = <-ch:
+			resp.Handled = true
+		case <-time.After(p.dialogTimeout()):
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dialogTimeout returns the dialog timeout or the default if unset.
+func (p *Process) dialogTimeout() time.Duration {
+	if p.DialogTimeout <= 0 {
+		return DefaultDialogTimeout
+	}
+	return p.DialogTimeout
+}
+
+// subscribe returns a queue which receives events pushed for a page.
+func (p *Process) subscribe(id string) *eventQueue {
+	q := newEventQueue()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queues == nil {
+		p.queues = make(map[string][]*eventQueue)
+	}
+	p.queues[id] = append(p.queues[id], q)
+	return q
+}
+
+// unsubscribe stops pushing events for a page to q.
+func (p *Process) unsubscribe(id string, q *eventQueue) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := p.queues[id]
+	for i := range a {
+		if a[i] == q {
+			p.queues[id] = append(a[:i:i], a[i+1:]...)
+			break
+		}
+	}
+	if len(p.queues[id]) == 0 {
+		delete(p.queues, id)
+	}
+	q.close()
 }
 
 // wait continually checks the process until it gets a response or times out.
@@ -153,7 +586,11 @@ func (p *Process) wait() error {
 // ping checks the process to see if it is up.
 func (p *Process) ping() error {
 	// Send request.
-	resp, err := http.Get(p.URL() + "/ping")
+	req, _, err := p.newRequest(context.Background(), "GET", "/ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -171,14 +608,220 @@ func (p *Process) CreateWebPage() (*WebPage, error) {
 	var resp struct {
 		Ref refJSON `json:"ref"`
 	}
-	if err := p.doJSON("POST", "/webpage/Create", nil, &resp); err != nil {
+	var req map[string]interface{}
+	if p.DefaultPageSettings != nil {
+		req = map[string]interface{}{"defaults": encodePageDefaultsJSON(p.DefaultPageSettings)}
+	}
+	if err := p.doJSON("POST", "/webpage/Create", req, &resp); err != nil {
+		return nil, err
+	}
+	return newWebPage(p, resp.Ref.ID), nil
+}
+
+// Events returns a channel of events raised by the process rather than by a
+// page. Currently these are EventError events containing a *PageError for
+// uncaught errors in the shim, which may otherwise appear only as requests
+// which never return. The channel is closed when the process is closed.
+func (p *Process) Events() <-chan Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.events == nil {
+		p.events = make(chan Event, 100)
+		p.eventsClosing = make(chan struct{})
+		go p.pollEvents(p.events, p.eventsClosing)
+	}
+	return p.events
+}
+
+// pollEvents sends process events to ch until closing is closed or the
+// process can no longer be reached.
+func (p *Process) pollEvents(ch chan Event, closing chan struct{}) {
+	defer close(ch)
+
+	var seq int
+	for {
+		var resp struct {
+			Events []eventJSON `json:"events"`
+			Closed bool        `json:"closed"`
+		}
+		req := map[string]interface{}{"since": seq, "timeout": int(eventPollTimeout / time.Millisecond)}
+		if err := p.doJSON("POST", "/process/Events", req, &resp); err != nil {
+			return
+		}
+
+		for _, v := range resp.Events {
+			seq = v.Seq
+
+			e, err := decodeEventJSON(p, v)
+			if err != nil {
+				continue
+			}
+
+			select {
+			case <-closing:
+				return
+			case ch <- e:
+			}
+		}
+
+		select {
+		case <-closing:
+			return
+		default:
+		}
+		if resp.Closed {
+			return
+		}
+	}
+}
+
+// Cookies returns all cookies in the process' cookie store, which is shared
+// by every page.
+func (p *Process) Cookies() ([]*http.Cookie, error) {
+	var resp struct {
+		Value []cookieJSON `json:"value"`
+	}
+	if err := p.doJSON("POST", "/process/Cookies", nil, &resp); err != nil {
 		return nil, err
 	}
-	return &WebPage{ref: newRef(p, resp.Ref.ID)}, nil
+
+	a := make([]*http.Cookie, len(resp.Value))
+	for i := range resp.Value {
+		a[i] = decodeCookieJSON(resp.Value[i])
+	}
+	return a, nil
+}
+
+// AddCookie adds a cookie to the process' cookie store. The cookie must have
+// a domain. Returns true if the cookie was successfully added.
+func (p *Process) AddCookie(cookie *http.Cookie) (bool, error) {
+	var resp struct {
+		ReturnValue bool `json:"returnValue"`
+	}
+	if err := p.doJSON("POST", "/process/AddCookie", map[string]interface{}{"cookie": encodeCookieJSON(cookie)}, &resp); err != nil {
+		return false, err
+	}
+	return resp.ReturnValue, nil
+}
+
+// DeleteCookie removes cookies with a matching name from the process' cookie
+// store. Returns true if a cookie was deleted.
+func (p *Process) DeleteCookie(name string) (bool, error) {
+	var resp struct {
+		ReturnValue bool `json:"returnValue"`
+	}
+	if err := p.doJSON("POST", "/process/DeleteCookie", map[string]interface{}{"name": name}, &resp); err != nil {
+		return false, err
+	}
+	return resp.ReturnValue, nil
+}
+
+// ClearCookies removes all cookies from the process' cookie store.
+func (p *Process) ClearCookies() error {
+	return p.doJSON("POST", "/process/ClearCookies", nil, nil)
+}
+
+// CookiesEnabled returns true if cookies are sent and stored by pages.
+func (p *Process) CookiesEnabled() (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
+	}
+	if err := p.doJSON("POST", "/process/CookiesEnabled", nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Value, nil
+}
+
+// SetCookiesEnabled enables or disables cookies for all pages.
+func (p *Process) SetCookiesEnabled(value bool) error {
+	return p.doJSON("POST", "/process/SetCookiesEnabled", map[string]interface{}{"value": value}, nil)
+}
+
+// InjectJS evaluates the script in filename in the PhantomJS context itself
+// rather than in a page, such as to load helper libraries used by the shim.
+// Relative paths are resolved against LibraryPath().
+func (p *Process) InjectJS(filename string) error {
+	var resp struct {
+		ReturnValue bool `json:"returnValue"`
+	}
+	if err := p.doJSON("POST", "/process/InjectJS", map[string]interface{}{"filename": filename}, &resp); err != nil {
+		return err
+	}
+	if !resp.ReturnValue {
+		return ErrInjectionFailed
+	}
+	return nil
+}
+
+// LibraryPath returns the path used by Process.InjectJS() to resolve scripts.
+// Initially it is set to Path().
+func (p *Process) LibraryPath() (string, error) {
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := p.doJSON("POST", "/process/LibraryPath", nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// SetLibraryPath sets the library path used by Process.InjectJS().
+func (p *Process) SetLibraryPath(path string) error {
+	return p.doJSON("POST", "/process/SetLibraryPath", map[string]interface{}{"path": path}, nil)
+}
+
+// ClearCaches purges cached responses so pages fetch fresh assets without
+// restarting the process. The memory cache shared by all pages is cleared
+// and, if DiskCachePath is set, the files in the disk cache are removed.
+//
+// Only files are removed from the disk cache. Its directories, such as
+// "prepared" and "data8", are created by Qt when the process starts and are
+// not recreated if they are removed, which would stop caching until restart.
+func (p *Process) ClearCaches() error {
+	if err := p.doJSON("POST", "/process/ClearMemoryCache", nil, nil); err != nil {
+		return err
+	}
+	if p.DiskCachePath == "" {
+		return nil
+	}
+
+	err := filepath.Walk(p.DiskCachePath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if fi.IsDir() {
+			return nil
+		} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
 
+// requestIDHeader is the header carrying the ID assigned to each request so
+// the shim can correlate cancellations with in-flight requests.
+const requestIDHeader = "X-Phantomjs-Request-Id"
+
+// tokenHeader is the header carrying the process' token. The shim rejects
+// requests without it.
+const tokenHeader = "X-Phantomjs-Token"
+
 // doJSON sends an HTTP request to url and encodes and decodes the req/resp as JSON.
 func (p *Process) doJSON(method, path string, req, resp interface{}) error {
+	return p.doJSONContext(context.Background(), method, path, req, resp)
+}
+
+// doJSONContext sends a request the same as doJSON(). If ctx is done before
+// the response is received then the shim is told to cancel the request and
+// ctx's error is returned.
+func (p *Process) doJSONContext(ctx context.Context, method, path string, req, resp interface{}) error {
+	// Keep the request's page from being swept while it runs.
+	defer p.beginRequest(req)()
+
 	// Encode request.
 	var r io.Reader
 	if req != nil {
@@ -190,22 +833,28 @@ func (p *Process) doJSON(method, path string, req, resp interface{}) error {
 	}
 
 	// Create request.
-	httpRequest, err := http.NewRequest(method, p.URL()+path, r)
+	httpRequest, id, err := p.newRequest(ctx, method, path, r)
 	if err != nil {
 		return err
 	}
 
+	// Wait for a turn if the queue is enabled.
+	if err := p.acquire(ctx, path); err != nil {
+		return err
+	}
+	defer p.release(path)
+
 	// Send request.
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	httpResponse, err := (&http.Client{Transport: p.Transport}).Do(httpRequest)
 	if err != nil {
-		return err
+		return p.canceled(ctx, id, err)
 	}
 	defer httpResponse.Body.Close()
 
 	// Read response body.
-	body, err := ioutil.ReadAll(httpResponse.Body)
+	body, err := p.readResponse(path, httpResponse.Body, httpResponse.ContentLength)
 	if err != nil {
-		return err
+		return p.canceled(ctx, id, err)
 	}
 
 	// Check response code.
@@ -217,6 +866,8 @@ func (p *Process) doJSON(method, path string, req, resp interface{}) error {
 	var errResp errorResponse
 	if err := json.Unmarshal(body, &errResp); err != nil {
 		return errors.New("phantomjs.Process: " + string(body))
+	} else if errResp.Error == ErrPageClosed.Error() {
+		return ErrPageClosed
 	} else if errResp.Error != "" {
 		return errors.New(errResp.Error)
 	}
@@ -231,38 +882,202 @@ func (p *Process) doJSON(method, path string, req, resp interface{}) error {
 	return nil
 }
 
-type errorResponse struct {
-	Error string `json:"error"`
-}
-
-// DefaultProcess is a global, shared process.
-// It must be opened before use.
-var DefaultProcess = NewProcess()
-
-// CreateWebPage returns a new instance of a "webpage" using the default process.
-func CreateWebPage() (*WebPage, error) {
-	return DefaultProcess.CreateWebPage()
-}
-
-// WebPage represents an object returned from "webpage.create()".
-type WebPage struct {
-	ref *Ref
-}
+// doStream sends a request the same as doJSON() for routes which respond
+// with raw data instead of JSON. The caller must close the returned body.
+// Error responses are decoded and returned as errors.
+func (p *Process) doStream(method, path string, req interface{}) (io.ReadCloser, http.Header, error) {
+	end := p.beginRequest(req)
+	buf, err := json.Marshal(req)
+	if err != nil {
+		end()
+		return nil, nil, err
+	}
 
-// Open opens a URL.
-func (p *WebPage) Open(url string) error {
-	req := map[string]interface{}{
-		"ref": p.ref.id,
-		"url": url,
+	httpRequest, _, err := p.newRequest(context.Background(), method, path, bytes.NewReader(buf))
+	if err != nil {
+		end()
+		return nil, nil, err
 	}
-	var resp struct {
-		Status string `json:"status"`
+
+	// The queue slot and the page are held until the caller closes the body.
+	if err := p.acquire(context.Background(), path); err != nil {
+		end()
+		return nil, nil, err
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Open", req, &resp); err != nil {
-		return err
+	httpResponse, err := (&http.Client{Transport: p.Transport}).Do(httpRequest)
+	if err != nil {
+		p.release(path)
+		end()
+		return nil, nil, err
+	} else if httpResponse.StatusCode == http.StatusOK {
+		return &queuedBody{ReadCloser: httpResponse.Body, release: func() { p.release(path); end() }}, httpResponse.Header, nil
+	}
+	defer end()
+	defer p.release(path)
+	defer httpResponse.Body.Close()
+
+	// Decode the error from the response.
+	body, err := p.readResponse(path, httpResponse.Body, httpResponse.ContentLength)
+	if err != nil {
+		return nil, nil, err
+	} else if httpResponse.StatusCode == http.StatusNotFound {
+		return nil, nil, fmt.Errorf("not found: %s", path)
+	}
+
+	var errResp errorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error == "" {
+		return nil, nil, errors.New("phantomjs.Process: " + string(body))
+	} else if errResp.Error == ErrPageClosed.Error() {
+		return nil, nil, ErrPageClosed
+	} else if errResp.Error == ErrTimeout.Error() {
+		return nil, nil, ErrTimeout
+	}
+	return nil, nil, errors.New(errResp.Error)
+}
+
+// readResponse reads the body of a response to a request to path. The size
+// is the response's content length, or -1 if unknown. Returns a
+// *ResponseTooLargeError if the body is larger than MaxResponseBytes.
+func (p *Process) readResponse(path string, r io.Reader, size int64) ([]byte, error) {
+	limit := p.MaxResponseBytes
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	} else if size > limit {
+		return nil, &ResponseTooLargeError{Path: path, Size: size, Limit: limit}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(body)) <= limit {
+		return body, nil
+	}
+
+	// Discard the remainder without buffering it to report the actual size.
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+	return nil, &ResponseTooLargeError{Path: path, Size: int64(len(body)) + n, Limit: limit}
+}
+
+// newRequest returns a request to the shim tagged with a new request ID.
+func (p *Process) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, string, error) {
+	httpRequest, err := http.NewRequest(method, p.URL()+path, body)
+	if err != nil {
+		return nil, "", err
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&p.requestID, 1), 10)
+	httpRequest.Header.Set(requestIDHeader, id)
+	if p.token != "" {
+		httpRequest.Header.Set(tokenHeader, p.token)
+	}
+	return httpRequest.WithContext(ctx), id, nil
+}
+
+// canceled returns err unless it was caused by ctx being done. In that case
+// the shim is told to abandon the request in the background and ctx's error
+// is returned.
+func (p *Process) canceled(ctx context.Context, id string, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	go p.doJSON("POST", "/cancel", map[string]interface{}{"id": id}, nil)
+	return ctx.Err()
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// DefaultProcess is a global, shared process.
+// It must be opened before use.
+var DefaultProcess = NewProcess()
+
+// CreateWebPage returns a new instance of a "webpage" using the default process.
+func CreateWebPage() (*WebPage, error) {
+	return DefaultProcess.CreateWebPage()
+}
+
+// WebPage represents an object returned from "webpage.create()".
+type WebPage struct {
+	ref *Ref
+
+	mu      sync.Mutex
+	events  chan Event
+	closing chan struct{}
+
+	// Closed to stop the network log writer, if set.
+	networkLogClosing chan struct{}
+
+	// User agent assigned by a PagePool, if rotating.
+	rotatedUserAgent string
+
+	// Number of navigations made through methods such as Open(). Used by
+	// PagePool to recycle pages.
+	navigations int
+
+	// Metadata and watermark applied to rendered PDFs, if set.
+	pdfInfo      *PDFInfo
+	pdfWatermark *Watermark
+}
+
+// Ref returns the reference to the page within PhantomJS.
+func (p *WebPage) Ref() *Ref { return p.ref }
+
+// RotatedUserAgent returns the user agent applied to the page when it was
+// acquired from a PagePool with UserAgent set. Returns a blank string if the
+// page was not assigned a user agent.
+func (p *WebPage) RotatedUserAgent() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rotatedUserAgent
+}
+
+// setRotatedUserAgent sets the page's user agent and records it.
+func (p *WebPage) setRotatedUserAgent(ua string) error {
+	settings, err := p.Settings()
+	if err != nil {
+		return err
+	}
+	settings.UserAgent = ua
+	if err := p.SetSettings(settings); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.rotatedUserAgent = ua
+	p.mu.Unlock()
+	return nil
+}
+
+// Open opens a URL.
+func (p *WebPage) Open(url string) error {
+	return p.OpenContext(context.Background(), url)
+}
+
+// OpenContext opens a URL the same as Open(). If ctx is done before the page
+// has loaded then navigation is stopped and ctx's error is returned.
+func (p *WebPage) OpenContext(ctx context.Context, url string) error {
+	defer p.invalidateProperties()
+	defer p.countNavigation()
+
+	req := map[string]interface{}{
+		"ref": p.ref.id,
+		"url": url,
+	}
+	var resp struct {
+		Status        string             `json:"status"`
+		ResourceError *resourceErrorJSON `json:"resourceError"`
+	}
+	if err := p.ref.process.doJSONContext(ctx, "POST", "/webpage/Open", req, &resp); err != nil {
+		return err
 	}
 
 	if resp.Status != "success" {
+		if resp.ResourceError != nil {
+			return decodeResourceErrorJSON(*resp.ResourceError)
+		}
 		return errors.New("failed")
 	}
 	return nil
@@ -291,7 +1106,7 @@ func (p *WebPage) CanGoForward() (bool, error) {
 }
 
 // ClipRect returns the clipping rectangle used when rendering.
-// Returns nil if no clipping rectangle is set.
+// Returns an empty rectangle if no clipping rectangle is set.
 func (p *WebPage) ClipRect() (Rect, error) {
 	var resp struct {
 		Value rectJSON `json:"value"`
@@ -308,7 +1123,7 @@ func (p *WebPage) ClipRect() (Rect, error) {
 }
 
 // SetClipRect sets the clipping rectangle used when rendering.
-// Set to nil to render the entire webpage.
+// Set to an empty rectangle or call ClearClipRect() to render the entire webpage.
 func (p *WebPage) SetClipRect(rect Rect) error {
 	req := map[string]interface{}{
 		"ref": p.ref.id,
@@ -322,6 +1137,75 @@ func (p *WebPage) SetClipRect(rect Rect) error {
 	return p.ref.process.doJSON("POST", "/webpage/SetClipRect", req, nil)
 }
 
+// SetClipRectInt sets the clipping rectangle from integer coordinates, as
+// SetClipRect() accepted before Rect's fields became fractional.
+func (p *WebPage) SetClipRectInt(top, left, width, height int) error {
+	return p.SetClipRect(Rect{Top: float64(top), Left: float64(left), Width: float64(width), Height: float64(height)})
+}
+
+// SetClipRectToElement sets the clipping rectangle to the bounding rectangle
+// of the first element matching selector. The rectangle is computed and
+// applied within PhantomJS so layout changes cannot occur in between.
+//
+// Returns ErrElementNotFound if no element matches selector.
+func (p *WebPage) SetClipRectToElement(selector string) error {
+	var resp struct {
+		Found bool `json:"found"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/SetClipRectToElement", map[string]interface{}{"ref": p.ref.id, "selector": selector}, &resp); err != nil {
+		return err
+	} else if !resp.Found {
+		return ErrElementNotFound
+	}
+	return nil
+}
+
+// ClearClipRect removes the clipping rectangle so the entire webpage is rendered.
+func (p *WebPage) ClearClipRect() error {
+	return p.SetClipRect(Rect{})
+}
+
+// BoundingRect returns the bounding rectangle of the first element matching selector.
+//
+// The rectangle is relative to the top-left of the document, so the current
+// scroll offset is taken into account, and it is scaled by the zoom factor so
+// it can be passed directly to SetClipRect(). Returns ErrElementNotFound if no
+// element matches selector.
+func (p *WebPage) BoundingRect(selector string) (Rect, error) {
+	var resp struct {
+		Value *rectJSON `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/BoundingRect", map[string]interface{}{"ref": p.ref.id, "selector": selector}, &resp); err != nil {
+		return Rect{}, err
+	} else if resp.Value == nil {
+		return Rect{}, ErrElementNotFound
+	}
+	return Rect{
+		Top:    resp.Value.Top,
+		Left:   resp.Value.Left,
+		Width:  resp.Value.Width,
+		Height: resp.Value.Height,
+	}, nil
+}
+
+// BoundingRects returns the bounding rectangles of all elements matching
+// selector in document order, in the same coordinates as BoundingRect().
+// Returns an empty slice if no element matches selector.
+func (p *WebPage) BoundingRects(selector string) ([]Rect, error) {
+	var resp struct {
+		Value []rectJSON `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/BoundingRects", map[string]interface{}{"ref": p.ref.id, "selector": selector}, &resp); err != nil {
+		return nil, err
+	}
+
+	rects := make([]Rect, len(resp.Value))
+	for i, v := range resp.Value {
+		rects[i] = Rect{Top: v.Top, Left: v.Left, Width: v.Width, Height: v.Height}
+	}
+	return rects, nil
+}
+
 // Content returns content of the webpage enclosed in an HTML/XML element.
 func (p *WebPage) Content() (string, error) {
 	var resp struct {
@@ -333,8 +1217,17 @@ func (p *WebPage) Content() (string, error) {
 	return resp.Value, nil
 }
 
+// ContentReader returns a reader which streams the content of the web page.
+// Unlike Content(), the content is not buffered in memory by the client
+// which is useful for very large documents. The reader must be closed.
+func (p *WebPage) ContentReader() (io.ReadCloser, error) {
+	r, _, err := p.ref.process.doStream("POST", "/webpage/ContentStream", map[string]interface{}{"ref": p.ref.id})
+	return r, err
+}
+
 // SetContent sets the content of the webpage.
 func (p *WebPage) SetContent(content string) error {
+	defer p.invalidateProperties()
 	return p.ref.process.doJSON("POST", "/webpage/SetContent", map[string]interface{}{"ref": p.ref.id, "content": content}, nil)
 }
 
@@ -490,17 +1383,24 @@ func (p *WebPage) FrameNames() ([]string, error) {
 // LibraryPath returns the path used by InjectJS() to resolve scripts.
 // Initially it is set to Process.Path().
 func (p *WebPage) LibraryPath() (string, error) {
+	cached, gen := p.ref.process.loadProperties(p.ref.id)
+	if cached.libraryPath != nil {
+		return *cached.libraryPath, nil
+	}
+
 	var resp struct {
 		Value string `json:"value"`
 	}
 	if err := p.ref.process.doJSON("POST", "/webpage/LibraryPath", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
+	p.ref.process.storeProperties(p.ref.id, gen, func(c *pageProperties) { c.libraryPath = &resp.Value })
 	return resp.Value, nil
 }
 
 // SetLibraryPath sets the library path used by InjectJS().
 func (p *WebPage) SetLibraryPath(path string) error {
+	defer p.invalidateProperties()
 	return p.ref.process.doJSON("POST", "/webpage/SetLibraryPath", map[string]interface{}{"ref": p.ref.id, "path": path}, nil)
 }
 
@@ -542,6 +1442,148 @@ func (p *WebPage) OfflineStorageQuota() (int, error) {
 	return resp.Value, nil
 }
 
+// NavigationRules returns the rules used to block navigation requests.
+func (p *WebPage) NavigationRules() ([]NavigationRule, error) {
+	var resp struct {
+		Value []navigationRuleJSON `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/NavigationRules", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+
+	a := make([]NavigationRule, len(resp.Value))
+	for i, rule := range resp.Value {
+		a[i] = NavigationRule{Pattern: rule.Pattern, Type: rule.Type}
+	}
+	return a, nil
+}
+
+// SetNavigationRules sets rules used to block navigation requests. Unlike
+// SetNavigationLocked(), only navigations matching a rule are blocked.
+// Blocked navigations are still reported as EventNavigationRequested events.
+func (p *WebPage) SetNavigationRules(rules []NavigationRule) error {
+	a := make([]navigationRuleJSON, len(rules))
+	for i, rule := range rules {
+		a[i] = navigationRuleJSON{Pattern: rule.Pattern, Expr: patternRegexp(rule.Pattern), Type: rule.Type}
+	}
+	return p.ref.process.doJSON("POST", "/webpage/SetNavigationRules", map[string]interface{}{"ref": p.ref.id, "rules": a}, nil)
+}
+
+// InterceptRules returns the rules applied to resource requests made by the page.
+func (p *WebPage) InterceptRules() ([]InterceptRule, error) {
+	var resp struct {
+		Value []interceptRuleJSON `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/InterceptRules", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+
+	a := make([]InterceptRule, len(resp.Value))
+	for i := range resp.Value {
+		a[i] = decodeInterceptRuleJSON(resp.Value[i])
+	}
+	return a, nil
+}
+
+// SetInterceptRules sets the rules applied to resource requests made by the
+// page. Rules are evaluated within PhantomJS in order and the first matching
+// rule is applied, so requests do not need to be sent to the client.
+func (p *WebPage) SetInterceptRules(rules []InterceptRule) error {
+	a := make([]interceptRuleJSON, len(rules))
+	for i := range rules {
+		a[i] = encodeInterceptRuleJSON(rules[i])
+	}
+	return p.ref.process.doJSON("POST", "/webpage/SetInterceptRules", map[string]interface{}{"ref": p.ref.id, "rules": a}, nil)
+}
+
+// AddInterceptRule appends a rule to the page's intercept rules.
+func (p *WebPage) AddInterceptRule(rule InterceptRule) error {
+	return p.addInterceptRules([]InterceptRule{rule})
+}
+
+// BlockResourceTypes adds intercept rules which abort requests for the
+// given types of resources. Resources are matched by common file extensions
+// and by the request's Accept header. This can greatly speed up pages which
+// are only used for their text content.
+func (p *WebPage) BlockResourceTypes(images, stylesheets, fonts, media bool) error {
+	var rules []InterceptRule
+	if images {
+		rules = append(rules,
+			InterceptRule{Pattern: `/\.(png|jpe?g|gif|webp|svg|ico|bmp)([?#].*)?$/`, Abort: true},
+			InterceptRule{Accept: "image/", Abort: true},
+		)
+	}
+	if stylesheets {
+		rules = append(rules,
+			InterceptRule{Pattern: `/\.css([?#].*)?$/`, Abort: true},
+			InterceptRule{Accept: "text/css", Abort: true},
+		)
+	}
+	if fonts {
+		rules = append(rules, InterceptRule{Pattern: `/\.(woff2?|ttf|otf|eot)([?#].*)?$/`, Abort: true})
+	}
+	if media {
+		rules = append(rules,
+			InterceptRule{Pattern: `/\.(mp4|webm|ogg|ogv|mp3|wav|m4a|mov|avi)([?#].*)?$/`, Abort: true},
+			InterceptRule{Accept: "video/", Abort: true},
+			InterceptRule{Accept: "audio/", Abort: true},
+		)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return p.addInterceptRules(rules)
+}
+
+// Mock adds an intercept rule which answers requests matching pattern with
+// resp. Patterns are matched the same as in WaitForURL().
+func (p *WebPage) Mock(pattern string, resp *MockResponse) error {
+	return p.AddInterceptRule(InterceptRule{Pattern: pattern, Response: resp})
+}
+
+// addInterceptRules appends rules to the page's intercept rules in one request.
+func (p *WebPage) addInterceptRules(rules []InterceptRule) error {
+	a := make([]interceptRuleJSON, len(rules))
+	for i := range rules {
+		a[i] = encodeInterceptRuleJSON(rules[i])
+	}
+	return p.ref.process.doJSON("POST", "/webpage/AddInterceptRules", map[string]interface{}{"ref": p.ref.id, "rules": a}, nil)
+}
+
+// SetCapturePatterns sets URL patterns for which response bodies are
+// captured. Captured responses are retrieved with Responses(). Patterns are
+// matched the same as in WaitForURL(). Pass nil to stop capturing.
+//
+// The process must have CaptureResponses enabled. Bodies are captured by a
+// local proxy so HTTPS responses, which are tunneled, cannot be captured.
+func (p *WebPage) SetCapturePatterns(patterns []string) error {
+	if p.ref.process.capture == nil {
+		return ErrCaptureDisabled
+	}
+
+	a := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		a[i] = patternRegexp(pattern)
+	}
+	return p.ref.process.doJSON("POST", "/webpage/SetCapturePatterns", map[string]interface{}{"ref": p.ref.id, "patterns": a}, nil)
+}
+
+// Responses returns the responses captured for the page, oldest first.
+// Returns nil if response capture is not enabled on the process.
+func (p *WebPage) Responses() []*CapturedResponse {
+	if p.ref.process.capture == nil {
+		return nil
+	}
+	return p.ref.process.capture.Responses(p.ref.id)
+}
+
+// ClearResponses removes all responses captured for the page.
+func (p *WebPage) ClearResponses() {
+	if p.ref.process.capture != nil {
+		p.ref.process.capture.Clear(p.ref.id)
+	}
+}
+
 // OwnsPages returns true if this page owns pages opened in other windows.
 func (p *WebPage) OwnsPages() (bool, error) {
 	var resp struct {
@@ -581,7 +1623,7 @@ func (p *WebPage) Pages() ([]*WebPage, error) {
 	// Convert reference IDs to web pages.
 	a := make([]*WebPage, len(resp.Refs))
 	for i, ref := range resp.Refs {
-		a[i] = &WebPage{ref: newRef(p.ref.process, ref.ID)}
+		a[i] = newWebPage(p.ref.process, ref.ID)
 	}
 	return a, nil
 }
@@ -633,23 +1675,20 @@ func (p *WebPage) SetScrollPosition(pos Position) error {
 
 // Settings returns the settings used on the web page.
 func (p *WebPage) Settings() (WebPageSettings, error) {
+	cached, gen := p.ref.process.loadProperties(p.ref.id)
+	if cached.settings != nil {
+		return *cached.settings, nil
+	}
+
 	var resp struct {
 		Settings webPageSettingsJSON `json:"settings"`
 	}
 	if err := p.ref.process.doJSON("POST", "/webpage/Settings", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return WebPageSettings{}, err
 	}
-	return WebPageSettings{
-		JavascriptEnabled:             resp.Settings.JavascriptEnabled,
-		LoadImages:                    resp.Settings.LoadImages,
-		LocalToRemoteURLAccessEnabled: resp.Settings.LocalToRemoteURLAccessEnabled,
-		UserAgent:                     resp.Settings.UserAgent,
-		Username:                      resp.Settings.Username,
-		Password:                      resp.Settings.Password,
-		XSSAuditingEnabled:            resp.Settings.XSSAuditingEnabled,
-		WebSecurityEnabled:            resp.Settings.WebSecurityEnabled,
-		ResourceTimeout:               time.Duration(resp.Settings.ResourceTimeout) * time.Millisecond,
-	}, nil
+	settings := decodeWebPageSettingsJSON(resp.Settings)
+	p.ref.process.storeProperties(p.ref.id, gen, func(c *pageProperties) { c.settings = &settings })
+	return settings, nil
 }
 
 // SetSettings sets various settings on the web page.
@@ -657,19 +1696,10 @@ func (p *WebPage) Settings() (WebPageSettings, error) {
 // The settings apply only during the initial call to the page.open function.
 // Subsequent modification of the settings object will not have any impact.
 func (p *WebPage) SetSettings(settings WebPageSettings) error {
+	defer p.invalidateProperties()
 	req := map[string]interface{}{
-		"ref": p.ref.id,
-		"settings": webPageSettingsJSON{
-			JavascriptEnabled:             settings.JavascriptEnabled,
-			LoadImages:                    settings.LoadImages,
-			LocalToRemoteURLAccessEnabled: settings.LocalToRemoteURLAccessEnabled,
-			UserAgent:                     settings.UserAgent,
-			Username:                      settings.Username,
-			Password:                      settings.Password,
-			XSSAuditingEnabled:            settings.XSSAuditingEnabled,
-			WebSecurityEnabled:            settings.WebSecurityEnabled,
-			ResourceTimeout:               int(settings.ResourceTimeout / time.Millisecond),
-		},
+		"ref":      p.ref.id,
+		"settings": encodeWebPageSettingsJSON(settings),
 	}
 	return p.ref.process.doJSON("POST", "/webpage/SetSettings", req, nil)
 }
@@ -698,18 +1728,22 @@ func (p *WebPage) URL() (string, error) {
 
 // ViewportSize returns the size of the viewport on the browser.
 func (p *WebPage) ViewportSize() (width, height int, err error) {
-	var resp struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
+	cached, gen := p.ref.process.loadProperties(p.ref.id)
+	if cached.viewport != nil {
+		return cached.viewport.Width, cached.viewport.Height, nil
 	}
+
+	var resp sizeJSON
 	if err := p.ref.process.doJSON("POST", "/webpage/ViewportSize", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return 0, 0, err
 	}
+	p.ref.process.storeProperties(p.ref.id, gen, func(c *pageProperties) { c.viewport = &resp })
 	return resp.Width, resp.Height, nil
 }
 
 // SetViewportSize sets the size of the viewport.
 func (p *WebPage) SetViewportSize(width, height int) error {
+	defer p.invalidateProperties()
 	return p.ref.process.doJSON("POST", "/webpage/SetViewportSize", map[string]interface{}{"ref": p.ref.id, "width": width, "height": height}, nil)
 }
 
@@ -758,9 +1792,78 @@ func (p *WebPage) ClearCookies() error {
 	return p.ref.process.doJSON("POST", "/webpage/ClearCookies", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
-// Close releases the web page and its resources.
+// Close releases the web page and its resources. Closing a page which has
+// already been closed by the process, such as after its PageTTL, only
+// releases its resources in the client.
 func (p *WebPage) Close() error {
-	return p.ref.process.doJSON("POST", "/webpage/Close", map[string]interface{}{"ref": p.ref.id}, nil)
+	if err := p.ref.process.doJSON("POST", "/webpage/Close", map[string]interface{}{"ref": p.ref.id}, nil); err != nil && err != ErrPageClosed {
+		return err
+	}
+
+	// Release captured responses and network conditions.
+	p.ClearResponses()
+	p.clearNetworkConditions()
+
+	// Stop tracking the page's handles for sweeping and drop its cache.
+	p.ref.process.forgetHandles(p.ref.id)
+	p.ref.process.forgetProperties(p.ref.id)
+
+	// Remove dialog handlers.
+	p.ref.process.mu.Lock()
+	delete(p.ref.process.confirmHandlers, p.ref.id)
+	delete(p.ref.process.promptHandlers, p.ref.id)
+	p.ref.process.mu.Unlock()
+
+	// Stop event polling and network logging, if started.
+	p.mu.Lock()
+	if p.closing != nil {
+		close(p.closing)
+		p.closing = nil
+	}
+	if p.networkLogClosing != nil {
+		close(p.networkLogClosing)
+		p.networkLogClosing = nil
+	}
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Reset restores the page to the state of a newly created page so it can be
+// reused by another caller. Cookies visible to the current URL, the clip rect,
+// dialog handlers, interception rules, network conditions, offline mode, PDF
+// metadata and watermarks, and scripts added with EvaluateOnNewDocument() are
+// cleared, custom headers and settings are restored to the process'
+// DefaultPageSettings, and the content is replaced with a blank document. The
+// Events() channel remains open but buffered events are discarded.
+func (p *WebPage) Reset() error {
+	defer p.invalidateProperties()
+	if err := p.ref.process.doJSON("POST", "/webpage/Reset", map[string]interface{}{"ref": p.ref.id}, nil); err != nil {
+		return err
+	}
+
+	// Release captured responses and network conditions.
+	p.ClearResponses()
+	p.clearNetworkConditions()
+
+	// Remove dialog handlers.
+	p.ref.process.mu.Lock()
+	delete(p.ref.process.confirmHandlers, p.ref.id)
+	delete(p.ref.process.promptHandlers, p.ref.id)
+	p.ref.process.mu.Unlock()
+
+	// Stop network logging, if started, and forget the restored user agent.
+	p.mu.Lock()
+	if p.networkLogClosing != nil {
+		close(p.networkLogClosing)
+		p.networkLogClosing = nil
+	}
+	p.rotatedUserAgent = ""
+	p.pdfInfo = nil
+	p.pdfWatermark = nil
+	p.mu.Unlock()
+
+	return nil
 }
 
 // DeleteCookie removes a cookie with a matching name.
@@ -797,15 +1900,35 @@ func (p *WebPage) EvaluateJavaScript(script string) (interface{}, error) {
 // Evaluate executes a JavaScript function in the context of the web page.
 // Returns the value returned by the function.
 func (p *WebPage) Evaluate(script string) (interface{}, error) {
+	return p.EvaluateContext(context.Background(), script)
+}
+
+// EvaluateContext executes a JavaScript function the same as Evaluate(). If
+// ctx is done before the function returns then ctx's error is returned and
+// the function's result is discarded. A function which is already running
+// cannot be interrupted so it continues until it returns.
+func (p *WebPage) EvaluateContext(ctx context.Context, script string) (interface{}, error) {
 	var resp struct {
 		ReturnValue interface{} `json:"returnValue"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Evaluate", map[string]interface{}{"ref": p.ref.id, "script": script}, &resp); err != nil {
+	if err := p.ref.process.doJSONContext(ctx, "POST", "/webpage/Evaluate", map[string]interface{}{"ref": p.ref.id, "script": script}, &resp); err != nil {
 		return nil, err
 	}
 	return resp.ReturnValue, nil
 }
 
+// EvaluateOnNewDocument adds a JavaScript function which is executed in every
+// new document loaded by the page before any of the document's own scripts
+// run. This can be used to stub globals or install polyfills.
+func (p *WebPage) EvaluateOnNewDocument(script string) error {
+	return p.ref.process.doJSON("POST", "/webpage/EvaluateOnNewDocument", map[string]interface{}{"ref": p.ref.id, "script": script}, nil)
+}
+
+// ClearNewDocumentScripts removes all scripts added by EvaluateOnNewDocument().
+func (p *WebPage) ClearNewDocumentScripts() error {
+	return p.ref.process.doJSON("POST", "/webpage/ClearNewDocumentScripts", map[string]interface{}{"ref": p.ref.id}, nil)
+}
+
 // Page returns an owned page by window name.
 // Returns nil if the page cannot be found.
 func (p *WebPage) Page(name string) (*WebPage, error) {
@@ -818,22 +1941,28 @@ func (p *WebPage) Page(name string) (*WebPage, error) {
 	if resp.Ref.ID == "" {
 		return nil, nil
 	}
-	return &WebPage{ref: newRef(p.ref.process, resp.Ref.ID)}, nil
+	return newWebPage(p.ref.process, resp.Ref.ID), nil
 }
 
 // GoBack navigates back to the previous page.
 func (p *WebPage) GoBack() error {
+	defer p.invalidateProperties()
+	defer p.countNavigation()
 	return p.ref.process.doJSON("POST", "/webpage/GoBack", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // GoForward navigates to the next page.
 func (p *WebPage) GoForward() error {
+	defer p.invalidateProperties()
+	defer p.countNavigation()
 	return p.ref.process.doJSON("POST", "/webpage/GoForward", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // Go navigates to the page in history by relative offset.
 // A positive index moves forward, a negative index moves backwards.
 func (p *WebPage) Go(index int) error {
+	defer p.invalidateProperties()
+	defer p.countNavigation()
 	return p.ref.process.doJSON("POST", "/webpage/Go", map[string]interface{}{"ref": p.ref.id, "index": index}, nil)
 }
 
@@ -862,6 +1991,8 @@ func (p *WebPage) InjectJS(filename string) error {
 
 // Reload reloads the current web page.
 func (p *WebPage) Reload() error {
+	defer p.invalidateProperties()
+	defer p.countNavigation()
 	return p.ref.process.doJSON("POST", "/webpage/Reload", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
@@ -877,913 +2008,4930 @@ func (p *WebPage) RenderBase64(format string) (string, error) {
 }
 
 // Render renders the web page to a file with the given format and quality settings.
-// This supports the "PDF", "PNG", "JPEG", "BMP", "PPM", and "GIF" formats.
+// This supports the "PDF", "PNG", "JPEG", "BMP", "PPM", and "GIF" formats,
+// and "WebP" when built with the "webp" tag. WebP images are rendered as PNG
+// by PhantomJS and re-encoded in Go with a quality from 1 to 100, which
+// defaults to DefaultWebPQuality.
+//
+// PDFs are stamped with the watermark set with SetPDFWatermark() and given
+// the metadata set with SetPDFInfo(), if any.
 func (p *WebPage) Render(filename, format string, quality int) error {
+	if strings.EqualFold(format, "webp") {
+		buf, err := p.renderWebP(quality)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filename, buf, 0666)
+	}
+
 	req := map[string]interface{}{"ref": p.ref.id, "filename": filename, "format": format, "quality": quality}
-	return p.ref.process.doJSON("POST", "/webpage/Render", req, nil)
-}
+	if err := p.ref.process.doJSON("POST", "/webpage/Render", req, nil); err != nil {
+		return err
+	}
 
-// SendMouseEvent sends a mouse event as if it came from the user.
-// It is not a synthetic event.
-//
-// The eventType can be "mouseup", "mousedown", "mousemove", "doubleclick",
-// or "click". The mouseX and mouseY specify the position of the mouse on the
-// screen. The button argument specifies the mouse button clicked (e.g. "left").
-func (p *WebPage) SendMouseEvent(eventType string, mouseX, mouseY int, button string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SendMouseEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "mouseX": mouseX, "mouseY": mouseY, "button": button}, nil)
+	if !strings.EqualFold(format, "pdf") || (p.PDFInfo() == nil && p.PDFWatermark() == nil) {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	} else if buf, err = p.finishPDF(buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf, 0666)
 }
 
-// SendKeyboardEvent sends a keyboard event as if it came from the user.
-// It is not a synthetic event.
-//
-// The eventType can be "keyup", "keypress", or "keydown".
-//
-// The key argument is a string or a key listed here:
-// https://github.com/ariya/phantomjs/commit/cab2635e66d74b7e665c44400b8b20a8f225153a
+// RenderBytes renders the web page with the given format and quality settings
+// and returns the rendered data. This supports the same formats as Render(),
+// including applying the watermark and metadata set with SetPDFWatermark()
+// and SetPDFInfo() to PDFs.
 //
-// Keyboard modifiers can be joined together using the bitwise OR operator.
-func (p *WebPage) SendKeyboardEvent(eventType string, key string, modifier int) error {
-	return p.ref.process.doJSON("POST", "/webpage/SendKeyboardEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "key": key, "modifier": modifier}, nil)
-}
+// The data is transferred from the process as raw bytes instead of base64 so
+// it is smaller and faster to decode than RenderBase64(), especially for
+// large screenshots and PDFs.
+func (p *WebPage) RenderBytes(format string, quality int) ([]byte, error) {
+	if strings.EqualFold(format, "webp") {
+		return p.renderWebP(quality)
+	}
 
-// SetContentAndURL sets the content and URL of the page.
-func (p *WebPage) SetContentAndURL(content, url string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetContentAndURL", map[string]interface{}{"ref": p.ref.id, "content": content, "url": url}, nil)
-}
+	r, _, err := p.renderStream(RenderOptions{Format: format}, quality)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
 
-// Stop stops the web page.
-func (p *WebPage) Stop() error {
-	return p.ref.process.doJSON("POST", "/webpage/Stop", map[string]interface{}{"ref": p.ref.id}, nil)
+	buf, err := p.ref.process.readResponse("/webpage/RenderBytes", r, -1)
+	if err != nil {
+		return nil, err
+	} else if strings.EqualFold(format, "pdf") {
+		return p.finishPDF(buf)
+	}
+	return buf, nil
 }
 
-// SwitchToFocusedFrame changes the current frame to the frame that is in focus.
-func (p *WebPage) SwitchToFocusedFrame() error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToFocusedFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+// finishPDF applies the page's PDF watermark and metadata to a rendered PDF.
+func (p *WebPage) finishPDF(buf []byte) ([]byte, error) {
+	if wm := p.PDFWatermark(); wm != nil {
+		mark, err := p.watermarkImage(wm, pdfWatermarkScale)
+		if err != nil {
+			return nil, err
+		} else if buf, err = stampPDF(buf, mark, wm, pdfWatermarkScale); err != nil {
+			return nil, err
+		}
+	}
+	if info := p.PDFInfo(); info != nil {
+		return ApplyPDFInfo(buf, *info)
+	}
+	return buf, nil
 }
 
-// SwitchToFrameName changes the current frame to a frame with a given name.
-func (p *WebPage) SwitchToFrameName(name string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToFrameName", map[string]interface{}{"ref": p.ref.id, "name": name}, nil)
-}
+// encodeWebP encodes img as WebP. It is set when building with the "webp"
+// tag so the package does not otherwise depend on a WebP encoder.
+var encodeWebP func(w io.Writer, img image.Image, quality int) error
 
-// SwitchToFramePosition changes the current frame to the frame at the given position.
-func (p *WebPage) SwitchToFramePosition(pos int) error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToFramePosition", map[string]interface{}{"ref": p.ref.id, "position": pos}, nil)
+// renderWebP renders the page as PNG and re-encodes it as WebP.
+func (p *WebPage) renderWebP(quality int) ([]byte, error) {
+	if encodeWebP == nil {
+		return nil, ErrWebPUnsupported
+	}
+	if quality <= 0 {
+		quality = DefaultWebPQuality
+	}
+
+	img, err := p.RenderImage(RenderOptions{Format: "png"})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, img, quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-// SwitchToMainFrame switches the current frame to the main frame.
-func (p *WebPage) SwitchToMainFrame() error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToMainFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+// SetPDFInfo sets the metadata, such as the title and author, given to PDFs
+// rendered by Render() and RenderBytes(). Pass nil to leave PDFs as they are
+// rendered by PhantomJS.
+func (p *WebPage) SetPDFInfo(info *PDFInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pdfInfo = info
 }
 
-// SwitchToParentFrame switches the current frame to the parent of the current frame.
-func (p *WebPage) SwitchToParentFrame() error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToParentFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+// PDFInfo returns the metadata set with SetPDFInfo().
+func (p *WebPage) PDFInfo() *PDFInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pdfInfo
 }
 
-// UploadFile uploads a file to a form element specified by selector.
-func (p *WebPage) UploadFile(selector, filename string) error {
-	return p.ref.process.doJSON("POST", "/webpage/UploadFile", map[string]interface{}{"ref": p.ref.id, "selector": selector, "filename": filename}, nil)
+// SetPDFWatermark sets the watermark drawn over every page of PDFs rendered
+// by Render() and RenderBytes(), such as a "DRAFT" stamp. Image watermarks
+// are drawn at 96 DPI. Pass nil to disable.
+func (p *WebPage) SetPDFWatermark(wm *Watermark) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pdfWatermark = wm
 }
 
-// OpenWebPageSettings represents the settings object passed to WebPage.Open().
-type OpenWebPageSettings struct {
-	Method string `json:"method"`
+// PDFWatermark returns the watermark set with SetPDFWatermark().
+func (p *WebPage) PDFWatermark() *Watermark {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pdfWatermark
 }
 
-// Ref represents a reference to an object in phantomjs.
-type Ref struct {
-	process *Process
-	id      string
+// RenderImage renders the web page to an image using the given options.
+//
+// Returns ErrTimeout if WaitForAssets is set and the page's images and
+// fonts do not finish loading within the asset timeout.
+func (p *WebPage) RenderImage(opt RenderOptions) (image.Image, error) {
+	scale := opt.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	var clip Rect
+	if len(opt.Annotations) > 0 {
+		var err error
+		if clip, err = p.ClipRect(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Annotated elements are located by the render so the boxes match the
+	// layout which is rendered.
+	var img image.Image
+	var rects [][]Rect
+	var err error
+	if opt.Stitch {
+		img, rects, err = p.renderStitched(opt)
+	} else {
+		img, rects, err = p.renderImage(opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opt.Annotations) > 0 {
+		labels, err := p.annotationLabels(opt.Annotations, scale)
+		if err != nil {
+			return nil, err
+		}
+		img = drawAnnotations(img, opt.Annotations, rects, labels, clip, scale)
+	}
+
+	// Watermark before resizing so the watermark scales with the page.
+	if opt.Watermark != nil {
+		mark, err := p.watermarkImage(opt.Watermark, scale)
+		if err != nil {
+			return nil, err
+		}
+		img = drawWatermark(img, mark, opt.Watermark, scale)
+	}
+	if opt.ResizeTo != nil {
+		img = ResizeImage(img, *opt.ResizeTo)
+	}
+	return img, nil
 }
 
-// newRef returns a new instance of a referenced object within the process.
-func newRef(p *Process, id string) *Ref {
-	return &Ref{process: p, id: id}
+// annotationsHeader is the response header carrying the rects of the
+// elements matching each annotation's selector, measured by the render.
+const annotationsHeader = "X-Phantomjs-Annotations"
+
+// renderImage renders the web page in a single pass and decodes it. Returns
+// the rects of the elements matching each annotation.
+func (p *WebPage) renderImage(opt RenderOptions) (image.Image, [][]Rect, error) {
+	r, header, err := p.renderStream(opt, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	rects := make([][]Rect, len(opt.Annotations))
+	if v := header.Get(annotationsHeader); v != "" {
+		if err := json.Unmarshal([]byte(v), &rects); err != nil {
+			return nil, nil, fmt.Errorf("phantomjs: invalid annotations: %s", err)
+		}
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, rects, nil
 }
 
-// ID returns the reference identifier.
-func (r *Ref) ID() string {
-	return r.id
+// renderStream renders the web page using the given options and returns the
+// raw rendered data and the response header. The caller must close the
+// returned reader.
+func (p *WebPage) renderStream(opt RenderOptions, quality int) (io.ReadCloser, http.Header, error) {
+	req := map[string]interface{}{"ref": p.ref.id, "options": encodeRenderOptionsJSON(opt), "quality": quality}
+	return p.ref.process.doStream("POST", "/webpage/RenderBytes", req)
 }
 
-// refJSON is a struct for encoding refs as JSON.
-type refJSON struct {
-	ID string `json:"id"`
+// SendMouseEvent sends a mouse event as if it came from the user.
+// It is not a synthetic event.
+//
+// The eventType can be "mouseup", "mousedown", "mousemove", "doubleclick",
+// or "click". The mouseX and mouseY specify the position of the mouse on the
+// screen. The button argument specifies the mouse button clicked (e.g. "left").
+func (p *WebPage) SendMouseEvent(eventType string, mouseX, mouseY int, button string) error {
+	return p.ref.process.doJSON("POST", "/webpage/SendMouseEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "mouseX": mouseX, "mouseY": mouseY, "button": button}, nil)
 }
 
-// Rect represents a rectangle used by WebPage.ClipRect().
-type Rect struct {
-	Top    int
-	Left   int
-	Width  int
-	Height int
+// SendKeyboardEvent sends a keyboard event as if it came from the user.
+// It is not a synthetic event.
+//
+// The eventType can be "keyup", "keypress", or "keydown".
+//
+// The key argument is a string or a key listed here:
+// https://github.com/ariya/phantomjs/commit/cab2635e66d74b7e665c44400b8b20a8f225153a
+//
+// Keyboard modifiers can be joined together using the bitwise OR operator.
+func (p *WebPage) SendKeyboardEvent(eventType string, key string, modifier int) error {
+	return p.ref.process.doJSON("POST", "/webpage/SendKeyboardEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "key": key, "modifier": modifier}, nil)
 }
 
-// rectJSON is a struct for encoding rects as JSON.
-type rectJSON struct {
-	Top    int `json:"top"`
-	Left   int `json:"left"`
-	Width  int `json:"width"`
-	Height int `json:"height"`
+// MediaType returns the CSS media type emulated by the page.
+func (p *WebPage) MediaType() (string, error) {
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/MediaType", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
 }
 
-// cookieJSON is a struct for encoding http.Cookie objects as JSON.
-type cookieJSON struct {
-	Domain   string `json:"domain"`
-	Expires  string `json:"expires"`
-	Expiry   int    `json:"expiry"`
-	HTTPOnly bool   `json:"httponly"`
-	Name     string `json:"name"`
-	Path     string `json:"path"`
-	Secure   bool   `json:"secure"`
-	Value    string `json:"value"`
+// SetMediaType sets the CSS media type emulated by the page: "screen" or "print".
+//
+// Emulating "print" enables print stylesheets and media rules and disables
+// screen-only ones. The media type is reapplied when new pages are loaded.
+func (p *WebPage) SetMediaType(mediaType string) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetMediaType", map[string]interface{}{"ref": p.ref.id, "value": mediaType}, nil)
+}
+
+// SetLocale emulates a locale, such as "fr-FR", by overriding
+// navigator.language, the default locale of Intl and toLocaleString(), and
+// the Accept-Language header. The locale is applied to the current document
+// and to new documents before their scripts run. Pass a blank locale to stop
+// emulating for new documents.
+func (p *WebPage) SetLocale(locale string) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetLocale", map[string]interface{}{"ref": p.ref.id, "value": locale}, nil)
+}
+
+// SetTimezoneOffset emulates a timezone which is minutes east of UTC, such as
+// 60 for UTC+1, by overriding Date's local time getters and setters,
+// getTimezoneOffset(), toString() and its variants, toLocaleString() and its
+// variants, Date.parse(), and the Date constructor for local date components
+// and for strings without an offset. Daylight saving time is not emulated.
+// The offset is applied to the current document and to new documents before
+// their scripts run.
+//
+// Where Intl is available and the offset is whole hours, Intl.DateTimeFormat
+// defaults to the matching "Etc/GMT" zone, which resolvedOptions().timeZone
+// reports. PhantomJS has no Intl so locale strings are formatted by shifting
+// the date, and any zone name they include is the host's.
+func (p *WebPage) SetTimezoneOffset(minutes int) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetTimezoneOffset", map[string]interface{}{"ref": p.ref.id, "value": minutes}, nil)
 }
 
-func encodeCookieJSON(v *http.Cookie) cookieJSON {
-	out := cookieJSON{
-		Domain:   v.Domain,
-		HTTPOnly: v.HttpOnly,
-		Name:     v.Name,
-		Path:     v.Path,
-		Secure:   v.Secure,
-		Value:    v.Value,
+// Offline returns true if the page is emulating being offline.
+func (p *WebPage) Offline() (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
 	}
-
-	if !v.Expires.IsZero() {
-		out.Expires = v.Expires.UTC().Format(http.TimeFormat)
+	if err := p.ref.process.doJSON("POST", "/webpage/Offline", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return false, err
 	}
-	return out
+	return resp.Value, nil
 }
 
-func decodeCookieJSON(v cookieJSON) *http.Cookie {
-	out := &http.Cookie{
-		Domain:     v.Domain,
-		RawExpires: v.Expires,
-		HttpOnly:   v.HTTPOnly,
-		Name:       v.Name,
-		Path:       v.Path,
-		Secure:     v.Secure,
-		Value:      v.Value,
-	}
+// SetOffline emulates the page losing its network connection, such as to
+// test a site's offline fallbacks. While offline, every network request from
+// the page fails, including navigations, and navigator.onLine is false. The
+// "offline" and "online" events are fired on the current document as the
+// state changes. Content set with SetContent() is still loaded.
+func (p *WebPage) SetOffline(v bool) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetOffline", map[string]interface{}{"ref": p.ref.id, "value": v}, nil)
+}
 
-	if v.Expires != "" {
-		expires, _ := time.Parse(http.TimeFormat, v.Expires)
-		out.Expires = expires
-		out.RawExpires = v.Expires
+// XHROnly returns true if resource events and response capture are limited
+// to XMLHttpRequest and fetch() traffic.
+func (p *WebPage) XHROnly() (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/XHROnly", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return false, err
 	}
+	return resp.Value, nil
+}
 
-	return out
+// SetXHROnly limits resource events and response capture to XMLHttpRequest
+// and fetch() traffic. PhantomJS does not report what initiated a request
+// so requests are classified by their headers and URL. See ResourceRequest.XHR.
+func (p *WebPage) SetXHROnly(v bool) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetXHROnly", map[string]interface{}{"ref": p.ref.id, "value": v}, nil)
 }
 
-// PaperSize represents the size of a webpage when rendered as a PDF.
-//
-// Units can be specified in "mm", "cm", "in", or "px".
-// If no unit is specified then "px" is used.
-type PaperSize struct {
-	// Dimensions of the paper.
-	// This can also be specified via Format.
-	Width  string
-	Height string
+// SetContentAndURL sets the content and URL of the page.
+func (p *WebPage) SetContentAndURL(content, url string) error {
+	defer p.invalidateProperties()
+	return p.ref.process.doJSON("POST", "/webpage/SetContentAndURL", map[string]interface{}{"ref": p.ref.id, "content": content, "url": url}, nil)
+}
 
-	// Supported formats: "A3", "A4", "A5", "Legal", "Letter", "Tabloid".
-	Format string
+// Stop stops the web page.
+func (p *WebPage) Stop() error {
+	return p.ref.process.doJSON("POST", "/webpage/Stop", map[string]interface{}{"ref": p.ref.id}, nil)
+}
 
-	// Margins around the paper.
-	Margin *PaperSizeMargin
+// SwitchToFocusedFrame changes the current frame to the frame that is in focus.
+func (p *WebPage) SwitchToFocusedFrame() error {
+	return p.ref.process.doJSON("POST", "/webpage/SwitchToFocusedFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+}
 
-	// Supported orientations: "portrait", "landscape".
-	Orientation string
+// SwitchToFrameName changes the current frame to a frame with a given name.
+func (p *WebPage) SwitchToFrameName(name string) error {
+	return p.ref.process.doJSON("POST", "/webpage/SwitchToFrameName", map[string]interface{}{"ref": p.ref.id, "name": name}, nil)
 }
 
-// PaperSizeMargin represents the margins around the paper.
-type PaperSizeMargin struct {
-	Top    string
-	Bottom string
-	Left   string
-	Right  string
+// SwitchToFramePosition changes the current frame to the frame at the given position.
+func (p *WebPage) SwitchToFramePosition(pos int) error {
+	return p.ref.process.doJSON("POST", "/webpage/SwitchToFramePosition", map[string]interface{}{"ref": p.ref.id, "position": pos}, nil)
 }
 
-type paperSizeJSON struct {
-	Width       string               `json:"width,omitempty"`
-	Height      string               `json:"height,omitempty"`
-	Format      string               `json:"format,omitempty"`
-	Margin      *paperSizeMarginJSON `json:"margin,omitempty"`
-	Orientation string               `json:"orientation,omitempty"`
+// SwitchToMainFrame switches the current frame to the main frame.
+func (p *WebPage) SwitchToMainFrame() error {
+	return p.ref.process.doJSON("POST", "/webpage/SwitchToMainFrame", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
-type paperSizeMarginJSON struct {
-	Top    string `json:"top,omitempty"`
-	Bottom string `json:"bottom,omitempty"`
-	Left   string `json:"left,omitempty"`
-	Right  string `json:"right,omitempty"`
+// SwitchToParentFrame switches the current frame to the parent of the current frame.
+func (p *WebPage) SwitchToParentFrame() error {
+	return p.ref.process.doJSON("POST", "/webpage/SwitchToParentFrame", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
-func encodePaperSizeJSON(v PaperSize) paperSizeJSON {
-	out := paperSizeJSON{
-		Width:       v.Width,
-		Height:      v.Height,
-		Format:      v.Format,
-		Orientation: v.Orientation,
+// UploadFile uploads a file to a form element specified by selector.
+func (p *WebPage) UploadFile(selector, filename string) error {
+	return p.ref.process.doJSON("POST", "/webpage/UploadFile", map[string]interface{}{"ref": p.ref.id, "selector": selector, "filename": filename}, nil)
+}
+
+// WaitForFunction repeatedly evaluates script in the context of the web page
+// until it returns a truthy value. The script is polled within PhantomJS every
+// interval so only a single request is made. If interval is zero then
+// DefaultPollInterval is used.
+//
+// Returns ErrTimeout if the script does not return a truthy value within timeout.
+func (p *WebPage) WaitForFunction(script string, timeout, interval time.Duration) error {
+	return p.WaitForFunctionContext(context.Background(), script, timeout, interval)
+}
+
+// WaitForFunctionContext waits the same as WaitForFunction(). If ctx is done
+// before the wait finishes then polling is stopped and ctx's error is returned.
+func (p *WebPage) WaitForFunctionContext(ctx context.Context, script string, timeout, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultPollInterval
 	}
-	if v.Margin != nil {
-		out.Margin = &paperSizeMarginJSON{
-			Top:    v.Margin.Top,
-			Bottom: v.Margin.Bottom,
-			Left:   v.Margin.Left,
-			Right:  v.Margin.Right,
-		}
+
+	var resp struct {
+		Timeout bool `json:"timeout"`
 	}
-	return out
+	req := map[string]interface{}{
+		"ref":      p.ref.id,
+		"script":   script,
+		"timeout":  int(timeout / time.Millisecond),
+		"interval": int(interval / time.Millisecond),
+	}
+	if err := p.ref.process.doJSONContext(ctx, "POST", "/webpage/WaitForFunction", req, &resp); err != nil {
+		return err
+	} else if resp.Timeout {
+		return ErrTimeout
+	}
+	return nil
 }
 
-func decodePaperSizeJSON(v paperSizeJSON) PaperSize {
-	out := PaperSize{
-		Width:       v.Width,
-		Height:      v.Height,
-		Format:      v.Format,
-		Orientation: v.Orientation,
+// WaitForSelector waits until an element matching selector is in the page.
+//
+// Returns ErrTimeout if no element matches within timeout.
+func (p *WebPage) WaitForSelector(selector string, timeout time.Duration) error {
+	script := fmt.Sprintf(`function() { return document.querySelector(%s) !== null }`, strconv.Quote(selector))
+	return p.WaitForFunction(script, timeout, 0)
+}
+
+// WaitForNavigation waits for the next page load to finish and returns its
+// status (e.g. "success" or "fail"). If a page load is already in progress
+// then it waits for that load to finish. This is typically called after an
+// action, such as a click, which causes the page to navigate.
+//
+// Returns ErrTimeout if the page has not finished loading within timeout.
+func (p *WebPage) WaitForNavigation(timeout time.Duration) (status string, err error) {
+	var resp struct {
+		Status  string `json:"status"`
+		Timeout bool   `json:"timeout"`
 	}
-	if v.Margin != nil {
-		out.Margin = &PaperSizeMargin{
-			Top:    v.Margin.Top,
-			Bottom: v.Margin.Bottom,
-			Left:   v.Margin.Left,
-			Right:  v.Margin.Right,
-		}
+	req := map[string]interface{}{"ref": p.ref.id, "timeout": int(timeout / time.Millisecond)}
+	if err := p.ref.process.doJSON("POST", "/webpage/WaitForNavigation", req, &resp); err != nil {
+		return "", err
+	} else if resp.Timeout {
+		return "", ErrTimeout
 	}
-	return out
+	return resp.Status, nil
 }
 
-// Position represents a coordinate on the page, in pixels.
-type Position struct {
-	Top  int
-	Left int
+// WaitForResponse waits for the next response for a resource whose URL
+// matches pattern to be fully received. Responses already in progress are
+// matched but those already finished are not. Patterns are matched the same
+// as in WaitForURL().
+//
+// If the URL matches the page's capture patterns then the response body is
+// included. Returns ErrTimeout if no response is received within timeout.
+func (p *WebPage) WaitForResponse(pattern string, timeout time.Duration) (*ResourceResponse, error) {
+	expr := patternRegexp(pattern)
+	deadline := time.Now().Add(timeout)
+
+	var resp struct {
+		Value    resourceResponseJSON `json:"value"`
+		Captured bool                 `json:"captured"`
+		Timeout  bool                 `json:"timeout"`
+	}
+	req := map[string]interface{}{"ref": p.ref.id, "pattern": expr, "timeout": int(timeout / time.Millisecond)}
+	if err := p.ref.process.doJSON("POST", "/webpage/WaitForResponse", req, &resp); err != nil {
+		return nil, err
+	} else if resp.Timeout {
+		return nil, ErrTimeout
+	}
+	v := decodeResourceResponseJSON(resp.Value)
+
+	// The proxy records the body just after PhantomJS receives it so wait
+	// for the proxy to capture it.
+	if resp.Captured && p.ref.process.capture != nil {
+		r := p.ref.process.capture.Wait(p.ref.id, v.ID, time.Until(deadline))
+		if r == nil {
+			return nil, ErrTimeout
+		}
+		v.Body = r.Body
+	}
+	return v, nil
 }
 
-// WebPageSettings represents various settings on a web page.
-type WebPageSettings struct {
-	JavascriptEnabled             bool
-	LoadImages                    bool
-	LocalToRemoteURLAccessEnabled bool
-	UserAgent                     string
-	Username                      string
-	Password                      string
-	XSSAuditingEnabled            bool
-	WebSecurityEnabled            bool
-	ResourceTimeout               time.Duration
+// WaitForNetworkIdle waits until the page has no requests in progress and
+// no network activity has occurred for the idle duration. This is useful for
+// single-page applications which load their content after the page loads.
+//
+// Returns ErrTimeout if the network is not idle within timeout.
+func (p *WebPage) WaitForNetworkIdle(idle, timeout time.Duration) error {
+	var resp struct {
+		Timeout bool `json:"timeout"`
+	}
+	req := map[string]interface{}{
+		"ref":      p.ref.id,
+		"idle":     int(idle / time.Millisecond),
+		"timeout":  int(timeout / time.Millisecond),
+		"interval": int(DefaultPollInterval / time.Millisecond),
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/WaitForNetworkIdle", req, &resp); err != nil {
+		return err
+	} else if resp.Timeout {
+		return ErrTimeout
+	}
+	return nil
 }
 
-type webPageSettingsJSON struct {
-	JavascriptEnabled             bool   `json:"javascriptEnabled"`
-	LoadImages                    bool   `json:"loadImages"`
-	LocalToRemoteURLAccessEnabled bool   `json:"localToRemoteUrlAccessEnabled"`
-	UserAgent                     string `json:"userAgent"`
-	Username                      string `json:"username"`
-	Password                      string `json:"password"`
-	XSSAuditingEnabled            bool   `json:"XSSAuditingEnabled"`
-	WebSecurityEnabled            bool   `json:"webSecurityEnabled"`
-	ResourceTimeout               int    `json:"resourceTimeout"`
+// WaitForURL waits until the URL of the web page matches pattern.
+//
+// The pattern is matched as a glob where "*" matches any sequence of
+// characters. Patterns enclosed in slashes, such as "/^https:.*\/home$/",
+// are matched as regular expressions instead. Expressions are evaluated by
+// PhantomJS so they use JavaScript syntax, including lookaheads, and invalid
+// expressions are reported as errors by the shim.
+//
+// Returns ErrTimeout if the URL does not match within timeout.
+func (p *WebPage) WaitForURL(pattern string, timeout time.Duration) error {
+	return p.waitForMatch("/webpage/WaitForURL", pattern, timeout)
 }
 
-// shim is the included javascript used to communicate with PhantomJS.
-const shim = `
-var system = require("system")
-var webpage = require('webpage');
-var webserver = require('webserver');
+// WaitForTitle waits until the title of the web page matches pattern.
+// Patterns are matched the same as in WaitForURL().
+//
+// Returns ErrTimeout if the title does not match within timeout.
+func (p *WebPage) WaitForTitle(pattern string, timeout time.Duration) error {
+	return p.waitForMatch("/webpage/WaitForTitle", pattern, timeout)
+}
 
-/*
- * HTTP API
- */
+// waitForMatch sends a wait request for a pattern to the shim at path.
+func (p *WebPage) waitForMatch(path, pattern string, timeout time.Duration) error {
+	expr := patternRegexp(pattern)
 
-// Serves RPC API.
-var server = webserver.create();
-server.listen(system.env["PORT"], function(request, response) {
-	try {
-		switch (request.url) {
-			case '/ping': return handlePing(request, response);
-			case '/webpage/CanGoBack': return handleWebpageCanGoBack(request, response);
-			case '/webpage/CanGoForward': return handleWebpageCanGoForward(request, response);
-			case '/webpage/ClipRect': return handleWebpageClipRect(request, response);
-			case '/webpage/SetClipRect': return handleWebpageSetClipRect(request, response);
-			case '/webpage/Cookies': return handleWebpageCookies(request, response);
-			case '/webpage/SetCookies': return handleWebpageSetCookies(request, response);
-			case '/webpage/CustomHeaders': return handleWebpageCustomHeaders(request, response);
-			case '/webpage/SetCustomHeaders': return handleWebpageSetCustomHeaders(request, response);
-			case '/webpage/Create': return handleWebpageCreate(request, response);
-			case '/webpage/Content': return handleWebpageContent(request, response);
-			case '/webpage/SetContent': return handleWebpageSetContent(request, response);
-			case '/webpage/FocusedFrameName': return handleWebpageFocusedFrameName(request, response);
-			case '/webpage/FrameContent': return handleWebpageFrameContent(request, response);
-			case '/webpage/SetFrameContent': return handleWebpageSetFrameContent(request, response);
-			case '/webpage/FrameName': return handleWebpageFrameName(request, response);
-			case '/webpage/FramePlainText': return handleWebpageFramePlainText(request, response);
-			case '/webpage/FrameTitle': return handleWebpageFrameTitle(request, response);
-			case '/webpage/FrameURL': return handleWebpageFrameURL(request, response);
-			case '/webpage/FrameCount': return handleWebpageFrameCount(request, response);
-			case '/webpage/FrameNames': return handleWebpageFrameNames(request, response);
-			case '/webpage/LibraryPath': return handleWebpageLibraryPath(request, response);
-			case '/webpage/SetLibraryPath': return handleWebpageSetLibraryPath(request, response);
-			case '/webpage/NavigationLocked': return handleWebpageNavigationLocked(request, response);
-			case '/webpage/SetNavigationLocked': return handleWebpageSetNavigationLocked(request, response);
-			case '/webpage/OfflineStoragePath': return handleWebpageOfflineStoragePath(request, response);
-			case '/webpage/OfflineStorageQuota': return handleWebpageOfflineStorageQuota(request, response);
-			case '/webpage/OwnsPages': return handleWebpageOwnsPages(request, response);
-			case '/webpage/SetOwnsPages': return handleWebpageSetOwnsPages(request, response);
-			case '/webpage/PageWindowNames': return handleWebpagePageWindowNames(request, response);
-			case '/webpage/Pages': return handleWebpagePages(request, response);
-			case '/webpage/PaperSize': return handleWebpagePaperSize(request, response);
-			case '/webpage/SetPaperSize': return handleWebpageSetPaperSize(request, response);
-			case '/webpage/PlainText': return handleWebpagePlainText(request, response);
-			case '/webpage/ScrollPosition': return handleWebpageScrollPosition(request, response);
-			case '/webpage/SetScrollPosition': return handleWebpageSetScrollPosition(request, response);
-			case '/webpage/Settings': return handleWebpageSettings(request, response);
-			case '/webpage/SetSettings': return handleWebpageSetSettings(request, response);
-			case '/webpage/Title': return handleWebpageTitle(request, response);
-			case '/webpage/URL': return handleWebpageURL(request, response);
-			case '/webpage/ViewportSize': return handleWebpageViewportSize(request, response);
-			case '/webpage/SetViewportSize': return handleWebpageSetViewportSize(request, response);
-			case '/webpage/WindowName': return handleWebpageWindowName(request, response);
-			case '/webpage/ZoomFactor': return handleWebpageZoomFactor(request, response);
-			case '/webpage/SetZoomFactor': return handleWebpageSetZoomFactor(request, response);
+	var resp struct {
+		Timeout bool `json:"timeout"`
+	}
+	req := map[string]interface{}{
+		"ref":      p.ref.id,
+		"pattern":  expr,
+		"timeout":  int(timeout / time.Millisecond),
+		"interval": int(DefaultPollInterval / time.Millisecond),
+	}
+	if err := p.ref.process.doJSON("POST", path, req, &resp); err != nil {
+		return err
+	} else if resp.Timeout {
+		return ErrTimeout
+	}
+	return nil
+}
 
-			case '/webpage/AddCookie': return handleWebpageAddCookie(request, response);
-			case '/webpage/ClearCookies': return handleWebpageClearCookies(request, response);
-			case '/webpage/DeleteCookie': return handleWebpageDeleteCookie(request, response);
-			case '/webpage/Open': return handleWebpageOpen(request, response);
-			case '/webpage/Close': return handleWebpageClose(request, response);
-			case '/webpage/EvaluateAsync': return handleWebpageEvaluateAsync(request, response);
-			case '/webpage/EvaluateJavaScript': return handleWebpageEvaluateJavaScript(request, response);
-			case '/webpage/Evaluate': return handleWebpageEvaluate(request, response);
-			case '/webpage/Page': return handleWebpagePage(request, response);
-			case '/webpage/GoBack': return handleWebpageGoBack(request, response);
-			case '/webpage/GoForward': return handleWebpageGoForward(request, response);
-			case '/webpage/Go': return handleWebpageGo(request, response);
-			case '/webpage/IncludeJS': return handleWebpageIncludeJS(request, response);
-			case '/webpage/InjectJS': return handleWebpageInjectJS(request, response);
-			case '/webpage/Reload': return handleWebpageReload(request, response);
-			case '/webpage/RenderBase64': return handleWebpageRenderBase64(request, response);
-			case '/webpage/Render': return handleWebpageRender(request, response);
-			case '/webpage/SendMouseEvent': return handleWebpageSendMouseEvent(request, response);
-			case '/webpage/SendKeyboardEvent': return handleWebpageSendKeyboardEvent(request, response);
-			case '/webpage/SetContentAndURL': return handleWebpageSetContentAndURL(request, response);
-			case '/webpage/Stop': return handleWebpageStop(request, response);
-			case '/webpage/SwitchToFocusedFrame': return handleWebpageSwitchToFocusedFrame(request, response);
-			case '/webpage/SwitchToFrameName': return handleWebpageSwitchToFrameName(request, response);
-			case '/webpage/SwitchToFramePosition': return handleWebpageSwitchToFramePosition(request, response);
-			case '/webpage/SwitchToMainFrame': return handleWebpageSwitchToMainFrame(request, response);
-			case '/webpage/SwitchToParentFrame': return handleWebpageSwitchToParentFrame(request, response);
-			case '/webpage/UploadFile': return handleWebpageUploadFile(request, response);
-			default: return handleNotFound(request, response);
+// ScrollToBottomUntilStable repeatedly scrolls to the bottom of the page and
+// waits for the network to be idle for the idle duration until the page's
+// height stops growing. This loads the content of infinite scrolling pages.
+// At most maxScrolls scrolls are made.
+//
+// Each scroll waits up to DefaultScrollTimeout for the network to go idle.
+// Pages which never go idle, such as those which poll, are still measured
+// once the wait times out.
+func (p *WebPage) ScrollToBottomUntilStable(maxScrolls int, idle time.Duration) error {
+	height, err := p.scrollHeight()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxScrolls; i++ {
+		if _, err := p.Evaluate(`function() { window.scrollTo(0, document.body.scrollHeight) }`); err != nil {
+			return err
+		} else if err := p.WaitForNetworkIdle(idle, DefaultScrollTimeout); err != nil && err != ErrTimeout {
+			return err
+		}
+
+		prev := height
+		if height, err = p.scrollHeight(); err != nil {
+			return err
+		} else if height <= prev {
+			return nil
 		}
-	} catch(e) {
-		response.statusCode = 500;
-		response.write(JSON.stringify({url: request.url, error: e.message}));
-		response.closeGracefully();
 	}
-});
+	return nil
+}
+
+// scrollHeight returns the height of the page's document.
+func (p *WebPage) scrollHeight() (int, error) {
+	v, err := p.Evaluate(`function() { return document.body ? document.body.scrollHeight : 0 }`)
+	if err != nil {
+		return 0, err
+	}
+	height, _ := v.(float64)
+	return int(height), nil
+}
+
+// Events returns a channel of events fired by the web page.
+//
+// Events are buffered within PhantomJS and retrieved in the background by
+// long polling, or pushed as they occur if the process has its callback
+// server enabled. Events fired before the first call to Events() are also
+// delivered as long as they have not been evicted from the buffer. The
+// channel is closed when the page is closed or events cannot be retrieved.
+func (p *WebPage) Events() <-chan Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.events == nil {
+		p.events = make(chan Event, 100)
+		p.closing = make(chan struct{})
+		p.startEvents(p.events, p.closing)
+	}
+	return p.events
+}
+
+// startEvents begins sending the page's events to ch until closing is closed.
+func (p *WebPage) startEvents(ch chan Event, closing chan struct{}) {
+	if p.ref.process.CallbackURL() != "" {
+		go p.forwardEvents(ch, closing)
+	} else {
+		go p.pollEvents(ch, closing)
+	}
+}
+
+// SetNetworkLog streams the page's resource events to w as newline-delimited
+// JSON as they occur. Requests, responses, errors and timeouts are written as
+// one object per line. Only activity after the call is written. Pass nil to
+// stop logging. Replacing or clearing the writer stops the previous log's
+// event stream. Logging stops if a write to w fails.
+func (p *WebPage) SetNetworkLog(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.networkLogClosing != nil {
+		close(p.networkLogClosing)
+		p.networkLogClosing = nil
+	}
+	if w == nil {
+		return
+	}
+
+	ch, closing := make(chan Event, 100), make(chan struct{})
+	p.networkLogClosing = closing
+	p.startEvents(ch, closing)
+	go p.writeNetworkLog(w, ch, closing, time.Now().Truncate(time.Millisecond))
+}
+
+// writeNetworkLog writes resource events from ch to w which occurred at or
+// after since.
+func (p *WebPage) writeNetworkLog(w io.Writer, ch <-chan Event, closing chan struct{}, since time.Time) {
+	enc := json.NewEncoder(w)
+	for {
+		var e Event
+		select {
+		case <-closing:
+			return
+		case v, ok := <-ch:
+			if !ok {
+				return
+			}
+			e = v
+		}
+
+		if e.Time.Before(since) {
+			continue
+		}
+
+		entry := networkLogEntry{Time: e.Time, Page: p.ref.id, Type: e.Type}
+		switch data := e.Data.(type) {
+		case *ResourceRequest:
+			entry.ID, entry.Method, entry.URL, entry.Header = data.ID, data.Method, data.URL, data.Header
+			entry.XHR = data.XHR
+		case *ResourceResponse:
+			entry.ID, entry.URL, entry.Header = data.ID, data.URL, data.Header
+			entry.Stage, entry.Status, entry.StatusText = data.Stage, data.Status, data.StatusText
+			entry.ContentType, entry.BodySize, entry.XHR = data.ContentType, data.BodySize, data.XHR
+		case *ResourceError:
+			entry.ID, entry.URL, entry.Error = data.ID, data.URL, data.ErrorString
+			entry.Status, entry.StatusText, entry.XHR = data.Status, data.StatusText, data.XHR
+		default:
+			continue
+		}
+
+		if err := enc.Encode(entry); err != nil {
+			return
+		}
+	}
+}
+
+// networkLogEntry is a single line written by SetNetworkLog().
+type networkLogEntry struct {
+	Time        time.Time   `json:"time"`
+	Page        string      `json:"page"`
+	Type        string      `json:"type"`
+	ID          int         `json:"id"`
+	Method      string      `json:"method,omitempty"`
+	URL         string      `json:"url"`
+	Stage       string      `json:"stage,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	StatusText  string      `json:"statusText,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+	BodySize    int         `json:"bodySize,omitempty"`
+	Header      http.Header `json:"headers,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	XHR         bool        `json:"xhr,omitempty"`
+}
+
+// forwardEvents sends events pushed to the process' callback server to ch.
+// Events already buffered by the shim are retrieved first.
+func (p *WebPage) forwardEvents(ch chan Event, closing chan struct{}) {
+	defer close(ch)
+
+	q := p.ref.process.subscribe(p.ref.id)
+	defer p.ref.process.unsubscribe(p.ref.id, q)
+
+	// Ask the shim to push events only while they are being forwarded.
+	if err := p.ref.process.doJSON("POST", "/webpage/SubscribeEvents", map[string]interface{}{"ref": p.ref.id, "value": true}, nil); err != nil {
+		return
+	}
+	defer p.ref.process.doJSON("POST", "/webpage/SubscribeEvents", map[string]interface{}{"ref": p.ref.id, "value": false}, nil)
+
+	// Stop waiting on the queue once the page is closed.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-closing:
+		case <-done:
+		}
+		q.close()
+	}()
+
+	// Retrieve backlog of events without waiting.
+	var resp struct {
+		Events []eventJSON `json:"events"`
+		Closed bool        `json:"closed"`
+	}
+	req := map[string]interface{}{"ref": p.ref.id, "since": 0, "timeout": 0}
+	if err := p.ref.process.doJSON("POST", "/webpage/Events", req, &resp); err != nil {
+		return
+	}
+
+	// Send backlog and then pushed events, skipping any duplicates.
+	var seq int
+	for {
+		var v eventJSON
+		if len(resp.Events) > 0 {
+			v, resp.Events = resp.Events[0], resp.Events[1:]
+		} else if resp.Closed {
+			return
+		} else if e, ok := q.pop(); !ok {
+			return
+		} else {
+			v = e
+		}
+
+		if v.Seq <= seq {
+			continue
+		}
+		seq = v.Seq
+
+		e, err := decodeEventJSON(p.ref.process, v)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case <-closing:
+			return
+		case ch <- e:
+		}
+	}
+}
+
+// pollEvents continually retrieves events from the shim and sends them to ch.
+// Polling stops as soon as closing is closed, even during a long poll.
+func (p *WebPage) pollEvents(ch chan Event, closing chan struct{}) {
+	defer close(ch)
+
+	// Cancel the outstanding poll once closing is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var seq int
+	for {
+		var resp struct {
+			Events []eventJSON `json:"events"`
+			Closed bool        `json:"closed"`
+		}
+		req := map[string]interface{}{"ref": p.ref.id, "since": seq, "timeout": int(eventPollTimeout / time.Millisecond)}
+		if err := p.ref.process.doJSONContext(ctx, "POST", "/webpage/Events", req, &resp); err != nil {
+			return
+		}
+
+		for _, v := range resp.Events {
+			seq = v.Seq
+
+			e, err := decodeEventJSON(p.ref.process, v)
+			if err != nil {
+				continue
+			}
+
+			select {
+			case <-closing:
+				return
+			case ch <- e:
+			}
+		}
+
+		if resp.Closed {
+			return
+		}
+	}
+}
+
+// LastErrors returns the most recent uncaught JavaScript errors on the page.
+// Errors are retained across page loads, up to a limit, oldest first.
+func (p *WebPage) LastErrors() ([]*PageError, error) {
+	var resp struct {
+		Value []pageErrorJSON `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/LastErrors", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+
+	a := make([]*PageError, len(resp.Value))
+	for i := range resp.Value {
+		a[i] = decodePageErrorJSON(resp.Value[i])
+	}
+	return a, nil
+}
+
+// HAR returns the network activity of the page as a HAR 1.2 document.
+// Activity is recorded from the most recent call to Open(). Encode the
+// result with encoding/json to use it with existing HAR tools.
+func (p *WebPage) HAR() (*HAR, error) {
+	var resp harJSON
+	if err := p.ref.process.doJSON("POST", "/webpage/HAR", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+	return decodeHARJSON(resp), nil
+}
+
+// OnConfirm sets a handler which answers confirm() dialogs shown by the page.
+// The dialog blocks until fn returns or until the process' DialogTimeout
+// elapses, in which case the default answer is used. Pass nil to remove the
+// handler.
+//
+// PhantomJS is blocked while fn runs so fn must not call methods on the page.
+// Returns ErrCallbackServerDisabled if the process' callback server is not running.
+func (p *WebPage) OnConfirm(fn func(message string) bool) error {
+	if fn != nil && p.ref.process.CallbackURL() == "" {
+		return ErrCallbackServerDisabled
+	}
+
+	p.ref.process.mu.Lock()
+	if p.ref.process.confirmHandlers == nil {
+		p.ref.process.confirmHandlers = make(map[string]func(string) bool)
+	}
+	if fn != nil {
+		p.ref.process.confirmHandlers[p.ref.id] = fn
+	} else {
+		delete(p.ref.process.confirmHandlers, p.ref.id)
+	}
+	p.ref.process.mu.Unlock()
+
+	return p.ref.process.doJSON("POST", "/webpage/SetConfirmHandler", map[string]interface{}{"ref": p.ref.id, "value": fn != nil}, nil)
+}
+
+// ConfirmDefault returns the answer to confirm() dialogs when no handler is
+// set or the handler times out.
+func (p *WebPage) ConfirmDefault() (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/ConfirmDefault", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Value, nil
+}
+
+// SetConfirmDefault sets the default answer to confirm() dialogs.
+// Initially, dialogs are answered with false.
+func (p *WebPage) SetConfirmDefault(value bool) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetConfirmDefault", map[string]interface{}{"ref": p.ref.id, "value": value}, nil)
+}
+
+// OnPrompt sets a handler which supplies the response to prompt() dialogs
+// shown by the page. The handler receives the prompt message and the default
+// value passed to prompt(). The dialog blocks until fn returns or until the
+// process' DialogTimeout elapses, in which case the default response is used.
+// Pass nil to remove the handler.
+//
+// PhantomJS is blocked while fn runs so fn must not call methods on the page.
+// Returns ErrCallbackServerDisabled if the process' callback server is not running.
+func (p *WebPage) OnPrompt(fn func(message, defaultValue string) string) error {
+	if fn != nil && p.ref.process.CallbackURL() == "" {
+		return ErrCallbackServerDisabled
+	}
+
+	p.ref.process.mu.Lock()
+	if p.ref.process.promptHandlers == nil {
+		p.ref.process.promptHandlers = make(map[string]func(string, string) string)
+	}
+	if fn != nil {
+		p.ref.process.promptHandlers[p.ref.id] = fn
+	} else {
+		delete(p.ref.process.promptHandlers, p.ref.id)
+	}
+	p.ref.process.mu.Unlock()
+
+	return p.ref.process.doJSON("POST", "/webpage/SetPromptHandler", map[string]interface{}{"ref": p.ref.id, "value": fn != nil}, nil)
+}
+
+// PromptDefault returns the response to prompt() dialogs when no handler is
+// set or the handler times out. A blank string means the default value passed
+// to prompt() is used.
+func (p *WebPage) PromptDefault() (string, error) {
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/PromptDefault", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// SetPromptDefault sets the default response to prompt() dialogs.
+func (p *WebPage) SetPromptDefault(value string) error {
+	return p.ref.process.doJSON("POST", "/webpage/SetPromptDefault", map[string]interface{}{"ref": p.ref.id, "value": value}, nil)
+}
+
+// OpenWebPageSettings represents the settings object passed to WebPage.Open().
+type OpenWebPageSettings struct {
+	Method string `json:"method"`
+}
+
+// eventPollTimeout is the time the shim holds an event poll open for.
+const eventPollTimeout = 30 * time.Second
+
+// Event types.
+const (
+	EventConsoleMessage      = "consoleMessage"
+	EventError               = "error"
+	EventLoadStarted         = "loadStarted"
+	EventLoadFinished        = "loadFinished"
+	EventNavigationRequested = "navigationRequested"
+	EventPageCreated         = "pageCreated"
+	EventClosing             = "closing"
+	EventInitialized         = "initialized"
+	EventResourceRequested   = "resourceRequested"
+	EventResourceReceived    = "resourceReceived"
+	EventResourceError       = "resourceError"
+	EventResourceTimeout     = "resourceTimeout"
+)
+
+// Event represents a callback fired by a web page.
+type Event struct {
+	// Type of event, such as EventConsoleMessage.
+	Type string
+
+	// Time the event was fired.
+	Time time.Time
+
+	// Data associated with the event. The concrete type depends on the event
+	// type. For example, EventConsoleMessage events contain a *ConsoleMessage
+	// and EventPageCreated events contain the new *WebPage. EventClosing
+	// events contain the *WebPage being closed, which is released afterward.
+	// Unrecognized event types contain the data decoded from JSON.
+	Data interface{}
+}
+
+// ConsoleMessage represents a message logged to the console by a web page.
+type ConsoleMessage struct {
+	Message  string
+	Line     int
+	SourceID string
+}
+
+// PageError represents an uncaught JavaScript error in a web page.
+type PageError struct {
+	Message string
+	Trace   []StackFrame
+}
+
+// Error returns the error message.
+func (e *PageError) Error() string { return e.Message }
+
+// StackFrame represents a single entry in a JavaScript stack trace.
+type StackFrame struct {
+	File     string
+	Line     int
+	Function string
+}
+
+// PageLoad represents the start or end of a page load. It is also used for
+// EventInitialized events, which fire when a new document is created.
+type PageLoad struct {
+	// URL of the page when the event fired. For EventLoadStarted this is the
+	// URL being navigated away from.
+	URL string
+
+	// Status of a finished load: "success" or "fail".
+	// Blank for EventLoadStarted.
+	Status string
+}
+
+// NavigationRequest represents a navigation requested by a web page.
+type NavigationRequest struct {
+	URL          string
+	Type         string // "LinkClicked", "FormSubmitted", "Reload", etc.
+	WillNavigate bool   // false if navigation is locked
+	Main         bool   // true if navigation is in the main frame
+	Blocked      bool   // true if blocked by a navigation rule
+}
+
+// ResourceRequest represents a request for a resource made by a web page.
+type ResourceRequest struct {
+	ID     int
+	Method string
+	URL    string
+	Time   time.Time
+	Header http.Header
+
+	// True if the request appears to be made by XMLHttpRequest or fetch().
+	// This is determined heuristically from the request's headers and URL.
+	XHR bool
+}
+
+// ResourceResponse represents a response received for a resource requested
+// by a web page. Responses are received in stages: "start" when the first
+// chunk arrives and "end" when the whole body has been received.
+type ResourceResponse struct {
+	ID          int // matches ResourceRequest.ID
+	URL         string
+	Time        time.Time
+	Stage       string
+	Status      int
+	StatusText  string
+	Header      http.Header
+	ContentType string
+	BodySize    int
+	RedirectURL string
+	XHR         bool // true if the request was classified as XHR
+
+	// Body of the response. Only set by WebPage.WaitForResponse() when the
+	// response was captured. See WebPage.SetCapturePatterns().
+	Body []byte
+}
+
+// ResourceError represents a resource which failed to load, such as from a
+// DNS failure, an SSL error or an HTTP error status. Open() returns the
+// error for the main document when the page fails to load.
+//
+// ResourceError is also used for EventResourceTimeout events, which are fired
+// when a request is cancelled after exceeding the ResourceTimeout setting.
+type ResourceError struct {
+	ID          int // matches ResourceRequest.ID
+	URL         string
+	Time        time.Time
+	ErrorCode   int
+	ErrorString string
+	Status      int
+	StatusText  string
+	XHR         bool // true if the request was classified as XHR
+}
+
+// Error returns the error string and the URL of the failed resource.
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.ErrorString, e.URL)
+}
+
+// ResponseTooLargeError is returned when a response from the shim is larger
+// than Process.MaxResponseBytes.
+type ResponseTooLargeError struct {
+	Path  string // route of the request, such as "/webpage/Content"
+	Size  int64  // actual size of the response, in bytes
+	Limit int64
+}
+
+// Error returns the route and the size of the response.
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("phantomjs: response from %s too large: %d bytes exceeds limit of %d", e.Path, e.Size, e.Limit)
+}
+
+// eventQueue is an unbounded queue of events pushed to the callback server.
+// Pushing never blocks so that PhantomJS is not held up by slow consumers.
+type eventQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events []eventJSON
+	closed bool
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds an event to the end of the queue.
+func (q *eventQueue) push(e eventJSON) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.events = append(q.events, e)
+		q.cond.Signal()
+	}
+}
+
+// pop removes an event from the front of the queue. Blocks until an event is
+// available. Returns false if the queue is closed.
+func (q *eventQueue) pop() (eventJSON, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return eventJSON{}, false
+	}
+
+	e := q.events[0]
+	q.events = q.events[1:]
+	return e, true
+}
+
+// close stops the queue and wakes any waiting callers.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// eventJSON is a struct for decoding events from the shim.
+type eventJSON struct {
+	Seq  int             `json:"seq"`
+	Type string          `json:"type"`
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+type consoleMessageJSON struct {
+	Message  string `json:"message"`
+	Line     int    `json:"line"`
+	SourceID string `json:"sourceId"`
+}
+
+type pageErrorJSON struct {
+	Message string `json:"message"`
+	Trace   []struct {
+		File     string `json:"file"`
+		Line     int    `json:"line"`
+		Function string `json:"function"`
+	} `json:"trace"`
+}
+
+func decodePageErrorJSON(v pageErrorJSON) *PageError {
+	out := &PageError{Message: v.Message}
+	for _, frame := range v.Trace {
+		out.Trace = append(out.Trace, StackFrame{
+			File:     frame.File,
+			Line:     frame.Line,
+			Function: frame.Function,
+		})
+	}
+	return out
+}
+
+type pageLoadJSON struct {
+	URL    string `json:"url"`
+	Status string `json:"status"`
+}
+
+type navigationRequestJSON struct {
+	URL          string `json:"url"`
+	Type         string `json:"type"`
+	WillNavigate bool   `json:"willNavigate"`
+	Main         bool   `json:"main"`
+	Blocked      bool   `json:"blocked"`
+}
+
+type resourceRequestJSON struct {
+	ID      int          `json:"id"`
+	Method  string       `json:"method"`
+	URL     string       `json:"url"`
+	Time    string       `json:"time"`
+	Headers []headerJSON `json:"headers"`
+	XHR     bool         `json:"xhr"`
+}
+
+type resourceResponseJSON struct {
+	ID          int          `json:"id"`
+	URL         string       `json:"url"`
+	Time        string       `json:"time"`
+	Stage       string       `json:"stage"`
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	Headers     []headerJSON `json:"headers"`
+	ContentType string       `json:"contentType"`
+	BodySize    int          `json:"bodySize"`
+	RedirectURL string       `json:"redirectURL"`
+	XHR         bool         `json:"xhr"`
+}
+
+func decodeResourceResponseJSON(v resourceResponseJSON) *ResourceResponse {
+	t, _ := time.Parse(time.RFC3339Nano, v.Time)
+	return &ResourceResponse{
+		ID:          v.ID,
+		URL:         v.URL,
+		Time:        t,
+		Stage:       v.Stage,
+		Status:      v.Status,
+		StatusText:  v.StatusText,
+		Header:      decodeHeaderJSON(v.Headers),
+		ContentType: v.ContentType,
+		BodySize:    v.BodySize,
+		RedirectURL: v.RedirectURL,
+		XHR:         v.XHR,
+	}
+}
+
+type resourceErrorJSON struct {
+	ID          int    `json:"id"`
+	URL         string `json:"url"`
+	Time        string `json:"time"`
+	ErrorCode   int    `json:"errorCode"`
+	ErrorString string `json:"errorString"`
+	Status      int    `json:"status"`
+	StatusText  string `json:"statusText"`
+	XHR         bool   `json:"xhr"`
+}
+
+func decodeResourceErrorJSON(v resourceErrorJSON) *ResourceError {
+	t, _ := time.Parse(time.RFC3339Nano, v.Time)
+	return &ResourceError{
+		ID:          v.ID,
+		URL:         v.URL,
+		Time:        t,
+		ErrorCode:   v.ErrorCode,
+		ErrorString: v.ErrorString,
+		Status:      v.Status,
+		StatusText:  v.StatusText,
+		XHR:         v.XHR,
+	}
+}
+
+// headerJSON is a struct for decoding a single HTTP header as JSON.
+type headerJSON struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func decodeHeaderJSON(a []headerJSON) http.Header {
+	hdr := make(http.Header)
+	for _, h := range a {
+		hdr.Add(h.Name, h.Value)
+	}
+	return hdr
+}
+
+// decodeEventJSON decodes an event and its type-specific data.
+// Pages referenced by the event are attached to process p.
+func decodeEventJSON(p *Process, v eventJSON) (Event, error) {
+	e := Event{
+		Type: v.Type,
+		Time: time.Unix(0, v.Time*int64(time.Millisecond)),
+	}
+
+	switch v.Type {
+	case EventConsoleMessage:
+		var data consoleMessageJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = &ConsoleMessage{
+			Message:  data.Message,
+			Line:     data.Line,
+			SourceID: data.SourceID,
+		}
+
+	case EventError:
+		var data pageErrorJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = decodePageErrorJSON(data)
+
+	case EventLoadStarted, EventLoadFinished, EventInitialized:
+		var data pageLoadJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = &PageLoad{URL: data.URL, Status: data.Status}
+
+	case EventNavigationRequested:
+		var data navigationRequestJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = &NavigationRequest{
+			URL:          data.URL,
+			Type:         data.Type,
+			WillNavigate: data.WillNavigate,
+			Main:         data.Main,
+			Blocked:      data.Blocked,
+		}
+
+	case EventPageCreated, EventClosing:
+		var data struct {
+			Ref refJSON `json:"ref"`
+		}
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = newWebPage(p, data.Ref.ID)
+
+	case EventResourceRequested:
+		var data resourceRequestJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		t, _ := time.Parse(time.RFC3339Nano, data.Time)
+		e.Data = &ResourceRequest{
+			ID:     data.ID,
+			Method: data.Method,
+			URL:    data.URL,
+			Time:   t,
+			Header: decodeHeaderJSON(data.Headers),
+			XHR:    data.XHR,
+		}
+
+	case EventResourceReceived:
+		var data resourceResponseJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = decodeResourceResponseJSON(data)
+
+	case EventResourceError, EventResourceTimeout:
+		var data resourceErrorJSON
+		if err := json.Unmarshal(v.Data, &data); err != nil {
+			return Event{}, err
+		}
+		e.Data = decodeResourceErrorJSON(data)
+
+	default:
+		if len(v.Data) > 0 {
+			if err := json.Unmarshal(v.Data, &e.Data); err != nil {
+				return Event{}, err
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// Ref represents a reference to an object in phantomjs.
+type Ref struct {
+	process *Process
+	id      string
+}
+
+// newRef returns a new instance of a referenced object within the process.
+func newRef(p *Process, id string) *Ref {
+	return &Ref{process: p, id: id}
+}
+
+// ID returns the reference identifier.
+func (r *Ref) ID() string {
+	return r.id
+}
+
+// refJSON is a struct for encoding refs as JSON.
+type refJSON struct {
+	ID string `json:"id"`
+}
+
+// Rect represents a rectangle used by WebPage.ClipRect().
+//
+// Dimensions are fractional so that rectangles scaled by a zoom factor
+// are not rounded to the nearest pixel. Callers with integer coordinates can
+// use WebPage.SetClipRectInt().
+type Rect struct {
+	Top    float64
+	Left   float64
+	Width  float64
+	Height float64
+}
+
+// IsZero returns true if the rectangle is empty.
+func (r Rect) IsZero() bool {
+	return r == Rect{}
+}
+
+// rectJSON is a struct for encoding rects as JSON.
+type rectJSON struct {
+	Top    float64 `json:"top"`
+	Left   float64 `json:"left"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// patternRegexp converts a glob or slash-enclosed regular expression pattern
+// into a regular expression that can be evaluated by the shim. Expressions
+// are JavaScript syntax so they are validated by the shim rather than Go.
+func patternRegexp(pattern string) string {
+	// Slash-enclosed patterns are regular expressions.
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return pattern[1 : len(pattern)-1]
+	}
+
+	// Otherwise convert glob to an anchored expression. Escapes from
+	// QuoteMeta() are also valid in JavaScript.
+	a := strings.Split(pattern, "*")
+	for i := range a {
+		a[i] = regexp.QuoteMeta(a[i])
+	}
+	return "^" + strings.Join(a, ".*") + "$"
+}
+
+// cookieJSON is a struct for encoding http.Cookie objects as JSON.
+type cookieJSON struct {
+	Domain   string `json:"domain"`
+	Expires  string `json:"expires"`
+	Expiry   int    `json:"expiry"`
+	HTTPOnly bool   `json:"httponly"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Secure   bool   `json:"secure"`
+	Value    string `json:"value"`
+}
+
+func encodeCookieJSON(v *http.Cookie) cookieJSON {
+	out := cookieJSON{
+		Domain:   v.Domain,
+		HTTPOnly: v.HttpOnly,
+		Name:     v.Name,
+		Path:     v.Path,
+		Secure:   v.Secure,
+		Value:    v.Value,
+	}
+
+	if !v.Expires.IsZero() {
+		out.Expires = v.Expires.UTC().Format(http.TimeFormat)
+	}
+	return out
+}
+
+func decodeCookieJSON(v cookieJSON) *http.Cookie {
+	out := &http.Cookie{
+		Domain:     v.Domain,
+		RawExpires: v.Expires,
+		HttpOnly:   v.HTTPOnly,
+		Name:       v.Name,
+		Path:       v.Path,
+		Secure:     v.Secure,
+		Value:      v.Value,
+	}
+
+	if v.Expires != "" {
+		expires, _ := time.Parse(http.TimeFormat, v.Expires)
+		out.Expires = expires
+		out.RawExpires = v.Expires
+	}
+
+	return out
+}
+
+// PaperSize represents the size of a webpage when rendered as a PDF.
+//
+// Units can be specified in "mm", "cm", "in", or "px".
+// If no unit is specified then "px" is used.
+type PaperSize struct {
+	// Dimensions of the paper.
+	// This can also be specified via Format.
+	Width  string
+	Height string
+
+	// Supported formats: "A3", "A4", "A5", "Legal", "Letter", "Tabloid".
+	Format string
+
+	// Margins around the paper.
+	Margin *PaperSizeMargin
+
+	// Supported orientations: "portrait", "landscape".
+	Orientation string
+
+	// Optional header and footer repeated on every page.
+	Header *PaperSizeSection
+	Footer *PaperSizeSection
+}
+
+// PaperSizeSection represents a header or footer printed on each PDF page.
+// Contents is HTML in which "{{pageNum}}" and "{{numPages}}" are replaced
+// with the current page number and the total number of pages.
+type PaperSizeSection struct {
+	Height   string
+	Contents string
+}
+
+// PaperSizeMargin represents the margins around the paper.
+type PaperSizeMargin struct {
+	Top    string
+	Bottom string
+	Left   string
+	Right  string
+}
+
+type paperSizeJSON struct {
+	Width       string                `json:"width,omitempty"`
+	Height      string                `json:"height,omitempty"`
+	Format      string                `json:"format,omitempty"`
+	Margin      *paperSizeMarginJSON  `json:"margin,omitempty"`
+	Orientation string                `json:"orientation,omitempty"`
+	Header      *paperSizeSectionJSON `json:"header,omitempty"`
+	Footer      *paperSizeSectionJSON `json:"footer,omitempty"`
+}
+
+type paperSizeSectionJSON struct {
+	Height   string `json:"height,omitempty"`
+	Contents string `json:"contents"`
+}
+
+type paperSizeMarginJSON struct {
+	Top    string `json:"top,omitempty"`
+	Bottom string `json:"bottom,omitempty"`
+	Left   string `json:"left,omitempty"`
+	Right  string `json:"right,omitempty"`
+}
+
+func encodePaperSizeJSON(v PaperSize) paperSizeJSON {
+	out := paperSizeJSON{
+		Width:       v.Width,
+		Height:      v.Height,
+		Format:      v.Format,
+		Orientation: v.Orientation,
+		Header:      encodePaperSizeSectionJSON(v.Header),
+		Footer:      encodePaperSizeSectionJSON(v.Footer),
+	}
+	if v.Margin != nil {
+		out.Margin = &paperSizeMarginJSON{
+			Top:    v.Margin.Top,
+			Bottom: v.Margin.Bottom,
+			Left:   v.Margin.Left,
+			Right:  v.Margin.Right,
+		}
+	}
+	return out
+}
+
+func decodePaperSizeJSON(v paperSizeJSON) PaperSize {
+	out := PaperSize{
+		Width:       v.Width,
+		Height:      v.Height,
+		Format:      v.Format,
+		Orientation: v.Orientation,
+		Header:      decodePaperSizeSectionJSON(v.Header),
+		Footer:      decodePaperSizeSectionJSON(v.Footer),
+	}
+	if v.Margin != nil {
+		out.Margin = &PaperSizeMargin{
+			Top:    v.Margin.Top,
+			Bottom: v.Margin.Bottom,
+			Left:   v.Margin.Left,
+			Right:  v.Margin.Right,
+		}
+	}
+	return out
+}
+
+func encodePaperSizeSectionJSON(v *PaperSizeSection) *paperSizeSectionJSON {
+	if v == nil {
+		return nil
+	}
+	return &paperSizeSectionJSON{Height: v.Height, Contents: v.Contents}
+}
+
+func decodePaperSizeSectionJSON(v *paperSizeSectionJSON) *PaperSizeSection {
+	if v == nil {
+		return nil
+	}
+	return &PaperSizeSection{Height: v.Height, Contents: v.Contents}
+}
+
+// RenderOptions represents options used when rendering a web page to an image.
+type RenderOptions struct {
+	// Image format: "png", "jpeg", "gif", or "webp". Defaults to "png".
+	// WebP is rendered as PNG, which decodes to the same image.
+	Format string
+
+	// Multiplier for the pixel density of the rendered image, emulating a
+	// device pixel ratio. A scale of 2 renders the page at twice the width
+	// and height without changing its layout. Defaults to 1.
+	Scale float64
+
+	// CSS selectors for elements that are hidden while rendering, such as
+	// cookie banners or chat widgets. Elements are restored afterward.
+	HideSelectors []string
+
+	// If true, rendering waits until all images and web fonts in the
+	// document have loaded. AssetTimeout limits how long to wait and
+	// defaults to DefaultAssetTimeout.
+	WaitForAssets bool
+	AssetTimeout  time.Duration
+
+	// If set, RenderImage() scales the rendered image, such as to produce a
+	// thumbnail. The page is rendered at full size and resized in Go.
+	ResizeTo *ResizeOptions
+
+	// If true, RenderImage() renders the page in tiles of TileHeight CSS
+	// pixels and composes them in Go. This avoids the excessive memory use
+	// and blank areas of rendering very tall pages in one pass. TileHeight
+	// defaults to the viewport height.
+	Stitch     bool
+	TileHeight int
+
+	// If set, RenderImage() draws the watermark over the rendered image,
+	// such as to brand screenshots or mark them as previews. Text
+	// watermarks are rendered at the same scale as the page.
+	Watermark *Watermark
+
+	// If set, RenderImage() draws a box and label around the elements
+	// matching each annotation, such as for visual bug reports or to audit
+	// what a scraper extracts. Element positions are read by the render,
+	// after HideSelectors are applied and assets are loaded, so the boxes
+	// match the rendered layout. Hidden elements are not annotated.
+	Annotations []Annotation
+}
+
+type renderOptionsJSON struct {
+	Format        string   `json:"format"`
+	Scale         float64  `json:"scale"`
+	HideSelectors []string `json:"hideSelectors,omitempty"`
+	WaitForAssets bool     `json:"waitForAssets"`
+	AssetTimeout  int      `json:"assetTimeout"`
+	Annotations   []string `json:"annotations,omitempty"`
+}
+
+func encodeRenderOptionsJSON(v RenderOptions) renderOptionsJSON {
+	out := renderOptionsJSON{
+		Format:        v.Format,
+		Scale:         v.Scale,
+		HideSelectors: v.HideSelectors,
+		WaitForAssets: v.WaitForAssets,
+		AssetTimeout:  int(v.AssetTimeout / time.Millisecond),
+	}
+	for _, a := range v.Annotations {
+		out.Annotations = append(out.Annotations, a.Selector)
+	}
+	if out.Format == "" || strings.EqualFold(out.Format, "webp") {
+		out.Format = "png"
+	}
+	if out.Scale <= 0 {
+		out.Scale = 1
+	}
+	if v.AssetTimeout <= 0 {
+		out.AssetTimeout = int(DefaultAssetTimeout / time.Millisecond)
+	}
+	return out
+}
+
+// NavigationRule represents a rule for blocking navigation requests.
+type NavigationRule struct {
+	// URL pattern to block. Patterns are matched the same as in
+	// WebPage.WaitForURL().
+	Pattern string
+
+	// Type of navigation to block, such as "LinkClicked", "FormSubmitted",
+	// "Reload", or "Other". Blank matches all types.
+	Type string
+}
+
+type navigationRuleJSON struct {
+	Pattern string `json:"pattern"`
+	Expr    string `json:"expr"`
+	Type    string `json:"type,omitempty"`
+}
+
+// InterceptRule represents a rule for aborting or rewriting resource requests.
+//
+// A request matches a rule if it matches all non-blank match fields. Matching
+// requests are aborted if Abort is set, are answered with Response if set, or
+// are sent to RedirectURL instead.
+type InterceptRule struct {
+	// URL pattern to match. Patterns are matched the same as in
+	// WebPage.WaitForURL().
+	Pattern string
+
+	// HTTP method to match, such as "GET" or "POST".
+	Method string
+
+	// Substring of the request's Accept header to match, such as "image/"
+	// or "text/css". This hints at the type of resource requested.
+	Accept string
+
+	// Action to perform on matching requests.
+	Abort       bool
+	Response    *MockResponse
+	RedirectURL string
+}
+
+// MockResponse represents a canned response for intercepted requests.
+//
+// Mocked requests are redirected to a server in PhantomJS which only serves
+// mock responses, so pages can be rendered without hitting the network. The
+// server is separate from the shim's API and each page can only load its own
+// mocks. As PhantomJS cannot answer requests itself, a mocked document takes
+// the server's URL so its relative URLs and cookies do not resolve against
+// the original origin. Use SetContentAndURL() to load a document under its
+// real URL instead.
+type MockResponse struct {
+	Status int // defaults to 200
+	Header http.Header
+	Body   []byte
+}
+
+type interceptRuleJSON struct {
+	Pattern     string            `json:"pattern,omitempty"`
+	Expr        string            `json:"expr,omitempty"`
+	Method      string            `json:"method,omitempty"`
+	Accept      string            `json:"accept,omitempty"`
+	Abort       bool              `json:"abort,omitempty"`
+	Response    *mockResponseJSON `json:"response,omitempty"`
+	RedirectURL string            `json:"redirectURL,omitempty"`
+}
+
+type mockResponseJSON struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body"`
+}
+
+func encodeInterceptRuleJSON(v InterceptRule) interceptRuleJSON {
+	out := interceptRuleJSON{
+		Pattern:     v.Pattern,
+		Method:      v.Method,
+		Accept:      v.Accept,
+		Abort:       v.Abort,
+		RedirectURL: v.RedirectURL,
+	}
+	if v.Response != nil {
+		out.Response = &mockResponseJSON{Status: v.Response.Status, Header: v.Response.Header, Body: v.Response.Body}
+		if out.Response.Status == 0 {
+			out.Response.Status = http.StatusOK
+		}
+	}
+	if v.Pattern != "" {
+		out.Expr = patternRegexp(v.Pattern)
+	}
+	return out
+}
+
+func decodeInterceptRuleJSON(v interceptRuleJSON) InterceptRule {
+	out := InterceptRule{
+		Pattern:     v.Pattern,
+		Method:      v.Method,
+		Accept:      v.Accept,
+		Abort:       v.Abort,
+		RedirectURL: v.RedirectURL,
+	}
+	if v.Response != nil {
+		out.Response = &MockResponse{Status: v.Response.Status, Header: v.Response.Header, Body: v.Response.Body}
+	}
+	return out
+}
+
+// Position represents a coordinate on the page, in pixels.
+type Position struct {
+	Top  int
+	Left int
+}
+
+// WebPageSettings represents various settings on a web page.
+type WebPageSettings struct {
+	JavascriptEnabled             bool
+	LoadImages                    bool
+	LocalToRemoteURLAccessEnabled bool
+	UserAgent                     string
+	Username                      string
+	Password                      string
+	XSSAuditingEnabled            bool
+	WebSecurityEnabled            bool
+	ResourceTimeout               time.Duration
+}
+
+type webPageSettingsJSON struct {
+	JavascriptEnabled             bool   `json:"javascriptEnabled"`
+	LoadImages                    bool   `json:"loadImages"`
+	LocalToRemoteURLAccessEnabled bool   `json:"localToRemoteUrlAccessEnabled"`
+	UserAgent                     string `json:"userAgent"`
+	Username                      string `json:"username"`
+	Password                      string `json:"password"`
+	XSSAuditingEnabled            bool   `json:"XSSAuditingEnabled"`
+	WebSecurityEnabled            bool   `json:"webSecurityEnabled"`
+	ResourceTimeout               int    `json:"resourceTimeout"`
+}
+
+func decodeWebPageSettingsJSON(v webPageSettingsJSON) WebPageSettings {
+	return WebPageSettings{
+		JavascriptEnabled:             v.JavascriptEnabled,
+		LoadImages:                    v.LoadImages,
+		LocalToRemoteURLAccessEnabled: v.LocalToRemoteURLAccessEnabled,
+		UserAgent:                     v.UserAgent,
+		Username:                      v.Username,
+		Password:                      v.Password,
+		XSSAuditingEnabled:            v.XSSAuditingEnabled,
+		WebSecurityEnabled:            v.WebSecurityEnabled,
+		ResourceTimeout:               time.Duration(v.ResourceTimeout) * time.Millisecond,
+	}
+}
+
+func encodeWebPageSettingsJSON(v WebPageSettings) webPageSettingsJSON {
+	return webPageSettingsJSON{
+		JavascriptEnabled:             v.JavascriptEnabled,
+		LoadImages:                    v.LoadImages,
+		LocalToRemoteURLAccessEnabled: v.LocalToRemoteURLAccessEnabled,
+		UserAgent:                     v.UserAgent,
+		Username:                      v.Username,
+		Password:                      v.Password,
+		XSSAuditingEnabled:            v.XSSAuditingEnabled,
+		WebSecurityEnabled:            v.WebSecurityEnabled,
+		ResourceTimeout:               int(v.ResourceTimeout / time.Millisecond),
+	}
+}
+
+// PageDefaults represents configuration applied to new pages by a Process.
+// Zero values leave PhantomJS' defaults unchanged.
+type PageDefaults struct {
+	ViewportWidth  int
+	ViewportHeight int
+
+	// User agent sent by the page. Takes precedence over Settings.UserAgent.
+	UserAgent string
+
+	// Headers sent with every request.
+	CustomHeaders http.Header
+
+	// Settings merged into the page's settings, if set. Only non-zero fields
+	// are applied so the page keeps its defaults for the other fields. Use
+	// WebPage.SetSettings() to turn off a setting, such as LoadImages.
+	Settings *WebPageSettings
+}
+
+type pageDefaultsJSON struct {
+	Viewport      *sizeJSON              `json:"viewport,omitempty"`
+	UserAgent     string                 `json:"userAgent,omitempty"`
+	CustomHeaders map[string]string      `json:"customHeaders,omitempty"`
+	Settings      map[string]interface{} `json:"settings,omitempty"`
+}
+
+type sizeJSON struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func encodePageDefaultsJSON(v *PageDefaults) pageDefaultsJSON {
+	var out pageDefaultsJSON
+	if v.ViewportWidth > 0 && v.ViewportHeight > 0 {
+		out.Viewport = &sizeJSON{Width: v.ViewportWidth, Height: v.ViewportHeight}
+	}
+	out.UserAgent = v.UserAgent
+	if len(v.CustomHeaders) > 0 {
+		out.CustomHeaders = make(map[string]string)
+		for key := range v.CustomHeaders {
+			out.CustomHeaders[key] = v.CustomHeaders.Get(key)
+		}
+	}
+	if v.Settings != nil {
+		out.Settings = nonZeroSettings(*v.Settings)
+	}
+	return out
+}
+
+// nonZeroSettings returns the encoded fields of v which are not zero.
+func nonZeroSettings(v WebPageSettings) map[string]interface{} {
+	buf, _ := json.Marshal(encodeWebPageSettingsJSON(v))
+	var m map[string]interface{}
+	json.Unmarshal(buf, &m)
+	for key, value := range m {
+		if value == false || value == "" || value == float64(0) {
+			delete(m, key)
+		}
+	}
+	return m
+}
+
+// shim is the included javascript used to communicate with PhantomJS.
+const shim = `
+var system = require("system")
+var fs = require('fs');
+var childProcess = require('child_process');
+var webpage = require('webpage');
+var webserver = require('webserver');
+
+// URL of the client's callback server, if enabled.
+var callbackURL = system.env["CALLBACK_URL"];
+
+// If true, page console messages and errors are written to stdout/stderr.
+var forwardConsole = !!system.env["FORWARD_CONSOLE"];
+
+// Time, in milliseconds, after which unused pages are closed. Disabled if zero.
+var pageTTL = parseInt(system.env["PAGE_TTL"] || "0", 10);
+
+// Secret the client sends with every request. Requests without it, such as
+// from pages loaded by PhantomJS, are rejected.
+var token = system.env["TOKEN"];
+var tokenHeader = 'X-Phantomjs-Token';
+
+// If true, the client may run commands on the host with /process/Spawn.
+var allowSpawn = !!system.env["ALLOW_SPAWN"];
+
+/*
+ * HTTP API
+ */
+
+// Serves RPC API.
+var server = webserver.create();
+server.listen('127.0.0.1:' + system.env["PORT"], function(request, response) {
+	try {
+		if (!token || request.headers[tokenHeader] !== token) {
+			response.statusCode = 403;
+			response.write(JSON.stringify({error: 'forbidden'}));
+			response.closeGracefully();
+			return;
+		}
+
+		switch (request.url) {
+			case '/ping': return handlePing(request, response);
+			case '/cancel': return handleCancel(request, response);
+			case '/process/Refs': return handleProcessRefs(request, response);
+			case '/process/SystemInfo': return handleProcessSystemInfo(request, response);
+			case '/process/Spawn': return handleProcessSpawn(request, response);
+			case '/process/SetProxy': return handleProcessSetProxy(request, response);
+			case '/process/Serve': return handleProcessServe(request, response);
+			case '/process/CloseServer': return handleProcessCloseServer(request, response);
+			case '/process/TunnelOwner': return handleProcessTunnelOwner(request, response);
+			case '/fs/Read': return handleFSRead(request, response);
+			case '/fs/Write': return handleFSWrite(request, response);
+			case '/fs/Exists': return handleFSExists(request, response);
+			case '/fs/List': return handleFSList(request, response);
+			case '/fs/Remove': return handleFSRemove(request, response);
+			case '/process/Events': return handleProcessEvents(request, response);
+			case '/process/Cookies': return handleProcessCookies(request, response);
+			case '/process/AddCookie': return handleProcessAddCookie(request, response);
+			case '/process/DeleteCookie': return handleProcessDeleteCookie(request, response);
+			case '/process/ClearCookies': return handleProcessClearCookies(request, response);
+			case '/process/CookiesEnabled': return handleProcessCookiesEnabled(request, response);
+			case '/process/SetCookiesEnabled': return handleProcessSetCookiesEnabled(request, response);
+			case '/process/InjectJS': return handleProcessInjectJS(request, response);
+			case '/process/LibraryPath': return handleProcessLibraryPath(request, response);
+			case '/process/SetLibraryPath': return handleProcessSetLibraryPath(request, response);
+			case '/process/ClearMemoryCache': return handleProcessClearMemoryCache(request, response);
+			case '/process/ReleaseRef': return handleProcessReleaseRef(request, response);
+			case '/webpage/CanGoBack': return handleWebpageCanGoBack(request, response);
+			case '/webpage/CanGoForward': return handleWebpageCanGoForward(request, response);
+			case '/webpage/ClipRect': return handleWebpageClipRect(request, response);
+			case '/webpage/SetClipRect': return handleWebpageSetClipRect(request, response);
+			case '/webpage/SetClipRectToElement': return handleWebpageSetClipRectToElement(request, response);
+			case '/webpage/BoundingRect': return handleWebpageBoundingRect(request, response);
+			case '/webpage/BoundingRects': return handleWebpageBoundingRects(request, response);
+			case '/webpage/ExtractTable': return handleWebpageExtractTable(request, response);
+			case '/webpage/Links': return handleWebpageLinks(request, response);
+			case '/webpage/Images': return handleWebpageImages(request, response);
+			case '/webpage/Metadata': return handleWebpageMetadata(request, response);
+			case '/webpage/Markdown': return handleWebpageMarkdown(request, response);
+			case '/webpage/Cookies': return handleWebpageCookies(request, response);
+			case '/webpage/SetCookies': return handleWebpageSetCookies(request, response);
+			case '/webpage/CustomHeaders': return handleWebpageCustomHeaders(request, response);
+			case '/webpage/SetCustomHeaders': return handleWebpageSetCustomHeaders(request, response);
+			case '/webpage/Create': return handleWebpageCreate(request, response);
+			case '/webpage/Content': return handleWebpageContent(request, response);
+			case '/webpage/ContentStream': return handleWebpageContentStream(request, response);
+			case '/webpage/SetContent': return handleWebpageSetContent(request, response);
+			case '/webpage/FocusedFrameName': return handleWebpageFocusedFrameName(request, response);
+			case '/webpage/FrameContent': return handleWebpageFrameContent(request, response);
+			case '/webpage/SetFrameContent': return handleWebpageSetFrameContent(request, response);
+			case '/webpage/FrameName': return handleWebpageFrameName(request, response);
+			case '/webpage/FramePlainText': return handleWebpageFramePlainText(request, response);
+			case '/webpage/FrameTitle': return handleWebpageFrameTitle(request, response);
+			case '/webpage/FrameURL': return handleWebpageFrameURL(request, response);
+			case '/webpage/FrameCount': return handleWebpageFrameCount(request, response);
+			case '/webpage/FrameNames': return handleWebpageFrameNames(request, response);
+			case '/webpage/LibraryPath': return handleWebpageLibraryPath(request, response);
+			case '/webpage/SetLibraryPath': return handleWebpageSetLibraryPath(request, response);
+			case '/webpage/NavigationLocked': return handleWebpageNavigationLocked(request, response);
+			case '/webpage/SetNavigationLocked': return handleWebpageSetNavigationLocked(request, response);
+			case '/webpage/NavigationRules': return handleWebpageNavigationRules(request, response);
+			case '/webpage/SetNavigationRules': return handleWebpageSetNavigationRules(request, response);
+			case '/webpage/InterceptRules': return handleWebpageInterceptRules(request, response);
+			case '/webpage/SetInterceptRules': return handleWebpageSetInterceptRules(request, response);
+			case '/webpage/AddInterceptRules': return handleWebpageAddInterceptRules(request, response);
+			case '/webpage/SetCapturePatterns': return handleWebpageSetCapturePatterns(request, response);
+			case '/webpage/SetThrottled': return handleWebpageSetThrottled(request, response);
+			case '/webpage/OfflineStoragePath': return handleWebpageOfflineStoragePath(request, response);
+			case '/webpage/OfflineStorageQuota': return handleWebpageOfflineStorageQuota(request, response);
+			case '/webpage/OwnsPages': return handleWebpageOwnsPages(request, response);
+			case '/webpage/SetOwnsPages': return handleWebpageSetOwnsPages(request, response);
+			case '/webpage/PageWindowNames': return handleWebpagePageWindowNames(request, response);
+			case '/webpage/Pages': return handleWebpagePages(request, response);
+			case '/webpage/PaperSize': return handleWebpagePaperSize(request, response);
+			case '/webpage/SetPaperSize': return handleWebpageSetPaperSize(request, response);
+			case '/webpage/PlainText': return handleWebpagePlainText(request, response);
+			case '/webpage/ScrollPosition': return handleWebpageScrollPosition(request, response);
+			case '/webpage/SetScrollPosition': return handleWebpageSetScrollPosition(request, response);
+			case '/webpage/Settings': return handleWebpageSettings(request, response);
+			case '/webpage/Snapshot': return handleWebpageSnapshot(request, response);
+			case '/webpage/SetSettings': return handleWebpageSetSettings(request, response);
+			case '/webpage/Title': return handleWebpageTitle(request, response);
+			case '/webpage/URL': return handleWebpageURL(request, response);
+			case '/webpage/ViewportSize': return handleWebpageViewportSize(request, response);
+			case '/webpage/SetViewportSize': return handleWebpageSetViewportSize(request, response);
+			case '/webpage/WindowName': return handleWebpageWindowName(request, response);
+			case '/webpage/ZoomFactor': return handleWebpageZoomFactor(request, response);
+			case '/webpage/SetZoomFactor': return handleWebpageSetZoomFactor(request, response);
+
+			case '/webpage/AddCookie': return handleWebpageAddCookie(request, response);
+			case '/webpage/ClearCookies': return handleWebpageClearCookies(request, response);
+			case '/webpage/DeleteCookie': return handleWebpageDeleteCookie(request, response);
+			case '/webpage/Open': return handleWebpageOpen(request, response);
+			case '/webpage/Close': return handleWebpageClose(request, response);
+			case '/webpage/Reset': return handleWebpageReset(request, response);
+			case '/webpage/EvaluateAsync': return handleWebpageEvaluateAsync(request, response);
+			case '/webpage/EvaluateJavaScript': return handleWebpageEvaluateJavaScript(request, response);
+			case '/webpage/Evaluate': return handleWebpageEvaluate(request, response);
+			case '/webpage/EvaluateOnNewDocument': return handleWebpageEvaluateOnNewDocument(request, response);
+			case '/webpage/ClearNewDocumentScripts': return handleWebpageClearNewDocumentScripts(request, response);
+			case '/webpage/Page': return handleWebpagePage(request, response);
+			case '/webpage/GoBack': return handleWebpageGoBack(request, response);
+			case '/webpage/GoForward': return handleWebpageGoForward(request, response);
+			case '/webpage/Go': return handleWebpageGo(request, response);
+			case '/webpage/IncludeJS': return handleWebpageIncludeJS(request, response);
+			case '/webpage/InjectJS': return handleWebpageInjectJS(request, response);
+			case '/webpage/Reload': return handleWebpageReload(request, response);
+			case '/webpage/RenderBase64': return handleWebpageRenderBase64(request, response);
+			case '/webpage/Render': return handleWebpageRender(request, response);
+			case '/webpage/RenderBytes': return handleWebpageRenderBytes(request, response);
+			case '/webpage/SendMouseEvent': return handleWebpageSendMouseEvent(request, response);
+			case '/webpage/SendKeyboardEvent': return handleWebpageSendKeyboardEvent(request, response);
+			case '/webpage/XHROnly': return handleWebpageXHROnly(request, response);
+			case '/webpage/SetXHROnly': return handleWebpageSetXHROnly(request, response);
+			case '/webpage/DownloadCapture': return handleWebpageDownloadCapture(request, response);
+			case '/webpage/SetDownloadCapture': return handleWebpageSetDownloadCapture(request, response);
+			case '/webpage/Downloads': return handleWebpageDownloads(request, response);
+			case '/webpage/MediaType': return handleWebpageMediaType(request, response);
+			case '/webpage/SetMediaType': return handleWebpageSetMediaType(request, response);
+			case '/webpage/SetLocale': return handleWebpageSetLocale(request, response);
+			case '/webpage/SetTimezoneOffset': return handleWebpageSetTimezoneOffset(request, response);
+			case '/webpage/Offline': return handleWebpageOffline(request, response);
+			case '/webpage/SetOffline': return handleWebpageSetOffline(request, response);
+			case '/webpage/SetContentAndURL': return handleWebpageSetContentAndURL(request, response);
+			case '/webpage/Stop': return handleWebpageStop(request, response);
+			case '/webpage/SwitchToFocusedFrame': return handleWebpageSwitchToFocusedFrame(request, response);
+			case '/webpage/SwitchToFrameName': return handleWebpageSwitchToFrameName(request, response);
+			case '/webpage/SwitchToFramePosition': return handleWebpageSwitchToFramePosition(request, response);
+			case '/webpage/SwitchToMainFrame': return handleWebpageSwitchToMainFrame(request, response);
+			case '/webpage/SwitchToParentFrame': return handleWebpageSwitchToParentFrame(request, response);
+			case '/webpage/UploadFile': return handleWebpageUploadFile(request, response);
+			case '/webpage/Events': return handleWebpageEvents(request, response);
+			case '/webpage/SubscribeEvents': return handleWebpageSubscribeEvents(request, response);
+			case '/webpage/SetConfirmHandler': return handleWebpageSetConfirmHandler(request, response);
+			case '/webpage/ConfirmDefault': return handleWebpageConfirmDefault(request, response);
+			case '/webpage/SetConfirmDefault': return handleWebpageSetConfirmDefault(request, response);
+			case '/webpage/SetPromptHandler': return handleWebpageSetPromptHandler(request, response);
+			case '/webpage/PromptDefault': return handleWebpagePromptDefault(request, response);
+			case '/webpage/SetPromptDefault': return handleWebpageSetPromptDefault(request, response);
+			case '/webpage/HAR': return handleWebpageHAR(request, response);
+			case '/webpage/LastErrors': return handleWebpageLastErrors(request, response);
+			case '/webpage/WaitForFunction': return handleWebpageWaitForFunction(request, response);
+			case '/webpage/WaitForNavigation': return handleWebpageWaitForNavigation(request, response);
+			case '/webpage/WaitForResponse': return handleWebpageWaitForResponse(request, response);
+			case '/webpage/WaitForNetworkIdle': return handleWebpageWaitForNetworkIdle(request, response);
+			case '/webpage/WaitForURL': return handleWebpageWaitForURL(request, response);
+			case '/webpage/WaitForTitle': return handleWebpageWaitForTitle(request, response);
+			default: return handleNotFound(request, response);
+		}
+	} catch(e) {
+		response.statusCode = 500;
+		response.write(JSON.stringify({url: request.url, error: e.message}));
+		response.closeGracefully();
+	}
+});
+
+function handlePing(request, response) {
+	response.statusCode = 200;
+	response.write('ok');
+	response.closeGracefully();
+}
+
+// Header carrying the ID the client assigned to a request.
+var requestIDHeader = 'X-Phantomjs-Request-Id';
+
+// Functions which abandon in-flight requests, by request ID.
+var cancelers = {};
+
+// Registers fn to be called if the client cancels request. Handlers must
+// call offCancel() once the request completes.
+function onCancel(request, fn) {
+	var id = request.headers[requestIDHeader];
+	if (id) {
+		cancelers[id] = fn;
+	}
+}
+
+// Unregisters the cancel function of request.
+function offCancel(request) {
+	delete cancelers[request.headers[requestIDHeader]];
+}
+
+// Cancels an in-flight request by ID. Requests which have already completed
+// or which cannot be cancelled are ignored.
+function handleCancel(request, response) {
+	var id = JSON.parse(request.post).id;
+	var fn = cancelers[id];
+	delete cancelers[id];
+	if (fn) {
+		fn();
+	}
+	response.write(JSON.stringify({value: !!fn}));
+	response.closeGracefully();
+}
+
+// Represents a request which was cancelled by the client.
+function CancelError() {
+	this.message = "canceled";
+}
+
+function handleProcessRefs(request, response) {
+	var a = [];
+	for (var id in refs) {
+		if (refs.hasOwnProperty(id)) {
+			a.push({
+				id: id,
+				type: refType(refs[id]),
+				url: refs[id].url || "",
+				created: refCreated[id],
+				lastUsed: refTimes[id]
+			});
+		}
+	}
+	response.write(JSON.stringify({refs: a}));
+	response.closeGracefully();
+}
+
+function handleProcessReleaseRef(request, response) {
+	var msg = JSON.parse(request.post);
+	if (refType(peekRef(msg.id)) === "webpage") {
+		closePage(msg.id);
+	} else {
+		delete refs[msg.id];
+		delete refTimes[msg.id];
+		delete refCreated[msg.id];
+	}
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleProcessEvents(request, response) {
+	var msg = JSON.parse(request.post);
+	waitEvents(processEvents, msg.since, msg.timeout, function(events, closed) {
+		response.write(JSON.stringify({events: events, closed: closed}));
+		response.closeGracefully();
+	});
+}
+
+function handleProcessSystemInfo(request, response) {
+	var value = {
+		pid: system.pid,
+		os: system.os,
+		version: phantom.version,
+		env: system.env,
+		args: system.args
+	};
+	response.write(JSON.stringify({value: value}));
+	response.closeGracefully();
+}
+
+function handleProcessSpawn(request, response) {
+	if (!allowSpawn) {
+		throw new Error('spawn disabled');
+	}
+
+	var msg = JSON.parse(request.post);
+	var stdout = '', stderr = '', done = false;
+
+	var child = childProcess.spawn(msg.name, msg.args);
+	child.stdout.on('data', function(data) { stdout += data; });
+	child.stderr.on('data', function(data) { stderr += data; });
+	child.on('exit', function(code) {
+		if (done) {
+			return;
+		}
+		done = true;
+		response.write(JSON.stringify({exitCode: code, stdout: stdout, stderr: stderr}));
+		response.closeGracefully();
+	});
+	child.on('error', function(err) {
+		if (done) {
+			return;
+		}
+		done = true;
+		writeError(response, new Error('spawn ' + msg.name + ': ' + (err && err.message || err)));
+	});
+}
+
+function handleProcessSetProxy(request, response) {
+	var msg = JSON.parse(request.post);
+	phantom.setProxy(msg.host, msg.port, msg.type, msg.username, msg.password);
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// Fixture servers started by the client, by id.
+var fixtureServers = {};
+var nextFixtureServerID = 1;
+
+function handleProcessServe(request, response) {
+	var msg = JSON.parse(request.post);
+	var handler = msg.script ? eval('(' + msg.script + ')') : staticHandler(msg.dir);
+
+	// Listen on the first available loopback port after the API port.
+	var srv = webserver.create();
+	var port = parseInt(system.env["PORT"], 10) + 1;
+	for (var i = 0; i < 100 && !srv.listen('127.0.0.1:' + port, handler); i++) {
+		port++;
+	}
+	if (i === 100) {
+		throw new Error('no port available for server');
+	}
+
+	var id = String(nextFixtureServerID++);
+	fixtureServers[id] = srv;
+	response.write(JSON.stringify({id: id, port: port}));
+	response.closeGracefully();
+}
+
+function handleProcessCloseServer(request, response) {
+	var msg = JSON.parse(request.post);
+	var srv = fixtureServers[msg.id];
+	if (srv) {
+		srv.close();
+		delete fixtureServers[msg.id];
+	}
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// Content types of static files by extension.
+var contentTypes = {
+	'html': 'text/html; charset=utf-8',
+	'htm': 'text/html; charset=utf-8',
+	'css': 'text/css; charset=utf-8',
+	'js': 'application/javascript; charset=utf-8',
+	'json': 'application/json; charset=utf-8',
+	'txt': 'text/plain; charset=utf-8',
+	'svg': 'image/svg+xml',
+	'png': 'image/png',
+	'jpg': 'image/jpeg',
+	'jpeg': 'image/jpeg',
+	'gif': 'image/gif',
+	'woff': 'font/woff',
+	'woff2': 'font/woff2'
+};
+
+// Returns a webserver callback which serves the files in dir.
+function staticHandler(dir) {
+	return function(request, response) {
+		var path = decodeURIComponent(request.url.split('?')[0]);
+		if (path.split('/').indexOf('..') !== -1) {
+			path = null;
+		} else if (path.charAt(path.length - 1) === '/') {
+			path += 'index.html';
+		}
+
+		var filename = path && dir + path;
+		if (!filename || !fs.isFile(filename)) {
+			response.statusCode = 404;
+			response.write('not found');
+			response.close();
+			return;
+		}
+
+		var ext = filename.slice(filename.lastIndexOf('.') + 1).toLowerCase();
+		response.statusCode = 200;
+		response.setHeader('Content-Type', contentTypes[ext] || 'application/octet-stream');
+		response.setEncoding('binary');
+		response.write(fs.read(filename, 'b'));
+		response.close();
+	};
+}
+
+function handleProcessCookies(request, response) {
+	response.write(JSON.stringify({value: phantom.cookies}));
+	response.closeGracefully();
+}
+
+function handleProcessAddCookie(request, response) {
+	var msg = JSON.parse(request.post);
+	var returnValue = phantom.addCookie(msg.cookie);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleProcessDeleteCookie(request, response) {
+	var msg = JSON.parse(request.post);
+	var returnValue = phantom.deleteCookie(msg.name);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleProcessClearCookies(request, response) {
+	phantom.clearCookies();
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleProcessCookiesEnabled(request, response) {
+	response.write(JSON.stringify({value: phantom.cookiesEnabled}));
+	response.closeGracefully();
+}
+
+function handleProcessSetCookiesEnabled(request, response) {
+	var msg = JSON.parse(request.post);
+	phantom.cookiesEnabled = msg.value;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleProcessInjectJS(request, response) {
+	var msg = JSON.parse(request.post);
+	var returnValue = phantom.injectJs(msg.filename);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleProcessLibraryPath(request, response) {
+	response.write(JSON.stringify({value: phantom.libraryPath}));
+	response.closeGracefully();
+}
+
+function handleProcessSetLibraryPath(request, response) {
+	var msg = JSON.parse(request.post);
+	phantom.libraryPath = msg.path;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// The memory cache is shared by all pages so it is cleared through a
+// temporary page.
+function handleProcessClearMemoryCache(request, response) {
+	var page = webpage.create();
+	try {
+		page.clearMemoryCache();
+	} finally {
+		page.close();
+	}
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// File contents are sent base64 encoded so binary files, such as rendered
+// images, are not corrupted.
+function handleFSRead(request, response) {
+	var msg = JSON.parse(request.post);
+	var value = {exists: fs.isFile(msg.path)};
+	if (value.exists) {
+		value.data = btoa(fs.read(msg.path, 'b'));
+	}
+	response.write(JSON.stringify(value));
+	response.closeGracefully();
+}
+
+function handleFSWrite(request, response) {
+	var msg = JSON.parse(request.post);
+	var i = msg.path.lastIndexOf(fs.separator);
+	if (i > 0) {
+		fs.makeTree(msg.path.slice(0, i));
+	}
+	fs.write(msg.path, atob(msg.data), 'wb');
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleFSExists(request, response) {
+	var msg = JSON.parse(request.post);
+	response.write(JSON.stringify({value: fs.exists(msg.path)}));
+	response.closeGracefully();
+}
+
+function handleFSList(request, response) {
+	var msg = JSON.parse(request.post);
+	var value = {exists: fs.isDirectory(msg.path)};
+	if (value.exists) {
+		value.value = fs.list(msg.path).filter(function(name) {
+			return name !== '.' && name !== '..';
+		});
+	}
+	response.write(JSON.stringify(value));
+	response.closeGracefully();
+}
+
+function handleFSRemove(request, response) {
+	var msg = JSON.parse(request.post);
+	var exists = fs.exists(msg.path);
+	if (fs.isDirectory(msg.path)) {
+		fs.removeTree(msg.path);
+	} else if (exists) {
+		fs.remove(msg.path);
+	}
+	response.write(JSON.stringify({exists: exists}));
+	response.closeGracefully();
+}
+
+function handleWebpageCanGoBack(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.canGoBack}));
+	response.closeGracefully();
+}
+
+function handleWebpageCanGoForward(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.canGoForward}));
+	response.closeGracefully();
+}
+
+function handleWebpageClipRect(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.clipRect}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetClipRect(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.clipRect = msg.rect;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetClipRectToElement(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var rect = elementRect(page, msg.selector);
+	if (rect !== null) {
+		page.clipRect = rect;
+	}
+	response.write(JSON.stringify({found: rect !== null}));
+	response.closeGracefully();
+}
+
+function handleWebpageBoundingRect(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	response.write(JSON.stringify({value: elementRect(page, msg.selector)}));
+	response.closeGracefully();
+}
+
+function handleWebpageBoundingRects(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	response.write(JSON.stringify({value: elementRects(page, msg.selector)}));
+	response.closeGracefully();
+}
+
+function handleWebpageExtractTable(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	response.write(JSON.stringify({value: page.evaluate(extractTable, msg.selector)}));
+	response.closeGracefully();
+}
+
+function handleWebpageLinks(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.evaluate(extractLinks)}));
+	response.closeGracefully();
+}
+
+function handleWebpageImages(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.evaluate(extractImages)}));
+	response.closeGracefully();
+}
+
+function handleWebpageMetadata(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.evaluate(extractMetadata)}));
+	response.closeGracefully();
+}
+
+function handleWebpageMarkdown(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	response.write(JSON.stringify({value: page.evaluate(serializeNodes, msg.selector || null)}));
+	response.closeGracefully();
+}
+
+function handleWebpageCookies(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.cookies}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetCookies(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.cookies = msg.cookies;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageCustomHeaders(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.customHeaders}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetCustomHeaders(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.customHeaders = msg.headers;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageCreate(request, response) {
+	var msg = request.post ? JSON.parse(request.post) : {};
+	var page = webpage.create();
+	if (msg.defaults) {
+		applyPageDefaults(page, msg.defaults);
+	}
+	var ref = createRef(initPage(page));
+	response.statusCode = 200;
+	response.write(JSON.stringify({ref: ref}));
+	response.closeGracefully();
+}
+
+function handleWebpageOpen(request, response) {
+	var msg = JSON.parse(request.post)
+	var page = ref(msg.ref)
+	page._mainURL = null;
+	page._openErrors = [];
+	page._network = newNetworkLog();
+	onCancel(request, function() { page.stop(); });
+	page.open(msg.url, function(status) {
+		offCancel(request);
+
+		// Report the main document's error, if any, as the cause of failure.
+		var errors = page._openErrors || [];
+		page._openErrors = null;
+		var err = null;
+		if (status !== 'success') {
+			err = errors.filter(function(e) { return e.url === page._mainURL; })[0] || errors[0] || null;
+		}
+		response.write(JSON.stringify({status: status, resourceError: err}));
+		response.closeGracefully();
+	})
+}
+
+function handleWebpageContent(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.content}));
+	response.closeGracefully();
+}
+
+// Number of characters written at a time by handleWebpageContentStream().
+var contentChunkSize = 64 * 1024;
+
+// handleWebpageContentStream writes the page's content as raw HTML in chunks
+// instead of as JSON so the client can read it incrementally.
+function handleWebpageContentStream(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	var content = page.content;
+	response.statusCode = 200;
+	response.setHeader('Content-Type', 'text/html; charset=utf-8');
+	for (var i = 0; i < content.length;) {
+		// Keep surrogate pairs within a chunk so each chunk is valid UTF-16.
+		var end = Math.min(i + contentChunkSize, content.length);
+		var c = content.charCodeAt(end - 1);
+		if (c >= 0xD800 && c <= 0xDBFF && end < content.length) {
+			end++;
+		}
+		response.write(content.substring(i, end));
+		i = end;
+	}
+	response.closeGracefully();
+}
+
+function handleWebpageSetContent(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.content = msg.content;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageFocusedFrameName(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.focusedFrameName}));
+	response.closeGracefully();
+}
+
+function handleWebpageFrameContent(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.frameContent}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetFrameContent(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.frameContent = msg.content;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageFrameName(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.frameName}));
+	response.closeGracefully();
+}
+
+function handleWebpageFramePlainText(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.framePlainText}));
+	response.closeGracefully();
+}
+
+function handleWebpageFrameTitle(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.frameTitle}));
+	response.closeGracefully();
+}
+
+function handleWebpageFrameURL(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.frameUrl}));
+	response.closeGracefully();
+}
+
+function handleWebpageFrameCount(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.framesCount}));
+	response.closeGracefully();
+}
+
+function handleWebpageFrameNames(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.framesName}));
+	response.closeGracefully();
+}
+
+function handleWebpageLibraryPath(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.libraryPath}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetLibraryPath(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.libraryPath = msg.path;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageNavigationLocked(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.navigationLocked}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetNavigationLocked(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.navigationLocked = msg.value;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageNavigationRules(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page._navigationRules}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetNavigationRules(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	checkExprs(msg.rules.map(function(rule) { return rule.expr; }));
+	page._navigationRules = msg.rules;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageInterceptRules(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page._interceptRules}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetInterceptRules(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	checkExprs(msg.rules.map(function(rule) { return rule.expr; }));
+	page._mocks = {};
+	registerMocks(page, msg.rules);
+	page._interceptRules = msg.rules;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageAddInterceptRules(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	checkExprs(msg.rules.map(function(rule) { return rule.expr; }));
+	registerMocks(page, msg.rules);
+	page._interceptRules = page._interceptRules.concat(msg.rules);
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetCapturePatterns(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	checkExprs(msg.patterns || []);
+	page._capturePatterns = msg.patterns || [];
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// Throws if any expression is not a valid regular expression so invalid
+// patterns are reported when they are set rather than when they are matched.
+function checkExprs(exprs) {
+	exprs.forEach(function(expr) {
+		if (expr) {
+			new RegExp(expr);
+		}
+	});
+}
+
+function handleWebpageSetThrottled(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page._throttled = msg.value;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageOfflineStoragePath(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.offlineStoragePath}));
+	response.closeGracefully();
+}
+
+function handleWebpageOfflineStorageQuota(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.offlineStorageQuota}));
+	response.closeGracefully();
+}
+
+function handleWebpageOwnsPages(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.ownsPages}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetOwnsPages(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.ownsPages = msg.value;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpagePageWindowNames(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.pagesWindowName}));
+	response.closeGracefully();
+}
+
+function handleWebpagePages(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	var refs = page.pages.map(function(p) { return createRef(p); })
+	response.write(JSON.stringify({refs: refs}));
+	response.closeGracefully();
+}
+
+function handleWebpagePaperSize(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+
+	// Report sections as set since their callbacks cannot be serialized.
+	var value = {};
+	for (var key in page.paperSize) {
+		value[key] = page.paperSize[key];
+	}
+	delete value.header;
+	delete value.footer;
+	if (page._paperSections) {
+		value.header = page._paperSections.header;
+		value.footer = page._paperSections.footer;
+	}
+
+	response.write(JSON.stringify({value: value}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetPaperSize(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var size = msg.size;
+	page._paperSections = {header: size.header, footer: size.footer};
+	if (size.header) {
+		size.header = paperSection(size.header);
+	}
+	if (size.footer) {
+		size.footer = paperSection(size.footer);
+	}
+	page.paperSize = size;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// Converts a header or footer to a section rendered by PhantomJS on each page.
+function paperSection(section) {
+	return {
+		height: section.height,
+		contents: phantom.callback(function(pageNum, numPages) {
+			return section.contents.split('{{pageNum}}').join(pageNum).split('{{numPages}}').join(numPages);
+		})
+	};
+}
+
+function handleWebpagePlainText(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.plainText}));
+	response.closeGracefully();
+}
+
+function handleWebpageScrollPosition(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	var pos = page.scrollPosition;
+	response.write(JSON.stringify({top: pos.top, left: pos.left}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetScrollPosition(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.scrollPosition = {top: msg.top, left: msg.left};
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageSettings(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({settings: page.settings}));
+	response.closeGracefully();
+}
+
+function handleWebpageSnapshot(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({
+		url: page.url,
+		title: page.title,
+		contentLength: page.content.length,
+		frameName: page.frameName,
+		frameURL: page.frameUrl,
+		frameCount: page.framesCount,
+		frameNames: page.framesName,
+		viewportSize: page.viewportSize,
+		clipRect: page.clipRect,
+		cookies: page.cookies,
+		settings: page.settings
+	}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetSettings(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.settings = msg.settings;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageTitle(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.title}));
+	response.closeGracefully();
+}
+
+function handleWebpageURL(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.url}));
+	response.closeGracefully();
+}
+
+function handleWebpageViewportSize(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	var viewport = page.viewportSize;
+	response.write(JSON.stringify({width: viewport.width, height: viewport.height}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetViewportSize(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.viewportSize = {width: msg.width, height: msg.height};
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageWindowName(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.windowName}));
+	response.closeGracefully();
+}
+
+function handleWebpageZoomFactor(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page.zoomFactor}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetZoomFactor(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.zoomFactor = msg.value;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+
+function handleWebpageAddCookie(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var returnValue = page.addCookie(msg.cookie);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleWebpageClearCookies(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.clearCookies();
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageDeleteCookie(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var returnValue = page.deleteCookie(msg.name);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleWebpageClose(request, response) {
+	var msg = JSON.parse(request.post);
+	closePage(msg.ref);
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageReset(request, response) {
+	var msg = JSON.parse(request.post);
+	resetPage(ref(msg.ref));
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+// Restores a page to the state of a newly created page, including the
+// process' default page settings, so it can be reused.
+// Cookies are cleared before leaving the current URL as clearCookies() only
+// removes the cookies visible to it. Cookies of other domains remain in the
+// process' jar.
+function resetPage(page) {
+	page.stop();
+	page.clearCookies();
+	page.customHeaders = page._defaults.customHeaders;
+	page.clipRect = {top: 0, left: 0, width: 0, height: 0};
+	page.scrollPosition = {top: 0, left: 0};
+	page.zoomFactor = 1;
+	page.viewportSize = page._defaults.viewportSize;
+	page.paperSize = page._defaults.paperSize;
+	page.settings = JSON.parse(JSON.stringify(page._defaults.settings));
+	page.navigationLocked = false;
+
+	// Remove handlers, rules, and buffered state set by the previous user.
+	page._events.buffer = [];
+	page._errors = [];
+	page._confirmHandler = false;
+	page._confirmDefault = false;
+	page._promptHandler = false;
+	page._promptDefault = '';
+	page._navigationRules = [];
+	page._initScripts = [];
+	page._interceptRules = [];
+	page._mocks = {};
+	page._capturePatterns = [];
+	page._throttled = false;
+	page._paperSections = null;
+	page._xhrOnly = false;
+	page._xhrIDs = {};
+	page._inflight = {};
+	page._lastNetworkActivity = Date.now();
+	page._downloadCapture = false;
+	page._downloadRequests = {};
+	page._downloadNavigations = {};
+	page._downloads = [];
+	page._locale = null;
+	page._timezoneOffset = null;
+	page._offline = false;
+	if (page._mediaType) {
+		page._mediaType = 'screen';
+	}
+
+	page._network = newNetworkLog();
+	page.setContent('<html><head></head><body></body></html>', 'about:blank');
+}
+
+// Applies the process' default page settings to a new page.
+function applyPageDefaults(page, defaults) {
+	if (defaults.viewport) {
+		page.viewportSize = defaults.viewport;
+	}
+	if (defaults.settings) {
+		Object.keys(defaults.settings).forEach(function(key) {
+			page.settings[key] = defaults.settings[key];
+		});
+	}
+	if (defaults.userAgent) {
+		page.settings.userAgent = defaults.userAgent;
+	}
+	if (defaults.customHeaders) {
+		page.customHeaders = defaults.customHeaders;
+	}
+}
 
-function handlePing(request, response) {
-	response.statusCode = 200;
-	response.write('ok');
-	response.closeGracefully();
+// Closes the page with a reference ID and the pages it owns.
+function closePage(id) {
+	var page = ref(id);
+	page.close();
+	closeEvents(page);
+	delete refs[id];
+	delete refTimes[id];
+	delete refCreated[id];
+
+	// Close and dereference owned pages.
+	for (var i = 0; i < page.pages.length; i++) {
+		page.pages[i].close();
+		deleteRef(page.pages[i]);
+	}
 }
 
-function handleWebpageCanGoBack(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.canGoBack}));
+function handleWebpageEvaluateAsync(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.evaluateAsync(msg.script, msg.delay);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageCanGoForward(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.canGoForward}));
+function handleWebpageEvaluateJavaScript(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var returnValue = page.evaluateJavaScript(msg.script);
+	response.write(JSON.stringify({returnValue: returnValue}));
 	response.closeGracefully();
 }
 
-function handleWebpageClipRect(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.clipRect}));
+function handleWebpageEvaluate(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var returnValue = page.evaluate(msg.script);
+	response.write(JSON.stringify({returnValue: returnValue}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetClipRect(request, response) {
+function handleWebpageEvaluateOnNewDocument(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.clipRect = msg.rect;
+	page._initScripts.push(msg.script);
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageCookies(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.cookies}));
+function handleWebpageClearNewDocumentScripts(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page._initScripts = [];
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetCookies(request, response) {
+function handleWebpagePage(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.cookies = msg.cookies;
-	response.write(JSON.stringify({}));
+	var p = page.getPage(msg.name);
+
+	if (p === null) {
+		response.write(JSON.stringify({}));
+	} else {
+		response.write(JSON.stringify({ref: createRef(p)}));
+	}
 	response.closeGracefully();
 }
 
-function handleWebpageCustomHeaders(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.customHeaders}));
+function handleWebpageGoBack(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.goBack();
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetCustomHeaders(request, response) {
+function handleWebpageGoForward(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.customHeaders = msg.headers;
+	page.goForward();
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageCreate(request, response) {
-	var ref = createRef(webpage.create());
-	response.statusCode = 200;
-	response.write(JSON.stringify({ref: ref}));
+function handleWebpageGo(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.go(msg.index);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageOpen(request, response) {
-	var msg = JSON.parse(request.post)
-	var page = ref(msg.ref)
-	page.open(msg.url, function(status) {
-		response.write(JSON.stringify({status: status}));
+function handleWebpageIncludeJS(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.includeJs(msg.url, function() {
+		response.write(JSON.stringify({}));
 		response.closeGracefully();
-	})
+	});
 }
 
-function handleWebpageContent(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.content}));
+function handleWebpageInjectJS(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var returnValue = page.injectJs(msg.filename);
+	response.write(JSON.stringify({returnValue: returnValue}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetContent(request, response) {
+function handleWebpageReload(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.content = msg.content;
+	page.reload();
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageFocusedFrameName(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.focusedFrameName}));
-	response.closeGracefully();
-}
-
-function handleWebpageFrameContent(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.frameContent}));
+function handleWebpageRenderBase64(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var returnValue = page.renderBase64(msg.format);
+	response.write(JSON.stringify({returnValue: returnValue}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetFrameContent(request, response) {
+function handleWebpageRender(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.frameContent = msg.content;
+	page.render(msg.filename, {format: msg.format, quality: msg.quality});
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageFrameName(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.frameName}));
-	response.closeGracefully();
-}
+// Directory that temporary renders are written to. This is the shim's
+// directory which is removed when the process closes.
+var renderDir = system.args[0].substring(0, system.args[0].lastIndexOf(fs.separator));
 
-function handleWebpageFramePlainText(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.framePlainText}));
-	response.closeGracefully();
+// Sequence used to generate unique temporary render filenames.
+var nextRenderID = 1;
+
+// Content types of rendered formats written by handleWebpageRenderBytes().
+var renderContentTypes = {
+	png: 'image/png',
+	jpg: 'image/jpeg',
+	jpeg: 'image/jpeg',
+	gif: 'image/gif',
+	bmp: 'image/bmp',
+	ppm: 'image/x-portable-pixmap',
+	pdf: 'application/pdf'
+};
+
+// Renders to a temporary file and writes its raw contents to the response so
+// large renders are not inflated by base64 encoding.
+function handleWebpageRenderBytes(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var format = msg.options.format.toLowerCase();
+	var filename = renderDir + fs.separator + 'render-' + (nextRenderID++) + '.' + format;
+	renderWithOptions(page, msg.options, function() {
+		try {
+			page.render(filename, {format: format, quality: msg.quality > 0 ? msg.quality : -1});
+			return fs.read(filename, 'b');
+		} finally {
+			if (fs.exists(filename)) {
+				fs.remove(filename);
+			}
+		}
+	}, function(err, data, annotations) {
+		if (err) {
+			// Binary responses are only sent on success so report timeouts
+			// as errors which the client can distinguish by message.
+			response.statusCode = 500;
+			response.write(JSON.stringify({error: err.message}));
+			return response.closeGracefully();
+		}
+		response.statusCode = 200;
+		response.setHeader('Content-Type', renderContentTypes[format] || 'application/octet-stream');
+		if (annotations) {
+			response.setHeader('X-Phantomjs-Annotations', JSON.stringify(annotations));
+		}
+		response.setEncoding('binary');
+		response.write(data);
+		response.closeGracefully();
+	});
 }
 
-function handleWebpageFrameTitle(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.frameTitle}));
+function handleWebpageSendMouseEvent(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.sendEvent(msg.eventType, msg.mouseX, msg.mouseY, msg.button);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageFrameURL(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.frameUrl}));
+function handleWebpageSendKeyboardEvent(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.sendEvent(msg.eventType, msg.key, null, null, msg.modifier);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageFrameCount(request, response) {
+function handleWebpageOffline(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.framesCount}));
+	response.write(JSON.stringify({value: page._offline}));
 	response.closeGracefully();
 }
 
-function handleWebpageFrameNames(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.framesName}));
+function handleWebpageSetOffline(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page._offline = msg.value;
+	page.evaluate(emulateOffline, msg.value);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageLibraryPath(request, response) {
+function handleWebpageXHROnly(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.libraryPath}));
+	response.write(JSON.stringify({value: page._xhrOnly}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetLibraryPath(request, response) {
+function handleWebpageSetXHROnly(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.libraryPath = msg.path;
+	page._xhrOnly = msg.value;
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageNavigationLocked(request, response) {
+function handleWebpageDownloadCapture(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.navigationLocked}));
+	response.write(JSON.stringify({value: page._downloadCapture}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetNavigationLocked(request, response) {
+function handleWebpageSetDownloadCapture(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.navigationLocked = msg.value;
+	page._downloadCapture = msg.value;
+	page._downloadRequests = {};
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageOfflineStoragePath(request, response) {
+function handleWebpageDownloads(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.offlineStoragePath}));
+	var downloads = page._downloads;
+	page._downloads = [];
+	response.write(JSON.stringify({downloads: downloads}));
 	response.closeGracefully();
 }
 
-function handleWebpageOfflineStorageQuota(request, response) {
+function handleWebpageMediaType(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.offlineStorageQuota}));
+	response.write(JSON.stringify({value: page._mediaType || 'screen'}));
 	response.closeGracefully();
 }
 
-function handleWebpageOwnsPages(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.ownsPages}));
+function handleWebpageSetLocale(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page._locale = msg.value || null;
+	if (page._locale) {
+		page.evaluate(emulateLocale, page._locale);
+	}
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetOwnsPages(request, response) {
+function handleWebpageSetTimezoneOffset(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.ownsPages = msg.value;
+	page._timezoneOffset = msg.value;
+	page.evaluate(emulateTimezone, msg.value);
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpagePageWindowNames(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.pagesWindowName}));
+function handleWebpageSetMediaType(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	if (msg.value !== 'screen' && msg.value !== 'print') {
+		throw new Error('invalid media type: ' + msg.value);
+	}
+
+	// Reapply emulation whenever a new page loads.
+	if (!page._mediaType) {
+		listen(page, 'onLoadFinished', function() {
+			page.evaluate(emulateMediaType, page._mediaType);
+		});
+	}
+	page._mediaType = msg.value;
+	page.evaluate(emulateMediaType, msg.value);
+
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpagePages(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	var refs = page.pages.map(function(p) { return createRef(p); })
-	response.write(JSON.stringify({refs: refs}));
+function handleWebpageSetContentAndURL(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.setContent(msg.content, msg.url);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpagePaperSize(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.paperSize}));
+function handleWebpageStop(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.stop();
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetPaperSize(request, response) {
+function handleWebpageSwitchToFocusedFrame(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.paperSize = msg.size;
+	page.switchToFocusedFrame();
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpagePlainText(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.plainText}));
+function handleWebpageSwitchToFrameName(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.switchToFrame(msg.name);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageScrollPosition(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	var pos = page.scrollPosition;
-	response.write(JSON.stringify({top: pos.top, left: pos.left}));
+function handleWebpageSwitchToFramePosition(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.switchToFrame(msg.position);
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetScrollPosition(request, response) {
+function handleWebpageSwitchToMainFrame(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.scrollPosition = {top: msg.top, left: msg.left};
+	page.switchToMainFrame();
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSettings(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({settings: page.settings}));
+function handleWebpageSwitchToParentFrame(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.switchToParentFrame();
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetSettings(request, response) {
+function handleWebpageUploadFile(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.settings = msg.settings;
+	page.uploadFile(msg.selector, msg.filename);
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageTitle(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.title}));
-	response.closeGracefully();
+function handleWebpageEvents(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = peekRef(msg.ref);
+	waitEvents(page, msg.since, msg.timeout, function(events, closed) {
+		response.write(JSON.stringify({events: events, closed: closed}));
+		response.closeGracefully();
+	});
 }
 
-function handleWebpageURL(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.url}));
+// Counts the client's subscribers to pushed events. Events are only pushed
+// while the page has a subscriber.
+function handleWebpageSubscribeEvents(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = peekRef(msg.ref);
+	page._subscribers = Math.max(0, page._subscribers + (msg.value ? 1 : -1));
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetConfirmHandler(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page._confirmHandler = msg.value;
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageViewportSize(request, response) {
+function handleWebpageConfirmDefault(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	var viewport = page.viewportSize;
-	response.write(JSON.stringify({width: viewport.width, height: viewport.height}));
+	response.write(JSON.stringify({value: page._confirmDefault}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetViewportSize(request, response) {
+function handleWebpageSetConfirmDefault(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.viewportSize = {width: msg.width, height: msg.height};
+	page._confirmDefault = msg.value;
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageWindowName(request, response) {
-	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.windowName}));
+function handleWebpageSetPromptHandler(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page._promptHandler = msg.value;
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageZoomFactor(request, response) {
+function handleWebpagePromptDefault(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.zoomFactor}));
+	response.write(JSON.stringify({value: page._promptDefault}));
 	response.closeGracefully();
 }
 
-function handleWebpageSetZoomFactor(request, response) {
+function handleWebpageSetPromptDefault(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.zoomFactor = msg.value;
+	page._promptDefault = msg.value;
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-
-function handleWebpageAddCookie(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	var returnValue = page.addCookie(msg.cookie);
-	response.write(JSON.stringify({returnValue: returnValue}));
+function handleWebpageLastErrors(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	response.write(JSON.stringify({value: page._errors}));
 	response.closeGracefully();
 }
 
-function handleWebpageClearCookies(request, response) {
+function handleWebpageWaitForFunction(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.clearCookies();
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+	var stop;
+	onCancel(request, function() { stop(); });
+	stop = poll(function() { return page.evaluateJavaScript(msg.script); }, msg.timeout, msg.interval, function(err) {
+		offCancel(request);
+		writeWaitResult(response, err);
+	});
 }
 
-function handleWebpageDeleteCookie(request, response) {
+function handleWebpageWaitForNavigation(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	var returnValue = page.deleteCookie(msg.name);
-	response.write(JSON.stringify({returnValue: returnValue}));
-	response.closeGracefully();
+
+	var timer, unlisten;
+	unlisten = listen(page, 'onLoadFinished', function(status) {
+		clearTimeout(timer);
+		unlisten();
+		response.write(JSON.stringify({status: status}));
+		response.closeGracefully();
+	});
+	timer = setTimeout(function() {
+		unlisten();
+		writeWaitResult(response, new TimeoutError());
+	}, msg.timeout);
 }
 
-function handleWebpageClose(request, response) {
+function handleWebpageWaitForResponse(request, response) {
 	var msg = JSON.parse(request.post);
-
-	// Close page.
 	var page = ref(msg.ref);
-	page.close();
-	delete(refs, msg.ref);
+	var re = new RegExp(msg.pattern);
 
-	// Close and dereference owned pages.
-	for (var i = 0; i < page.pages.length; i++) {
-		page.pages[i].close();
-		deleteRef(page.pages[i]);
-	}
+	var timer, unlisten;
+	unlisten = listen(page, 'onResourceReceived', function(resp) {
+		if (resp.stage !== 'end' || !re.test(resp.url)) {
+			return;
+		}
+		clearTimeout(timer);
+		unlisten();
 
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+		var captured = page._capturePatterns.some(function(expr) {
+			return new RegExp(expr).test(resp.url);
+		});
+		response.write(JSON.stringify({value: resp, captured: captured}));
+		response.closeGracefully();
+	});
+	timer = setTimeout(function() {
+		unlisten();
+		writeWaitResult(response, new TimeoutError());
+	}, msg.timeout);
 }
 
-function handleWebpageEvaluateAsync(request, response) {
+function handleWebpageWaitForNetworkIdle(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.evaluateAsync(msg.script, msg.delay);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+	poll(function() {
+		return Object.keys(page._inflight).length === 0 && Date.now() - page._lastNetworkActivity >= msg.idle;
+	}, msg.timeout, msg.interval, function(err) {
+		writeWaitResult(response, err);
+	});
 }
 
-function handleWebpageEvaluateJavaScript(request, response) {
+function handleWebpageWaitForURL(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	var returnValue = page.evaluateJavaScript(msg.script);
-	response.write(JSON.stringify({returnValue: returnValue}));
-	response.closeGracefully();
+	var re = new RegExp(msg.pattern);
+	poll(function() { return re.test(page.url); }, msg.timeout, msg.interval, function(err) {
+		writeWaitResult(response, err);
+	});
 }
 
-function handleWebpageEvaluate(request, response) {
+function handleWebpageWaitForTitle(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	var returnValue = page.evaluate(msg.script);
-	response.write(JSON.stringify({returnValue: returnValue}));
+	var re = new RegExp(msg.pattern);
+	poll(function() { return re.test(page.title); }, msg.timeout, msg.interval, function(err) {
+		writeWaitResult(response, err);
+	});
+}
+
+
+function handleNotFound(request, response) {
+	response.statusCode = 404;
+	response.write(JSON.stringify({error:"not found"}));
 	response.closeGracefully();
 }
 
-function handleWebpagePage(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	var p = page.getPage(msg.name);
 
-	if (p === null) {
-		response.write(JSON.stringify({}));
-	} else {
-		response.write(JSON.stringify({ref: createRef(p)}));
+/*
+ * PAGE CALLBACKS
+ */
+
+// Maximum number of errors retained per page.
+var maxPageErrors = 100;
+
+// Returns the prefix for forwarded console output, e.g. "[3 http://x/] ".
+function consolePrefix(page) {
+	var id = findRef(page);
+	return '[' + (id === null ? '-' : id) + ' ' + page.url + '] ';
+}
+
+// Attaches the shim's internal listeners to a newly created page.
+// Pages opened by the page (e.g. via window.open) are initialized as well.
+function initPage(page) {
+	page._events = {seq: 0, buffer: [], waiters: [], closed: false};
+	page._subscribers = 0;
+	page._errors = [];
+	page._confirmHandler = false;
+	page._confirmDefault = false;
+	page._promptHandler = false;
+	page._promptDefault = '';
+	page._navigationRules = [];
+	page._navigationBlocks = 0;
+	page._initScripts = [];
+	page._interceptRules = [];
+	page._mocks = {};
+	page._capturePatterns = [];
+	page._throttled = false;
+	page._xhrOnly = false;
+	page._xhrIDs = {};
+	page._network = newNetworkLog();
+	page._inflight = {};
+	page._lastNetworkActivity = Date.now();
+	page._downloadCapture = false;
+	page._downloadRequests = {};
+	page._downloadNavigations = {};
+	page._downloads = [];
+	page._locale = null;
+	page._timezoneOffset = null;
+	page._offline = false;
+	page._defaults = {
+		viewportSize: page.viewportSize,
+		paperSize: page.paperSize,
+		customHeaders: page.customHeaders,
+		settings: JSON.parse(JSON.stringify(page.settings))
+	};
+
+	listen(page, 'onConsoleMessage', function(message, line, sourceId) {
+		if (forwardConsole) {
+			system.stdout.writeLine(consolePrefix(page) + message);
+		}
+		emit(page, 'consoleMessage', {message: message, line: line, sourceId: sourceId});
+	});
+	listen(page, 'onError', function(message, trace) {
+		var err = {message: message, trace: trace};
+		if (forwardConsole) {
+			var lines = [consolePrefix(page) + message];
+			(trace || []).forEach(function(t) {
+				lines.push('    ' + (t.file || '') + ':' + t.line + (t.function ? ' in ' + t.function : ''));
+			});
+			system.stderr.writeLine(lines.join('\n'));
+		}
+		page._errors.push(err);
+		if (page._errors.length > maxPageErrors) {
+			page._errors.shift();
+		}
+		emit(page, 'error', err);
+	});
+	listen(page, 'onInitialized', function() {
+		if (page._locale) {
+			page.evaluate(emulateLocale, page._locale);
+		}
+		if (page._timezoneOffset !== null) {
+			page.evaluate(emulateTimezone, page._timezoneOffset);
+		}
+		if (page._offline) {
+			page.evaluate(emulateOffline, true);
+		}
+		page._initScripts.forEach(function(script) {
+			page.evaluateJavaScript(script);
+		});
+		emit(page, 'initialized', {url: page.url});
+	});
+	listen(page, 'onLoadStarted', function() {
+		emit(page, 'loadStarted', {url: page.url});
+	});
+	listen(page, 'onLoadFinished', function(status) {
+		page._network.loaded = new Date();
+		emit(page, 'loadFinished', {url: page.url, status: status});
+	});
+	listen(page, 'onNavigationRequested', function(url, type, willNavigate, main) {
+		// Block matching navigations by locking navigation until the
+		// current callback has returned, then restore the caller's lock.
+		var blocked = willNavigate && page._navigationRules.some(function(rule) {
+			return (!rule.type || rule.type === type) && new RegExp(rule.expr).test(url);
+		});
+		if (blocked) {
+			if (page._navigationBlocks === 0) {
+				page._navigationLockedBefore = page.navigationLocked;
+			}
+			page._navigationBlocks++;
+			page.navigationLocked = true;
+			setTimeout(function() {
+				if (--page._navigationBlocks === 0) {
+					page.navigationLocked = page._navigationLockedBefore;
+				}
+			}, 0);
+		}
+		if (main && willNavigate && !blocked) {
+			page._mainURL = url;
+		}
+		if (page._downloadCapture && willNavigate && !blocked) {
+			page._downloadNavigations[url] = true;
+		}
+		emit(page, 'navigationRequested', {url: url, type: type, willNavigate: willNavigate && !blocked, main: main, blocked: blocked});
+	});
+	listen(page, 'onResourceRequested', function(requestData, networkRequest) {
+		page._inflight[requestData.id] = true;
+		page._lastNetworkActivity = Date.now();
+		requestData.xhr = isXHR(requestData);
+		if (requestData.xhr) {
+			page._xhrIDs[requestData.id] = true;
+		}
+		if (page._locale) {
+			networkRequest.setHeader('Accept-Language', page._locale);
+		}
+		intercept(page, requestData, networkRequest);
+		tagCapture(page, requestData, networkRequest);
+		tagThrottle(page, requestData, networkRequest);
+		trackDownload(page, requestData);
+		recordRequest(page._network, requestData);
+		if (requestData.xhr || !page._xhrOnly) {
+			emit(page, 'resourceRequested', requestData);
+		}
+	});
+	listen(page, 'onResourceReceived', function(response) {
+		response.xhr = !!page._xhrIDs[response.id];
+		if (response.stage === 'start') {
+			detectDownload(page, response);
+		} else if (response.stage === 'end') {
+			delete page._xhrIDs[response.id];
+			delete page._inflight[response.id];
+			delete page._downloadRequests[response.id];
+		}
+		page._lastNetworkActivity = Date.now();
+		recordResponse(page._network, response);
+		if (response.xhr || !page._xhrOnly) {
+			emit(page, 'resourceReceived', response);
+		}
+	});
+	listen(page, 'onResourceError', function(resourceError) {
+		var err = {
+			id: resourceError.id,
+			url: resourceError.url,
+			time: new Date(),
+			errorCode: resourceError.errorCode,
+			errorString: resourceError.errorString,
+			status: resourceError.status,
+			statusText: resourceError.statusText,
+			xhr: !!page._xhrIDs[resourceError.id]
+		};
+		delete page._xhrIDs[resourceError.id];
+		delete page._inflight[resourceError.id];
+		delete page._downloadRequests[resourceError.id];
+		page._lastNetworkActivity = Date.now();
+		if (page._openErrors) {
+			page._openErrors.push(err);
+		}
+		recordError(page._network, err);
+		if (err.xhr || !page._xhrOnly) {
+			emit(page, 'resourceError', err);
+		}
+	});
+	listen(page, 'onResourceTimeout', function(request) {
+		var err = {
+			id: request.id,
+			url: request.url,
+			time: new Date(),
+			errorCode: request.errorCode,
+			errorString: request.errorString,
+			xhr: !!page._xhrIDs[request.id]
+		};
+		delete page._xhrIDs[request.id];
+		delete page._inflight[request.id];
+		delete page._downloadRequests[request.id];
+		page._lastNetworkActivity = Date.now();
+		recordError(page._network, err);
+		if (err.xhr || !page._xhrOnly) {
+			emit(page, 'resourceTimeout', err);
+		}
+	});
+	listen(page, 'onConfirm', function(message) {
+		var id = findRef(page);
+		if (callbackURL && page._confirmHandler && id !== null) {
+			var resp = callClient('/confirm', {ref: id, message: message});
+			if (resp.handled) {
+				return resp.value;
+			}
+		}
+		return page._confirmDefault;
+	});
+	listen(page, 'onPrompt', function(message, defaultValue) {
+		var id = findRef(page);
+		if (callbackURL && page._promptHandler && id !== null) {
+			var resp = callClient('/prompt', {ref: id, message: message, defaultValue: defaultValue || ''});
+			if (resp.handled) {
+				return resp.value;
+			}
+		}
+		return page._promptDefault || defaultValue;
+	});
+	listen(page, 'onPageCreated', function(newPage) {
+		initPage(newPage);
+		newPage._owner = page;
+		emit(page, 'pageCreated', {ref: createRef(newPage)});
+	});
+	listen(page, 'onClosing', function() {
+		// Notify the page and its owner and then release the page.
+		var data = {ref: createRef(page)};
+		emit(page, 'closing', data);
+		if (page._owner) {
+			emit(page._owner, 'closing', data);
+		}
+		closeEvents(page);
+		deleteRef(page);
+	});
+
+	return page;
+}
+
+// Adds fn as a listener to the page callback with the given name
+// (e.g. "onLoadFinished"). Multiple listeners can be attached to the same
+// callback. The value returned by the last listener is returned to PhantomJS.
+//
+// Returns a function that removes the listener.
+function listen(page, name, fn) {
+	if (!page._listeners) {
+		page._listeners = {};
 	}
-	response.closeGracefully();
+
+	var listeners = page._listeners[name];
+	if (!listeners) {
+		listeners = page._listeners[name] = [];
+		page[name] = function() {
+			var args = arguments, returnValue;
+			listeners.slice().forEach(function(listener) {
+				returnValue = listener.apply(null, args);
+			});
+			return returnValue;
+		};
+	}
+
+	listeners.push(fn);
+	return function() {
+		var i = listeners.indexOf(fn);
+		if (i !== -1) {
+			listeners.splice(i, 1);
+		}
+	};
 }
 
-function handleWebpageGoBack(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.goBack();
-	response.write(JSON.stringify({}));
+
+/*
+ * NETWORK
+ */
+
+// Maximum number of requests retained per page for HAR export.
+var maxNetworkEntries = 1000;
+
+function newNetworkLog() {
+	return {started: new Date(), loaded: null, entries: [], byID: {}};
+}
+
+// Records a request. The oldest entries are dropped past maxNetworkEntries.
+function recordRequest(log, requestData) {
+	var entry = {request: requestData, start: null, end: null, error: null};
+	log.entries.push(entry);
+	log.byID[requestData.id] = entry;
+	if (log.entries.length > maxNetworkEntries) {
+		delete log.byID[log.entries.shift().request.id];
+	}
+}
+
+function recordResponse(log, response) {
+	var entry = log.byID[response.id];
+	if (entry) {
+		entry[response.stage === 'start' ? 'start' : 'end'] = response;
+	}
+}
+
+function recordError(log, err) {
+	var entry = log.byID[err.id];
+	if (entry) {
+		entry.error = err;
+	}
+}
+
+function handleWebpageHAR(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	var log = page._network;
+	var v = phantom.version;
+	response.write(JSON.stringify({
+		version: [v.major, v.minor, v.patch].join('.'),
+		url: page.url,
+		title: page.title,
+		started: log.started,
+		loaded: log.loaded,
+		entries: log.entries
+	}));
 	response.closeGracefully();
 }
 
-function handleWebpageGoForward(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.goForward();
-	response.write(JSON.stringify({}));
+
+/*
+ * EVENTS
+ */
+
+// Maximum number of events buffered per page.
+var eventBufferSize = 1000;
+
+// Appends an event to the page's event buffer and notifies waiting pollers.
+// The oldest events are evicted once the buffer is full.
+function emit(page, type, data) {
+	var events = page._events;
+	var e = {seq: ++events.seq, type: type, time: Date.now(), data: data};
+	events.buffer.push(e);
+	if (events.buffer.length > eventBufferSize) {
+		events.buffer.shift();
+	}
+
+	// Push to the client if it has subscribed to the page.
+	pushEvent(page, {event: e});
+
+	var waiters = events.waiters;
+	events.waiters = [];
+	waiters.forEach(function(waiter) { waiter(); });
+}
+
+// Sends an event to the client's callback server if the page is referenced
+// and the client has subscribed to it. Events are sent asynchronously, one
+// at a time so they arrive in order, and failures are ignored so a slow or
+// missing client cannot block the page.
+function pushEvent(page, body) {
+	var id = findRef(page);
+	if (!callbackURL || id === null || !page._subscribers) {
+		return;
+	}
+	body.ref = id;
+	pendingPushes.push(body);
+	if (pendingPushes.length > eventBufferSize) {
+		pendingPushes.shift();
+	}
+	if (!pushing) {
+		sendNextPush();
+	}
+}
+
+// Events waiting to be pushed and whether a push is in progress.
+var pendingPushes = [];
+var pushing = false;
+
+function sendNextPush() {
+	var body = pendingPushes.shift();
+	pushing = !!body;
+	if (!body) {
+		return;
+	}
+
+	try {
+		var xhr = new XMLHttpRequest();
+		xhr.open('POST', callbackURL + '/event', true);
+		xhr.setRequestHeader('Content-Type', 'application/json');
+		xhr.onreadystatechange = function() {
+			if (xhr.readyState === 4) {
+				sendNextPush();
+			}
+		};
+		xhr.send(JSON.stringify(body));
+	} catch (e) {
+		setTimeout(sendNextPush, 0);
+	}
+}
+
+// Calls callback with all events after the since sequence number. If there
+// are no events then it waits until an event occurs or timeout elapses.
+function waitEvents(page, since, timeout, callback) {
+	var events = page._events;
+
+	function flush() {
+		var a = events.buffer.filter(function(e) { return e.seq > since; });
+		callback(a, events.closed);
+	}
+
+	if (events.closed || events.buffer.length > 0 && events.buffer[events.buffer.length - 1].seq > since) {
+		return flush();
+	}
+
+	var timer;
+	var waiter = function() {
+		clearTimeout(timer);
+		flush();
+	};
+	events.waiters.push(waiter);
+	timer = setTimeout(function() {
+		var i = events.waiters.indexOf(waiter);
+		if (i !== -1) {
+			events.waiters.splice(i, 1);
+		}
+		flush();
+	}, timeout);
+}
+
+// Marks the page's events as closed and releases any waiting pollers.
+function closeEvents(page) {
+	var events = page._events;
+	if (!events) {
+		return;
+	}
+	events.closed = true;
+	pushEvent(page, {closed: true});
+
+	var waiters = events.waiters;
+	events.waiters = [];
+	waiters.forEach(function(waiter) { waiter(); });
+}
+
+// Event source for errors raised outside of a page, such as in callbacks
+// run by the shim after a request has been answered.
+var processEvents = {_events: {seq: 0, buffer: [], waiters: [], closed: false}};
+
+// Reports uncaught errors to the client instead of only logging them. Page
+// errors are handled by each page's onError and do not reach here.
+phantom.onError = function(message, trace) {
+	var lines = ['shim error: ' + message];
+	(trace || []).forEach(function(t) {
+		lines.push('    ' + (t.file || '') + ':' + t.line + (t.function ? ' in ' + t.function : ''));
+	});
+	system.stderr.writeLine(lines.join('\n'));
+	emit(processEvents, 'error', {message: message, trace: trace});
+};
+
+// Sends a synchronous request to the client's callback server and returns
+// the decoded response. Only used by dialogs, which must be answered before
+// the page continues.
+function callClient(path, body) {
+	var xhr = new XMLHttpRequest();
+	xhr.open('POST', callbackURL + path, false);
+	xhr.setRequestHeader('Content-Type', 'application/json');
+	xhr.send(JSON.stringify(body));
+	return JSON.parse(xhr.responseText);
+}
+
+
+/*
+ * INTERCEPTION
+ */
+
+// Applies the first intercept rule matching the request, if any. Requests
+// from offline pages are aborted.
+function intercept(page, requestData, networkRequest) {
+	// Offline pages fail every network request.
+	if (page._offline && !/^(data|about):/.test(requestData.url)) {
+		networkRequest.abort();
+		return {abort: true};
+	}
+
+	var rules = page._interceptRules;
+	for (var i = 0; i < rules.length; i++) {
+		var rule = rules[i];
+		if (!matchInterceptRule(rule, requestData)) {
+			continue;
+		}
+
+		if (rule.abort) {
+			networkRequest.abort();
+		} else if (rule.response) {
+			networkRequest.changeUrl(mockURL + '/' + findRef(page) + '/' + rule.mockID);
+		} else if (rule.redirectURL) {
+			networkRequest.changeUrl(rule.redirectURL);
+		}
+		return rule;
+	}
+	return null;
+}
+
+// Serves mock responses. Mocked requests are redirected to this server
+// rather than the API server so mocked documents cannot call the API.
+var mockServer = webserver.create();
+var mockURL = 'http://127.0.0.1:' + system.env["MOCK_PORT"];
+var mockServerListening = mockServer.listen('127.0.0.1:' + system.env["MOCK_PORT"], function(request, response) {
+	try {
+		handleMock(request, response);
+	} catch (e) {
+		response.statusCode = 500;
+		response.write(e.message);
+		response.closeGracefully();
+	}
+});
+
+// Assigns unguessable ids to rules with mock responses and stores the
+// responses on the page so they can be served.
+function registerMocks(page, rules) {
+	if (!mockServerListening && rules.some(function(rule) { return rule.response; })) {
+		throw new Error('mock server unavailable');
+	}
+	rules.forEach(function(rule) {
+		if (rule.response) {
+			rule.mockID = Math.random().toString(36).slice(2) + Math.random().toString(36).slice(2);
+			page._mocks[rule.mockID] = rule.response;
+		}
+	});
+}
+
+// Serves a mock response from its path of "/<ref>/<mock id>". Bodies are
+// sent base64 encoded by the client.
+function handleMock(request, response) {
+	var parts = request.url.split('?')[0].split('/');
+	var page = refs.hasOwnProperty(parts[1]) ? refs[parts[1]] : null;
+	var mock = page && page._mocks && page._mocks.hasOwnProperty(parts[2]) ? page._mocks[parts[2]] : null;
+	if (!mock) {
+		response.statusCode = 404;
+		response.write('mock not found');
+		response.closeGracefully();
+		return;
+	}
+
+	response.statusCode = mock.status;
+	var header = mock.header || {};
+	for (var name in header) {
+		response.setHeader(name, header[name].join(', '));
+	}
+	response.setEncoding('binary');
+	response.write(atob(mock.body || ''));
 	response.closeGracefully();
 }
 
-function handleWebpageGo(request, response) {
+// Returns true if the request matches all fields specified on the rule.
+function matchInterceptRule(rule, requestData) {
+	if (rule.expr && !new RegExp(rule.expr).test(requestData.url)) {
+		return false;
+	}
+	if (rule.method && rule.method.toUpperCase() !== requestData.method.toUpperCase()) {
+		return false;
+	}
+	if (rule.accept && requestHeader(requestData, 'Accept').indexOf(rule.accept) === -1) {
+		return false;
+	}
+	return true;
+}
+
+// Returns the value of a request header by case-insensitive name.
+// Returns a blank string if the header does not exist.
+function requestHeader(requestData, name) {
+	var headers = requestData.headers || [];
+	for (var i = 0; i < headers.length; i++) {
+		if (headers[i].name.toLowerCase() === name.toLowerCase()) {
+			return headers[i].value;
+		}
+	}
+	return '';
+}
+
+// Returns true if the request appears to be made by XMLHttpRequest or fetch().
+// PhantomJS does not expose the initiator so this is a heuristic based on the
+// headers sent by scripts and the Accept headers sent for other resources.
+// Content types which PhantomJS cannot display and are saved as downloads.
+var downloadContentTypes = /^\s*(application\/(octet-stream|zip|gzip|x-[\w.+-]+|pdf|msword|vnd\.[\w.+-]+)|audio\/|video\/)/i;
+
+// trackDownload records the headers of navigation requests while download
+// capture is enabled so downloads can be re-fetched with the same headers.
+function trackDownload(page, requestData) {
+	if (!page._downloadCapture || !page._downloadNavigations[requestData.url]) {
+		return;
+	}
+	delete page._downloadNavigations[requestData.url];
+	page._downloadRequests[requestData.id] = {method: requestData.method, headers: requestData.headers};
+}
+
+// detectDownload queues a navigation's response as a download if it is an
+// attachment or has a content type which cannot be displayed.
+function detectDownload(page, response) {
+	var req = page._downloadRequests[response.id];
+	if (!req) {
+		return;
+	}
+	delete page._downloadRequests[response.id];
+
+	var disposition = requestHeader(response, 'Content-Disposition') || '';
+	if (!/^\s*attachment/i.test(disposition) && !downloadContentTypes.test(response.contentType || '')) {
+		return;
+	}
+	page._downloads.push({
+		url: response.url,
+		method: req.method,
+		headers: req.headers,
+		responseHeaders: response.headers,
+		contentType: response.contentType,
+		time: new Date()
+	});
+}
+
+function isXHR(requestData) {
+	if (requestHeader(requestData, 'X-Requested-With')) {
+		return true;
+	}
+
+	var accept = requestHeader(requestData, 'Accept');
+	if (/text\/html|^image\/|text\/css/.test(accept)) {
+		return false;
+	} else if (/json|xml|text\/plain|text\/event-stream/.test(accept)) {
+		return true;
+	}
+
+	// Scripts and other static assets are also requested with "*/*".
+	return !/\.(js|css|png|jpe?g|gif|webp|svg|ico|bmp|woff2?|ttf|otf|eot|mp4|webm|ogg|mp3|wav)([?#].*)?$/i.test(requestData.url);
+}
+
+// Tags requests matching the page's capture patterns so the client's
+// capture proxy records their response bodies.
+function tagCapture(page, requestData, networkRequest) {
+	var id = findRef(page);
+	if (id === null) {
+		return;
+	}
+
+	var matched = page._capturePatterns.some(function(expr) {
+		return new RegExp(expr).test(requestData.url);
+	});
+	if (matched && (requestData.xhr || !page._xhrOnly)) {
+		networkRequest.setHeader('X-Phantomjs-Capture', id + ':' + requestData.id);
+	}
+}
+
+// Tags requests from pages with network conditions so the client's proxy
+// can throttle them. HTTPS requests are tunneled so their headers cannot be
+// read by the proxy; instead the page is recorded as the owner of the host
+// for the proxy to look up when the tunnel is opened.
+function tagThrottle(page, requestData, networkRequest) {
+	var id = findRef(page);
+	if (id === null || !page._throttled) {
+		return;
+	}
+	networkRequest.setHeader('X-Phantomjs-Page', id);
+
+	var m = /^https:\/\/(?:[^\/?#@]*@)?([^\/?#]+)/i.exec(requestData.url);
+	if (m) {
+		var host = m[1].toLowerCase();
+		tunnelOwners[/:\d+$/.test(host) ? host : host + ':443'] = id;
+	}
+}
+
+// Maps "host:port" to the ref of the throttled page which last requested it.
+var tunnelOwners = {};
+
+function handleProcessTunnelOwner(request, response) {
 	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.go(msg.index);
-	response.write(JSON.stringify({}));
+	var id = tunnelOwners[String(msg.host).toLowerCase()];
+	var page = id ? refs[id] : null;
+	response.write(JSON.stringify({value: page && page._throttled ? id : ''}));
 	response.closeGracefully();
 }
 
-function handleWebpageIncludeJS(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.includeJs(msg.url, function() {
-		response.write(JSON.stringify({}));
-		response.closeGracefully();
-	});
+
+/*
+ * WAITING
+ */
+
+// Calls fn every interval milliseconds until it returns a truthy value or
+// until timeout milliseconds have elapsed. The callback is passed an error
+// if fn throws or if the timeout elapses.
+function poll(fn, timeout, interval, callback) {
+	var deadline = Date.now() + timeout;
+	var timer = null;
+	var done = false;
+	function finish(err) {
+		done = true;
+		callback(err);
+	}
+
+	(function check() {
+		var value;
+		try {
+			value = fn();
+		} catch(e) {
+			return finish(e);
+		}
+
+		if (value) {
+			return finish(null);
+		} else if (Date.now() >= deadline) {
+			return finish(new TimeoutError());
+		}
+		timer = setTimeout(check, interval);
+	})();
+
+	// Returns a function which stops polling and reports a CancelError.
+	return function() {
+		if (!done) {
+			clearTimeout(timer);
+			finish(new CancelError());
+		}
+	};
 }
 
-function handleWebpageInjectJS(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	var returnValue = page.injectJs(msg.filename);
-	response.write(JSON.stringify({returnValue: returnValue}));
-	response.closeGracefully();
+// Represents a wait that did not complete in time.
+function TimeoutError() {
+	this.message = "timeout";
 }
 
-function handleWebpageReload(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.reload();
+// Writes the result of a wait operation to the response.
+function writeWaitResult(response, err) {
+	if (err) {
+		return writeError(response, err);
+	}
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
-function handleWebpageRenderBase64(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	var returnValue = page.renderBase64(msg.format);
-	response.write(JSON.stringify({returnValue: returnValue}));
+// Writes an error from an asynchronous operation to the response.
+// Timeouts are reported separately so they can be distinguished by the client.
+function writeError(response, err) {
+	if (err instanceof TimeoutError) {
+		response.write(JSON.stringify({timeout: true}));
+	} else {
+		response.statusCode = 500;
+		response.write(JSON.stringify({error: err.message}));
+	}
 	response.closeGracefully();
 }
 
-function handleWebpageRender(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.render(msg.filename, {format: msg.format, quality: msg.quality});
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+
+/*
+ * RENDERING
+ */
+
+// Applies render options to the page, calls render(), and then restores the
+// page to its original state. The callback is passed any error, the value
+// returned by render(), and the rects of the elements matching each of the
+// annotation selectors, measured in the layout which was rendered.
+function renderWithOptions(page, options, render, callback) {
+	var zoomFactor = page.zoomFactor;
+	var viewportSize = page.viewportSize;
+	var clipRect = page.clipRect;
+
+	// Restores the original page state.
+	function restore() {
+		page.evaluate(function() {
+			var style = document.getElementById('__phantomjs_hide_selectors');
+			if (style !== null) {
+				style.parentNode.removeChild(style);
+			}
+		});
+		page.zoomFactor = zoomFactor;
+		page.viewportSize = viewportSize;
+		page.clipRect = clipRect;
+	}
+
+	try {
+		// Hide elements by injecting a stylesheet.
+		if (options.hideSelectors && options.hideSelectors.length > 0) {
+			page.evaluate(function(selectors) {
+				var style = document.createElement('style');
+				style.id = '__phantomjs_hide_selectors';
+				style.textContent = selectors.join(', ') + ' { display: none !important; }';
+				(document.head || document.documentElement).appendChild(style);
+			}, options.hideSelectors);
+		}
+
+		// Emulate device pixel ratio by zooming and scaling the viewport and
+		// clipping rectangle proportionally so the layout does not change.
+		var scale = options.scale;
+		if (scale !== 1) {
+			page.zoomFactor = zoomFactor * scale;
+			page.viewportSize = {
+				width: Math.round(viewportSize.width * scale),
+				height: Math.round(viewportSize.height * scale)
+			};
+			if (clipRect.width > 0 && clipRect.height > 0) {
+				page.clipRect = {
+					top: clipRect.top * scale,
+					left: clipRect.left * scale,
+					width: clipRect.width * scale,
+					height: clipRect.height * scale
+				};
+			}
+		}
+	} catch(e) {
+		restore();
+		return callback(e);
+	}
+
+	// Render once the page is ready.
+	function ready(err) {
+		if (err) {
+			restore();
+			return callback(err);
+		}
+
+		var value, annotations = null;
+		try {
+			if (options.annotations) {
+				annotations = options.annotations.map(function(selector) {
+					return annotationRects(page, selector, options.scale);
+				});
+			}
+			value = render();
+		} catch(e) {
+			restore();
+			return callback(e);
+		}
+		restore();
+		callback(null, value, annotations);
+	}
+
+	if (options.waitForAssets) {
+		poll(function() { return page.evaluate(assetsLoaded); }, options.assetTimeout, 50, ready);
+	} else {
+		ready(null);
+	}
 }
 
-function handleWebpageSendMouseEvent(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.sendEvent(msg.eventType, msg.mouseX, msg.mouseY, msg.button);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// Returns the rects of the visible elements matching selector at the page's
+// zoom before it was scaled for rendering.
+function annotationRects(page, selector, scale) {
+	return elementRects(page, selector).filter(function(rect) {
+		return rect.width > 0 || rect.height > 0;
+	}).map(function(rect) {
+		return {top: rect.top / scale, left: rect.left / scale, width: rect.width / scale, height: rect.height / scale};
+	});
 }
 
-function handleWebpageSendKeyboardEvent(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.sendEvent(msg.eventType, msg.key, null, null, msg.modifier);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// Returns true if all images and web fonts in the document have finished loading.
+// This function is evaluated within the page.
+function assetsLoaded() {
+	var images = document.images;
+	for (var i = 0; i < images.length; i++) {
+		if (!images[i].complete) {
+			return false;
+		}
+	}
+
+	if (document.readyState !== 'complete') {
+		return false;
+	} else if (document.fonts) {
+		return document.fonts.status === 'loaded';
+	}
+
+	// PhantomJS has no font loading API so fall back to measuring text in
+	// each @font-face family. A family is loaded once its text no longer
+	// measures the same as the fallback fonts and its width is unchanged
+	// since the last poll. Families which still match the fallback after a
+	// second are assumed to have failed to load.
+	var families = {};
+	var sheets = document.styleSheets;
+	for (var i = 0; i < sheets.length; i++) {
+		var rules;
+		try {
+			rules = sheets[i].cssRules;
+		} catch (e) {
+			continue; // cross-origin stylesheet
+		}
+		for (var j = 0; rules && j < rules.length; j++) {
+			if (rules[j].type === 5) { // CSSRule.FONT_FACE_RULE
+				var family = rules[j].style.getPropertyValue('font-family').replace(/^\s*['"]?|['"]?\s*$/g, '');
+				if (family) {
+					families[family] = true;
+				}
+			}
+		}
+	}
+
+	if (!document.body) {
+		return true;
+	}
+	var span = document.createElement('span');
+	span.textContent = 'BESbswy 0123456789';
+	span.style.cssText = 'position:absolute;left:-9999px;top:-9999px;font-size:72px;white-space:nowrap;visibility:hidden';
+	document.body.appendChild(span);
+	function measure(font) {
+		span.style.fontFamily = font;
+		return span.offsetWidth;
+	}
+
+	var state = window.__phantomjsFontWidths = window.__phantomjsFontWidths || {};
+	var fallbacks = ['monospace', 'serif'];
+	var widths = fallbacks.map(measure);
+	var now = Date.now();
+	var loaded = true;
+	for (var name in families) {
+		var quoted = '"' + name.replace(/"/g, '\\"') + '"';
+		var current = fallbacks.map(function(fallback) { return measure(quoted + ',' + fallback); });
+		var key = current.join(',');
+		var prev = state[name];
+		state[name] = {key: key, since: prev && prev.key === key ? prev.since : now};
+
+		var fallback = current[0] === widths[0] && current[1] === widths[1];
+		if (!prev || prev.key !== key || (fallback && now - state[name].since < 1000)) {
+			loaded = false;
+		}
+	}
+	document.body.removeChild(span);
+	return loaded;
 }
 
-function handleWebpageSetContentAndURL(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.setContent(msg.content, msg.url);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// Overrides the locale reported to scripts and used by default for formatting.
+// Runs in the page.
+function emulateLocale(locale) {
+	function define(obj, name, value) {
+		try {
+			Object.defineProperty(obj, name, {get: function() { return value; }, configurable: true});
+		} catch (e) {}
+	}
+	define(navigator, 'language', locale);
+	define(navigator, 'languages', [locale]);
+	define(navigator, 'userLanguage', locale);
+	define(navigator, 'browserLanguage', locale);
+
+	// Default the locale of formatting methods, keeping the originals so that
+	// repeated calls do not wrap them again. The originals are looked up when
+	// called as emulateTimezone() replaces them with zoned formatters.
+	var natives = window.__phantomjsLocaleNatives = window.__phantomjsLocaleNatives || {
+		dateString: Date.prototype.toLocaleString,
+		date: Date.prototype.toLocaleDateString,
+		time: Date.prototype.toLocaleTimeString,
+		number: Number.prototype.toLocaleString,
+		DateTimeFormat: window.Intl && Intl.DateTimeFormat,
+		NumberFormat: window.Intl && Intl.NumberFormat
+	};
+	function wrap(name) {
+		return function(locales, options) { return natives[name].call(this, locales || locale, options); };
+	}
+	Date.prototype.toLocaleString = wrap('dateString');
+	Date.prototype.toLocaleDateString = wrap('date');
+	Date.prototype.toLocaleTimeString = wrap('time');
+	Number.prototype.toLocaleString = wrap('number');
+
+	function wrapFormat(name) {
+		var fn = function(locales, options) { return new natives[name](locales || locale, options); };
+		fn.prototype = natives[name].prototype;
+		fn.supportedLocalesOf = natives[name].supportedLocalesOf;
+		return fn;
+	}
+	if (natives.DateTimeFormat) {
+		Intl.DateTimeFormat = wrapFormat('DateTimeFormat');
+		Intl.NumberFormat = wrapFormat('NumberFormat');
+	}
 }
 
-function handleWebpageStop(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.stop();
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// Overrides navigator.onLine and fires the "online" or "offline" event on
+// the window when it changes. Runs in the page.
+function emulateOffline(offline) {
+	var online = !offline;
+	if (navigator.onLine === online) {
+		return;
+	}
+	try {
+		Object.defineProperty(navigator, 'onLine', {get: function() { return online; }, configurable: true});
+	} catch (e) {}
+
+	var event = document.createEvent('Event');
+	event.initEvent(online ? 'online' : 'offline', false, false);
+	window.dispatchEvent(event);
 }
 
-function handleWebpageSwitchToFocusedFrame(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.switchToFocusedFrame();
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// Overrides the local time methods of Date to use a fixed offset, in minutes
+// east of UTC. Runs in the page.
+function emulateTimezone(offset) {
+	var NativeDate = window.__phantomjsNativeDate = window.__phantomjsNativeDate || Date;
+	var proto = NativeDate.prototype;
+	var ms = offset * 60000;
+
+	// Returns a date whose UTC fields are the fields of d in the zone.
+	function shifted(d) {
+		return new NativeDate(d.getTime() + ms);
+	}
+
+	var nativeOffset = (window.__phantomjsTimezoneNatives || proto).getTimezoneOffset;
+	proto.getTimezoneOffset = function() { return -offset; };
+	['FullYear', 'Month', 'Date', 'Day', 'Hours', 'Minutes', 'Seconds', 'Milliseconds'].forEach(function(name) {
+		var getUTC = proto['getUTC' + name], setUTC = proto['setUTC' + name];
+		proto['get' + name] = function() { return getUTC.call(shifted(this)); };
+		if (setUTC) {
+			proto['set' + name] = function() {
+				var d = shifted(this);
+				setUTC.apply(d, arguments);
+				return this.setTime(d.getTime() - ms);
+			};
+		}
+	});
+
+	// Format dates in the zone, such as "Wed Jan 01 2020 10:00:00 GMT+0100".
+	function pad(n) { return (n < 10 ? '0' : '') + n; }
+	var days = ['Sun', 'Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat'];
+	var months = ['Jan', 'Feb', 'Mar', 'Apr', 'May', 'Jun', 'Jul', 'Aug', 'Sep', 'Oct', 'Nov', 'Dec'];
+	var zone = 'GMT' + (offset < 0 ? '-' : '+') + pad(Math.floor(Math.abs(offset) / 60)) + pad(Math.abs(offset) % 60);
+	proto.toDateString = function() {
+		return days[this.getDay()] + ' ' + months[this.getMonth()] + ' ' + pad(this.getDate()) + ' ' + this.getFullYear();
+	};
+	proto.toTimeString = function() {
+		return pad(this.getHours()) + ':' + pad(this.getMinutes()) + ':' + pad(this.getSeconds()) + ' ' + zone;
+	};
+	proto.toString = function() {
+		return this.toDateString() + ' ' + this.toTimeString();
+	};
+
+	// Parse strings without an explicit zone as times in the zone. Date-only
+	// ISO strings are UTC, as in the native parser.
+	var explicitZone = /(Z|[+-]\d\d:?\d\d|\b(GMT|UTC|UT|[ECMP][SD]T))\s*(\(.*\))?\s*$/i;
+	function parse(str) {
+		str = String(str);
+		if (explicitZone.test(str) || /^[+-]?\d{4,6}(-\d\d(-\d\d)?)?$/.test(str)) {
+			return NativeDate.parse(str);
+		}
+		var utc = NativeDate.parse(/^\d{4}-\d\d-\d\dT/.test(str) ? str + 'Z' : str + ' GMT');
+		return isNaN(utc) ? NativeDate.parse(str) : utc - ms;
+	}
+
+	// Interpret local date components passed to the constructor in the zone.
+	var FakeDate = function(y, m, d, h, min, s, msec) {
+		if (!(this instanceof FakeDate)) {
+			return new NativeDate().toString();
+		} else if (arguments.length === 0) {
+			return new NativeDate();
+		} else if (arguments.length === 1) {
+			return new NativeDate(typeof y === 'string' ? parse(y) : y);
+		}
+		return new NativeDate(NativeDate.UTC(y, m, d === undefined ? 1 : d, h || 0, min || 0, s || 0, msec || 0) - ms);
+	};
+	FakeDate.prototype = proto;
+	FakeDate.now = NativeDate.now;
+	FakeDate.UTC = NativeDate.UTC;
+	FakeDate.parse = parse;
+	window.Date = FakeDate;
+
+	// Format locale strings in the zone, keeping the original formatters so
+	// that repeated calls do not wrap them again. If emulateLocale() has run
+	// then its originals are the native formatters and its wrappers call the
+	// zoned formatters in their place.
+	var localeNatives = window.__phantomjsLocaleNatives;
+	var source = localeNatives || {
+		dateString: proto.toLocaleString,
+		date: proto.toLocaleDateString,
+		time: proto.toLocaleTimeString,
+		DateTimeFormat: window.Intl && Intl.DateTimeFormat
+	};
+	var natives = window.__phantomjsTimezoneNatives = window.__phantomjsTimezoneNatives || {
+		dateString: source.dateString,
+		date: source.date,
+		time: source.time,
+		DateTimeFormat: source.DateTimeFormat,
+		getTimezoneOffset: nativeOffset
+	};
+
+	// Intl can format in whole hour offsets through the "Etc/GMT" zones,
+	// whose signs are inverted. Otherwise, dates are shifted so that the
+	// host's local time matches the zone.
+	var zoneName = null;
+	if (natives.DateTimeFormat && offset % 60 === 0 && offset >= -720 && offset <= 840) {
+		zoneName = offset === 0 ? 'UTC' : 'Etc/GMT' + (offset > 0 ? '-' : '+') + Math.abs(offset / 60);
+	}
+	function withZone(options) {
+		var other = {};
+		for (var key in options || {}) {
+			other[key] = options[key];
+		}
+		other.timeZone = other.timeZone || zoneName;
+		return other;
+	}
+	function local(d) {
+		var t = d.getTime() + ms;
+		return new NativeDate(t + natives.getTimezoneOffset.call(new NativeDate(t)) * 60000);
+	}
+	function zoned(name) {
+		return function(locales, options) {
+			if (zoneName) {
+				return natives[name].call(this, locales, withZone(options));
+			} else if (options && options.timeZone) {
+				return natives[name].call(this, locales, options);
+			}
+			return natives[name].call(local(this), locales, options);
+		};
+	}
+	var target = localeNatives || {};
+	target.dateString = zoned('dateString');
+	target.date = zoned('date');
+	target.time = zoned('time');
+	if (!localeNatives) {
+		proto.toLocaleString = target.dateString;
+		proto.toLocaleDateString = target.date;
+		proto.toLocaleTimeString = target.time;
+	}
+
+	if (natives.DateTimeFormat) {
+		var Format = function(locales, options) {
+			return new natives.DateTimeFormat(locales, zoneName ? withZone(options) : options);
+		};
+		Format.prototype = natives.DateTimeFormat.prototype;
+		Format.supportedLocalesOf = natives.DateTimeFormat.supportedLocalesOf;
+		if (localeNatives) {
+			localeNatives.DateTimeFormat = Format;
+		} else {
+			Intl.DateTimeFormat = Format;
+		}
+	}
 }
 
-function handleWebpageSwitchToFrameName(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.switchToFrame(msg.name);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// Emulates a CSS media type by rewriting the media lists of stylesheets and
+// @media rules. Emulating "screen" restores the original media lists.
+// This function is evaluated within the page.
+function emulateMediaType(mediaType) {
+	// Restore media lists modified by a previous call.
+	var modified = window.__phantomjsMediaLists || [];
+	for (var i = 0; i < modified.length; i++) {
+		modified[i].list.mediaText = modified[i].text;
+	}
+	modified = window.__phantomjsMediaLists = [];
+	if (mediaType !== 'print') {
+		return;
+	}
+
+	// Enable print media and disable screen media.
+	function rewrite(list) {
+		var text = list ? list.mediaText : '';
+		var print = /\bprint\b/.test(text), screen = /\bscreen\b/.test(text);
+		if (print || screen) {
+			modified.push({list: list, text: text});
+			list.mediaText = print ? 'all' : 'not all';
+		}
+	}
+
+	for (var i = 0; i < document.styleSheets.length; i++) {
+		var sheet = document.styleSheets[i];
+		rewrite(sheet.media);
+		try {
+			for (var j = 0; j < sheet.cssRules.length; j++) {
+				rewrite(sheet.cssRules[j].media);
+			}
+		} catch(e) {
+			// Rules of cross-origin stylesheets cannot be read.
+		}
+	}
 }
 
-function handleWebpageSwitchToFramePosition(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.switchToFrame(msg.position);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+
+/*
+ * ELEMENTS
+ */
+
+// Returns the document-relative rectangle of the first element matching
+// selector, scaled by the page's zoom factor. Returns null if not found.
+function elementRect(page, selector) {
+	var rect = page.evaluate(function(selector) {
+		var el = document.querySelector(selector);
+		if (el === null) {
+			return null;
+		}
+		var r = el.getBoundingClientRect();
+		return {
+			top: r.top + window.pageYOffset,
+			left: r.left + window.pageXOffset,
+			width: r.width,
+			height: r.height
+		};
+	}, selector);
+	if (rect === null) {
+		return null;
+	}
+
+	var zoom = page.zoomFactor;
+	return {
+		top: rect.top * zoom,
+		left: rect.left * zoom,
+		width: rect.width * zoom,
+		height: rect.height * zoom
+	};
+}
+
+function elementRects(page, selector) {
+	var rects = page.evaluate(function(selector) {
+		var a = [];
+		var els = document.querySelectorAll(selector);
+		for (var i = 0; i < els.length; i++) {
+			var r = els[i].getBoundingClientRect();
+			a.push({
+				top: r.top + window.pageYOffset,
+				left: r.left + window.pageXOffset,
+				width: r.width,
+				height: r.height
+			});
+		}
+		return a;
+	}, selector);
+
+	var zoom = page.zoomFactor;
+	return rects.map(function(rect) {
+		return {
+			top: rect.top * zoom,
+			left: rect.left * zoom,
+			width: rect.width * zoom,
+			height: rect.height * zoom
+		};
+	});
 }
 
-function handleWebpageSwitchToMainFrame(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.switchToMainFrame();
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// extractTable returns the text of each cell of a table, evaluated within
+// the page. Cells spanning multiple rows or columns are repeated in each.
+function extractTable(selector) {
+	var table = document.querySelector(selector);
+	if (table === null || !table.rows) {
+		return null;
+	}
+
+	var grid = [];
+	for (var i = 0; i < table.rows.length; i++) {
+		grid[i] = grid[i] || [];
+		var col = 0, cells = table.rows[i].cells;
+		for (var j = 0; j < cells.length; j++) {
+			while (grid[i][col] !== undefined) {
+				col++;
+			}
+			var text = (cells[j].innerText || cells[j].textContent || '').replace(/\s+/g, ' ').trim();
+			var rowSpan = Math.max(cells[j].rowSpan || 1, 1), colSpan = Math.max(cells[j].colSpan || 1, 1);
+			for (var r = i; r < Math.min(i + rowSpan, table.rows.length); r++) {
+				grid[r] = grid[r] || [];
+				for (var c = col; c < col + colSpan; c++) {
+					grid[r][c] = text;
+				}
+			}
+			col += colSpan;
+		}
+	}
+
+	// Fill gaps left by rows with fewer cells.
+	return grid.map(function(row) {
+		var a = [];
+		for (var c = 0; c < row.length; c++) {
+			a.push(row[c] === undefined ? '' : row[c]);
+		}
+		return a;
+	});
 }
 
-function handleWebpageSwitchToParentFrame(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.switchToParentFrame();
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// extractLinks returns the links in the page, evaluated within the page.
+// The href property is used as it is resolved against the document's base URL.
+function extractLinks() {
+	var a = [], links = document.querySelectorAll('a[href], area[href]');
+	for (var i = 0; i < links.length; i++) {
+		var link = links[i];
+		if (!link.href || /^javascript:/i.test(link.href)) {
+			continue;
+		}
+		a.push({
+			url: link.href,
+			text: (link.innerText || link.textContent || link.alt || '').replace(/\s+/g, ' ').trim(),
+			title: link.title || '',
+			rel: link.rel || ''
+		});
+	}
+	return a;
 }
 
-function handleWebpageUploadFile(request, response) {
-	var msg = JSON.parse(request.post);
-	var page = ref(msg.ref);
-	page.uploadFile(msg.selector, msg.filename);
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+// extractImages returns the images in the page, evaluated within the page.
+function extractImages() {
+	var a = [], images = document.images;
+	for (var i = 0; i < images.length; i++) {
+		var img = images[i];
+		if (!img.src) {
+			continue;
+		}
+		a.push({
+			url: img.src,
+			alt: img.alt || '',
+			title: img.title || '',
+			width: img.naturalWidth || 0,
+			height: img.naturalHeight || 0
+		});
+	}
+	return a;
 }
 
+// extractMetadata returns the page's title, description, canonical URL, and
+// OpenGraph and Twitter card fields, evaluated within the page.
+function extractMetadata() {
+	function meta(attr, name) {
+		var tags = document.getElementsByTagName('meta');
+		for (var i = 0; i < tags.length; i++) {
+			if ((tags[i].getAttribute(attr) || '').toLowerCase() === name) {
+				return (tags[i].getAttribute('content') || '').trim();
+			}
+		}
+		return '';
+	}
+	function resolve(url) {
+		if (!url) {
+			return '';
+		}
+		var a = document.createElement('a');
+		a.href = url;
+		return a.href;
+	}
+
+	// Twitter cards are commonly published with "property" instead of "name".
+	function twitter(name) {
+		return meta('name', 'twitter:' + name) || meta('property', 'twitter:' + name);
+	}
 
-function handleNotFound(request, response) {
-	response.statusCode = 404;
-	response.write(JSON.stringify({error:"not found"}));
-	response.closeGracefully();
+	var canonical = document.querySelector('link[rel~="canonical"]');
+	return {
+		title: document.title,
+		description: meta('name', 'description'),
+		canonical: canonical ? canonical.href : '',
+		openGraph: {
+			title: meta('property', 'og:title'),
+			description: meta('property', 'og:description'),
+			type: meta('property', 'og:type'),
+			url: resolve(meta('property', 'og:url')),
+			image: resolve(meta('property', 'og:image')),
+			siteName: meta('property', 'og:site_name'),
+			locale: meta('property', 'og:locale')
+		},
+		twitter: {
+			card: twitter('card'),
+			site: twitter('site'),
+			creator: twitter('creator'),
+			title: twitter('title'),
+			description: twitter('description'),
+			image: resolve(twitter('image'))
+		}
+	};
 }
 
+// serializeNodes returns the displayed element and text nodes within the
+// first element matching selector, or the body, evaluated within the page.
+// Link and image URLs are resolved so they are absolute.
+function serializeNodes(selector) {
+	var root = selector ? document.querySelector(selector) : document.body;
+	if (root === null) {
+		return null;
+	}
+
+	function walk(node) {
+		if (node.nodeType === 3) {
+			return {text: node.nodeValue};
+		} else if (node.nodeType !== 1) {
+			return null;
+		}
+
+		var tag = node.tagName.toLowerCase();
+		if (/^(script|style|noscript|template|head|iframe|object|svg|canvas)$/.test(tag)) {
+			return null;
+		}
+		var style = window.getComputedStyle(node);
+		if (style && style.display === 'none') {
+			return null;
+		}
+
+		var attrs = {};
+		if (tag === 'a' && node.getAttribute('href') !== null) {
+			attrs.href = node.href;
+		} else if (tag === 'img') {
+			attrs.src = node.src;
+			attrs.alt = node.alt || '';
+		}
+
+		var children = [];
+		for (var i = 0; i < node.childNodes.length; i++) {
+			var child = walk(node.childNodes[i]);
+			if (child !== null) {
+				children.push(child);
+			}
+		}
+		return {tag: tag, attrs: attrs, children: children};
+	}
+	return walk(root);
+}
 
 /*
  * REFS
@@ -1793,36 +6941,85 @@ function handleNotFound(request, response) {
 var refID = 0;
 var refs = {};
 
+// Time each reference was last used, by ID, for closing idle pages.
+var refTimes = {};
+
+// Time each reference was created, by ID.
+var refCreated = {};
+
 // Adds an object to the reference map and a ref object.
 function createRef(value) {
 	// Return existing reference, if one exists.
-	for (var key in refs) {
-		if (refs.hasOwnProperty(key)) {
-			if (refs[key] === value) {
-				return key
-			}
-		}
+	var id = findRef(value);
+	if (id !== null) {
+		return {id: id};
 	}
 
 	// Generate a new id for new references.
 	refID++;
 	refs[refID.toString()] = value;
+	refTimes[refID.toString()] = Date.now();
+	refCreated[refID.toString()] = Date.now();
 	return {id: refID.toString()};
 }
 
+// Returns the reference ID of an object or null if it is not referenced.
+function findRef(value) {
+	for (var key in refs) {
+		if (refs.hasOwnProperty(key) && refs[key] === value) {
+			return key;
+		}
+	}
+	return null;
+}
+
 // Removes a reference to a value, if any.
 function deleteRef(value) {
 	for (var key in refs) {
 		if (refs.hasOwnProperty(key)) {
 			if (refs[key] === value) {
-				delete(refs, key);
+				delete refs[key];
+				delete refTimes[key];
+				delete refCreated[key];
 			}
 		}
 	}
 }
 
-// Returns a reference object by ID.
+// Returns a reference object by ID and marks it as used.
+// Throws a PageClosedError if the reference does not exist.
 function ref(id) {
+	var value = peekRef(id);
+	refTimes[id] = Date.now();
+	return value;
+}
+
+// Returns a reference object by ID without marking it as used.
+function peekRef(id) {
+	if (!refs.hasOwnProperty(id)) {
+		throw new PageClosedError();
+	}
 	return refs[id];
 }
+
+// Returns the type name of a referenced object.
+function refType(value) {
+	return value && typeof value.open === "function" ? "webpage" : "object";
+}
+
+function PageClosedError() {
+	this.message = "page closed";
+}
+
+// Periodically closes pages which have not been used within the page TTL.
+if (pageTTL > 0) {
+	setInterval(function() {
+		var now = Date.now();
+		for (var id in refTimes) {
+			if (refTimes.hasOwnProperty(id) && refs.hasOwnProperty(id) && now - refTimes[id] > pageTTL) {
+				closePage(id);
+			}
+		}
+	}, Math.max(100, Math.min(pageTTL / 4, 60000)));
+}
 `
@@ -2,18 +2,39 @@ package phantomjs_test
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/png"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/mail"
+	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
 )
 
 // Ensure web page can return whether it can navigate forward.
@@ -69,6 +90,119 @@ func TestWebPage_ClipRect(t *testing.T) {
 	} else if !reflect.DeepEqual(v, rect) {
 		t.Fatalf("unexpected value: %#v", v)
 	}
+
+	// Fractional rectangles should be preserved.
+	rect = phantomjs.Rect{Top: 1.5, Left: 2.25, Width: 3.5, Height: 4.75}
+	if err := page.SetClipRect(rect); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, rect) {
+		t.Fatalf("unexpected fractional value: %#v", v)
+	}
+
+	// Integer coordinates can still be set.
+	if err := page.SetClipRectInt(5, 6, 7, 8); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if v != (phantomjs.Rect{Top: 5, Left: 6, Width: 7, Height: 8}) {
+		t.Fatalf("unexpected integer value: %#v", v)
+	}
+
+	// Clear the rectangle.
+	if err := page.ClearClipRect(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if !v.IsZero() {
+		t.Fatalf("expected empty rect: %#v", v)
+	}
+}
+
+// Ensure web page can return the bounding rectangle of an element.
+func TestWebPage_BoundingRect(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0"><div id="box" style="position:absolute;top:10px;left:20px;width:30px;height:40px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if rect, err := page.BoundingRect("#box"); err != nil {
+		t.Fatal(err)
+	} else if rect != (phantomjs.Rect{Top: 10, Left: 20, Width: 30, Height: 40}) {
+		t.Fatalf("unexpected rect: %#v", rect)
+	}
+
+	// Rectangle should be scaled by the zoom factor.
+	if err := page.SetZoomFactor(2); err != nil {
+		t.Fatal(err)
+	} else if rect, err := page.BoundingRect("#box"); err != nil {
+		t.Fatal(err)
+	} else if rect != (phantomjs.Rect{Top: 20, Left: 40, Width: 60, Height: 80}) {
+		t.Fatalf("unexpected zoomed rect: %#v", rect)
+	}
+
+	// Missing elements should return an error.
+	if _, err := page.BoundingRect("#no_such_element"); err != phantomjs.ErrElementNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web page can return the bounding rectangles of all matching elements.
+func TestWebPage_BoundingRects(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0"><div class="box" style="position:absolute;top:10px;left:20px;width:30px;height:40px"></div><div class="box" style="position:absolute;top:50px;left:60px;width:10px;height:10px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if rects, err := page.BoundingRects(".box"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rects, []phantomjs.Rect{{Top: 10, Left: 20, Width: 30, Height: 40}, {Top: 50, Left: 60, Width: 10, Height: 10}}) {
+		t.Fatalf("unexpected rects: %#v", rects)
+	}
+
+	// Missing elements should return no rects.
+	if rects, err := page.BoundingRects("#no_such_element"); err != nil {
+		t.Fatal(err)
+	} else if len(rects) != 0 {
+		t.Fatalf("unexpected rects: %#v", rects)
+	}
+}
+
+// Ensure web page can set the clipping rectangle to an element's bounds.
+func TestWebPage_SetClipRectToElement(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0"><div id="box" style="position:absolute;top:10px;left:20px;width:30px;height:40px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := page.SetClipRectToElement("#box"); err != nil {
+		t.Fatal(err)
+	} else if rect, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if rect != (phantomjs.Rect{Top: 10, Left: 20, Width: 30, Height: 40}) {
+		t.Fatalf("unexpected rect: %#v", rect)
+	}
+
+	// Missing elements should return an error.
+	if err := page.SetClipRectToElement("#no_such_element"); err != phantomjs.ErrElementNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
 }
 
 // Ensure process can set and retrieve cookies.
@@ -715,6 +849,63 @@ func TestWebPage_PaperSize(t *testing.T) {
 			t.Fatalf("unexpected size: %#v", other)
 		}
 	})
+
+	// Ensure header and footer can be set.
+	t.Run("HeaderFooter", func(t *testing.T) {
+		page := p.MustCreateWebPage()
+		defer MustClosePage(page)
+
+		sz := phantomjs.PaperSize{
+			Format: "A4",
+			Header: &phantomjs.PaperSizeSection{Height: "1cm", Contents: "<h1>TITLE</h1>"},
+			Footer: &phantomjs.PaperSizeSection{Height: "1cm", Contents: "{{pageNum}} of {{numPages}}"},
+		}
+		if err := page.SetPaperSize(sz); err != nil {
+			t.Fatal(err)
+		}
+		if other, err := page.PaperSize(); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(other, sz) {
+			t.Fatalf("unexpected size: %#v", other)
+		}
+	})
+}
+
+// Ensure headers and footers are printed on rendered PDFs.
+func TestWebPage_RenderBytes_PDFHeader(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><div style="height:2000px">-</div></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetPaperSize(phantomjs.PaperSize{Format: "A4"}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := page.RenderBytes("pdf", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := page.SetPaperSize(phantomjs.PaperSize{
+		Format: "A4",
+		Header: &phantomjs.PaperSizeSection{Height: "1cm", Contents: "<span>QXZ</span>"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := page.RenderBytes("pdf", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Glyphs depend on the installed fonts so verify the page count is
+	// unchanged and that each page has an additional text object.
+	if n := MustCountPDFPages(buf); n != 2 || n != MustCountPDFPages(plain) {
+		t.Fatalf("unexpected page count: %d", n)
+	} else if n, m := MustCountPDFTextObjects(buf), MustCountPDFTextObjects(plain); n < m+2 {
+		t.Fatalf("expected header text objects: %d <= %d", n, m)
+	}
 }
 
 // Ensure process can retrieve the plain text representation of a page.
@@ -999,6 +1190,44 @@ func TestWebPage_Evaluate(t *testing.T) {
 	}
 }
 
+// Ensure web page can run scripts before a new document's own scripts.
+func TestWebPage_EvaluateOnNewDocument(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.EvaluateOnNewDocument(`function() { window.injected = "INJECTED" }`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body><script>window.seen = window.injected</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := page.Evaluate(`function() { return window.seen }`); err != nil {
+		t.Fatal(err)
+	} else if v != "INJECTED" {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+
+	// Cleared scripts should no longer run. Other page state is kept.
+	rules := []phantomjs.InterceptRule{{Pattern: "*/blocked.js", Abort: true}}
+	if err := page.SetInterceptRules(rules); err != nil {
+		t.Fatal(err)
+	} else if err := page.ClearNewDocumentScripts(); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.InterceptRules(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, rules) {
+		t.Fatalf("unexpected rules: %#v", v)
+	} else if err := page.SetContent(`<html><body><script>window.seen = window.injected</script></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(`function() { return window.seen === undefined }`); err != nil {
+		t.Fatal(err)
+	} else if v != true {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+}
+
 // Ensure process can retrieve a page by window name.
 func TestWebPage_Page(t *testing.T) {
 	p := MustOpenNewProcess()
@@ -1323,13 +1552,11 @@ func TestWebPage_RenderBase64(t *testing.T) {
 	}
 }
 
-// Ensure web page can render to a file.
-func TestWebPage_Render(t *testing.T) {
-	// Start process.
+// Ensure web page can render to raw bytes.
+func TestWebPage_RenderBytes(t *testing.T) {
 	p := MustOpenNewProcess()
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
 	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
@@ -1339,254 +1566,4631 @@ func TestWebPage_Render(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Render page.
-	filename := filepath.Join(p.Path(), "test.png")
-	if err := page.Render(filename, "png", 100); err != nil {
+	// Render & parse image and verify dimensions.
+	if buf, err := page.RenderBytes("png", 0); err != nil {
+		t.Fatal(err)
+	} else if img, err := png.Decode(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 200 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+
+	// Render to a PDF.
+	if buf, err := page.RenderBytes("pdf", 0); err != nil {
 		t.Fatal(err)
+	} else if !bytes.HasPrefix(buf, []byte("%PDF-")) {
+		t.Fatal("expected pdf data")
 	}
+}
 
-	// Read file.
-	buf, err := ioutil.ReadFile(filename)
+// webpSupported is set by tests built with the webp tag.
+var webpSupported bool
+
+// Ensure rendering to WebP requires the webp build tag.
+func TestWebPage_RenderBytes_WebPUnsupported(t *testing.T) {
+	if webpSupported {
+		t.Skip("built with webp tag")
+	}
+
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	page, err := s.NewProcess().CreateWebPage()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err := page.RenderBytes("webp", 0); err != phantomjs.ErrWebPUnsupported {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := page.Render("out.webp", "WEBP", 0); err != phantomjs.ErrWebPUnsupported {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n := len(s.RequestsTo("/webpage/RenderBytes")); n != 0 {
+		t.Fatalf("unexpected render requests: %d", n)
+	}
+}
 
-	// Parse image and verify dimensions.
-	img, err := png.Decode(bytes.NewReader(buf))
+// Ensure an SVG document is rendered at its own size.
+func TestProcess_RenderSVG(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	svg := []byte(`<?xml version="1.0"?>
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 40 20"><rect width="20" height="20" fill="#f00"/></svg>`)
+
+	img, err := p.RenderSVG(svg, phantomjs.SVGOptions{})
 	if err != nil {
 		t.Fatal(err)
-	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 200 {
-		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	} else if bounds := img.Bounds(); bounds.Dx() != 40 || bounds.Dy() != 20 {
+		t.Fatalf("unexpected image dimensions: %dx%d", bounds.Dx(), bounds.Dy())
+	} else if c := color.RGBAModel.Convert(img.At(5, 5)); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Fatalf("unexpected color: %v", c)
+	} else if _, _, _, a := img.At(30, 5).RGBA(); a != 0 {
+		t.Fatalf("expected transparent background: %d", a)
+	}
+
+	// Scale to a requested width, keeping the aspect ratio.
+	if img, err := p.RenderSVG(svg, phantomjs.SVGOptions{Width: 80, Background: "#fff"}); err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Dx() != 80 || bounds.Dy() != 40 {
+		t.Fatalf("unexpected image dimensions: %dx%d", bounds.Dx(), bounds.Dy())
+	} else if c := color.RGBAModel.Convert(img.At(70, 5)); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Fatalf("unexpected background: %v", c)
+	}
+
+	if _, err := p.RenderSVG([]byte(`<html></html>`), phantomjs.SVGOptions{}); err != phantomjs.ErrInvalidSVG {
+		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
-// Ensure web page can receive mouse events.
-func TestWebPage_SendMouseEvent(t *testing.T) {
-	// Start process.
+// Ensure frames of an animation can be captured on a timer.
+func TestWebPage_CaptureFrames(t *testing.T) {
 	p := MustOpenNewProcess()
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
-	if err := page.SetContent(`<html><head><script>window.onclick = function(e) { window.testX = e.x; window.testY = e.y; window.testButton = e.button }</script></head><body></body></html>`); err != nil {
+	if err := page.SetViewportSize(100, 100); err != nil {
 		t.Fatal(err)
-	}
-
-	// Send mouse event.
-	if err := page.SendMouseEvent("click", 100, 200, "middle"); err != nil {
+	} else if err := page.SetContent(`<html><body><script>setTimeout(function() { document.body.style.background = '#00f' }, 250)</script></body></html>`); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify test variables.
-	if x, err := page.Evaluate(`function() { return window.testX }`); err != nil {
+	frames, err := page.CaptureFrames(100*time.Millisecond, 500*time.Millisecond, phantomjs.RenderOptions{})
+	if err != nil {
 		t.Fatal(err)
-	} else if x != float64(100) {
-		t.Fatalf("unexpected x: %d", x)
+	} else if len(frames) < 3 {
+		t.Fatalf("unexpected frame count: %d", len(frames))
+	} else if frames[0].Time >= 100*time.Millisecond {
+		t.Fatalf("unexpected first frame time: %s", frames[0].Time)
+	} else if c := color.RGBAModel.Convert(frames[len(frames)-1].Image.At(50, 50)); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Fatalf("unexpected last frame color: %v", c)
 	}
-	if y, err := page.Evaluate(`function() { return window.testY }`); err != nil {
+	for i := 1; i < len(frames); i++ {
+		if frames[i].Time <= frames[i-1].Time {
+			t.Fatalf("frame times out of order: %s, %s", frames[i-1].Time, frames[i].Time)
+		}
+	}
+}
+
+// Ensure frames are assembled into an animated GIF with their timing.
+func TestEncodeGIF(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+	blue := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(blue, blue.Bounds(), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.ZP, draw.Src)
+
+	var buf bytes.Buffer
+	if err := phantomjs.EncodeGIF(&buf, []*phantomjs.Frame{
+		{Image: red, Time: 0},
+		{Image: blue, Time: 200 * time.Millisecond},
+		{Image: red, Time: 500 * time.Millisecond},
+	}); err != nil {
 		t.Fatal(err)
-	} else if y != float64(200) {
-		t.Fatalf("unexpected y: %d", y)
 	}
-	if button, err := page.Evaluate(`function() { return window.testButton }`); err != nil {
+
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
 		t.Fatal(err)
-	} else if button != float64(1) {
-		t.Fatalf("unexpected button: %d", button)
+	} else if len(g.Image) != 3 {
+		t.Fatalf("unexpected frame count: %d", len(g.Image))
+	} else if !reflect.DeepEqual(g.Delay, []int{20, 30, 30}) {
+		t.Fatalf("unexpected delays: %v", g.Delay)
+	} else if g.Config.Width != 20 || g.Config.Height != 10 {
+		t.Fatalf("unexpected size: %dx%d", g.Config.Width, g.Config.Height)
+	} else if c := color.RGBAModel.Convert(g.Image[1].At(5, 5)); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Fatalf("unexpected color: %v", c)
 	}
 }
 
-// Ensure web page can receive keyboard events.
-func TestWebPage_SendKeyboardEvent(t *testing.T) {
-	// Start process.
+// Ensure a tall page can be rendered in tiles which are stitched together.
+func TestWebPage_RenderImage_Stitch(t *testing.T) {
 	p := MustOpenNewProcess()
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
-	if err := page.SetContent(`<html><head><script>document.onkeydown = function(e) { window.testKey = e.keyCode; window.testAlt = e.altKey; window.testCtrl = e.ctrlKey; window.testMeta = e.metaKey; window.testShift = e.shiftKey;  }</script></head><body></body></html>`); err != nil {
+	if err := page.SetContent(`<html><body style="margin:0"><div style="height:1500px;background:#f00"></div><div style="height:1500px;background:#00f"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetViewportSize(200, 400); err != nil {
 		t.Fatal(err)
 	}
 
-	// Send event.
-	if err := page.SendKeyboardEvent("keydown", "A", phantomjs.AltKey|phantomjs.CtrlKey|phantomjs.MetaKey|phantomjs.ShiftKey); err != nil {
+	img, err := page.RenderImage(phantomjs.RenderOptions{Stitch: true})
+	if err != nil {
 		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Dx() != 200 || bounds.Dy() != 3000 {
+		t.Fatalf("unexpected image dimensions: %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	// Verify tiles on both sides of the boundary and in the last partial tile.
+	for _, tt := range []struct {
+		y    int
+		want color.RGBA
+	}{
+		{10, color.RGBA{255, 0, 0, 255}},
+		{1499, color.RGBA{255, 0, 0, 255}},
+		{1500, color.RGBA{0, 0, 255, 255}},
+		{2990, color.RGBA{0, 0, 255, 255}},
+	} {
+		if c := color.RGBAModel.Convert(img.At(100, tt.y)); c != tt.want {
+			t.Errorf("%d: unexpected color: %v", tt.y, c)
+		}
 	}
 
-	// Verify test variables.
-	if key, err := page.Evaluate(`function() { return window.testKey }`); err != nil {
+	// The clip rect is restored.
+	if rect, err := page.ClipRect(); err != nil {
 		t.Fatal(err)
-	} else if key != float64(65) {
-		t.Fatalf("unexpected key: %s", key)
+	} else if rect != (phantomjs.Rect{}) {
+		t.Fatalf("unexpected clip rect: %#v", rect)
 	}
-	if altKey, err := page.Evaluate(`function() { return window.testAlt }`); err != nil {
+}
+
+// Ensure a watermark is blended over the rendered image at its position.
+func TestWebPage_RenderImage_Watermark(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0;background:#fff"></body></html>`); err != nil {
 		t.Fatal(err)
-	} else if altKey != true {
-		t.Fatalf("unexpected alt key: %v", altKey)
-	}
-	if ctrlKey, err := page.Evaluate(`function() { return window.testCtrl }`); err != nil {
+	} else if err := page.SetViewportSize(100, 100); err != nil {
 		t.Fatal(err)
-	} else if ctrlKey != true {
-		t.Fatalf("unexpected ctrl key: %v", ctrlKey)
-	}
-	if metaKey, err := page.Evaluate(`function() { return window.testMeta }`); err != nil {
+	} else if err := page.SetClipRect(phantomjs.Rect{Width: 100, Height: 100}); err != nil {
 		t.Fatal(err)
-	} else if metaKey != true {
-		t.Fatalf("unexpected meta key: %v", metaKey)
 	}
-	if shiftKey, err := page.Evaluate(`function() { return window.testShift }`); err != nil {
+
+	mark := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(mark, mark.Bounds(), image.NewUniform(color.Black), image.ZP, draw.Src)
+	img, err := page.RenderImage(phantomjs.RenderOptions{Watermark: &phantomjs.Watermark{
+		Image:    mark,
+		Position: phantomjs.WatermarkBottomRight,
+		Margin:   5,
+	}})
+	if err != nil {
 		t.Fatal(err)
-	} else if shiftKey != true {
-		t.Fatalf("unexpected shift key: %v", shiftKey)
+	}
+
+	// The watermark is drawn at half opacity by default.
+	if r, _, _, _ := img.At(90, 90).RGBA(); r>>8 < 0x7e || r>>8 > 0x81 {
+		t.Fatalf("unexpected watermark color: %v", img.At(90, 90))
+	} else if c := color.RGBAModel.Convert(img.At(80, 80)); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Fatalf("unexpected background color: %v", c)
 	}
 }
 
-// Ensure web page can set content and URL at the same time.
-func TestWebPage_SetContentAndURL(t *testing.T) {
-	// Start process.
+// Ensure matching elements are outlined and labeled on the rendered image.
+func TestWebPage_RenderImage_Annotations(t *testing.T) {
 	p := MustOpenNewProcess()
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
-	if err := page.SetContentAndURL(`<html><body>FOO</body></html>`, "http://google.com"); err != nil {
+	if err := page.SetContent(`<html><body style="margin:0;background:#fff"><div class="price" style="position:absolute;top:50px;left:20px;width:40px;height:20px"></div><div class="price" style="position:absolute;top:100px;left:20px;width:40px;height:20px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetViewportSize(200, 200); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetClipRect(phantomjs.Rect{Width: 200, Height: 200}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify content & URL.
-	if content, err := page.Content(); err != nil {
+	blue := color.RGBA{0, 0, 255, 255}
+	img, err := page.RenderImage(phantomjs.RenderOptions{Annotations: []phantomjs.Annotation{
+		{Selector: ".price", Label: "price", Color: blue},
+		{Selector: "#no_such_element", Label: "missing"},
+	}})
+	if err != nil {
 		t.Fatal(err)
-	} else if content != `<html><head></head><body>FOO</body></html>` {
-		t.Fatalf("unexpected content: %s", content)
 	}
-	if u, err := page.URL(); err != nil {
-		t.Fatal(err)
-	} else if u != `http://google.com/` {
-		t.Fatalf("unexpected URL: %s", u)
+
+	// Both elements are outlined but not filled, with a label above each.
+	white := color.RGBA{255, 255, 255, 255}
+	for _, tt := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{20, 60, blue},
+		{59, 110, blue},
+		{40, 51, blue},
+		{40, 119, blue},
+		{40, 60, white},
+		{40, 110, white},
+		{100, 150, white},
+		{20, 48, blue},
+	} {
+		if c := color.RGBAModel.Convert(img.At(tt.x, tt.y)); c != tt.want {
+			t.Errorf("%d,%d: unexpected color: %v", tt.x, tt.y, c)
+		}
 	}
 }
 
-// Ensure web page can call stop().
-func TestWebPage_Stop(t *testing.T) {
-	// Start process.
+// Ensure annotations are drawn where elements are rendered after hidden
+// elements reflow the page.
+func TestWebPage_RenderImage_Annotations_HideSelectors(t *testing.T) {
 	p := MustOpenNewProcess()
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
-
-	// Call stop and ensure it doesn't blow up.
-	if err := page.Stop(); err != nil {
+	if err := page.SetContent(`<html><body style="margin:0;background:#fff"><div id="banner" style="height:100px"></div><div class="price" style="margin-left:20px;width:40px;height:20px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetViewportSize(200, 200); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetClipRect(phantomjs.Rect{Width: 200, Height: 200}); err != nil {
 		t.Fatal(err)
 	}
-}
+
+	blue := color.RGBA{0, 0, 255, 255}
+	img, err := page.RenderImage(phantomjs.RenderOptions{
+		HideSelectors: []string{"#banner"},
+		Annotations:   []phantomjs.Annotation{{Selector: ".price", Color: blue}, {Selector: "#banner"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The box is drawn at the top, where the element moved, and the hidden
+	// banner is not annotated.
+	if c := color.RGBAModel.Convert(img.At(20, 10)); c != blue {
+		t.Fatalf("unexpected color: %v", c)
+	} else if c := color.RGBAModel.Convert(img.At(20, 110)); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Fatalf("unexpected color: %v", c)
+	} else if c := color.RGBAModel.Convert(img.At(0, 0)); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Fatalf("unexpected color: %v", c)
+	}
+}
+
+// Ensure a text watermark is stamped onto every page of a rendered PDF.
+func TestWebPage_RenderBytes_PDFWatermark(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body>report</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	page.SetPDFWatermark(&phantomjs.Watermark{Text: "PREVIEW"})
+
+	buf, err := page.RenderBytes("pdf", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(buf, []byte("/PhantomJSWatermark")) {
+		t.Fatal("expected watermark")
+	} else if _, err := phantomjs.MergePDF([][]byte{buf}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure web page can render to an image at a higher pixel density.
+func TestWebPage_RenderImage_Scale(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetViewportSize(100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render page at 2x and verify dimensions.
+	if img, err := page.RenderImage(phantomjs.RenderOptions{Scale: 2}); err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 200 || bounds.Max.Y != 400 {
+		t.Fatalf("unexpected image dimensions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+
+	// Verify the page is restored after rendering.
+	if width, height, err := page.ViewportSize(); err != nil {
+		t.Fatal(err)
+	} else if width != 100 || height != 200 {
+		t.Fatalf("unexpected viewport: %dx%d", width, height)
+	} else if zoom, err := page.ZoomFactor(); err != nil {
+		t.Fatal(err)
+	} else if zoom != 1 {
+		t.Fatalf("unexpected zoom factor: %f", zoom)
+	}
+}
+
+// Ensure web page can hide elements while rendering.
+func TestWebPage_RenderImage_HideSelectors(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0;background:white"><div id="banner" style="width:100px;height:100px;background:red"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetViewportSize(100, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render with the banner hidden and verify it is not drawn.
+	img, err := page.RenderImage(phantomjs.RenderOptions{HideSelectors: []string{"#banner"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if r, g, b, _ := img.At(50, 50).RGBA(); r != 0xFFFF || g != 0xFFFF || b != 0xFFFF {
+		t.Fatalf("unexpected color: %d,%d,%d", r, g, b)
+	}
+
+	// Verify the element is visible again after rendering.
+	if v, err := page.Evaluate(`function() { return getComputedStyle(document.getElementById("banner")).display }`); err != nil {
+		t.Fatal(err)
+	} else if v != "block" {
+		t.Fatalf("unexpected display: %v", v)
+	}
+}
+
+// Ensure web page can wait for images to load before rendering.
+func TestWebPage_RenderImage_WaitForAssets(t *testing.T) {
+	// Serve a slow image.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100"><rect width="100" height="100" fill="red"/></svg>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetViewportSize(100, 100); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body style="margin:0"><img src="` + srv.URL + `"></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render and verify the image was drawn.
+	img, err := page.RenderImage(phantomjs.RenderOptions{WaitForAssets: true, AssetTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	} else if r, g, b, _ := img.At(50, 50).RGBA(); r != 0xFFFF || g != 0 || b != 0 {
+		t.Fatalf("unexpected color: %d,%d,%d", r, g, b)
+	}
+}
+
+// Ensure web page waits for web fonts without the font loading API and does
+// not wait forever for fonts which fail to load.
+func TestWebPage_RenderImage_WaitForAssets_Fonts(t *testing.T) {
+	// Serve a slow, missing font.
+	var served int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		atomic.StoreInt32(&served, 1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head><style>@font-face { font-family: "Slow"; src: url(` + srv.URL + `/slow.woff); } body { font-family: "Slow", serif }</style></head><body>text</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render once the font request has finished.
+	start := time.Now()
+	if _, err := page.RenderImage(phantomjs.RenderOptions{WaitForAssets: true, AssetTimeout: 5 * time.Second}); err != nil {
+		t.Fatal(err)
+	} else if atomic.LoadInt32(&served) != 1 {
+		t.Fatal("expected render to wait for font")
+	} else if d := time.Since(start); d >= 5*time.Second {
+		t.Fatalf("unexpected wait: %s", d)
+	}
+}
+
+// Ensure web page can render to a file.
+func TestWebPage_Render(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetViewportSize(100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render page.
+	filename := filepath.Join(p.Path(), "test.png")
+	if err := page.Render(filename, "png", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read file.
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse image and verify dimensions.
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 200 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+}
+
+// Ensure web page can receive mouse events.
+func TestWebPage_SendMouseEvent(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head><script>window.onclick = function(e) { window.testX = e.x; window.testY = e.y; window.testButton = e.button }</script></head><body></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send mouse event.
+	if err := page.SendMouseEvent("click", 100, 200, "middle"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify test variables.
+	if x, err := page.Evaluate(`function() { return window.testX }`); err != nil {
+		t.Fatal(err)
+	} else if x != float64(100) {
+		t.Fatalf("unexpected x: %d", x)
+	}
+	if y, err := page.Evaluate(`function() { return window.testY }`); err != nil {
+		t.Fatal(err)
+	} else if y != float64(200) {
+		t.Fatalf("unexpected y: %d", y)
+	}
+	if button, err := page.Evaluate(`function() { return window.testButton }`); err != nil {
+		t.Fatal(err)
+	} else if button != float64(1) {
+		t.Fatalf("unexpected button: %d", button)
+	}
+}
+
+// Ensure web page can receive keyboard events.
+func TestWebPage_SendKeyboardEvent(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head><script>document.onkeydown = function(e) { window.testKey = e.keyCode; window.testAlt = e.altKey; window.testCtrl = e.ctrlKey; window.testMeta = e.metaKey; window.testShift = e.shiftKey;  }</script></head><body></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send event.
+	if err := page.SendKeyboardEvent("keydown", "A", phantomjs.AltKey|phantomjs.CtrlKey|phantomjs.MetaKey|phantomjs.ShiftKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify test variables.
+	if key, err := page.Evaluate(`function() { return window.testKey }`); err != nil {
+		t.Fatal(err)
+	} else if key != float64(65) {
+		t.Fatalf("unexpected key: %s", key)
+	}
+	if altKey, err := page.Evaluate(`function() { return window.testAlt }`); err != nil {
+		t.Fatal(err)
+	} else if altKey != true {
+		t.Fatalf("unexpected alt key: %v", altKey)
+	}
+	if ctrlKey, err := page.Evaluate(`function() { return window.testCtrl }`); err != nil {
+		t.Fatal(err)
+	} else if ctrlKey != true {
+		t.Fatalf("unexpected ctrl key: %v", ctrlKey)
+	}
+	if metaKey, err := page.Evaluate(`function() { return window.testMeta }`); err != nil {
+		t.Fatal(err)
+	} else if metaKey != true {
+		t.Fatalf("unexpected meta key: %v", metaKey)
+	}
+	if shiftKey, err := page.Evaluate(`function() { return window.testShift }`); err != nil {
+		t.Fatal(err)
+	} else if shiftKey != true {
+		t.Fatalf("unexpected shift key: %v", shiftKey)
+	}
+}
+
+// Ensure web page can mask headless browser fingerprints.
+func TestWebPage_EnableStealth(t *testing.T) {
+	// Mock external HTTP server which echoes the user agent.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>` + r.UserAgent() + `</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.EnableStealth(); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != phantomjs.StealthUserAgent {
+		t.Fatalf("unexpected user agent: %q", v)
+	}
+
+	if v, err := page.Evaluate(`function() {
+		return [typeof window.callPhantom, navigator.webdriver, navigator.plugins.length > 0].join(",");
+	}`); err != nil {
+		t.Fatal(err)
+	} else if v != "undefined,false,true" {
+		t.Fatalf("unexpected fingerprint: %#v", v)
+	}
+}
+
+// Ensure web page can emulate a locale and timezone.
+func TestWebPage_SetLocale(t *testing.T) {
+	// Mock external HTTP server which echoes the Accept-Language header.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>` + r.Header.Get("Accept-Language") + `</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.SetLocale("fr-FR"); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetTimezoneOffset(60); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "fr-FR" {
+		t.Fatalf("unexpected header: %q", v)
+	} else if v, err := page.Evaluate(`function() { return navigator.language }`); err != nil {
+		t.Fatal(err)
+	} else if v != "fr-FR" {
+		t.Fatalf("unexpected language: %#v", v)
+	} else if v, err := page.Evaluate(`function() { var d = new Date(0); return [d.getHours(), d.getTimezoneOffset()].join(",") }`); err != nil {
+		t.Fatal(err)
+	} else if v != "1,-60" {
+		t.Fatalf("unexpected time: %#v", v)
+	} else if v, err := page.Evaluate(`function() { return new Date(2020, 0, 1, 10).toISOString() }`); err != nil {
+		t.Fatal(err)
+	} else if v != "2020-01-01T09:00:00.000Z" {
+		t.Fatalf("unexpected date: %#v", v)
+	}
+
+	// Strings without an offset are parsed in the zone.
+	if v, err := page.Evaluate(`function() { return [new Date("2020-01-01T10:00:00").toISOString(), new Date(Date.parse("Jan 1 2020 10:00:00")).toISOString(), new Date("2020-01-01T10:00:00Z").toISOString()].join(",") }`); err != nil {
+		t.Fatal(err)
+	} else if v != "2020-01-01T09:00:00.000Z,2020-01-01T09:00:00.000Z,2020-01-01T10:00:00.000Z" {
+		t.Fatalf("unexpected parse: %#v", v)
+	}
+
+	// Locale strings are formatted in the zone.
+	if v, err := page.Evaluate(`function() { return new Date(Date.UTC(2020, 0, 1, 9, 30)).toLocaleTimeString() }`); err != nil {
+		t.Fatal(err)
+	} else if s, _ := v.(string); !strings.Contains(s, "10") || !strings.Contains(s, "30") {
+		t.Fatalf("unexpected locale time: %#v", v)
+	}
+}
+
+// Ensure web page can emulate print and screen media types.
+func TestWebPage_SetMediaType(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head><style>@media print { #x { display: none } }</style></head><body><div id="x">X</div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	display := func() interface{} {
+		v, err := page.Evaluate(`function() { return getComputedStyle(document.getElementById("x")).display }`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// Print rules should apply after emulating print.
+	if err := page.SetMediaType("print"); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.MediaType(); err != nil {
+		t.Fatal(err)
+	} else if v != "print" {
+		t.Fatalf("unexpected media type: %s", v)
+	} else if v := display(); v != "none" {
+		t.Fatalf("unexpected print display: %v", v)
+	}
+
+	// Switching back to screen should restore the original rules.
+	if err := page.SetMediaType("screen"); err != nil {
+		t.Fatal(err)
+	} else if v := display(); v != "block" {
+		t.Fatalf("unexpected screen display: %v", v)
+	}
+}
+
+// Ensure web page can set content and URL at the same time.
+func TestWebPage_SetContentAndURL(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContentAndURL(`<html><body>FOO</body></html>`, "http://google.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify content & URL.
+	if content, err := page.Content(); err != nil {
+		t.Fatal(err)
+	} else if content != `<html><head></head><body>FOO</body></html>` {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	if u, err := page.URL(); err != nil {
+		t.Fatal(err)
+	} else if u != `http://google.com/` {
+		t.Fatalf("unexpected URL: %s", u)
+	}
+}
+
+// Ensure web page can call stop().
+func TestWebPage_Stop(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Call stop and ensure it doesn't blow up.
+	if err := page.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
 
 // Ensure web page can switch to the focused frame.
 func TestWebPage_SwitchToFocusedFrame(t *testing.T) {
 	// Mock external HTTP server.
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
-		case "/":
-			w.Write([]byte(`<html><frameset rows="*,*"><frame name="FRAME1" src="/frame1.html"/><frame name="FRAME2" src="/frame2.html"/></frameset></html>`))
-		case "/frame1.html":
-			w.Write([]byte(`<html><body></body></html>`))
-		case "/frame2.html":
-			w.Write([]byte(`<html><body><input autofocus/></body></html>`))
+		case "/":
+			w.Write([]byte(`<html><frameset rows="*,*"><frame name="FRAME1" src="/frame1.html"/><frame name="FRAME2" src="/frame2.html"/></frameset></html>`))
+		case "/frame1.html":
+			w.Write([]byte(`<html><body></body></html>`))
+		case "/frame2.html":
+			w.Write([]byte(`<html><body><input autofocus/></body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check initial current frame.
+	if other, err := page.FrameName(); err != nil {
+		t.Fatal(err)
+	} else if other != `` {
+		t.Fatalf("unexpected value: %#v", other)
+	}
+
+	// Switch to focused frame and verify.
+	if err := page.SwitchToFocusedFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := page.FrameName(); err != nil {
+		t.Fatal(err)
+	} else if other != `FRAME2` {
+		t.Fatalf("unexpected value: %#v", other)
+	}
+}
+
+// Ensure web page can upload a file to a form field.
+func TestWebPage_UploadFile(t *testing.T) {
+	// Mock external HTTP server.
+	uploadData := make(chan []byte, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(`<html><body><form id="myForm" method="POST" enctype="multipart/form-data"><input type="file" name="myfile"/></form></body></html>`))
+		case "POST":
+			f, _, err := r.FormFile("myfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uploadData <- buf
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write file to disk.
+	path := filepath.Join(p.Path(), "testfile")
+	if err := ioutil.WriteFile(path, []byte("TESTDATA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload to field
+	if err := page.UploadFile("input[name=myfile]", path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Submit form.
+	if _, err := page.Evaluate(`function() { document.body.querySelector("#myForm").submit() }`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for upload.
+	buf := <-uploadData
+	if string(buf) != "TESTDATA" {
+		t.Fatalf("unexpected upload data: %s", buf)
+	}
+}
+
+// Ensure web page can wait for a function to return a truthy value.
+func TestWebPage_WaitForFunction(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><script>setTimeout(function() { window.ready = true }, 200)</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the variable to be set.
+	if err := page.WaitForFunction(`function() { return window.ready }`, 5*time.Second, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// A function that never returns true should time out.
+	if err := page.WaitForFunction(`function() { return false }`, 200*time.Millisecond, 0); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web page can wait for an element to be added.
+func TestWebPage_WaitForSelector(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><script>setTimeout(function() { document.body.innerHTML = '<div data-state="ready"></div>' }, 200)</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Quotes within the selector must not break the generated script.
+	if err := page.WaitForSelector(`div[data-state="ready"]`, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := page.WaitForSelector("#never", 200*time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web page can wait for a navigation caused by a click to finish.
+func TestWebPage_WaitForNavigation(t *testing.T) {
+	// Serve web pages.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><a id="link" href="/next">NEXT</a></body></html>`))
+		case "/next":
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte(`<html><head><title>NEXT</title></head><body></body></html>`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Click the link and wait for the next page to load.
+	if _, err := page.Evaluate(`function() { document.querySelector("#link").click() }`); err != nil {
+		t.Fatal(err)
+	} else if status, err := page.WaitForNavigation(5 * time.Second); err != nil {
+		t.Fatal(err)
+	} else if status != "success" {
+		t.Fatalf("unexpected status: %s", status)
+	} else if title, err := page.Title(); err != nil {
+		t.Fatal(err)
+	} else if title != "NEXT" {
+		t.Fatalf("unexpected title: %s", title)
+	}
+
+	// Waiting without a navigation should time out.
+	if _, err := page.WaitForNavigation(200 * time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web page can wait for its URL to match a glob or regular expression.
+func TestWebPage_WaitForURL(t *testing.T) {
+	// Serve a page which redirects after loading.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Write([]byte(`<html><body><script>setTimeout(function() { location.href = "/home?id=1" }, 100)</script></body></html>`))
+		case "/home":
+			w.Write([]byte(`<html><body>HOME</body></html>`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL + "/login"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait using a glob and then a regular expression.
+	if err := page.WaitForURL(srv.URL+"/home?*", 5*time.Second); err != nil {
+		t.Fatal(err)
+	} else if err := page.WaitForURL(`/\/home\?id=\d+$/`, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expressions use JavaScript syntax, such as lookaheads.
+	if err := page.WaitForURL(`/\/home(?=\?)/`, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-matching pattern should time out.
+	if err := page.WaitForURL("*/logout", 200*time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Invalid expressions are rejected by the shim, including when set.
+	if err := page.WaitForURL("/(/", time.Second); err == nil {
+		t.Fatal("expected error")
+	} else if err := page.SetInterceptRules([]phantomjs.InterceptRule{{Pattern: "/(/", Abort: true}}); err == nil {
+		t.Fatal("expected error")
+	} else if rules, err := page.InterceptRules(); err != nil {
+		t.Fatal(err)
+	} else if len(rules) != 0 {
+		t.Fatalf("unexpected rules: %#v", rules)
+	}
+}
+
+// Ensure web page can wait for its title to match a pattern.
+func TestWebPage_WaitForTitle(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head><title>Loading</title></head><body><script>setTimeout(function() { document.title = "Step 2 of 3" }, 100)</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := page.WaitForTitle("Step * of 3", 5*time.Second); err != nil {
+		t.Fatal(err)
+	} else if err := page.WaitForTitle("Done", 200*time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web page delivers events fired by the page.
+func TestWebPage_Events(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><script>console.log("hello")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the console message.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			if e.Type != phantomjs.EventConsoleMessage {
+				continue
+			} else if msg := e.Data.(*phantomjs.ConsoleMessage); msg.Message != "hello" {
+				t.Fatalf("unexpected message: %#v", msg)
+			}
+			return
+		}
+	}
+}
+
+// Ensure web page events can be pushed through the callback server.
+func TestProcess_CallbackServer(t *testing.T) {
+	p := NewProcess()
+	p.CallbackServer = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	if p.CallbackURL() == "" {
+		t.Fatal("expected callback url")
+	}
+
+	page := p.MustCreateWebPage()
+	ch := page.Events()
+	if err := page.SetContent(`<html><body><script>console.log("pushed")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the console message.
+	timeout := time.After(5 * time.Second)
+	for found := false; !found; {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-ch:
+			if e.Type == phantomjs.EventConsoleMessage && e.Data.(*phantomjs.ConsoleMessage).Message == "pushed" {
+				found = true
+			}
+		}
+	}
+
+	// Closing the page should close the channel.
+	MustClosePage(page)
+	for range ch {
+	}
+}
+
+// Ensure web page records uncaught JavaScript errors.
+func TestWebPage_LastErrors(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><script>function fail() { throw new Error("BOOM") }; fail()</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if errs, err := page.LastErrors(); err != nil {
+		t.Fatal(err)
+	} else if len(errs) != 1 {
+		t.Fatalf("unexpected error count: %d", len(errs))
+	} else if errs[0].Message != "Error: BOOM" {
+		t.Fatalf("unexpected message: %s", errs[0].Message)
+	} else if len(errs[0].Trace) == 0 {
+		t.Fatal("expected stack trace")
+	}
+}
+
+// Ensure web page delivers load started and finished events.
+func TestWebPage_Events_Load(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>OK</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Collect load events in order.
+	var types []string
+	timeout := time.After(5 * time.Second)
+	for len(types) < 2 {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout: %v", types)
+		case e := <-page.Events():
+			switch e.Type {
+			case phantomjs.EventLoadStarted:
+				types = append(types, e.Type)
+			case phantomjs.EventLoadFinished:
+				types = append(types, e.Type)
+				if load := e.Data.(*phantomjs.PageLoad); load.Status != "success" || load.URL != srv.URL+"/" {
+					t.Fatalf("unexpected load: %#v", load)
+				}
+			}
+		}
+	}
+	if !reflect.DeepEqual(types, []string{phantomjs.EventLoadStarted, phantomjs.EventLoadFinished}) {
+		t.Fatalf("unexpected events: %v", types)
+	}
+}
+
+// Ensure web page can block navigations matching a rule.
+func TestWebPage_SetNavigationRules(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><a id="blocked" href="/logout">LOGOUT</a><a id="allowed" href="/next">NEXT</a></body></html>`))
+		default:
+			w.Write([]byte(`<html><body>` + r.URL.Path + `</body></html>`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []phantomjs.NavigationRule{{Pattern: "*/logout", Type: "LinkClicked"}}
+	if err := page.SetNavigationRules(rules); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.NavigationRules(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, rules) {
+		t.Fatalf("unexpected rules: %#v", v)
+	}
+
+	// Clicking the blocked link should not navigate.
+	if _, err := page.Evaluate(`function() { document.querySelector("#blocked").click() }`); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.WaitForNavigation(500 * time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Blocking a navigation should not change a lock set by the caller.
+	if err := page.SetNavigationLocked(true); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.Evaluate(`function() { document.querySelector("#blocked").click() }`); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.WaitForNavigation(500 * time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	} else if v, err := page.NavigationLocked(); err != nil {
+		t.Fatal(err)
+	} else if !v {
+		t.Fatal("expected navigation to remain locked")
+	} else if err := page.SetNavigationLocked(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clicking the allowed link should navigate.
+	if _, err := page.Evaluate(`function() { document.querySelector("#allowed").click() }`); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.WaitForNavigation(5 * time.Second); err != nil {
+		t.Fatal(err)
+	} else if u, err := page.URL(); err != nil {
+		t.Fatal(err)
+	} else if u != srv.URL+"/next" {
+		t.Fatalf("unexpected url: %s", u)
+	}
+}
+
+// Ensure web page delivers popups as new pages.
+func TestWebPage_Events_PageCreated(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><script>window.open("about:blank", "popup")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the popup and drive it immediately.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			if e.Type != phantomjs.EventPageCreated {
+				continue
+			}
+			popup := e.Data.(*phantomjs.WebPage)
+			if name, err := popup.WindowName(); err != nil {
+				t.Fatal(err)
+			} else if name != "popup" {
+				t.Fatalf("unexpected window name: %s", name)
+			}
+			return
+		}
+	}
+}
+
+// Ensure web page delivers an event when a popup closes itself.
+func TestWebPage_Events_Closing(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><script>var w = window.open("about:blank", "popup"); setTimeout(function() { w.close() }, 100)</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the popup to be created and then closed.
+	var popup *phantomjs.WebPage
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			switch e.Type {
+			case phantomjs.EventPageCreated:
+				popup = e.Data.(*phantomjs.WebPage)
+			case phantomjs.EventClosing:
+				if popup == nil {
+					t.Fatal("expected page created event first")
+				} else if closing := e.Data.(*phantomjs.WebPage); closing.Ref().ID() != popup.Ref().ID() {
+					t.Fatalf("unexpected page: %s", closing.Ref().ID())
+				}
+				return
+			}
+		}
+	}
+}
+
+// Ensure web page can abort and rewrite requests using intercept rules.
+func TestWebPage_SetInterceptRules(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><script src="/blocked.js"></script><script src="/original.js"></script></body></html>`))
+		case "/blocked.js":
+			w.Write([]byte(`window.blocked = true`))
+		case "/original.js":
+			w.Write([]byte(`window.value = "ORIGINAL"`))
+		case "/rewritten.js":
+			w.Write([]byte(`window.value = "REWRITTEN"`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	rules := []phantomjs.InterceptRule{
+		{Pattern: "*/blocked.js", Abort: true},
+		{Pattern: "*/original.js", Method: "GET", RedirectURL: srv.URL + "/rewritten.js"},
+	}
+	if err := page.SetInterceptRules(rules); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.InterceptRules(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, rules) {
+		t.Fatalf("unexpected rules: %#v", v)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := page.Evaluate(`function() { return [window.blocked === undefined, window.value] }`); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []interface{}{true, "REWRITTEN"}) {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+}
+
+// Ensure web page can block requests for common resource types.
+func TestWebPage_BlockResourceTypes(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"></head><body><img src="/image.png?v=1"><script src="/app.js"></script></body></html>`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.BlockResourceTypes(true, true, true, true); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the page and script should have been requested.
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(paths, []string{"/", "/app.js"}) {
+		t.Fatalf("unexpected requests: %v", paths)
+	}
+}
+
+// Ensure web page delivers resource responses with status and headers.
+func TestWebPage_Events_ResourceReceived(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "VALUE")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<html><body>FORBIDDEN</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	page.Open(srv.URL)
+
+	// Wait for the final stage of the response.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			if e.Type != phantomjs.EventResourceReceived {
+				continue
+			} else if resp := e.Data.(*phantomjs.ResourceResponse); resp.Stage != "end" {
+				continue
+			} else if resp.Status != http.StatusForbidden {
+				t.Fatalf("unexpected status: %d", resp.Status)
+			} else if v := resp.Header.Get("X-Test"); v != "VALUE" {
+				t.Fatalf("unexpected header: %s", v)
+			}
+			return
+		}
+	}
+}
+
+// Ensure web page emits an event when a resource fails to load.
+func TestWebPage_Events_ResourceError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><img src="/missing.png"></body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			if e.Type != phantomjs.EventResourceError {
+				continue
+			} else if err := e.Data.(*phantomjs.ResourceError); err.URL != srv.URL+"/missing.png" {
+				t.Fatalf("unexpected url: %s", err.URL)
+			} else if err.Status != http.StatusNotFound {
+				t.Fatalf("unexpected status: %d", err.Status)
+			}
+			return
+		}
+	}
+}
+
+// Ensure web page emits an event when a resource exceeds the resource timeout.
+func TestWebPage_Events_ResourceTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><img src="/slow.png"></body></html>`))
+		default:
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetSettings(phantomjs.WebPageSettings{ResourceTimeout: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	page.Open(srv.URL)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			if e.Type != phantomjs.EventResourceTimeout {
+				continue
+			} else if err := e.Data.(*phantomjs.ResourceError); err.URL != srv.URL+"/slow.png" {
+				t.Fatalf("unexpected url: %s", err.URL)
+			}
+			return
+		}
+	}
+}
+
+// Ensure opening an unreachable URL returns the underlying resource error.
+func TestWebPage_Open_ResourceError(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	err := page.Open("http://127.0.0.1:1/")
+	if e, ok := err.(*phantomjs.ResourceError); !ok {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if e.URL != "http://127.0.0.1:1/" {
+		t.Fatalf("unexpected url: %s", e.URL)
+	} else if e.ErrorString == "" {
+		t.Fatal("expected error string")
+	}
+}
+
+// Ensure web page can export its network activity as HAR.
+func TestWebPage_HAR(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><head><title>FOO</title></head><body><img src="/missing.png?x=1"></body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	har, err := page.HAR()
+	if err != nil {
+		t.Fatal(err)
+	} else if har.Log.Version != "1.2" {
+		t.Fatalf("unexpected version: %s", har.Log.Version)
+	} else if len(har.Log.Pages) != 1 || har.Log.Pages[0].Title != "FOO" {
+		t.Fatalf("unexpected pages: %#v", har.Log.Pages)
+	} else if len(har.Log.Entries) != 2 {
+		t.Fatalf("unexpected entry count: %d", len(har.Log.Entries))
+	}
+
+	if e := har.Log.Entries[0]; e.Request.URL != srv.URL+"/" {
+		t.Fatalf("unexpected url: %s", e.Request.URL)
+	} else if e.Response.Status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", e.Response.Status)
+	}
+
+	if e := har.Log.Entries[1]; e.Response.Status != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", e.Response.Status)
+	} else if len(e.Request.QueryString) != 1 || e.Request.QueryString[0] != (phantomjs.HARNameValue{Name: "x", Value: "1"}) {
+		t.Fatalf("unexpected query string: %#v", e.Request.QueryString)
+	}
+}
+
+// Ensure network activity is recorded for pages which are never opened.
+func TestWebPage_HAR_SetContent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><img src="` + srv.URL + `/logo.png"></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if har, err := page.HAR(); err != nil {
+			t.Fatal(err)
+		} else if len(har.Log.Entries) == 1 && har.Log.Entries[0].Response.Status == http.StatusNotFound {
+			return
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Ensure web page can stream network activity as NDJSON.
+func TestWebPage_SetNetworkLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>OK</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	page.SetNetworkLog(pw)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read until the request and its final response have been logged.
+	types := make(map[string]bool)
+	dec := json.NewDecoder(pr)
+	for !types[phantomjs.EventResourceRequested] || !types[phantomjs.EventResourceReceived] {
+		var entry struct {
+			Type  string `json:"type"`
+			URL   string `json:"url"`
+			Stage string `json:"stage"`
+		}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		} else if entry.URL != srv.URL+"/" {
+			t.Fatalf("unexpected url: %s", entry.URL)
+		}
+		if entry.Type == phantomjs.EventResourceRequested || entry.Stage == "end" {
+			types[entry.Type] = true
+		}
+	}
+	page.SetNetworkLog(nil)
+}
+
+// Ensure replacing or clearing the network log stops the previous poller.
+func TestWebPage_SetNetworkLog_Replace(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each replaced log's outstanding long poll is canceled.
+	page.SetNetworkLog(ioutil.Discard)
+	time.Sleep(50 * time.Millisecond)
+	page.SetNetworkLog(ioutil.Discard)
+	time.Sleep(50 * time.Millisecond)
+	page.SetNetworkLog(nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.RequestsTo("/cancel")) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected cancels: %d", len(s.RequestsTo("/cancel")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Ensure web page can answer requests with mock responses.
+func TestWebPage_Mock(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.Mock("http://example.invalid/*", &phantomjs.MockResponse{
+		Header: http.Header{"Content-Type": {"text/html"}},
+		Body:   []byte(`<html><body><div id="x">MOCKED</div></body></html>`),
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open("http://example.invalid/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := page.Evaluate(`function() { return document.getElementById('x').innerText }`); err != nil {
+		t.Fatal(err)
+	} else if v != "MOCKED" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	// Mocks are not served from the API's origin.
+	if u, err := page.URL(); err != nil {
+		t.Fatal(err)
+	} else if strings.HasPrefix(u, p.URL()) {
+		t.Fatalf("mock served from api: %s", u)
+	}
+
+	if rules, err := page.InterceptRules(); err != nil {
+		t.Fatal(err)
+	} else if len(rules) != 1 || rules[0].Response == nil || rules[0].Response.Status != http.StatusOK {
+		t.Fatalf("unexpected rules: %#v", rules)
+	}
+}
+
+// Ensure web page can wait for a response matching a URL pattern.
+func TestWebPage_WaitForResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><script>setTimeout(function() { var xhr = new XMLHttpRequest(); xhr.open("GET", "/api/search?q=foo"); xhr.send() }, 200)</script></body></html>`))
+		case "/api/search":
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := page.WaitForResponse("*/api/search*", 5*time.Second); err != nil {
+		t.Fatal(err)
+	} else if resp.Status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.Status)
+	} else if resp.URL != srv.URL+"/api/search?q=foo" {
+		t.Fatalf("unexpected url: %s", resp.URL)
+	}
+
+	// Ensure timeout is returned when no matching response is received.
+	if _, err := page.WaitForResponse("*/api/other", 100*time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure console messages are forwarded to the process output.
+func TestProcess_ForwardConsole(t *testing.T) {
+	var stdout bytes.Buffer
+	p := NewProcess()
+	p.ForwardConsole = true
+	p.Stdout = &stdout
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	page := p.MustCreateWebPage()
+	if err := page.SetContent(`<html><body><script>console.log("HELLO")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the process so all output has been written.
+	p.MustClose()
+	if s := stdout.String(); !strings.Contains(s, "["+page.Ref().ID()+" ") || !strings.Contains(s, "] HELLO") {
+		t.Fatalf("unexpected output: %q", s)
+	}
+}
+
+// Ensure unused pages are closed after the process' page TTL.
+func TestProcess_PageTTL(t *testing.T) {
+	p := NewProcess()
+	p.PageTTL = 200 * time.Millisecond
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	// Keep one page in use while the other is left idle.
+	active, idle := p.MustCreateWebPage(), p.MustCreateWebPage()
+	for i := 0; i < 10; i++ {
+		if _, err := active.URL(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := idle.URL(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := idle.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := active.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure default page settings are applied to new pages and restored by Reset().
+func TestProcess_DefaultPageSettings(t *testing.T) {
+	// Mock external HTTP server which echoes the user agent and header.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>` + r.UserAgent() + "|" + r.Header.Get("X-Tenant") + `</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := NewProcess()
+	p.DefaultPageSettings = &phantomjs.PageDefaults{
+		ViewportWidth:  800,
+		ViewportHeight: 600,
+		UserAgent:      "test-agent",
+		CustomHeaders:  http.Header{"X-Tenant": {"A"}},
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if w, h, err := page.ViewportSize(); err != nil {
+		t.Fatal(err)
+	} else if w != 800 || h != 600 {
+		t.Fatalf("unexpected viewport: %dx%d", w, h)
+	}
+
+	// Override the header and then reset the page to restore the default.
+	if err := page.SetCustomHeaders(http.Header{"X-Tenant": {"B"}}); err != nil {
+		t.Fatal(err)
+	} else if err := page.Reset(); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "test-agent|A" {
+		t.Fatalf("unexpected text: %q", v)
+	}
+}
+
+// Ensure only non-zero default settings are sent so other settings are kept.
+func TestProcess_DefaultPageSettings_Merge(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	p := s.NewProcess()
+	p.DefaultPageSettings = &phantomjs.PageDefaults{
+		Settings: &phantomjs.WebPageSettings{UserAgent: "x", ResourceTimeout: time.Second},
+	}
+	if _, err := p.CreateWebPage(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := s.RequestsTo("/webpage/Create")
+	if len(a) != 1 {
+		t.Fatalf("unexpected request count: %d", len(a))
+	}
+	defaults, _ := a[0].Body["defaults"].(map[string]interface{})
+	if settings := defaults["settings"]; !reflect.DeepEqual(settings, map[string]interface{}{"userAgent": "x", "resourceTimeout": float64(1000)}) {
+		t.Fatalf("unexpected settings: %#v", settings)
+	}
+}
+
+// Ensure live refs can be listed and released.
+func TestProcess_Refs(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	if err := page.SetContentAndURL(`<html></html>`, "http://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := p.Refs()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 {
+		t.Fatalf("unexpected refs: %d", len(refs))
+	} else if r := refs[0]; r.ID != page.Ref().ID() || r.Type != "webpage" || r.URL != "http://example.com/" {
+		t.Fatalf("unexpected ref: %#v", r)
+	} else if r.LastUsed.Before(r.Created) || r.Age() > time.Minute {
+		t.Fatalf("unexpected times: created=%s lastUsed=%s", r.Created, r.LastUsed)
+	}
+
+	// Released pages are closed.
+	if err := p.ReleaseRef(page.Ref().ID()); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.URL(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if refs, err := p.Refs(); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 0 {
+		t.Fatalf("unexpected refs: %d", len(refs))
+	}
+}
+
+// Ensure web page can limit resource events to XHR traffic.
+func TestWebPage_SetXHROnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><img src="/logo.png"><script>var xhr = new XMLHttpRequest(); xhr.open("GET", "/api/data"); xhr.setRequestHeader("Accept", "application/json"); xhr.send()</script></body></html>`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetXHROnly(true); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.XHROnly(); err != nil {
+		t.Fatal(err)
+	} else if !v {
+		t.Fatal("expected XHR only")
+	}
+	page.Open(srv.URL)
+
+	// The setting persists across navigations.
+	if v, err := page.XHROnly(); err != nil {
+		t.Fatal(err)
+	} else if !v {
+		t.Fatal("expected XHR only after open")
+	}
+
+	// Only the XHR request should be reported.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case e := <-page.Events():
+			if e.Type != phantomjs.EventResourceRequested {
+				continue
+			} else if req := e.Data.(*phantomjs.ResourceRequest); req.URL != srv.URL+"/api/data" {
+				t.Fatalf("unexpected url: %s", req.URL)
+			} else if !req.XHR {
+				t.Fatal("expected XHR")
+			}
+			return
+		}
+	}
+}
+
+// Ensure captured downloads are re-fetched with the page's headers and cookies.
+func TestWebPage_Downloads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		} else if r.Header.Get("X-Account") != "1" {
+			http.Error(w, "missing header", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("PK\x03\x04"))
+	}))
+	defer srv.Close()
+
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleValue("/process/Cookies", []map[string]interface{}{{"name": "session", "value": "abc", "domain": "127.0.0.1", "path": "/"}})
+	s.Handle("/webpage/Downloads", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"downloads": []map[string]interface{}{{
+			"url":             srv.URL + "/files/report.zip?id=1",
+			"method":          "GET",
+			"headers":         []map[string]string{{"name": "X-Account", "value": "1"}, {"name": "Accept-Encoding", "value": "gzip"}},
+			"responseHeaders": []map[string]string{{"name": "Content-Disposition", "value": `attachment; filename="q1.zip"`}},
+			"contentType":     "application/zip",
+			"time":            "2020-01-02T03:04:05Z",
+		}}}, nil
+	})
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page.SetDownloadCapture(true); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := page.Downloads()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(a) != 1 {
+		t.Fatalf("unexpected downloads: %d", len(a))
+	} else if d := a[0]; d.Err != nil {
+		t.Fatal(d.Err)
+	} else if string(d.Data) != "PK\x03\x04" {
+		t.Fatalf("unexpected data: %q", d.Data)
+	} else if d.Filename != "q1.zip" || d.ContentType != "application/zip" {
+		t.Fatalf("unexpected download: %#v", d)
+	} else if !d.Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected time: %s", d.Time)
+	}
+}
+
+// Ensure a page and its resources are archived as MHTML.
+func TestWebPage_SaveMHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	}))
+	defer srv.Close()
+
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleValue("/process/Cookies", []map[string]interface{}{})
+	s.HandleValue("/webpage/URL", srv.URL+"/")
+	s.HandleValue("/webpage/Title", "Report")
+	s.HandleValue("/webpage/Content", `<html><body><img src="/logo.png"></body></html>`)
+	s.Handle("/webpage/HAR", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"entries": []map[string]interface{}{
+			{"request": map[string]interface{}{"method": "GET", "url": srv.URL + "/"}, "end": map[string]interface{}{"status": 200, "contentType": "text/html"}},
+			{"request": map[string]interface{}{"method": "GET", "url": srv.URL + "/logo.png"}, "end": map[string]interface{}{"status": 200, "contentType": "image/png"}},
+			{"request": map[string]interface{}{"method": "GET", "url": srv.URL + "/missing.css"}, "end": map[string]interface{}{"status": 404, "contentType": "text/css"}},
+		}}, nil
+	})
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := page.SaveMHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if v := msg.Header.Get("Snapshot-Content-Location"); v != srv.URL+"/" {
+		t.Fatalf("unexpected location: %s", v)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	} else if mediaType != "multipart/related" {
+		t.Fatalf("unexpected media type: %s", mediaType)
+	}
+
+	var parts []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		var r io.Reader = part
+		if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+			r = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part.Header.Get("Content-Location")+" "+part.Header.Get("Content-Type")+" "+string(data))
+	}
+
+	if !reflect.DeepEqual(parts, []string{
+		srv.URL + "/ text/html; charset=utf-8 " + `<html><body><img src="/logo.png"></body></html>`,
+		srv.URL + "/logo.png image/png \x89PNG",
+	}) {
+		t.Fatalf("unexpected parts: %q", parts)
+	}
+}
+
+// Ensure a page is saved with its resources and links to them rewritten.
+func TestWebPage_SaveComplete(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/css/site.css":
+			w.Write([]byte(`body { background: url(../img/bg.png); }`))
+		case "/img/bg.png":
+			w.Write([]byte("\x89PNG"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleValue("/process/Cookies", []map[string]interface{}{})
+	s.HandleValue("/webpage/URL", srv.URL+"/articles/1")
+	s.HandleValue("/webpage/Content", `<html><head><link rel="stylesheet" href="/css/site.css"></head><body><a href="/articles/2">Next</a><div style="background: url('../img/bg.png')"></div></body></html>`)
+	s.Handle("/webpage/HAR", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"entries": []map[string]interface{}{
+			{"request": map[string]interface{}{"method": "GET", "url": srv.URL + "/articles/1"}, "end": map[string]interface{}{"status": 200, "contentType": "text/html"}},
+			{"request": map[string]interface{}{"method": "GET", "url": srv.URL + "/css/site.css"}, "end": map[string]interface{}{"status": 200, "contentType": "text/css"}},
+			{"request": map[string]interface{}{"method": "GET", "url": srv.URL + "/img/bg.png"}, "end": map[string]interface{}{"status": 200, "contentType": "image/png"}},
+		}}, nil
+	})
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "phantomjs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := page.SaveComplete(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "index.html")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != `<html><head><link rel="stylesheet" href="files/0-site.css"></head><body><a href="/articles/2">Next</a><div style="background: url(files/1-bg.png)"></div></body></html>` {
+		t.Fatalf("unexpected html: %s", buf)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "files", "0-site.css")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != `body { background: url(1-bg.png); }` {
+		t.Fatalf("unexpected css: %s", buf)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "files", "1-bg.png")); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "\x89PNG" {
+		t.Fatalf("unexpected image: %q", buf)
+	}
+}
+
+// Ensure infinite scrolling content is loaded until the page stops growing.
+func TestWebPage_ScrollToBottomUntilStable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><div id="feed"></div><script>
+				var pages = 0;
+				function more() {
+					var xhr = new XMLHttpRequest();
+					xhr.open("GET", "/items");
+					xhr.onload = function() {
+						var div = document.createElement("div");
+						div.className = "item";
+						div.style.height = "1000px";
+						document.getElementById("feed").appendChild(div);
+					};
+					xhr.send();
+				}
+				window.onscroll = function() {
+					if (pages < 3 && window.scrollY + window.innerHeight >= document.body.scrollHeight) {
+						pages++;
+						more();
+					}
+				};
+				more();
+			</script></body></html>`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetViewportSize(800, 600); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if err := page.ScrollToBottomUntilStable(10, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(`function() { return document.querySelectorAll(".item").length }`); err != nil {
+		t.Fatal(err)
+	} else if v != float64(4) {
+		t.Fatalf("unexpected item count: %v", v)
+	}
+}
+
+// Ensure paginated listings can be iterated by link and by URL.
+func TestWebPage_Paginate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if n > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		next := fmt.Sprintf(`<a class="next" href="/?page=%d">Next</a>`, n+1)
+		if n == 3 {
+			next = `<a class="next disabled">Next</a>`
+		}
+		title := strings.TrimSpace(fmt.Sprintf("Page %d %s", n, r.URL.Query().Get("q")))
+		fmt.Fprintf(w, `<html><head><title>%s</title></head><body>%s</body></html>`, title, next)
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	var titles []string
+	perPage := func(page *phantomjs.WebPage) error {
+		title, err := page.Title()
+		titles = append(titles, title)
+		return err
+	}
+
+	// Follow "next" links until the link is disabled.
+	if err := page.Open(srv.URL + "/?page=1"); err != nil {
+		t.Fatal(err)
+	} else if err := page.Paginate("a.next", 10, perPage); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(titles, []string{"Page 1", "Page 2", "Page 3"}) {
+		t.Fatalf("unexpected titles: %v", titles)
+	}
+
+	// Open numbered URLs until a page is not found, limited to maxPages.
+	titles = nil
+	if err := page.Paginate(srv.URL+"/?page=%d", 10, perPage); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(titles, []string{"Page 1", "Page 2", "Page 3"}) {
+		t.Fatalf("unexpected titles: %v", titles)
+	}
+	titles = nil
+	if err := page.Paginate(srv.URL+"/?page=%d", 2, perPage); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(titles, []string{"Page 1", "Page 2"}) {
+		t.Fatalf("unexpected titles: %v", titles)
+	}
+
+	// Other percent-escapes in numbered URLs are kept.
+	titles = nil
+	if err := page.Paginate(srv.URL+"/?q=a%20b&page=%d", 2, perPage); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(titles, []string{"Page 1 a b", "Page 2 a b"}) {
+		t.Fatalf("unexpected titles: %v", titles)
+	}
+}
+
+// Ensure tables can be extracted from a page.
+func TestWebPage_ExtractTable(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><table id="t">
+		<thead><tr><th>Name</th><th colspan="2">Contact</th></tr></thead>
+		<tbody>
+			<tr><td rowspan="2">Alice</td><td>alice@example.com</td><td>555-0100</td></tr>
+			<tr><td>a@example.org</td><td>  555-0101
+			</td></tr>
+		</tbody>
+	</table></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows, err := page.ExtractTable("#t"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rows, [][]string{
+		{"Name", "Contact", "Contact"},
+		{"Alice", "alice@example.com", "555-0100"},
+		{"Alice", "a@example.org", "555-0101"},
+	}) {
+		t.Fatalf("unexpected rows: %#v", rows)
+	}
+
+	var buf bytes.Buffer
+	if err := page.ExtractTableCSV(&buf, "#t"); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "Name,Contact,Contact\nAlice,alice@example.com,555-0100\nAlice,a@example.org,555-0101\n" {
+		t.Fatalf("unexpected csv: %q", buf.String())
+	}
+
+	if _, err := page.ExtractTable("#missing"); err != phantomjs.ErrElementNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure links and images are extracted with absolute URLs.
+func TestWebPage_LinksImages(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContentAndURL(`<html><head><base href="http://example.com/docs/"></head><body>
+		<a href="intro.html" title="Intro" rel="next">  Getting
+			started </a>
+		<a href="javascript:void(0)">Menu</a>
+		<a href="/about">About</a>
+		<img src="logo.png" alt="Logo">
+	</body></html>`, "http://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if links, err := page.Links(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(links, []phantomjs.Link{
+		{URL: "http://example.com/docs/intro.html", Text: "Getting started", Title: "Intro", Rel: "next"},
+		{URL: "http://example.com/about", Text: "About"},
+	}) {
+		t.Fatalf("unexpected links: %#v", links)
+	}
+
+	if images, err := page.Images(); err != nil {
+		t.Fatal(err)
+	} else if len(images) != 1 || images[0].URL != "http://example.com/docs/logo.png" || images[0].Alt != "Logo" {
+		t.Fatalf("unexpected images: %#v", images)
+	}
+}
+
+// Ensure page metadata is extracted.
+func TestWebPage_Metadata(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContentAndURL(`<html><head>
+		<title>Example Post</title>
+		<meta name="description" content="A post about examples.">
+		<link rel="canonical" href="/posts/1">
+		<meta property="og:title" content="Example Post">
+		<meta property="og:type" content="article">
+		<meta property="og:image" content="/images/1.png">
+		<meta property="og:site_name" content="Example">
+		<meta name="twitter:card" content="summary_large_image">
+		<meta property="twitter:site" content="@example">
+	</head><body></body></html>`, "http://example.com/posts/1?ref=feed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := page.Metadata(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(m, &phantomjs.Metadata{
+		Title:       "Example Post",
+		Description: "A post about examples.",
+		Canonical:   "http://example.com/posts/1",
+		OpenGraph: phantomjs.OpenGraph{
+			Title:    "Example Post",
+			Type:     "article",
+			Image:    "http://example.com/images/1.png",
+			SiteName: "Example",
+		},
+		Twitter: phantomjs.Twitter{
+			Card: "summary_large_image",
+			Site: "@example",
+		},
+	}) {
+		t.Fatalf("unexpected metadata: %#v", m)
+	}
+}
+
+// Ensure an article can be extracted with a Readability already in the page.
+func TestWebPage_Article(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Use a stub in place of Readability which returns the <article> element
+	// and removes it from the document it parses.
+	if err := page.SetContent(`<html><head><title>Post</title><script>
+		function Readability(doc) { this.doc = doc; }
+		Readability.prototype.parse = function() {
+			var el = this.doc.querySelector("article");
+			if (!el) { return null; }
+			el.parentNode.removeChild(el);
+			return {title: this.doc.title, byline: "Alice", content: el.innerHTML, textContent: el.textContent};
+		};
+	</script></head><body><nav>Menu</nav><article><p>Hello</p></article></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if article, err := page.Article(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(article, &phantomjs.Article{Title: "Post", Byline: "Alice", HTML: "<p>Hello</p>", Text: "Hello"}) {
+		t.Fatalf("unexpected article: %#v", article)
+	}
+
+	// The page's own document is left intact.
+	if _, err := page.Article(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure rendered content is converted to Markdown.
+func TestWebPage_Markdown(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	// Nodes as serialized by the shim for:
+	//
+	//	<h1>Title</h1>
+	//	<p>Some <b>bold </b>and <a href="http://example.com/">a link</a>.<br>2*2</p>
+	//	<ul><li>One</li><li>Two<ol><li>Nested</li></ol></li></ul>
+	//	<pre>x := 1
+	//	</pre>
+	//	<table><tr><th>A</th><th>B</th></tr><tr><td>1</td><td>a|b</td></tr></table>
+	var tree interface{}
+	if err := json.Unmarshal([]byte(`{"tag": "div", "children": [
+		{"tag": "h1", "children": [{"text": "Title"}]},
+		{"text": "\n  "},
+		{"tag": "p", "children": [
+			{"text": "Some "},
+			{"tag": "b", "children": [{"text": "bold "}]},
+			{"text": "and "},
+			{"tag": "a", "attrs": {"href": "http://example.com/"}, "children": [{"text": "a link"}]},
+			{"text": "."},
+			{"tag": "br"},
+			{"text": "2*2"}
+		]},
+		{"tag": "ul", "children": [
+			{"tag": "li", "children": [{"text": "One"}]},
+			{"tag": "li", "children": [
+				{"text": "Two"},
+				{"tag": "ol", "children": [{"tag": "li", "children": [{"text": "Nested"}]}]}
+			]}
+		]},
+		{"tag": "pre", "children": [{"text": "x := 1\n"}]},
+		{"tag": "table", "children": [{"tag": "tbody", "children": [
+			{"tag": "tr", "children": [{"tag": "th", "children": [{"text": "A"}]}, {"tag": "th", "children": [{"text": "B"}]}]},
+			{"tag": "tr", "children": [{"tag": "td", "children": [{"text": "1"}]}, {"tag": "td", "children": [{"text": "a|b"}]}]}
+		]}]}
+	]}`), &tree); err != nil {
+		t.Fatal(err)
+	}
+	s.HandleValue("/webpage/Markdown", tree)
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md, err := page.Markdown("#content"); err != nil {
+		t.Fatal(err)
+	} else if md != "# Title\n\n"+
+		"Some **bold** and [a link](http://example.com/).  \n2\\*2\n\n"+
+		"- One\n- Two\n\n  1. Nested\n\n"+
+		"```\nx := 1\n```\n\n"+
+		"| A | B |\n| --- | --- |\n| 1 | a\\|b |\n" {
+		t.Fatalf("unexpected markdown: %q", md)
+	} else if a := s.RequestsTo("/webpage/Markdown"); len(a) != 1 || a[0].Body["selector"] != "#content" {
+		t.Fatalf("unexpected requests: %#v", a)
+	}
+
+	// Missing elements are serialized as null.
+	s.HandleValue("/webpage/Markdown", nil)
+	if _, err := page.Markdown("#missing"); err != phantomjs.ErrElementNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web storage can be seeded, read, and cleared for the page's origin.
+func TestWebPage_Storage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><script>localStorage.setItem("theme", "dark")</script></body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Storage is unavailable until the page has an origin.
+	if _, err := page.LocalStorage(); err != phantomjs.ErrStorageUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetLocalStorageItem("token", "abc"); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetSessionStorageItem("tab", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, err := page.LocalStorage(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(items, map[string]string{"theme": "dark", "token": "abc"}) {
+		t.Fatalf("unexpected items: %#v", items)
+	} else if items, err := page.SessionStorage(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(items, map[string]string{"tab": "1"}) {
+		t.Fatalf("unexpected items: %#v", items)
+	}
+
+	if err := page.ClearStorage(); err != nil {
+		t.Fatal(err)
+	} else if items, err := page.LocalStorage(); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 0 {
+		t.Fatalf("unexpected items: %#v", items)
+	}
+}
+
+// Ensure a page's properties can be retrieved in a single snapshot.
+func TestWebPage_Snapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "id", Value: "1"})
+		w.Write([]byte(`<html><head><title>Snap</title></head><body><iframe name="ad" src="about:blank"></iframe></body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetViewportSize(640, 480); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetClipRect(phantomjs.Rect{Width: 100, Height: 50}); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := page.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	} else if snapshot.URL != srv.URL+"/" || snapshot.Title != "Snap" {
+		t.Fatalf("unexpected url/title: %s, %s", snapshot.URL, snapshot.Title)
+	} else if content, _ := page.Content(); snapshot.ContentLength != len(content) {
+		t.Fatalf("unexpected content length: %d", snapshot.ContentLength)
+	} else if snapshot.FrameCount != 1 || !reflect.DeepEqual(snapshot.FrameNames, []string{"ad"}) {
+		t.Fatalf("unexpected frames: %d, %v", snapshot.FrameCount, snapshot.FrameNames)
+	} else if snapshot.ViewportWidth != 640 || snapshot.ViewportHeight != 480 {
+		t.Fatalf("unexpected viewport: %dx%d", snapshot.ViewportWidth, snapshot.ViewportHeight)
+	} else if snapshot.ClipRect != (phantomjs.Rect{Width: 100, Height: 50}) {
+		t.Fatalf("unexpected clip rect: %#v", snapshot.ClipRect)
+	} else if len(snapshot.Cookies) != 1 || snapshot.Cookies[0].Name != "id" {
+		t.Fatalf("unexpected cookies: %#v", snapshot.Cookies)
+	} else if settings, _ := page.Settings(); !reflect.DeepEqual(snapshot.Settings, settings) {
+		t.Fatalf("unexpected settings: %#v", snapshot.Settings)
+	}
+}
+
+// Ensure cached properties are only requested again after invalidation.
+func TestProcess_CacheProperties(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.Handle("/webpage/Settings", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"settings": map[string]interface{}{"userAgent": "A"}}, nil
+	})
+
+	p := s.NewProcess()
+	p.CacheProperties = true
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := func() {
+		if v, err := page.Settings(); err != nil {
+			t.Fatal(err)
+		} else if v.UserAgent != "A" {
+			t.Fatalf("unexpected settings: %#v", v)
+		}
+	}
+
+	// Repeated reads are served from the cache.
+	settings()
+	settings()
+	if n := len(s.RequestsTo("/webpage/Settings")); n != 1 {
+		t.Fatalf("unexpected requests: %d", n)
+	}
+
+	// Setters and navigation invalidate the cache.
+	if err := page.SetSettings(phantomjs.WebPageSettings{UserAgent: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	settings()
+	if err := page.Open("http://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	settings()
+	settings()
+	if n := len(s.RequestsTo("/webpage/Settings")); n != 3 {
+		t.Fatalf("unexpected requests: %d", n)
+	}
+}
+
+// Ensure large content can be streamed from a page.
+func TestWebPage_ContentReader(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Generate content spanning several chunks with multi-byte characters.
+	if err := page.SetContent(`<html><body><script>
+		var s = "";
+		for (var i = 0; i < 50000; i++) { s += "<p>\u00e9\ud83d\ude00" + i + "</p>"; }
+		document.body.innerHTML = s;
+	</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := page.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := page.ContentReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if buf, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != content {
+		t.Fatalf("unexpected content: len=%d, expected=%d", len(buf), len(content))
+	} else if !strings.Contains(content, "<p>\u00e9\U0001F60049999</p>") {
+		t.Fatal("expected generated content")
+	}
+}
+
+// Ensure cancelling the context of an open cancels the request in the shim.
+func TestWebPage_OpenContext_Cancel(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	// Block the open until the shim is told to cancel it.
+	canceled := make(chan struct{})
+	s.Handle("/cancel", func(req *phantomjstest.Request) (interface{}, error) {
+		close(canceled)
+		return nil, nil
+	})
+	s.Handle("/webpage/Open", func(req *phantomjstest.Request) (interface{}, error) {
+		<-canceled
+		return map[string]interface{}{"status": "fail"}, nil
+	})
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := page.OpenContext(ctx, "http://example.com/"); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Verify the cancellation refers to the open request.
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected cancel request")
+	}
+	opens, cancels := s.RequestsTo("/webpage/Open"), s.RequestsTo("/cancel")
+	if len(opens) != 1 || opens[0].ID == "" {
+		t.Fatalf("unexpected open requests: %#v", opens)
+	} else if len(cancels) != 1 || cancels[0].Body["id"] != opens[0].ID {
+		t.Fatalf("unexpected cancel requests: %#v", cancels)
+	}
+}
+
+// Ensure responses larger than the process' limit return an error.
+func TestProcess_MaxResponseBytes(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleValue("/webpage/Content", strings.Repeat("x", 10000))
+
+	p := s.NewProcess()
+	p.MaxResponseBytes = 1000
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The error reports the actual size of the response.
+	if _, err := page.Content(); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*phantomjs.ResponseTooLargeError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e.Path != "/webpage/Content" || e.Size <= 10000 || e.Limit != 1000 {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+
+	// Responses within the limit are unaffected.
+	s.HandleValue("/webpage/Content", "<html></html>")
+	if content, err := page.Content(); err != nil {
+		t.Fatal(err)
+	} else if content != "<html></html>" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+}
+
+// Ensure requests beyond a full queue are rejected with the error policy.
+func TestProcess_QueuePolicy_Error(t *testing.T) {
+	s, page, unblock := MustOpenQueuedPage(phantomjs.QueueError)
+	defer s.Close()
+
+	// The first request is in flight and the second is queued.
+	first, second := make(chan error, 1), make(chan error, 1)
+	go func() { _, err := page.Content(); first <- err }()
+	<-unblock
+	go func() { _, err := page.Content(); second <- err }()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := page.Content(); err != phantomjs.ErrQueueFull {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Both accepted requests complete once the shim responds.
+	unblock <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	<-unblock
+	unblock <- struct{}{}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the oldest queued request is dropped with the drop policy.
+func TestProcess_QueuePolicy_Drop(t *testing.T) {
+	s, page, unblock := MustOpenQueuedPage(phantomjs.QueueDrop)
+	defer s.Close()
+
+	// The first request is in flight and the second is queued.
+	first, second, third := make(chan error, 1), make(chan error, 1), make(chan error, 1)
+	go func() { _, err := page.Content(); first <- err }()
+	<-unblock
+	go func() { _, err := page.Content(); second <- err }()
+	time.Sleep(50 * time.Millisecond)
+
+	// A third request drops the second.
+	go func() { _, err := page.Content(); third <- err }()
+	if err := <-second; err != phantomjs.ErrRequestDropped {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	unblock <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	<-unblock
+	unblock <- struct{}{}
+	if err := <-third; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure navigation is limited by the queue like other work.
+func TestProcess_MaxInFlight_Open(t *testing.T) {
+	s, page, unblock := MustOpenQueuedPage(phantomjs.QueueError)
+	defer s.Close()
+
+	// The first request is in flight and the second is queued.
+	first, second := make(chan error, 1), make(chan error, 1)
+	go func() { _, err := page.Content(); first <- err }()
+	<-unblock
+	go func() { _, err := page.Content(); second <- err }()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := page.Open("http://example.com/"); err != phantomjs.ErrQueueFull {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	unblock <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	<-unblock
+	unblock <- struct{}{}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a wait does not hold the only queue slot needed by the action which
+// completes it.
+func TestProcess_MaxInFlight_Wait(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	clicked := make(chan struct{})
+	s.Handle("/webpage/WaitForNavigation", func(req *phantomjstest.Request) (interface{}, error) {
+		select {
+		case <-clicked:
+			return map[string]interface{}{"status": "success"}, nil
+		case <-time.After(5 * time.Second):
+			return map[string]interface{}{"timeout": true}, nil
+		}
+	})
+	s.Handle("/webpage/SendMouseEvent", func(req *phantomjstest.Request) (interface{}, error) {
+		close(clicked)
+		return map[string]interface{}{}, nil
+	})
+
+	p := s.NewProcess()
+	p.MaxInFlight = 1
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { _, err := page.WaitForNavigation(5 * time.Second); done <- err }()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := page.SendMouseEvent("click", 0, 0, "left"); err != nil {
+		t.Fatal(err)
+	} else if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure metadata can be added to a PDF.
+func TestApplyPDFInfo(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", -5*60*60))
+	buf, err := phantomjs.ApplyPDFInfo(MustBuildPDF(1), phantomjs.PDFInfo{
+		Title:        "Q1 (draft)",
+		Author:       "Zoë",
+		Keywords:     "report, finance",
+		CreationDate: created,
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(buf, []byte("5 0 obj\n<< /Title (Q1 \\(draft\\)) /Author <FEFF005A006F00EB> /Keywords (report, finance) /Producer (PhantomJS) /CreationDate (D:20200102030405-05'00') /ModDate (D:20200102030405-05'00') >>")) {
+		t.Fatalf("unexpected info: %s", buf)
+	} else if !bytes.Contains(buf, []byte("/Size 6 /Root 1 0 R /Info 5 0 R /Prev ")) {
+		t.Fatalf("unexpected trailer: %s", buf)
+	}
+
+	// Ensure the update can be read back, such as by merging.
+	if buf, err := phantomjs.MergePDF([][]byte{buf}); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(buf, []byte("/Count 1 >>")) {
+		t.Fatalf("unexpected merge: %s", buf)
+	}
+}
+
+// Ensure several URLs can be rendered into a single PDF.
+func TestProcess_RenderPDFMulti(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><body>%s</body></html>`, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	buf, err := p.RenderPDFMulti([]string{srv.URL + "/a", srv.URL + "/b"}, phantomjs.PDFOptions{PaperSize: phantomjs.PaperSize{Format: "A4"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(buf, []byte("%PDF-")) {
+		t.Fatal("expected pdf data")
+	} else if !bytes.Contains(buf, []byte("/Count 2 >>")) {
+		t.Fatal("expected two pages")
+	}
+}
+
+// Ensure URLs can be captured concurrently with a result per request.
+func TestProcess_Screenshots(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><script>setTimeout(function() { document.body.innerHTML = '<div id="ready">OK</div>'; }, 50)</script></body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	results, err := p.Screenshots([]phantomjs.ScreenshotRequest{
+		{URL: srv.URL + "/a", Width: 100, Height: 200, WaitSelector: "#ready"},
+		{URL: "http://127.0.0.1:1/"},
+		{URL: srv.URL + "/b", Width: 300, Height: 100},
+		{URL: srv.URL + "/c", WaitSelector: "#never", WaitTimeout: 200 * time.Millisecond},
+		{URL: srv.URL + "/d", Width: 250},
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != 5 {
+		t.Fatalf("unexpected result count: %d", len(results))
+	}
+
+	if r := results[0]; r.Err != nil {
+		t.Fatal(r.Err)
+	} else if bounds := r.Image.Bounds(); r.URL != srv.URL+"/a" || bounds.Max.X != 100 || bounds.Max.Y != 200 {
+		t.Fatalf("unexpected result: %s %v", r.URL, bounds)
+	}
+	if r := results[1]; r.Err == nil {
+		t.Fatal("expected error")
+	}
+	if r := results[2]; r.Err != nil {
+		t.Fatal(r.Err)
+	} else if bounds := r.Image.Bounds(); bounds.Max.X != 300 || bounds.Max.Y != 100 {
+		t.Fatalf("unexpected dimensions: %v", bounds)
+	}
+	if r := results[3]; r.Err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", r.Err)
+	}
+
+	// A lone width keeps the page's height.
+	if r := results[4]; r.Err != nil {
+		t.Fatal(r.Err)
+	} else if bounds := r.Image.Bounds(); bounds.Max.X != 250 {
+		t.Fatalf("unexpected dimensions: %v", bounds)
+	}
+}
+
+// Ensure PDF documents are merged into one document with all of their pages.
+func TestMergePDF(t *testing.T) {
+	buf, err := phantomjs.MergePDF([][]byte{MustBuildPDF(2), MustBuildPDF(1)})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(buf, []byte("/Type /Pages /Kids [2 0 R 7 0 R] /Count 3")) {
+		t.Fatalf("unexpected page tree: %s", buf)
+	} else if !bytes.Contains(buf, []byte("2 0 obj\n<< /Parent 10 0 R /Type /Pages /Kids [3 0 R 4 0 R]")) {
+		t.Fatalf("unexpected first document: %s", buf)
+	} else if !bytes.Contains(buf, []byte("/Contents 9 0 R")) {
+		t.Fatalf("unexpected renumbering: %s", buf)
+	}
+
+	// Merging the result again ensures its cross-reference table is valid.
+	if buf, err = phantomjs.MergePDF([][]byte{buf, MustBuildPDF(1)}); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(buf, []byte("/Kids [10 0 R 13 0 R] /Count 4")) {
+		t.Fatalf("unexpected page tree: %s", buf)
+	}
+
+	if _, err := phantomjs.MergePDF([][]byte{[]byte("%PDF-1.5\n")}); err == nil || !strings.Contains(err.Error(), phantomjs.ErrUnsupportedPDF.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a web page can be reset to the state of a new page.
+func TestWebPage_Reset(t *testing.T) {
+	// Mock external HTTP server which sets a cookie and echoes request cookies.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		}
+		w.Write([]byte(`<html><body>` + r.Header.Get("Cookie") + "|" + r.Header.Get("X-Tenant") + `</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Leave state behind on the page.
+	hdr := make(http.Header)
+	hdr.Set("X-Tenant", "A")
+	if err := page.SetCustomHeaders(hdr); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL + "/login"); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetClipRect(phantomjs.Rect{Width: 10, Height: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := page.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the page is blank and its state is cleared.
+	if v, err := page.URL(); err != nil {
+		t.Fatal(err)
+	} else if v != "about:blank" {
+		t.Fatalf("unexpected url: %s", v)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "" {
+		t.Fatalf("unexpected text: %q", v)
+	} else if rect, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if rect != (phantomjs.Rect{}) {
+		t.Fatalf("unexpected clip rect: %#v", rect)
+	} else if hdr, err := page.CustomHeaders(); err != nil {
+		t.Fatal(err)
+	} else if len(hdr) != 0 {
+		t.Fatalf("unexpected headers: %#v", hdr)
+	}
+
+	// Neither the cookie nor the header should be sent to the server.
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "|" {
+		t.Fatalf("unexpected text: %q", v)
+	}
+}
+
+// Ensure pages can be acquired from and released to a pool.
+func TestPagePool(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	pool := phantomjs.NewPagePool(p, 2)
+	if err := pool.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	page0, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page1, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := page0.SetContent(`<html><body>FOO</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Released pages should be reset before being handed out again.
+	pool.Release(page0)
+	if page, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	} else if page != page0 {
+		t.Fatal("expected page to be reused")
+	} else if v, err := page.URL(); err != nil {
+		t.Fatal(err)
+	} else if v != "about:blank" {
+		t.Fatalf("unexpected url: %s", v)
+	} else {
+		pool.Release(page)
+	}
+	pool.Release(page1)
+
+	// Acquiring from a closed pool should return an error.
+	pool.Close()
+	if _, err := pool.Acquire(); err != phantomjs.ErrPoolClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the pool can clear the process' cookie jar as pages are released.
+func TestPagePool_ClearCookies(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	pool := phantomjs.NewPagePool(s.NewProcess(), 1)
+	if err := pool.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// Cookies are kept by default.
+	page, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(page)
+	if a := s.RequestsTo("/process/ClearCookies"); len(a) != 0 {
+		t.Fatalf("unexpected requests: %d", len(a))
+	}
+
+	// The whole jar is cleared before the page is reset.
+	pool.ClearCookies = true
+	if page, err = pool.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(page)
+	if a := s.RequestsTo("/process/ClearCookies"); len(a) != 1 {
+		t.Fatalf("unexpected requests: %d", len(a))
+	} else if a := s.RequestsTo("/webpage/Reset"); len(a) != 2 {
+		t.Fatalf("unexpected reset requests: %d", len(a))
+	}
+}
+
+// Ensure the pool rotates user agents as pages are acquired.
+func TestPagePool_UserAgent(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	pool := phantomjs.NewPagePool(s.NewProcess(), 2)
+	pool.UserAgent = phantomjs.RotateUserAgents([]string{"A", "B"})
+	if err := pool.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var agents []string
+	for i := 0; i < 3; i++ {
+		page, err := pool.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		agents = append(agents, page.RotatedUserAgent())
+		pool.Release(page)
+	}
+	if !reflect.DeepEqual(agents, []string{"A", "B", "A"}) {
+		t.Fatalf("unexpected user agents: %v", agents)
+	}
+
+	// Verify the user agent was set on each page.
+	if a := s.RequestsTo("/webpage/SetSettings"); len(a) != 3 {
+		t.Fatalf("unexpected requests: %d", len(a))
+	} else if settings, _ := a[1].Body["settings"].(map[string]interface{}); settings["userAgent"] != "B" {
+		t.Fatalf("unexpected settings: %#v", a[1].Body)
+	}
+}
+
+// Ensure the pool recycles pages after a number of navigations or an age.
+func TestPagePool_Recycle(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	pool := phantomjs.NewPagePool(s.NewProcess(), 1)
+	pool.RecycleAfter = 2
+	if err := pool.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// Pages below the limit are reused.
+	page0, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page0.Open("http://example.com/1"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(page0)
+	if page, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	} else if page != page0 {
+		t.Fatal("expected page to be reused")
+	}
+
+	// Pages reaching the limit are closed and replaced.
+	if err := page0.Open("http://example.com/2"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(page0)
+	page1, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	} else if page1 == page0 {
+		t.Fatal("expected page to be recycled")
+	} else if a := s.RequestsTo("/webpage/Close"); len(a) != 1 || a[0].Ref != page0.Ref().ID() {
+		t.Fatalf("unexpected requests: %#v", a)
+	}
+
+	// Pages older than the age limit are replaced.
+	pool.RecycleAfter, pool.RecycleAge = 0, time.Nanosecond
+	pool.Release(page1)
+	if page, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	} else if page == page1 {
+		t.Fatal("expected page to be recycled")
+	} else {
+		pool.Release(page)
+	}
+}
+
+// Ensure Acquire returns an error instead of blocking when the pool cannot
+// replace its pages, and recovers once pages can be created again.
+func TestPagePool_ReplaceError(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	proc := s.NewProcess()
+
+	var mu sync.Mutex
+	var failing bool
+	pool := phantomjs.NewPagePool(WebPageCreatorFunc(func() (*phantomjs.WebPage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return nil, errors.New("marker")
+		}
+		return proc.CreateWebPage()
+	}), 1)
+	if err := pool.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	page, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	pool.Discard(page)
+
+	acquire := func() (*phantomjs.WebPage, error) {
+		ch := make(chan error, 1)
+		var page *phantomjs.WebPage
+		go func() {
+			var err error
+			page, err = pool.Acquire()
+			ch <- err
+		}()
+		select {
+		case err := <-ch:
+			return page, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+			return nil, nil
+		}
+	}
+	if _, err := acquire(); err == nil || err.Error() != "marker" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Replacements are retried once pages can be created. Retries started
+	// before then may still report the error.
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	for i := 0; ; i++ {
+		if _, err := acquire(); err == nil {
+			break
+		} else if err.Error() != "marker" || i == 10 {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure a session's headers and user agent are applied to its pages.
+func TestSession_CreateWebPage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><body><div id="ua">%s</div><div id="x">%s</div></body></html>`, r.UserAgent(), r.Header.Get("X-Account"))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	session := &phantomjs.Session{
+		Header:    http.Header{"X-Account": {"alice"}},
+		UserAgent: "TestAgent/1.0",
+	}
+	page, err := session.CreateWebPage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClosePage(page)
+
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(`function() { return document.getElementById('ua').innerText + ',' + document.getElementById('x').innerText }`); err != nil {
+		t.Fatal(err)
+	} else if v != "TestAgent/1.0,alice" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+}
+
+// Ensure a login form can be filled in and submitted.
+func TestWebPage_Login(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.Method == "POST" && r.FormValue("user") == "alice" && r.FormValue("pass") == "secret" {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+				http.Redirect(w, r, "/home", http.StatusFound)
+				return
+			}
+			w.Write([]byte(`<html><body><form method="POST" action="/login"><input name="user"><input name="pass" type="password"><button id="go">Go</button></form></body></html>`))
+		case "/home":
+			w.Write([]byte(`<html><body><a class="logout" href="/logout">Log out</a></body></html>`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	spec := phantomjs.LoginSpec{
+		URL:              srv.URL + "/login",
+		UserSelector:     "input[name=user]",
+		PassSelector:     "input[name=pass]",
+		SubmitSelector:   "#go",
+		Username:         "alice",
+		Password:         "secret",
+		SuccessCondition: `function() { return !!document.querySelector('.logout') }`,
+		Timeout:          5 * time.Second,
+	}
+	if cookies, err := page.Login(spec); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "abc" {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	}
+
+	// Rejected credentials fail to meet the success condition.
+	spec.Password, spec.Timeout = "wrong", 500*time.Millisecond
+	if _, err := page.Login(spec); err != phantomjs.ErrLoginFailed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Missing fields are reported.
+	spec.UserSelector = "#missing"
+	if _, err := page.Login(spec); err != phantomjs.ErrElementNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure scripts can be injected into the PhantomJS context.
+func TestProcess_InjectJS(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Write a script to a separate directory which changes the library path
+	// so its evaluation can be observed.
+	dir, err := ioutil.TempDir("", "phantomjs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.js"), []byte(`phantom.libraryPath = "/injected";`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := p.LibraryPath(); err != nil {
+		t.Fatal(err)
+	} else if v != p.Path() {
+		t.Fatalf("unexpected library path: %s", v)
+	} else if err := p.SetLibraryPath(dir); err != nil {
+		t.Fatal(err)
+	} else if err := p.InjectJS("lib.js"); err != nil {
+		t.Fatal(err)
+	} else if v, err := p.LibraryPath(); err != nil {
+		t.Fatal(err)
+	} else if v != "/injected" {
+		t.Fatalf("unexpected library path: %s", v)
+	}
+
+	if err := p.InjectJS("missing.js"); err != phantomjs.ErrInjectionFailed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure uncaught errors in the PhantomJS context are reported as events.
+func TestProcess_Events(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+	ch := p.Events()
+
+	// Throw from a timer so the error is not caught by the shim.
+	if err := ioutil.WriteFile(filepath.Join(p.Path(), "throw.js"), []byte(`setTimeout(function() { throw new Error("boom"); }, 0);`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := p.InjectJS("throw.js"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-ch:
+		if e.Type != phantomjs.EventError {
+			t.Fatalf("unexpected event type: %s", e.Type)
+		} else if err, ok := e.Data.(*phantomjs.PageError); !ok || !strings.Contains(err.Message, "boom") {
+			t.Fatalf("unexpected event data: %#v", e.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+// Ensure files on the PhantomJS host can be managed through the fs module.
+func TestFS(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+	fs := p.FS()
+
+	// Write binary data to a new directory.
+	dir := filepath.Join(p.Path(), "out")
+	data := []byte{0, 1, 2, 0xff, 'A'}
+	if err := fs.WriteFile(filepath.Join(dir, "a.bin"), data); err != nil {
+		t.Fatal(err)
+	} else if buf, err := fs.ReadFile(filepath.Join(dir, "a.bin")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, data) {
+		t.Fatalf("unexpected data: %v", buf)
+	}
+
+	if ok, err := fs.Exists(dir); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected directory to exist")
+	} else if names, err := fs.List(dir); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"a.bin"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	// Remove the directory and its contents.
+	if err := fs.Remove(dir); err != nil {
+		t.Fatal(err)
+	} else if ok, err := fs.Exists(dir); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected directory to be removed")
+	} else if _, err := fs.ReadFile(filepath.Join(dir, "a.bin")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := fs.Remove(dir); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the process can report information about its host.
+func TestProcess_SystemInfo(t *testing.T) {
+	p := NewProcess()
+	p.Args = []string{"--ignore-ssl-errors=true"}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	info, err := p.SystemInfo()
+	if err != nil {
+		t.Fatal(err)
+	} else if info.PID <= 0 {
+		t.Fatalf("unexpected pid: %d", info.PID)
+	} else if info.OSName == "" || info.Version == "" {
+		t.Fatalf("unexpected info: %#v", info)
+	} else if info.Env["PORT"] != strconv.Itoa(p.Port) {
+		t.Fatalf("unexpected env: %#v", info.Env)
+	} else if len(info.Args) != 1 || filepath.Base(info.Args[0]) != "shim.js" {
+		t.Fatalf("unexpected args: %#v", info.Args)
+	}
+}
+
+// Ensure commands can be run on the PhantomJS host.
+func TestProcess_Spawn(t *testing.T) {
+	p := NewProcess()
+	p.AllowSpawn = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	if result, err := p.Spawn("sh", "-c", "echo out; echo err >&2; exit 3"); err != nil {
+		t.Fatal(err)
+	} else if result.ExitCode != 3 || result.Stdout != "out\n" || result.Stderr != "err\n" {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+}
+
+// Ensure commands cannot be run unless spawning is allowed.
+func TestProcess_Spawn_Disabled(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	if _, err := p.Spawn("true"); err != phantomjs.ErrSpawnDisabled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Calling the shim directly is rejected as well.
+	info, err := p.SystemInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", p.URL()+"/process/Spawn", strings.NewReader(`{"name":"true","args":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Phantomjs-Token", info.Env["TOKEN"])
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if body, _ := ioutil.ReadAll(resp.Body); !strings.Contains(string(body), "spawn disabled") {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+}
+
+// Ensure the shim rejects requests which do not carry the process' token,
+// such as from pages loaded by PhantomJS.
+func TestProcess_Token(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	for _, path := range []string{"/ping", "/process/SystemInfo", "/fs/Read", "/fs/Write", "/fs/Remove"} {
+		resp, err := http.Post(p.URL()+path, "text/plain", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: unexpected status: %d", path, resp.StatusCode)
+		}
+	}
+
+	// A page cannot reach the API either.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(`function() {
+		var xhr = new XMLHttpRequest();
+		xhr.open('POST', '` + p.URL() + `/process/SystemInfo', false);
+		try { xhr.send('{}'); } catch (e) { return 0; }
+		return xhr.status;
+	}`); err != nil {
+		t.Fatal(err)
+	} else if v == float64(http.StatusOK) {
+		t.Fatal("expected page request to be rejected")
+	}
+}
+
+// Ensure handler scripts cannot be served without the process' token.
+func TestProcess_ServeHandlerJS_Token(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	resp, err := http.Post(p.URL()+"/process/Serve", "text/plain", strings.NewReader(`{"script":"function(req, resp) {}"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+// Ensure fixtures can be served from within PhantomJS.
+func TestProcess_ServeStatic(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	dir := filepath.Join(p.Path(), "fixtures")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(`<html><body>FIXTURE</body></html>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := p.ServeStatic(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.Open(srv.URL() + "/"); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "FIXTURE" {
+		t.Fatalf("unexpected text: %q", v)
+	} else if err := page.Open(srv.URL() + "/missing.html"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure a JavaScript handler can be served from within PhantomJS.
+func TestProcess_ServeHandlerJS(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	srv, err := p.ServeHandlerJS(`function(request, response) {
+		response.statusCode = 200;
+		response.write("<html><body>" + request.url + "</body></html>");
+		response.close();
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.Open(srv.URL() + "/foo"); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "/foo" {
+		t.Fatalf("unexpected text: %q", v)
+	}
+}
+
+// Ensure the proxy can be changed at runtime.
+func TestProcess_SetProxy(t *testing.T) {
+	// Mock proxy which responds with the requested URL.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>` + r.URL.String() + `</body></html>`))
+	}))
+	defer proxy.Close()
+	host, port, _ := net.SplitHostPort(proxy.Listener.Addr().String())
+	portN, _ := strconv.Atoi(port)
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := p.SetProxy(phantomjs.Proxy{Host: host, Port: portN}); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open("http://fixture.test/foo"); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "http://fixture.test/foo" {
+		t.Fatalf("unexpected text: %q", v)
+	}
+}
+
+// Ensure proxies are formatted with their type.
+func TestProxy_String(t *testing.T) {
+	if s := (phantomjs.Proxy{Host: "10.0.0.1", Port: 8080}).String(); s != "http://10.0.0.1:8080" {
+		t.Fatalf("unexpected string: %s", s)
+	} else if s := (phantomjs.Proxy{Host: "::1", Port: 1080, Type: "socks5", Username: "u"}).String(); s != "socks5://[::1]:1080" {
+		t.Fatalf("unexpected string: %s", s)
+	}
+}
+
+// Ensure pages are spread across processes and proxies can be rotated.
+func TestProxyRotator(t *testing.T) {
+	s0, s1 := phantomjstest.NewServer(), phantomjstest.NewServer()
+	defer s0.Close()
+	defer s1.Close()
+	p0, p1 := s0.NewProcess(), s1.NewProcess()
+
+	proxies := []phantomjs.Proxy{
+		{Host: "10.0.0.1", Port: 8080},
+		{Host: "10.0.0.2", Port: 8080},
+		{Host: "10.0.0.3", Port: 8080},
+	}
+	r := phantomjs.NewProxyRotator([]*phantomjs.Process{p0, p1}, proxies)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	} else if a := s0.RequestsTo("/process/SetProxy"); len(a) != 1 || a[0].Body["host"] != "10.0.0.1" {
+		t.Fatalf("unexpected requests: %#v", a)
+	}
+
+	// Pages alternate between processes.
+	page0, err := r.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page1, err := r.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if v := r.ProxyFor(page0); v != proxies[0] {
+		t.Fatalf("unexpected proxy: %s", v)
+	} else if v := r.ProxyFor(page1); v != proxies[1] {
+		t.Fatalf("unexpected proxy: %s", v)
+	}
+
+	// Rotating assigns the next unused proxy once.
+	if v, err := r.Rotate(page0, proxies[0]); err != nil {
+		t.Fatal(err)
+	} else if v != proxies[2] || r.ProxyFor(page0) != proxies[2] {
+		t.Fatalf("unexpected proxy: %s", v)
+	} else if v, err := r.Rotate(page0, proxies[0]); err != nil || v != proxies[2] {
+		t.Fatalf("unexpected rotation: %s, %v", v, err)
+	} else if _, err := r.Rotate(page1, proxies[1]); err != phantomjs.ErrNoProxies {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure proxies are rotated when a page load detects a failure.
+func TestProxyRotator_OpenPage(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	p := s.NewProcess()
+
+	proxies := []phantomjs.Proxy{{Host: "10.0.0.1", Port: 8080}, {Host: "10.0.0.2", Port: 8080}}
+	r := phantomjs.NewProxyRotator([]*phantomjs.Process{p}, proxies)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	page, err := r.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A redirect to a ban page rotates the proxy.
+	var status int
+	s.Handle("/webpage/HAR", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"entries": []map[string]interface{}{
+			{"request": map[string]interface{}{"url": "http://example.com/"}, "end": map[string]interface{}{"status": 302, "redirectURL": "http://example.com/blocked"}},
+			{"request": map[string]interface{}{"url": "http://example.com/favicon.ico"}, "end": map[string]interface{}{"status": 200}},
+			{"request": map[string]interface{}{"url": "http://example.com/blocked"}, "end": map[string]interface{}{"status": status}},
+		}}, nil
+	})
+	status = 200
+	if err := r.OpenPage(page, "http://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	status = 429
+	if err := r.OpenPage(page, "http://example.com/"); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*phantomjs.ProxyFailedError); !ok || e.Proxy != proxies[0] || e.Status != 429 {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if v := r.ProxyFor(page); v != proxies[1] {
+		t.Fatalf("unexpected proxy: %s", v)
+	}
+
+	// Proxy errors from Open() are detected once all proxies are used.
+	status = 200
+	s.Handle("/webpage/Open", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"status": "fail", "resourceError": map[string]interface{}{"errorCode": 101, "errorString": "Proxy connection refused"}}, nil
+	})
+	if err := r.OpenPage(page, "http://example.com/"); err != phantomjs.ErrNoProxies {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Custom detectors replace the default.
+	r.Detect = func(page *phantomjs.WebPage, status int, err error) bool { return false }
+	if err := r.OpenPage(page, "http://example.com/"); err == nil || err.Error() != "Proxy connection refused ()" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure pages are routed to processes consistently by hostname.
+func TestHostRouter(t *testing.T) {
+	s0, s1 := phantomjstest.NewServer(), phantomjstest.NewServer()
+	defer s0.Close()
+	defer s1.Close()
+	p0, p1, p2 := s0.NewProcess(), s1.NewProcess(), phantomjs.NewProcess()
+	r := phantomjs.NewHostRouter([]*phantomjs.Process{p0, p1})
+
+	// Hostnames are spread across processes and the scheme, port, path and
+	// case of the URL are ignored.
+	assigned := make(map[string]*phantomjs.Process)
+	counts := make(map[*phantomjs.Process]int)
+	for i := 0; i < 100; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		p, err := r.ProcessFor("http://" + host + "/")
+		if err != nil {
+			t.Fatal(err)
+		} else if other, err := r.ProcessFor("https://" + strings.ToUpper(host) + ":8443/path?q=1"); err != nil {
+			t.Fatal(err)
+		} else if other != p {
+			t.Fatalf("inconsistent process for %s", host)
+		}
+		assigned[host] = p
+		counts[p]++
+	}
+	if counts[p0] == 0 || counts[p1] == 0 {
+		t.Fatalf("unexpected distribution: %d, %d", counts[p0], counts[p1])
+	}
+
+	// Adding a process only moves hostnames to the new process.
+	r2 := phantomjs.NewHostRouter([]*phantomjs.Process{p0, p1, p2})
+	moved := 0
+	for host, p := range assigned {
+		if v, err := r2.ProcessFor("http://" + host + "/"); err != nil {
+			t.Fatal(err)
+		} else if v == p2 {
+			moved++
+		} else if v != p {
+			t.Fatalf("unexpected move of %s", host)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("expected hostnames to move to the new process")
+	}
+
+	// Pages are opened on the routed process.
+	page, err := r.Open("http://host0.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := s0
+	if assigned["host0.example.com"] == p1 {
+		s = s1
+	}
+	if a := s.RequestsTo("/webpage/Open"); len(a) != 1 || a[0].Ref != page.Ref().ID() || a[0].Body["url"] != "http://host0.example.com/" {
+		t.Fatalf("unexpected requests: %#v", a)
+	}
+
+	// URLs without a hostname cannot be routed.
+	if _, err := r.ProcessFor("/relative"); err != phantomjs.ErrNoHost {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure hostnames are spread evenly across processes.
+func TestHostRouter_Distribution(t *testing.T) {
+	const n = 100000
+	for _, size := range []int{2, 3, 5, 10} {
+		processes := make([]*phantomjs.Process, size)
+		counts := make(map[*phantomjs.Process]int)
+		for i := range processes {
+			processes[i] = phantomjs.NewProcess()
+		}
+
+		r := phantomjs.NewHostRouter(processes)
+		for i := 0; i < n; i++ {
+			p, err := r.ProcessFor(fmt.Sprintf("http://host%d.example.com/", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[p]++
+		}
+
+		// Allow 5% deviation from an even share.
+		for i, p := range processes {
+			if want := n / size; counts[p] < want*95/100 || counts[p] > want*105/100 {
+				t.Fatalf("%d processes: unexpected count for process %d: %d", size, i, counts[p])
+			}
+		}
+	}
+}
+
+// Ensure a router without processes returns an error.
+func TestHostRouter_NoProcesses(t *testing.T) {
+	r := phantomjs.NewHostRouter(nil)
+	if _, err := r.ProcessFor("http://example.com/"); err != phantomjs.ErrNoProcesses {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := r.CreateWebPage("http://example.com/"); err != phantomjs.ErrNoProcesses {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the memory and disk caches can be cleared.
+func TestProcess_ClearCaches(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "phantomjs-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "data8", "1"), 0777); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "data8", "1", "entry"), []byte("x"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p := s.NewProcess()
+	p.DiskCachePath = dir
+	if err := p.ClearCaches(); err != nil {
+		t.Fatal(err)
+	} else if a := s.RequestsTo("/process/ClearMemoryCache"); len(a) != 1 {
+		t.Fatalf("unexpected requests: %#v", a)
+	}
+
+	// Cached files are removed but the directories are kept.
+	if _, err := os.Stat(filepath.Join(dir, "data8", "1", "entry")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if fi, err := os.Stat(filepath.Join(dir, "data8", "1")); err != nil {
+		t.Fatal(err)
+	} else if !fi.IsDir() {
+		t.Fatal("expected directory")
+	}
+}
+
+// Ensure responses are still cached on disk after the caches are cleared.
+func TestProcess_ClearCaches_DiskCache(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<html><body><script src="/app.js"></script></body></html>`))
+			return
+		}
+		atomic.AddInt32(&n, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte(`var x = 1;`))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "phantomjs-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewProcess()
+	p.DiskCachePath = dir
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	load := func() {
+		page := p.MustCreateWebPage()
+		defer MustClosePage(page)
+		if err := page.Open(srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The script is fetched once, cleared, fetched again and then cached.
+	load()
+	if err := p.ClearCaches(); err != nil {
+		t.Fatal(err)
+	}
+	load()
+	load()
+	if v := atomic.LoadInt32(&n); v != 2 {
+		t.Fatalf("unexpected script requests: %d", v)
+	}
+}
+
+// Ensure the process' cookie store can be managed.
+func TestProcess_Cookies(t *testing.T) {
+	// Mock external HTTP server which sets a cookie and echoes request cookies.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/"})
+		}
+		w.Write([]byte(`<html><body>` + r.Header.Get("Cookie") + `</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Cookies set by any page are visible on the process.
+	if err := page.Open(srv.URL + "/login"); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "1" {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	}
+
+	// Cookies added to the process are sent by pages.
+	if ok, err := p.AddCookie(&http.Cookie{Name: "token", Value: "2", Domain: "127.0.0.1", Path: "/"}); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected cookie to be added")
+	} else if ok, err := p.DeleteCookie("session"); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected cookie to be deleted")
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "token=2" {
+		t.Fatalf("unexpected text: %q", v)
+	}
+
+	// Disabling cookies stops them from being sent.
+	if err := p.SetCookiesEnabled(false); err != nil {
+		t.Fatal(err)
+	} else if v, err := p.CookiesEnabled(); err != nil {
+		t.Fatal(err)
+	} else if v {
+		t.Fatal("expected cookies to be disabled")
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if v != "" {
+		t.Fatalf("unexpected text: %q", v)
+	} else if err := p.SetCookiesEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ClearCookies(); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 0 {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	}
+}
+
+// Ensure cookies can be synced between the process and a Go cookie jar.
+func TestCookieSyncer(t *testing.T) {
+	// Mock external HTTP server which sets cookies and echoes request cookies.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "phantom", Path: "/"})
+		case "/token":
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "go", Path: "/"})
+		}
+		w.Write([]byte(`<html><body>` + r.Header.Get("Cookie") + `</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	syncer := phantomjs.NewCookieSyncer(p.Process, jar)
+
+	// Log in with the page and copy its cookie to the jar.
+	if err := page.Open(srv.URL + "/login"); err != nil {
+		t.Fatal(err)
+	} else if err := syncer.SyncToJar(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get(srv.URL + "/token"); err != nil {
+		t.Fatal(err)
+	} else if buf, _ := ioutil.ReadAll(resp.Body); !strings.Contains(string(buf), "session=phantom") {
+		t.Fatalf("unexpected body: %s", buf)
+	} else {
+		resp.Body.Close()
+	}
+
+	// Copy the cookie set on the client back to the process.
+	if err := syncer.SyncFromJar(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(v, "session=phantom") || !strings.Contains(v, "token=go") {
+		t.Fatalf("unexpected text: %q", v)
+	}
+}
+
+// Ensure web page can wait until its network activity has stopped.
+func TestWebPage_WaitForNetworkIdle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><script>setTimeout(function() { var xhr = new XMLHttpRequest(); xhr.open("GET", "/api/slow"); xhr.send() }, 100)</script></body></html>`))
+		default:
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := page.WaitForNetworkIdle(200*time.Millisecond, 5*time.Second); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("returned before request finished: %s", d)
+	}
+}
+
+// Ensure web page can wait for network idle on content it was not opened with.
+func TestWebPage_WaitForNetworkIdle_SetContent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	start := time.Now()
+	if err := page.SetContent(`<html><body><img src="` + srv.URL + `/logo.png"></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.WaitForNetworkIdle(100*time.Millisecond, 5*time.Second); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("returned before request finished: %s", d)
+	}
+}
+
+// Ensure calls recorded by a Recorder can be replayed without a process.
+func TestRecorder(t *testing.T) {
+	// Serve fake shim responses.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/webpage/Create":
+			w.Write([]byte(`{"ref":{"id":"1"}}`))
+		case "/webpage/Title":
+			w.Write([]byte(`{"value":"FOO"}`))
+		}
+	}))
+	defer srv.Close()
+
+	// Record calls against the fake shim.
+	rec := phantomjs.NewRecorder(nil)
+	p := phantomjs.NewProcess()
+	p.Port = srv.Listener.Addr().(*net.TCPAddr).Port
+	p.Transport = rec
+	if page, err := p.CreateWebPage(); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.Title(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := rec.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	// Replay the calls on an unopened process.
+	var calls []phantomjs.RecordedCall
+	if err := json.Unmarshal(buf.Bytes(), &calls); err != nil {
+		t.Fatal(err)
+	} else if len(calls) != 2 {
+		t.Fatalf("unexpected call count: %d", len(calls))
+	}
+
+	other := phantomjs.NewProcess()
+	other.Transport = phantomjs.NewReplayer(calls)
+	page, err := other.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if page.Ref().ID() != "1" {
+		t.Fatalf("unexpected ref: %s", page.Ref().ID())
+	}
+
+	// Calls are repeated once all matching calls have been served.
+	for i := 0; i < 2; i++ {
+		if title, err := page.Title(); err != nil {
+			t.Fatal(err)
+		} else if title != "FOO" {
+			t.Fatalf("unexpected title: %s", title)
+		}
+	}
+
+	// Unrecorded calls return an error.
+	if _, err := page.URL(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure images are resized to fit, fill, or stretch to a size.
+func TestResizeImage(t *testing.T) {
+	// 40x20 image with a black left half and white right half.
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 20, 20), image.NewUniform(color.Black), image.ZP, draw.Src)
+
+	for _, tt := range []struct {
+		opt  phantomjs.ResizeOptions
+		size image.Point
+	}{
+		{phantomjs.ResizeOptions{Width: 10, Height: 10}, image.Pt(10, 5)},
+		{phantomjs.ResizeOptions{Width: 10, Height: 10, Mode: phantomjs.ResizeFill}, image.Pt(10, 10)},
+		{phantomjs.ResizeOptions{Width: 10, Height: 10, Mode: phantomjs.ResizeStretch}, image.Pt(10, 10)},
+		{phantomjs.ResizeOptions{Height: 10}, image.Pt(20, 10)},
+		{phantomjs.ResizeOptions{Width: 80}, image.Pt(80, 40)},
+	} {
+		if size := phantomjs.ResizeImage(img, tt.opt).Bounds().Size(); size != tt.size {
+			t.Errorf("%+v: unexpected size: %v", tt.opt, size)
+		}
+	}
+
+	// Pixels are averaged so the halves stay black and white with the
+	// boundary in the middle.
+	out := phantomjs.ResizeImage(img, phantomjs.ResizeOptions{Width: 4, Height: 2})
+	for x, want := range []color.RGBA{{0, 0, 0, 255}, {0, 0, 0, 255}, {255, 255, 255, 255}, {255, 255, 255, 255}} {
+		if c := color.RGBAModel.Convert(out.At(x, 1)); c != want {
+			t.Errorf("%d: unexpected color: %v", x, c)
+		}
+	}
+
+	// Fill crops the sides so the center column is the boundary.
+	out = phantomjs.ResizeImage(img, phantomjs.ResizeOptions{Width: 2, Height: 2, Mode: phantomjs.ResizeFill})
+	if c := color.RGBAModel.Convert(out.At(0, 0)); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("unexpected left color: %v", c)
+	} else if c := color.RGBAModel.Convert(out.At(1, 0)); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("unexpected right color: %v", c)
+	}
+
+	// Images are returned as-is without a size.
+	if out := phantomjs.ResizeImage(img, phantomjs.ResizeOptions{}); out != image.Image(img) {
+		t.Fatal("expected original image")
+	}
+}
+
+// Ensure images can be compared with a perceptual threshold.
+func TestDiffImages(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(a, a.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	b := image.NewRGBA(a.Bounds())
+	draw.Draw(b, b.Bounds(), a, image.ZP, draw.Src)
+
+	// A barely visible change is ignored while a black pixel is not.
+	b.Set(1, 1, color.RGBA{0xFE, 0xFE, 0xFE, 0xFF})
+	b.Set(4, 5, color.Black)
+	b.Set(6, 7, color.Black)
+
+	diff, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if diff.Pixels != 2 || diff.Total != 100 || diff.Ratio() != 0.02 {
+		t.Fatalf("unexpected diff: %d/%d", diff.Pixels, diff.Total)
+	} else if diff.Bounds != image.Rect(4, 5, 7, 8) {
+		t.Fatalf("unexpected bounds: %v", diff.Bounds)
+	} else if c := diff.Image.RGBAAt(4, 5); c != (color.RGBA{0xFF, 0, 0, 0xFF}) {
+		t.Fatalf("unexpected highlight: %v", c)
+	}
+
+	// Images of different sizes cannot be compared.
+	if _, err := phantomjs.DiffImages(a, image.NewRGBA(image.Rect(0, 0, 5, 5)), phantomjs.DiffOptions{}); err != phantomjs.ErrImageSizeMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a rendered page can be compared to an expected image.
+func TestWebPage_DiffImage(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetViewportSize(20, 20); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body style="margin:0;background:#fff"><div style="width:10px;height:10px;background:#000"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := page.RenderImage(phantomjs.RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rendering the same content should match.
+	if diff, err := page.DiffImage(expected, phantomjs.RenderOptions{}, phantomjs.DiffOptions{}); err != nil {
+		t.Fatal(err)
+	} else if diff.Pixels != 0 {
+		t.Fatalf("unexpected diff: %d pixels", diff.Pixels)
+	}
+
+	// Changing the content should report the changed area.
+	if _, err := page.Evaluate(`function() { document.querySelector("div").style.background = "#fff" }`); err != nil {
+		t.Fatal(err)
+	} else if diff, err := page.DiffImage(expected, phantomjs.RenderOptions{}, phantomjs.DiffOptions{}); err != nil {
+		t.Fatal(err)
+	} else if diff.Pixels != 100 || diff.Bounds != image.Rect(0, 0, 10, 10) {
+		t.Fatalf("unexpected diff: %d pixels in %v", diff.Pixels, diff.Bounds)
+	}
+}
+
+// Ensure a page can be audited with a supplied axe-core script.
+func TestWebPage_Audit(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body><img src="x.png"></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a stub in place of axe-core which reports images without alt text.
+	result, err := page.Audit(phantomjs.AuditOptions{
+		Source: `window.axe = { run: function(context, options, callback) {
+			var nodes = [];
+			var imgs = document.querySelectorAll("img:not([alt])");
+			for (var i = 0; i < imgs.length; i++) {
+				nodes.push({html: imgs[i].outerHTML, target: ["img"], impact: "critical"});
+			}
+			setTimeout(function() {
+				callback(null, {
+					url: location.href,
+					timestamp: "2000-01-01T00:00:00.000Z",
+					violations: [{id: "image-alt", impact: "critical", tags: options.runOnly, nodes: nodes}],
+				});
+			}, 10);
+		}};`,
+		RunOnly: []string{"wcag2a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(result.Violations) != 1 {
+		t.Fatalf("unexpected violations: %#v", result.Violations)
+	} else if v := result.Violations[0]; v.ID != "image-alt" || v.Impact != "critical" || !reflect.DeepEqual(v.Tags, []string{"wcag2a"}) {
+		t.Fatalf("unexpected violation: %#v", v)
+	} else if len(v.Nodes) != 1 || v.Nodes[0].HTML != `<img src="x.png">` {
+		t.Fatalf("unexpected nodes: %#v", v.Nodes)
+	} else if !result.Timestamp.Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected timestamp: %s", result.Timestamp)
+	}
+}
+
+// Ensure an audit requires an axe-core script if the page has none.
+func TestWebPage_Audit_AxeRequired(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := page.Audit(phantomjs.AuditOptions{}); err != phantomjs.ErrAxeRequired {
+		t.Fatalf("unexpected error: %v", err)
+	} else if a := s.RequestsTo("/webpage/IncludeJS"); len(a) != 0 {
+		t.Fatalf("unexpected requests: %#v", a)
+	}
+}
+
+// Ensure navigation timing can be retrieved for a loaded page.
+func TestWebPage_Timing(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`<html><body>OK</body></html>`))
+	}))
+	defer srv.Close()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	timing, err := page.Timing()
+	if err != nil {
+		t.Fatal(err)
+	} else if timing.NavigationType != "navigate" {
+		t.Fatalf("unexpected navigation type: %s", timing.NavigationType)
+	} else if timing.TTFB < 20*time.Millisecond {
+		t.Fatalf("unexpected ttfb: %s", timing.TTFB)
+	} else if timing.Load < timing.DOMContentLoaded || timing.Load == 0 {
+		t.Fatalf("unexpected load: %s (domContentLoaded=%s)", timing.Load, timing.DOMContentLoaded)
+	} else if time.Since(timing.NavigationStart) > time.Minute {
+		t.Fatalf("unexpected navigation start: %s", timing.NavigationStart)
+	}
+}
+
+// Ensure resource timings can be retrieved for a loaded page.
+func TestWebPage_ResourceTimings(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(`window.loaded = true;`))
 		default:
-			http.NotFound(w, r)
+			w.Write([]byte(`<html><head><script src="/app.js"></script></head><body></body></html>`))
 		}
 	}))
 	defer srv.Close()
 
-	// Start process.
-	p := MustOpenNewProcess()
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	timings, err := page.ResourceTimings()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(timings) != 1 {
+		t.Fatalf("unexpected timings: %d", len(timings))
+	} else if timings[0].URL != srv.URL+"/app.js" || timings[0].InitiatorType != "script" {
+		t.Fatalf("unexpected timing: %#v", timings[0])
+	} else if timings[0].Duration < timings[0].TTFB || timings[0].StartTime < 0 {
+		t.Fatalf("unexpected durations: %#v", timings[0])
+	}
+}
+
+// Ensure resource timings are built from the network log when the page
+// lacks the Resource Timing API.
+func TestWebPage_ResourceTimings_HAR(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.Handle("/webpage/HAR", func(*phantomjstest.Request) (interface{}, error) {
+		return map[string]interface{}{"started": "2000-01-01T00:00:00.000Z", "entries": []map[string]interface{}{
+			{
+				"request": map[string]interface{}{"url": "http://example.com/", "time": "2000-01-01T00:00:00.000Z"},
+				"start":   map[string]interface{}{"time": "2000-01-01T00:00:00.010Z"},
+				"end":     map[string]interface{}{"time": "2000-01-01T00:00:00.020Z", "redirectURL": "http://example.com/home"},
+			},
+			{
+				"request": map[string]interface{}{"url": "http://example.com/home", "time": "2000-01-01T00:00:00.020Z"},
+				"start":   map[string]interface{}{"time": "2000-01-01T00:00:00.030Z"},
+				"end":     map[string]interface{}{"time": "2000-01-01T00:00:00.040Z"},
+			},
+			{
+				"request": map[string]interface{}{"url": "http://example.com/app.js?v=1", "time": "2000-01-01T00:00:00.050Z"},
+				"start":   map[string]interface{}{"time": "2000-01-01T00:00:00.080Z", "bodySize": 100},
+				"end":     map[string]interface{}{"time": "2000-01-01T00:00:00.100Z", "bodySize": 2000},
+			},
+			{
+				"request": map[string]interface{}{"url": "http://example.com/api", "time": "2000-01-01T00:00:00.060Z", "xhr": true},
+				"start":   map[string]interface{}{"time": "2000-01-01T00:00:00.070Z"},
+			},
+		}}, nil
+	})
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the completed script is returned.
+	timings, err := page.ResourceTimings()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(timings, []*phantomjs.ResourceTiming{{
+		URL:           "http://example.com/app.js?v=1",
+		InitiatorType: "script",
+		StartTime:     50 * time.Millisecond,
+		Duration:      50 * time.Millisecond,
+		TTFB:          30 * time.Millisecond,
+		Download:      20 * time.Millisecond,
+		TransferSize:  2000,
+	}}) {
+		t.Fatalf("unexpected timings: %#v", timings)
+	}
+
+	// HAR content sizes are also taken from the end stage.
+	if har, err := page.HAR(); err != nil {
+		t.Fatal(err)
+	} else if n := har.Log.Entries[2].Response.Content.Size; n != 2000 {
+		t.Fatalf("unexpected content size: %d", n)
+	}
+}
+
+// Ensure web page can capture response bodies for matching URLs.
+func TestWebPage_Responses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><script>var xhr = new XMLHttpRequest(); xhr.open("GET", "/api/data", false); xhr.send()</script></body></html>`))
+		case "/api/data":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "1")
+			w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := NewProcess()
+	p.CaptureResponses = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
-	if err := page.Open(srv.URL); err != nil {
+	if err := page.SetCapturePatterns([]string{"*/api/*"}); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
 		t.Fatal(err)
 	}
 
-	// Check initial current frame.
-	if other, err := page.FrameName(); err != nil {
+	if a := page.Responses(); len(a) != 1 {
+		t.Fatalf("unexpected response count: %d", len(a))
+	} else if a[0].URL != srv.URL+"/api/data" {
+		t.Fatalf("unexpected url: %s", a[0].URL)
+	} else if string(a[0].Body) != `{"ok":true}` {
+		t.Fatalf("unexpected body: %s", a[0].Body)
+	} else if a[0].Header.Get("Connection") != "" || a[0].Header.Get("X-Hop") != "" {
+		t.Fatalf("unexpected hop-by-hop headers: %v", a[0].Header)
+	}
+}
+
+// Ensure a web page can emulate being offline.
+func TestWebPage_SetOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>ONLINE</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.SetContent(`<html><body><script>addEventListener("offline", function() { window.wentOffline = true; });</script></body></html>`); err != nil {
 		t.Fatal(err)
-	} else if other != `` {
-		t.Fatalf("unexpected value: %#v", other)
+	} else if err := page.SetOffline(true); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Offline(); err != nil || !v {
+		t.Fatalf("unexpected offline: %v, %v", v, err)
 	}
 
-	// Switch to focused frame and verify.
-	if err := page.SwitchToFocusedFrame(); err != nil {
+	// The current document is notified of the change.
+	if v, err := page.Evaluate(`function() { return [navigator.onLine, !!window.wentOffline] }`); err != nil {
 		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []interface{}{false, true}) {
+		t.Fatalf("unexpected state: %#v", v)
 	}
-	if other, err := page.FrameName(); err != nil {
+
+	// Requests fail while offline.
+	if err := page.Open(srv.URL); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Pages load once back online.
+	if err := page.SetOffline(false); err != nil {
 		t.Fatal(err)
-	} else if other != `FRAME2` {
-		t.Fatalf("unexpected value: %#v", other)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(`function() { return navigator.onLine }`); err != nil || v != true {
+		t.Fatalf("unexpected online: %v, %v", v, err)
 	}
 }
 
-// Ensure web page can upload a file to a form field.
-func TestWebPage_UploadFile(t *testing.T) {
-	// Mock external HTTP server.
-	uploadData := make(chan []byte, 0)
+// Ensure a web page's network can be throttled.
+func TestWebPage_SetNetworkConditions(t *testing.T) {
+	body := `<html><body>` + strings.Repeat("x", 20000) + `</body></html>`
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			w.Write([]byte(`<html><body><form id="myForm" method="POST" enctype="multipart/form-data"><input type="file" name="myfile"/></form></body></html>`))
-		case "POST":
-			f, _, err := r.FormFile("myfile")
-			if err != nil {
-				t.Fatal(err)
-			}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
 
-			buf, err := ioutil.ReadAll(f)
-			if err != nil {
-				t.Fatal(err)
-			}
-			uploadData <- buf
+	p := NewProcess()
+	p.SimulateNetwork = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
 
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Loading 20KB at 160kbps takes at least a second.
+	if err := page.SetNetworkConditions(200*time.Millisecond, 160, 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d < time.Second {
+		t.Fatalf("expected throttled load: %s", d)
+	}
+
+	// Clearing the conditions restores the normal network.
+	if err := page.SetNetworkConditions(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if err := page.Open(srv.URL + "/?2"); err != nil {
+		t.Fatal(err)
+	} else if d := time.Since(start); d >= time.Second {
+		t.Fatalf("unexpected throttled load: %s", d)
+	}
+}
+
+// Ensure a page's bandwidth is shared by its parallel requests.
+func TestWebPage_SetNetworkConditions_Shared(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<html><body><img src="/1.png"><img src="/2.png"><img src="/3.png"><img src="/4.png"></body></html>`))
+			return
 		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(make([]byte, 10000))
 	}))
 	defer srv.Close()
 
-	// Start process.
-	p := MustOpenNewProcess()
+	p := NewProcess()
+	p.SimulateNetwork = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
 	defer p.MustClose()
 
-	// Create & open page.
 	page := p.MustCreateWebPage()
 	defer MustClosePage(page)
+
+	// Loading four 10KB images at 160kbps takes at least two seconds.
+	if err := page.SetNetworkConditions(0, 160, 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
 	if err := page.Open(srv.URL); err != nil {
 		t.Fatal(err)
+	} else if d := time.Since(start); d < 2*time.Second {
+		t.Fatalf("expected shared bandwidth: %s", d)
 	}
+}
 
-	// Write file to disk.
-	path := filepath.Join(p.Path(), "testfile")
-	if err := ioutil.WriteFile(path, []byte("TESTDATA"), 0600); err != nil {
+// Ensure tunneled HTTPS requests are delayed and throttled.
+func TestWebPage_SetNetworkConditions_HTTPS(t *testing.T) {
+	body := `<html><body>` + strings.Repeat("x", 20000) + `</body></html>`
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	p := NewProcess()
+	p.SimulateNetwork = true
+	p.Args = []string{"--ignore-ssl-errors=true"}
+	if err := p.Open(); err != nil {
 		t.Fatal(err)
 	}
+	defer p.MustClose()
 
-	// Upload to field
-	if err := page.UploadFile("input[name=myfile]", path); err != nil {
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Loading 20KB at 160kbps takes at least a second.
+	if err := page.SetNetworkConditions(200*time.Millisecond, 160, 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := page.Open(srv.URL); err != nil {
 		t.Fatal(err)
+	} else if d := time.Since(start); d < time.Second {
+		t.Fatalf("expected throttled load: %s", d)
 	}
+}
 
-	// Submit form.
-	if _, err := page.Evaluate(`function() { document.body.querySelector("#myForm").submit() }`); err != nil {
+// Ensure network conditions require network simulation on the process.
+func TestWebPage_SetNetworkConditions_Disabled(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
 		t.Fatal(err)
+	} else if err := page.SetNetworkConditions(time.Second, 0, 0); err != phantomjs.ErrNetworkSimulationDisabled {
+		t.Fatalf("unexpected error: %v", err)
 	}
+}
 
-	// Wait for upload.
-	buf := <-uploadData
-	if string(buf) != "TESTDATA" {
-		t.Fatalf("unexpected upload data: %s", buf)
+// Ensure web page can answer confirm() dialogs from Go.
+func TestWebPage_OnConfirm(t *testing.T) {
+	p := NewProcess()
+	p.CallbackServer = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Answer true only for a specific message.
+	if err := page.OnConfirm(func(message string) bool { return message == "Delete?" }); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body><script>window.a = confirm("Delete?"); window.b = confirm("Other?")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.Evaluate(`function() { return [window.a, window.b] }`); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, []interface{}{true, false}) {
+		t.Fatalf("unexpected answers: %#v", v)
+	}
+
+	// Remove the handler and use the default answer instead.
+	if err := page.OnConfirm(nil); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetConfirmDefault(true); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body><script>window.a = confirm("Delete?")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.Evaluate(`function() { return window.a }`); err != nil {
+		t.Fatal(err)
+	} else if v != true {
+		t.Fatalf("unexpected answer: %#v", v)
+	}
+}
+
+// Ensure web page can respond to prompt() dialogs from Go.
+func TestWebPage_OnPrompt(t *testing.T) {
+	p := NewProcess()
+	p.CallbackServer = true
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Respond with a value derived from the prompt.
+	if err := page.OnPrompt(func(message, defaultValue string) string { return message + ":" + defaultValue }); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body><script>window.a = prompt("Name?", "bob")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.Evaluate(`function() { return window.a }`); err != nil {
+		t.Fatal(err)
+	} else if v != "Name?:bob" {
+		t.Fatalf("unexpected response: %#v", v)
+	}
+
+	// Remove the handler and use the configured default instead.
+	if err := page.OnPrompt(nil); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetPromptDefault("alice"); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body><script>window.a = prompt("Name?", "bob")</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := page.Evaluate(`function() { return window.a }`); err != nil {
+		t.Fatal(err)
+	} else if v != "alice" {
+		t.Fatalf("unexpected response: %#v", v)
 	}
 }
 
@@ -1625,9 +6229,97 @@ func (p *Process) MustCreateWebPage() *phantomjs.WebPage {
 	return page
 }
 
+// WebPageCreatorFunc adapts a function to phantomjs.WebPageCreator.
+type WebPageCreatorFunc func() (*phantomjs.WebPage, error)
+
+// CreateWebPage calls fn.
+func (fn WebPageCreatorFunc) CreateWebPage() (*phantomjs.WebPage, error) { return fn() }
+
 // MustClosePage closes page. Panic on error.
 func MustClosePage(page *phantomjs.WebPage) {
 	if err := page.Close(); err != nil {
 		panic(err)
 	}
 }
+
+// MustOpenQueuedPage returns a page of a process which sends one request at a
+// time with a queue depth of one. Content requests signal on the returned
+// channel when received and respond after receiving from it. Panic on error.
+func MustOpenQueuedPage(policy phantomjs.QueuePolicy) (*phantomjstest.Server, *phantomjs.WebPage, chan struct{}) {
+	s := phantomjstest.NewServer()
+	unblock := make(chan struct{})
+	s.Handle("/webpage/Content", func(req *phantomjstest.Request) (interface{}, error) {
+		unblock <- struct{}{}
+		<-unblock
+		return map[string]interface{}{"value": ""}, nil
+	})
+
+	p := s.NewProcess()
+	p.MaxInFlight, p.QueueDepth, p.QueuePolicy = 1, 1, policy
+	page, err := p.CreateWebPage()
+	if err != nil {
+		panic(err)
+	}
+	return s, page, unblock
+}
+
+// MustInflatePDF returns the decompressed streams of a PDF concatenated.
+func MustInflatePDF(data []byte) []byte {
+	var out bytes.Buffer
+	for _, part := range bytes.Split(data, []byte("stream"))[1:] {
+		part = bytes.TrimLeft(part, "\r\n")
+		r, err := zlib.NewReader(bytes.NewReader(part))
+		if err != nil {
+			continue
+		}
+		io.Copy(&out, r)
+		r.Close()
+	}
+	return out.Bytes()
+}
+
+// MustCountPDFPages returns the page count from the page tree of a PDF.
+func MustCountPDFPages(data []byte) int {
+	m := regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)`).FindSubmatch(data)
+	if m == nil {
+		panic("page count not found")
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// MustCountPDFTextObjects returns the number of text objects drawn by the
+// content streams of a PDF.
+func MustCountPDFTextObjects(data []byte) int {
+	return len(regexp.MustCompile(`\bBT\b`).FindAll(MustInflatePDF(data), -1))
+}
+
+// MustBuildPDF returns a minimal PDF document with n blank pages.
+func MustBuildPDF(n int) []byte {
+	var objs []string
+	objs = append(objs, "<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, n)
+	for i := range kids {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+i)
+	}
+	objs = append(objs, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d /MediaBox [0 0 612 792] >>", strings.Join(kids, " "), n))
+	for i := 0; i < n; i++ {
+		objs = append(objs, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /Contents %d 0 R >>", 3+n))
+	}
+	objs = append(objs, "<< /Length 12 >>\nstream\n0 0 m endobj\nendstream")
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for i, obj := range objs {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,2333 @@
+// Package phantomjsmock provides in-memory fakes of the phantomjs interfaces
+// so code using phantomjs.Processor or phantomjs.WebPager can be tested
+// without spawning a PhantomJS process.
+//
+// Pages are served from the process' Sites map and the fakes keep the state
+// set through their setters so it can be read back. Behavior which requires a
+// browser, such as evaluating JavaScript, can be overridden with the "Fn"
+// fields on WebPage.
+package phantomjsmock
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure fakes implement the interfaces.
+var (
+	_ phantomjs.Processor = (*Process)(nil)
+	_ phantomjs.WebPager  = (*WebPage)(nil)
+)
+
+// Default viewport size of new pages, which matches PhantomJS.
+const (
+	DefaultViewportWidth  = 400
+	DefaultViewportHeight = 300
+)
+
+// Process is a fake phantomjs.Processor which creates in-memory pages.
+type Process struct {
+	mu     sync.Mutex
+	pages  []*WebPage
+	open   bool
+	events chan phantomjs.Event
+
+	// Process-wide cookie store. Cookies are not shared with pages.
+	cookies         []*http.Cookie
+	cookiesDisabled bool
+
+	libraryPath string
+	proxy       phantomjs.Proxy
+	fs          *FS
+
+	// Page content by URL. Opening a URL which is not in the map returns
+	// a 404 *phantomjs.ResourceError. All URLs open as blank pages if nil.
+	Sites map[string]string
+
+	// Configuration applied to every page created by CreateWebPage().
+	DefaultPageSettings *phantomjs.PageDefaults
+
+	// Optional function which returns the result of Spawn(). Commands are
+	// never run on the host. Spawn() returns phantomjs.ErrSpawnDisabled if
+	// nil, matching a process without AllowSpawn set.
+	SpawnFn func(name string, args ...string) (*phantomjs.SpawnResult, error)
+}
+
+// NewProcess returns a new instance of Process.
+func NewProcess() *Process {
+	return &Process{}
+}
+
+// Open marks the process as open.
+func (p *Process) Open() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.open = true
+	return nil
+}
+
+// Close closes all pages created by the process.
+func (p *Process) Close() error {
+	p.mu.Lock()
+	pages := p.pages
+	p.pages, p.open = nil, false
+	if p.events != nil {
+		close(p.events)
+		p.events = nil
+	}
+	p.mu.Unlock()
+
+	for _, page := range pages {
+		page.Close()
+	}
+	return nil
+}
+
+// Path returns a blank path as the fake does not use a working directory.
+func (p *Process) Path() string { return "" }
+
+// URL returns a blank URL as the fake does not run a shim server.
+func (p *Process) URL() string { return "" }
+
+// CallbackURL returns a blank URL as the fake does not run a callback server.
+func (p *Process) CallbackURL() string { return "" }
+
+// Events returns a channel of events sent by Emit(). The channel is closed
+// when the process is closed.
+func (p *Process) Events() <-chan phantomjs.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events == nil {
+		p.events = make(chan phantomjs.Event, 100)
+	}
+	return p.events
+}
+
+// Emit fires a process-level event, such as an EventError for a shim error.
+// Events are dropped if Events() has not been called or its channel is full.
+func (p *Process) Emit(e phantomjs.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events != nil {
+		select {
+		case p.events <- e:
+		default:
+		}
+	}
+}
+
+// SystemInfo returns information about the current Go process and host.
+func (p *Process) SystemInfo() (*phantomjs.SystemInfo, error) {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return &phantomjs.SystemInfo{
+		PID:            os.Getpid(),
+		OSName:         runtime.GOOS,
+		OSArchitecture: fmt.Sprintf("%dbit", strconv.IntSize),
+		Version:        "2.1.1",
+		Env:            env,
+		Args:           append([]string(nil), os.Args...),
+	}, nil
+}
+
+// Spawn returns the result of SpawnFn.
+func (p *Process) Spawn(name string, args ...string) (*phantomjs.SpawnResult, error) {
+	if p.SpawnFn == nil {
+		return nil, phantomjs.ErrSpawnDisabled
+	}
+	return p.SpawnFn(name, args...)
+}
+
+// FileSystem returns the process' in-memory filesystem.
+func (p *Process) FileSystem() phantomjs.FileSystem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fs == nil {
+		p.fs = NewFS()
+	}
+	return p.fs
+}
+
+// SetProxy records the proxy. It can be read back with Proxy().
+func (p *Process) SetProxy(proxy phantomjs.Proxy) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proxy = proxy
+	return nil
+}
+
+// Proxy returns the proxy last set with SetProxy().
+func (p *Process) Proxy() phantomjs.Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.proxy
+}
+
+// CreateWebPage returns a new fake page.
+func (p *Process) CreateWebPage() (*WebPage, error) {
+	page := NewWebPage()
+	page.process = p
+	page.applyDefaults(p.DefaultPageSettings)
+
+	p.mu.Lock()
+	p.pages = append(p.pages, page)
+	p.mu.Unlock()
+	return page, nil
+}
+
+// CreateWebPager returns a new fake page as a phantomjs.WebPager.
+func (p *Process) CreateWebPager() (phantomjs.WebPager, error) {
+	return p.CreateWebPage()
+}
+
+// Pages returns the pages created by the process which have not been closed.
+func (p *Process) Pages() []*WebPage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*WebPage(nil), p.pages...)
+}
+
+// IsOpen returns true if the process has been opened and not closed.
+func (p *Process) IsOpen() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
+
+// Refs returns an entry for each open page, identified by its position.
+func (p *Process) Refs() ([]*phantomjs.RefInfo, error) {
+	p.mu.Lock()
+	pages := append([]*WebPage(nil), p.pages...)
+	p.mu.Unlock()
+
+	a := make([]*phantomjs.RefInfo, len(pages))
+	for i, page := range pages {
+		url, _ := page.URL()
+		a[i] = &phantomjs.RefInfo{
+			ID:       strconv.Itoa(i),
+			Type:     "webpage",
+			URL:      url,
+			Created:  page.created,
+			LastUsed: page.created,
+		}
+	}
+	return a, nil
+}
+
+// ReleaseRef closes the page with the ID returned by Refs().
+func (p *Process) ReleaseRef(id string) error {
+	i, err := strconv.Atoi(id)
+	p.mu.Lock()
+	if err != nil || i < 0 || i >= len(p.pages) {
+		p.mu.Unlock()
+		return phantomjs.ErrPageClosed
+	}
+	page := p.pages[i]
+	p.mu.Unlock()
+	return page.Close()
+}
+
+// Sweep does nothing as fake pages are not released on garbage collection.
+func (p *Process) Sweep() (int, error) { return 0, nil }
+
+// Cookies returns the cookies in the process' cookie store.
+func (p *Process) Cookies() ([]*http.Cookie, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*http.Cookie(nil), p.cookies...), nil
+}
+
+// AddCookie adds a cookie, replacing any cookie with the same name and domain.
+func (p *Process) AddCookie(cookie *http.Cookie) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.cookies {
+		if c.Name == cookie.Name && c.Domain == cookie.Domain {
+			p.cookies[i] = cookie
+			return true, nil
+		}
+	}
+	p.cookies = append(p.cookies, cookie)
+	return true, nil
+}
+
+// DeleteCookie removes cookies with a matching name.
+// Returns true if a cookie existed.
+func (p *Process) DeleteCookie(name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var a []*http.Cookie
+	for _, c := range p.cookies {
+		if c.Name != name {
+			a = append(a, c)
+		}
+	}
+	deleted := len(a) != len(p.cookies)
+	p.cookies = a
+	return deleted, nil
+}
+
+// ClearCookies removes all cookies from the process' cookie store.
+func (p *Process) ClearCookies() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cookies = nil
+	return nil
+}
+
+// CookiesEnabled returns true unless cookies have been disabled.
+func (p *Process) CookiesEnabled() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.cookiesDisabled, nil
+}
+
+// SetCookiesEnabled enables or disables cookies.
+func (p *Process) SetCookiesEnabled(value bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cookiesDisabled = !value
+	return nil
+}
+
+// InjectJS returns phantomjs.ErrInjectionFailed if the file cannot be read.
+// Relative paths are resolved against the library path.
+func (p *Process) InjectJS(filename string) error {
+	path, _ := p.LibraryPath()
+	if !filepath.IsAbs(filename) && path != "" {
+		filename = filepath.Join(path, filename)
+	}
+	if _, err := ioutil.ReadFile(filename); err != nil {
+		return phantomjs.ErrInjectionFailed
+	}
+	return nil
+}
+
+// LibraryPath returns the path used by InjectJS().
+func (p *Process) LibraryPath() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.libraryPath, nil
+}
+
+// SetLibraryPath sets the path used by InjectJS().
+func (p *Process) SetLibraryPath(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.libraryPath = path
+	return nil
+}
+
+// ClearCaches is a no-op as fake processes do not cache responses.
+func (p *Process) ClearCaches() error {
+	return nil
+}
+
+// RenderPDFMulti opens each URL with a fake page and returns an empty PDF
+// document, the same as WebPage.RenderBytes().
+func (p *Process) RenderPDFMulti(urls []string, opt phantomjs.PDFOptions) ([]byte, error) {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err := page.SetPaperSize(opt.PaperSize); err != nil {
+		return nil, err
+	}
+	for _, u := range urls {
+		if err := page.Open(u); err != nil {
+			return nil, err
+		}
+	}
+	return page.RenderBytes("pdf", 0)
+}
+
+// Screenshots opens each request's URL with a fake page and renders it with
+// the request's options. Wait conditions and concurrency are ignored.
+func (p *Process) Screenshots(reqs []phantomjs.ScreenshotRequest, concurrency int) ([]*phantomjs.ScreenshotResult, error) {
+	results := make([]*phantomjs.ScreenshotResult, len(reqs))
+	for i, req := range reqs {
+		results[i] = &phantomjs.ScreenshotResult{URL: req.URL}
+		results[i].Image, results[i].Err = p.screenshot(req)
+	}
+	return results, nil
+}
+
+// screenshot renders the URL of req with a new fake page.
+func (p *Process) screenshot(req phantomjs.ScreenshotRequest) (image.Image, error) {
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if req.Width > 0 && req.Height > 0 {
+		if err := page.SetViewportSize(req.Width, req.Height); err != nil {
+			return nil, err
+		}
+	}
+	if err := page.Open(req.URL); err != nil {
+		return nil, err
+	}
+	return page.RenderImage(req.Options)
+}
+
+// RenderSVG returns a blank white image of the requested size, or of the
+// default SVG size if not set. The document is not parsed.
+func (p *Process) RenderSVG(svg []byte, opt phantomjs.SVGOptions) (image.Image, error) {
+	width, height := opt.Width, opt.Height
+	if width <= 0 {
+		width = phantomjs.DefaultSVGWidth
+	}
+	if height <= 0 {
+		height = phantomjs.DefaultSVGHeight
+	}
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err := page.SetViewportSize(width, height); err != nil {
+		return nil, err
+	}
+	return page.RenderImage(phantomjs.RenderOptions{Format: "png", Scale: opt.Scale})
+}
+
+// site returns the content for url and whether it exists.
+func (p *Process) site(url string) (string, bool) {
+	if p == nil {
+		return "", true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Sites == nil {
+		return "", true
+	}
+	content, ok := p.Sites[url]
+	return content, ok
+}
+
+// remove removes page from the process' list of pages.
+func (p *Process) remove(page *WebPage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.pages {
+		if p.pages[i] == page {
+			p.pages = append(p.pages[:i], p.pages[i+1:]...)
+			return
+		}
+	}
+}
+
+// WebPage is a fake phantomjs.WebPager which keeps its state in memory.
+type WebPage struct {
+	mu      sync.Mutex
+	process *Process
+	closed  bool
+	created time.Time
+
+	url      string
+	content  string
+	history  []string
+	index    int
+	cookies  []*http.Cookie
+	storage  map[string]map[string]string // by storage name and origin
+	header   http.Header
+	clipRect phantomjs.Rect
+	frame    string
+
+	libraryPath        string
+	navigationLocked   bool
+	navigationRules    []phantomjs.NavigationRule
+	interceptRules     []phantomjs.InterceptRule
+	capturePatterns    []string
+	responses          []*phantomjs.CapturedResponse
+	networkConditions  phantomjs.NetworkConditions
+	ownsPages          bool
+	paperSize          phantomjs.PaperSize
+	pdfInfo            *phantomjs.PDFInfo
+	pdfWatermark       *phantomjs.Watermark
+	scrollPosition     phantomjs.Position
+	settings           phantomjs.WebPageSettings
+	width, height      int
+	zoomFactor         float64
+	mediaType          string
+	locale             string
+	timezoneOffset     *int
+	xhrOnly            bool
+	offline            bool
+	downloadCapture    bool
+	downloads          []*phantomjs.Download
+	newDocumentScripts []string
+	networkLog         io.Writer
+
+	confirmHandler func(message string) bool
+	promptHandler  func(message, defaultValue string) string
+	confirmDefault bool
+	promptDefault  string
+
+	events    chan phantomjs.Event
+	errors    []*phantomjs.PageError
+	resources []*phantomjs.ResourceResponse
+
+	// Bounding rectangles of elements by selector. Selectors which are not
+	// in the map return phantomjs.ErrElementNotFound.
+	Elements map[string]phantomjs.Rect
+
+	// Cells of tables by selector, returned by ExtractTable(). Selectors
+	// which are not in the map return phantomjs.ErrElementNotFound.
+	Tables map[string][][]string
+
+	// Links and images returned by Links() and Images().
+	PageLinks  []phantomjs.Link
+	PageImages []phantomjs.Image
+
+	// Metadata returned by Metadata(), if set.
+	PageMetadata *phantomjs.Metadata
+
+	// Article returned by Article(), if set. Otherwise Article() returns
+	// phantomjs.ErrNoArticle.
+	ArticleResult *phantomjs.Article
+
+	// Markdown returned by Markdown() by selector, using a blank selector
+	// for the whole page. Selectors which are not in the map return
+	// phantomjs.ErrElementNotFound.
+	PageMarkdown map[string]string
+
+	// Optional functions which override the default behavior. By default,
+	// scripts evaluate to nil and pages render as blank white images.
+	OpenFn        func(url string) error
+	EvaluateFn    func(script string) (interface{}, error)
+	RenderImageFn func(opt phantomjs.RenderOptions) (image.Image, error)
+
+	// Optional function called by Login() after the form's elements are
+	// found, such as to set session cookies or return ErrLoginFailed.
+	LoginFn func(spec phantomjs.LoginSpec) error
+
+	// Result returned by Audit(), if set.
+	AuditResult *phantomjs.AuditResult
+}
+
+// NewWebPage returns a new fake page which is not attached to a process.
+func NewWebPage() *WebPage {
+	return &WebPage{
+		created:    time.Now(),
+		url:        "about:blank",
+		header:     make(http.Header),
+		width:      DefaultViewportWidth,
+		height:     DefaultViewportHeight,
+		zoomFactor: 1,
+		settings: phantomjs.WebPageSettings{
+			JavascriptEnabled:  true,
+			LoadImages:         true,
+			WebSecurityEnabled: true,
+		},
+	}
+}
+
+// Open navigates the page to url using the content from the process' Sites.
+func (p *WebPage) Open(url string) error {
+	return p.OpenContext(context.Background(), url)
+}
+
+// OpenContext opens a URL the same as Open(). Returns ctx's error without
+// opening the URL if ctx is already done.
+func (p *WebPage) OpenContext(ctx context.Context, url string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Offline pages fail the same as aborted requests in PhantomJS.
+	p.mu.Lock()
+	offline := p.offline
+	p.mu.Unlock()
+	if offline {
+		return &phantomjs.ResourceError{
+			URL:         url,
+			Time:        time.Now(),
+			ErrorCode:   5,
+			ErrorString: "Operation canceled",
+		}
+	}
+
+	if p.OpenFn != nil {
+		if err := p.OpenFn(url); err != nil {
+			return err
+		}
+	}
+
+	content, ok := p.process.site(url)
+	if !ok {
+		return &phantomjs.ResourceError{
+			URL:         url,
+			Time:        time.Now(),
+			ErrorCode:   203,
+			ErrorString: "Error downloading " + url + " - server replied: Not Found",
+			Status:      http.StatusNotFound,
+			StatusText:  "Not Found",
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return phantomjs.ErrPageClosed
+	}
+	p.history = append(p.history[:p.index], url)
+	p.index = len(p.history)
+	p.url, p.content = url, content
+	p.mu.Unlock()
+
+	p.Emit(phantomjs.Event{Type: phantomjs.EventLoadFinished, Data: &phantomjs.PageLoad{URL: url, Status: "success"}})
+	return nil
+}
+
+// Close closes the page and its events channel.
+func (p *WebPage) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	if p.events != nil {
+		close(p.events)
+	}
+	p.responses = nil
+	p.mu.Unlock()
+
+	if p.process != nil {
+		p.process.remove(p)
+	}
+	return nil
+}
+
+// Reset restores the page to the state of a newly created page, including
+// the process' DefaultPageSettings. The process, events channel, and test
+// configuration, such as Elements and OpenFn, are kept. Buffered events are
+// discarded.
+func (p *WebPage) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return phantomjs.ErrPageClosed
+	}
+
+	fresh := NewWebPage()
+	p.url, p.content = fresh.url, fresh.content
+	p.history, p.index = nil, 0
+	p.cookies, p.header = nil, fresh.header
+	p.clipRect, p.frame = phantomjs.Rect{}, ""
+	p.libraryPath, p.navigationLocked = "", false
+	p.navigationRules, p.interceptRules, p.capturePatterns = nil, nil, nil
+	p.responses, p.networkConditions = nil, phantomjs.NetworkConditions{}
+	p.paperSize, p.scrollPosition = phantomjs.PaperSize{}, phantomjs.Position{}
+	p.pdfInfo = nil
+	p.pdfWatermark = nil
+	p.settings = fresh.settings
+	p.width, p.height, p.zoomFactor = fresh.width, fresh.height, fresh.zoomFactor
+	p.mediaType, p.xhrOnly, p.offline = "", false, false
+	p.downloadCapture, p.downloads = false, nil
+	p.locale, p.timezoneOffset = "", nil
+	p.newDocumentScripts, p.networkLog = nil, nil
+	p.confirmHandler, p.promptHandler = nil, nil
+	p.confirmDefault, p.promptDefault = false, ""
+	p.errors, p.resources = nil, nil
+	if p.process != nil {
+		p.applyDefaults(p.process.DefaultPageSettings)
+	}
+
+	for p.events != nil && len(p.events) > 0 {
+		<-p.events
+	}
+	return nil
+}
+
+// applyDefaults applies the process' default page settings, if set.
+func (p *WebPage) applyDefaults(d *phantomjs.PageDefaults) {
+	if d == nil {
+		return
+	}
+	if d.ViewportWidth > 0 && d.ViewportHeight > 0 {
+		p.width, p.height = d.ViewportWidth, d.ViewportHeight
+	}
+	if d.Settings != nil {
+		mergeSettings(&p.settings, *d.Settings)
+	}
+	if d.UserAgent != "" {
+		p.settings.UserAgent = d.UserAgent
+	}
+	if d.CustomHeaders != nil {
+		p.header = cloneHeader(d.CustomHeaders)
+	}
+}
+
+// mergeSettings copies the non-zero fields of src to dst, the same as the
+// shim applies default settings.
+func mergeSettings(dst *phantomjs.WebPageSettings, src phantomjs.WebPageSettings) {
+	dv, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	for i := 0; i < sv.NumField(); i++ {
+		if f := sv.Field(i); !f.IsZero() {
+			dv.Field(i).Set(f)
+		}
+	}
+}
+
+// Closed returns true if the page has been closed.
+func (p *WebPage) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Reload reopens the current URL.
+func (p *WebPage) Reload() error {
+	url, _ := p.URL()
+	p.mu.Lock()
+	if p.index > 0 {
+		p.index--
+	}
+	p.mu.Unlock()
+	return p.Open(url)
+}
+
+// Stop is a no-op as fake pages load synchronously.
+func (p *WebPage) Stop() error { return nil }
+
+// CanGoBack returns true if there is a previous entry in the page's history.
+func (p *WebPage) CanGoBack() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.index > 1, nil
+}
+
+// CanGoForward returns true if there is a next entry in the page's history.
+func (p *WebPage) CanGoForward() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.index < len(p.history), nil
+}
+
+// GoBack navigates to the previous entry in the page's history.
+func (p *WebPage) GoBack() error { return p.Go(-1) }
+
+// GoForward navigates to the next entry in the page's history.
+func (p *WebPage) GoForward() error { return p.Go(1) }
+
+// Go navigates relative to the current entry in the page's history.
+// Does nothing if the index is out of range, the same as PhantomJS.
+func (p *WebPage) Go(index int) error {
+	p.mu.Lock()
+	i := p.index + index
+	if index == 0 || i < 1 || i > len(p.history) {
+		p.mu.Unlock()
+		return nil
+	}
+	url := p.history[i-1]
+	p.mu.Unlock()
+
+	content, _ := p.process.site(url)
+
+	p.mu.Lock()
+	p.index, p.url, p.content = i, url, content
+	p.mu.Unlock()
+	return nil
+}
+
+// ClipRect returns the clipping rectangle used when rendering.
+func (p *WebPage) ClipRect() (phantomjs.Rect, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clipRect, nil
+}
+
+// SetClipRect sets the clipping rectangle used when rendering.
+func (p *WebPage) SetClipRect(rect phantomjs.Rect) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clipRect = rect
+	return nil
+}
+
+// SetClipRectInt sets the clipping rectangle from integer coordinates.
+func (p *WebPage) SetClipRectInt(top, left, width, height int) error {
+	return p.SetClipRect(phantomjs.Rect{Top: float64(top), Left: float64(left), Width: float64(width), Height: float64(height)})
+}
+
+// SetClipRectToElement sets the clipping rectangle to the element's bounds.
+func (p *WebPage) SetClipRectToElement(selector string) error {
+	rect, err := p.BoundingRect(selector)
+	if err != nil {
+		return err
+	}
+	return p.SetClipRect(rect)
+}
+
+// ClearClipRect removes the clipping rectangle.
+func (p *WebPage) ClearClipRect() error {
+	return p.SetClipRect(phantomjs.Rect{})
+}
+
+// BoundingRect returns the bounds of the element from Elements.
+func (p *WebPage) BoundingRect(selector string) (phantomjs.Rect, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rect, ok := p.Elements[selector]
+	if !ok {
+		return phantomjs.Rect{}, phantomjs.ErrElementNotFound
+	}
+	return rect, nil
+}
+
+// BoundingRects returns the bounds of the element from Elements as the only
+// match, or no rects if selector is not in Elements.
+func (p *WebPage) BoundingRects(selector string) ([]phantomjs.Rect, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rect, ok := p.Elements[selector]
+	if !ok {
+		return []phantomjs.Rect{}, nil
+	}
+	return []phantomjs.Rect{rect}, nil
+}
+
+// ExtractTable returns the table in Tables for selector.
+func (p *WebPage) ExtractTable(selector string) ([][]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rows, ok := p.Tables[selector]
+	if !ok {
+		return nil, phantomjs.ErrElementNotFound
+	}
+	return rows, nil
+}
+
+// ExtractTableCSV writes the table in Tables for selector to w as CSV.
+func (p *WebPage) ExtractTableCSV(w io.Writer, selector string) error {
+	rows, err := p.ExtractTable(selector)
+	if err != nil {
+		return err
+	}
+	return csv.NewWriter(w).WriteAll(rows)
+}
+
+// Links returns PageLinks.
+func (p *WebPage) Links() ([]phantomjs.Link, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]phantomjs.Link(nil), p.PageLinks...), nil
+}
+
+// Images returns PageImages.
+func (p *WebPage) Images() ([]phantomjs.Image, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]phantomjs.Image(nil), p.PageImages...), nil
+}
+
+// Metadata returns PageMetadata if set. Otherwise only the title is set.
+func (p *WebPage) Metadata() (*phantomjs.Metadata, error) {
+	if p.PageMetadata != nil {
+		return p.PageMetadata, nil
+	}
+	title, err := p.Title()
+	if err != nil {
+		return nil, err
+	}
+	return &phantomjs.Metadata{Title: title}, nil
+}
+
+// Article returns ArticleResult, if set.
+func (p *WebPage) Article() (*phantomjs.Article, error) {
+	if p.ArticleResult == nil {
+		return nil, phantomjs.ErrNoArticle
+	}
+	return p.ArticleResult, nil
+}
+
+// Markdown returns the Markdown in PageMarkdown for the selector.
+func (p *WebPage) Markdown(selector ...string) (string, error) {
+	var key string
+	if len(selector) > 0 {
+		key = selector[0]
+	}
+	md, ok := p.PageMarkdown[key]
+	if !ok && key != "" {
+		return "", phantomjs.ErrElementNotFound
+	}
+	return md, nil
+}
+
+// Content returns the content of the page.
+func (p *WebPage) Content() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.content, nil
+}
+
+// ContentReader returns a reader of the content of the page.
+func (p *WebPage) ContentReader() (io.ReadCloser, error) {
+	content, err := p.Content()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+// SetContent sets the content of the page.
+func (p *WebPage) SetContent(content string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.content = content
+	return nil
+}
+
+// SetContentAndURL sets the content and URL of the page.
+func (p *WebPage) SetContentAndURL(content, url string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.content, p.url = content, url
+	return nil
+}
+
+// PlainText returns the content of the page with tags removed.
+func (p *WebPage) PlainText() (string, error) {
+	content, _ := p.Content()
+	return plainText(content), nil
+}
+
+// Title returns the contents of the page's <title> element.
+func (p *WebPage) Title() (string, error) {
+	content, _ := p.Content()
+	return title(content), nil
+}
+
+// URL returns the current URL of the page.
+func (p *WebPage) URL() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.url, nil
+}
+
+// Cookies returns the page's cookies.
+func (p *WebPage) Cookies() ([]*http.Cookie, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*http.Cookie(nil), p.cookies...), nil
+}
+
+// SetCookies replaces the page's cookies.
+func (p *WebPage) SetCookies(cookies []*http.Cookie) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cookies = append([]*http.Cookie(nil), cookies...)
+	return nil
+}
+
+// AddCookie adds a cookie, replacing any cookie with the same name.
+func (p *WebPage) AddCookie(cookie *http.Cookie) (bool, error) {
+	p.DeleteCookie(cookie.Name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cookies = append(p.cookies, cookie)
+	return true, nil
+}
+
+// DeleteCookie removes a cookie with a matching name.
+// Returns true if the cookie existed.
+func (p *WebPage) DeleteCookie(name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.cookies {
+		if c.Name == name {
+			p.cookies = append(p.cookies[:i], p.cookies[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClearCookies removes all cookies.
+func (p *WebPage) ClearCookies() error {
+	return p.SetCookies(nil)
+}
+
+// LocalStorage returns the localStorage items for the page's origin.
+func (p *WebPage) LocalStorage() (map[string]string, error) {
+	return p.storageItems("localStorage")
+}
+
+// SessionStorage returns the sessionStorage items for the page's origin.
+func (p *WebPage) SessionStorage() (map[string]string, error) {
+	return p.storageItems("sessionStorage")
+}
+
+// SetLocalStorageItem sets a localStorage item for the page's origin.
+func (p *WebPage) SetLocalStorageItem(key, value string) error {
+	return p.setStorageItem("localStorage", key, value)
+}
+
+// SetSessionStorageItem sets a sessionStorage item for the page's origin.
+func (p *WebPage) SetSessionStorageItem(key, value string) error {
+	return p.setStorageItem("sessionStorage", key, value)
+}
+
+// ClearStorage removes all storage items for the page's origin.
+func (p *WebPage) ClearStorage() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	origin, ok := p.origin()
+	if !ok {
+		return phantomjs.ErrStorageUnavailable
+	}
+	delete(p.storage, "localStorage "+origin)
+	delete(p.storage, "sessionStorage "+origin)
+	return nil
+}
+
+func (p *WebPage) storageItems(name string) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	origin, ok := p.origin()
+	if !ok {
+		return nil, phantomjs.ErrStorageUnavailable
+	}
+	items := make(map[string]string)
+	for k, v := range p.storage[name+" "+origin] {
+		items[k] = v
+	}
+	return items, nil
+}
+
+func (p *WebPage) setStorageItem(name, key, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	origin, ok := p.origin()
+	if !ok {
+		return phantomjs.ErrStorageUnavailable
+	}
+	if p.storage == nil {
+		p.storage = make(map[string]map[string]string)
+	}
+	if p.storage[name+" "+origin] == nil {
+		p.storage[name+" "+origin] = make(map[string]string)
+	}
+	p.storage[name+" "+origin][key] = value
+	return nil
+}
+
+// origin returns the scheme and host of the page's URL. Returns false if the
+// page has no origin with storage, such as "about:blank".
+func (p *WebPage) origin() (string, bool) {
+	u, err := url.Parse(p.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// CustomHeaders returns the headers sent with every request.
+func (p *WebPage) CustomHeaders() (http.Header, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return cloneHeader(p.header), nil
+}
+
+// SetCustomHeaders sets the headers sent with every request.
+func (p *WebPage) SetCustomHeaders(header http.Header) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.header = cloneHeader(header)
+	return nil
+}
+
+// FocusedFrameName returns the name of the focused frame, which is always
+// the main frame.
+func (p *WebPage) FocusedFrameName() (string, error) { return "", nil }
+
+// FrameContent returns the content of the current frame.
+func (p *WebPage) FrameContent() (string, error) { return p.Content() }
+
+// SetFrameContent sets the content of the current frame.
+func (p *WebPage) SetFrameContent(content string) error { return p.SetContent(content) }
+
+// FrameName returns the name of the current frame.
+func (p *WebPage) FrameName() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.frame, nil
+}
+
+// FramePlainText returns the plain text of the current frame.
+func (p *WebPage) FramePlainText() (string, error) { return p.PlainText() }
+
+// FrameTitle returns the title of the current frame.
+func (p *WebPage) FrameTitle() (string, error) { return p.Title() }
+
+// FrameURL returns the URL of the current frame.
+func (p *WebPage) FrameURL() (string, error) { return p.URL() }
+
+// FrameCount returns the number of child frames, which is always zero.
+func (p *WebPage) FrameCount() (int, error) { return 0, nil }
+
+// FrameNames returns the names of child frames, which is always empty.
+func (p *WebPage) FrameNames() ([]string, error) { return nil, nil }
+
+// SwitchToFocusedFrame switches to the main frame.
+func (p *WebPage) SwitchToFocusedFrame() error { return p.SwitchToMainFrame() }
+
+// SwitchToFrameName sets the current frame name.
+func (p *WebPage) SwitchToFrameName(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frame = name
+	return nil
+}
+
+// SwitchToFramePosition returns an error as fake pages have no child frames.
+func (p *WebPage) SwitchToFramePosition(pos int) error {
+	return fmt.Errorf("frame not found: %d", pos)
+}
+
+// SwitchToMainFrame switches to the main frame.
+func (p *WebPage) SwitchToMainFrame() error { return p.SwitchToFrameName("") }
+
+// SwitchToParentFrame switches to the main frame.
+func (p *WebPage) SwitchToParentFrame() error { return p.SwitchToMainFrame() }
+
+// LibraryPath returns the path used by InjectJS().
+func (p *WebPage) LibraryPath() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.libraryPath, nil
+}
+
+// SetLibraryPath sets the path used by InjectJS().
+func (p *WebPage) SetLibraryPath(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.libraryPath = path
+	return nil
+}
+
+// NavigationLocked returns true if navigation is locked.
+func (p *WebPage) NavigationLocked() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.navigationLocked, nil
+}
+
+// SetNavigationLocked sets whether navigation is locked.
+func (p *WebPage) SetNavigationLocked(value bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.navigationLocked = value
+	return nil
+}
+
+// OfflineStoragePath returns a blank path.
+func (p *WebPage) OfflineStoragePath() (string, error) { return "", nil }
+
+// OfflineStorageQuota returns the PhantomJS default quota of 5MB.
+func (p *WebPage) OfflineStorageQuota() (int, error) { return 5 * 1024 * 1024, nil }
+
+// NavigationRules returns the page's navigation rules.
+func (p *WebPage) NavigationRules() ([]phantomjs.NavigationRule, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]phantomjs.NavigationRule(nil), p.navigationRules...), nil
+}
+
+// SetNavigationRules sets the page's navigation rules.
+func (p *WebPage) SetNavigationRules(rules []phantomjs.NavigationRule) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.navigationRules = append([]phantomjs.NavigationRule(nil), rules...)
+	return nil
+}
+
+// InterceptRules returns the page's intercept rules.
+func (p *WebPage) InterceptRules() ([]phantomjs.InterceptRule, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]phantomjs.InterceptRule(nil), p.interceptRules...), nil
+}
+
+// SetInterceptRules sets the page's intercept rules.
+func (p *WebPage) SetInterceptRules(rules []phantomjs.InterceptRule) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interceptRules = append([]phantomjs.InterceptRule(nil), rules...)
+	return nil
+}
+
+// AddInterceptRule appends an intercept rule.
+func (p *WebPage) AddInterceptRule(rule phantomjs.InterceptRule) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interceptRules = append(p.interceptRules, rule)
+	return nil
+}
+
+// BlockResourceTypes adds an abort rule matching the Accept header of each
+// blocked resource type.
+func (p *WebPage) BlockResourceTypes(images, stylesheets, fonts, media bool) error {
+	for _, v := range []struct {
+		block  bool
+		accept []string
+	}{
+		{images, []string{"image/"}},
+		{stylesheets, []string{"text/css"}},
+		{fonts, []string{"font/"}},
+		{media, []string{"video/", "audio/"}},
+	} {
+		if !v.block {
+			continue
+		}
+		for _, accept := range v.accept {
+			p.AddInterceptRule(phantomjs.InterceptRule{Accept: accept, Abort: true})
+		}
+	}
+	return nil
+}
+
+// Mock adds an intercept rule which responds to matching URLs with resp.
+func (p *WebPage) Mock(pattern string, resp *phantomjs.MockResponse) error {
+	return p.AddInterceptRule(phantomjs.InterceptRule{Pattern: pattern, Response: resp})
+}
+
+// SetCapturePatterns sets the URL patterns of captured responses.
+func (p *WebPage) SetCapturePatterns(patterns []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capturePatterns = append([]string(nil), patterns...)
+	return nil
+}
+
+// Responses returns responses added by AddResponse().
+func (p *WebPage) Responses() []*phantomjs.CapturedResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*phantomjs.CapturedResponse(nil), p.responses...)
+}
+
+// AddResponse adds a captured response to be returned by Responses().
+func (p *WebPage) AddResponse(resp *phantomjs.CapturedResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responses = append(p.responses, resp)
+}
+
+// ClearResponses removes all captured responses.
+func (p *WebPage) ClearResponses() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responses = nil
+}
+
+// SetNetworkConditions records the page's network conditions. Fake pages
+// load synchronously so they are not throttled.
+func (p *WebPage) SetNetworkConditions(latency time.Duration, downloadKbps, uploadKbps int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.networkConditions = phantomjs.NetworkConditions{Latency: latency, DownloadKbps: downloadKbps, UploadKbps: uploadKbps}
+	return nil
+}
+
+// NetworkConditions returns the conditions set with SetNetworkConditions().
+func (p *WebPage) NetworkConditions() phantomjs.NetworkConditions {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.networkConditions
+}
+
+// OwnsPages returns true if child pages are closed with the page.
+func (p *WebPage) OwnsPages() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ownsPages, nil
+}
+
+// SetOwnsPages sets whether child pages are closed with the page.
+func (p *WebPage) SetOwnsPages(v bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ownsPages = v
+	return nil
+}
+
+// PageWindowNames returns the window names of child pages, which is always empty.
+func (p *WebPage) PageWindowNames() ([]string, error) { return nil, nil }
+
+// WindowName returns a blank window name.
+func (p *WebPage) WindowName() (string, error) { return "", nil }
+
+// PaperSize returns the size used when rendering to PDF.
+func (p *WebPage) PaperSize() (phantomjs.PaperSize, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paperSize, nil
+}
+
+// SetPaperSize sets the size used when rendering to PDF.
+func (p *WebPage) SetPaperSize(size phantomjs.PaperSize) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paperSize = size
+	return nil
+}
+
+// ScrollPosition returns the scroll position of the page.
+func (p *WebPage) ScrollPosition() (phantomjs.Position, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.scrollPosition, nil
+}
+
+// SetScrollPosition sets the scroll position of the page.
+func (p *WebPage) SetScrollPosition(pos phantomjs.Position) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scrollPosition = pos
+	return nil
+}
+
+// Snapshot returns the page's state from its getters.
+func (p *WebPage) Snapshot() (*phantomjs.Snapshot, error) {
+	url, _ := p.URL()
+	title, _ := p.Title()
+	content, _ := p.Content()
+	frameName, _ := p.FrameName()
+	settings, _ := p.Settings()
+	cookies, _ := p.Cookies()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &phantomjs.Snapshot{
+		URL:            url,
+		Title:          title,
+		ContentLength:  len(content),
+		FrameName:      frameName,
+		FrameURL:       url,
+		ViewportWidth:  p.width,
+		ViewportHeight: p.height,
+		ClipRect:       p.clipRect,
+		Cookies:        cookies,
+		Settings:       settings,
+	}, nil
+}
+
+// Settings returns the page's settings.
+func (p *WebPage) Settings() (phantomjs.WebPageSettings, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings, nil
+}
+
+// SetSettings sets the page's settings.
+func (p *WebPage) SetSettings(settings phantomjs.WebPageSettings) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settings = settings
+	return nil
+}
+
+// ViewportSize returns the size of the viewport.
+func (p *WebPage) ViewportSize() (width, height int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.width, p.height, nil
+}
+
+// SetViewportSize sets the size of the viewport.
+func (p *WebPage) SetViewportSize(width, height int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.width, p.height = width, height
+	return nil
+}
+
+// ZoomFactor returns the page's zoom factor.
+func (p *WebPage) ZoomFactor() (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.zoomFactor, nil
+}
+
+// SetZoomFactor sets the page's zoom factor.
+func (p *WebPage) SetZoomFactor(factor float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.zoomFactor = factor
+	return nil
+}
+
+// MediaType returns the emulated CSS media type.
+func (p *WebPage) MediaType() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mediaType, nil
+}
+
+// SetMediaType sets the emulated CSS media type.
+func (p *WebPage) SetMediaType(mediaType string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mediaType = mediaType
+	return nil
+}
+
+// SetLocale sets the emulated locale. It can be read back with Locale().
+func (p *WebPage) SetLocale(locale string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.locale = locale
+	return nil
+}
+
+// Locale returns the locale set with SetLocale().
+func (p *WebPage) Locale() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.locale
+}
+
+// SetTimezoneOffset sets the emulated timezone offset, in minutes east of UTC.
+func (p *WebPage) SetTimezoneOffset(minutes int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timezoneOffset = &minutes
+	return nil
+}
+
+// TimezoneOffset returns the offset set with SetTimezoneOffset() and whether
+// one has been set.
+func (p *WebPage) TimezoneOffset() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timezoneOffset == nil {
+		return 0, false
+	}
+	return *p.timezoneOffset, true
+}
+
+// EnableStealth sets phantomjs.StealthUserAgent as the user agent.
+func (p *WebPage) EnableStealth() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settings.UserAgent = phantomjs.StealthUserAgent
+	return nil
+}
+
+// RotatedUserAgent returns a blank string as fake pages are not pooled.
+func (p *WebPage) RotatedUserAgent() string { return "" }
+
+// XHROnly returns true if only XHR resource events are reported.
+func (p *WebPage) XHROnly() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.xhrOnly, nil
+}
+
+// Offline returns true if the page is offline.
+func (p *WebPage) Offline() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.offline, nil
+}
+
+// SetOffline sets whether the page is offline. Offline pages fail to open.
+func (p *WebPage) SetOffline(v bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offline = v
+	return nil
+}
+
+// SetXHROnly sets whether only XHR resource events are reported.
+func (p *WebPage) SetXHROnly(v bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.xhrOnly = v
+	return nil
+}
+
+// DownloadCapture returns true if download capture is enabled.
+func (p *WebPage) DownloadCapture() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.downloadCapture, nil
+}
+
+// SetDownloadCapture sets whether download capture is enabled.
+func (p *WebPage) SetDownloadCapture(v bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloadCapture = v
+	return nil
+}
+
+// Downloads returns and removes downloads added by AddDownload().
+func (p *WebPage) Downloads() ([]*phantomjs.Download, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.downloads
+	p.downloads = nil
+	return a, nil
+}
+
+// AddDownload adds a download to be returned by Downloads(). Downloads are
+// added regardless of whether capture is enabled.
+func (p *WebPage) AddDownload(d *phantomjs.Download) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloads = append(p.downloads, d)
+}
+
+// EvaluateAsync evaluates script after delay, ignoring the result.
+func (p *WebPage) EvaluateAsync(script string, delay time.Duration) error {
+	time.AfterFunc(delay, func() { p.Evaluate(script) })
+	return nil
+}
+
+// EvaluateJavaScript evaluates script with EvaluateFn.
+func (p *WebPage) EvaluateJavaScript(script string) (interface{}, error) {
+	return p.Evaluate(script)
+}
+
+// Evaluate evaluates script with EvaluateFn. Returns nil if EvaluateFn is not set.
+func (p *WebPage) Evaluate(script string) (interface{}, error) {
+	return p.EvaluateContext(context.Background(), script)
+}
+
+// EvaluateContext evaluates script the same as Evaluate(). Returns ctx's
+// error without evaluating script if ctx is already done.
+func (p *WebPage) EvaluateContext(ctx context.Context, script string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	} else if p.EvaluateFn == nil {
+		return nil, nil
+	}
+	return p.EvaluateFn(script)
+}
+
+// EvaluateOnNewDocument records a script to run in new documents.
+func (p *WebPage) EvaluateOnNewDocument(script string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.newDocumentScripts = append(p.newDocumentScripts, script)
+	return nil
+}
+
+// NewDocumentScripts returns scripts added by EvaluateOnNewDocument().
+func (p *WebPage) NewDocumentScripts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.newDocumentScripts...)
+}
+
+// ClearNewDocumentScripts removes scripts added by EvaluateOnNewDocument().
+func (p *WebPage) ClearNewDocumentScripts() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.newDocumentScripts = nil
+	return nil
+}
+
+// IncludeJS is a no-op as fake pages do not load scripts.
+func (p *WebPage) IncludeJS(url string) error { return nil }
+
+// InjectJS returns phantomjs.ErrInjectionFailed if the file cannot be read.
+func (p *WebPage) InjectJS(filename string) error {
+	if _, err := ioutil.ReadFile(filename); err != nil {
+		return phantomjs.ErrInjectionFailed
+	}
+	return nil
+}
+
+// RenderBase64 renders the page and returns it as base64-encoded image data.
+func (p *WebPage) RenderBase64(format string) (string, error) {
+	var buf bytes.Buffer
+	if err := p.render(&buf, format, 0); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Render renders the page to a file. PDFs are written as an empty document.
+func (p *WebPage) Render(filename, format string, quality int) error {
+	var buf bytes.Buffer
+	if err := p.render(&buf, format, quality); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0666)
+}
+
+// RenderBytes renders the page and returns the encoded data. PDFs are returned
+// as an empty document.
+func (p *WebPage) RenderBytes(format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.render(&buf, format, quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PDFInfo returns the metadata set with SetPDFInfo().
+func (p *WebPage) PDFInfo() *phantomjs.PDFInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pdfInfo
+}
+
+// SetPDFInfo sets the PDF metadata. It is recorded but not applied as the
+// fake does not render real PDFs.
+func (p *WebPage) SetPDFInfo(info *phantomjs.PDFInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pdfInfo = info
+}
+
+// PDFWatermark returns the watermark set with SetPDFWatermark().
+func (p *WebPage) PDFWatermark() *phantomjs.Watermark {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pdfWatermark
+}
+
+// SetPDFWatermark sets the PDF watermark. It is recorded but not applied as
+// the fake does not render real PDFs.
+func (p *WebPage) SetPDFWatermark(wm *phantomjs.Watermark) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pdfWatermark = wm
+}
+
+// SaveMHTML writes the page's content to w as an MHTML archive. The fake
+// does not load resources so the archive only contains the document.
+func (p *WebPage) SaveMHTML(w io.Writer) error {
+	content, _ := p.Content()
+	rawurl, _ := p.URL()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: <Saved by PhantomJS>\r\n")
+	fmt.Fprintf(&buf, "Snapshot-Content-Location: %s\r\n", rawurl)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", title(content)))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/related; type=\"text/html\"; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+		"Content-Location":          {rawurl},
+	})
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(part)
+	io.WriteString(qw, content)
+	if err := qw.Close(); err != nil {
+		return err
+	} else if err := mw.Close(); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// SaveComplete writes the page's content to dir/index.html. The fake does
+// not load resources so no other files are written.
+func (p *WebPage) SaveComplete(dir string) error {
+	content, _ := p.Content()
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0666)
+}
+
+// render encodes the rendered page to w in format.
+func (p *WebPage) render(w io.Writer, format string, quality int) error {
+	if format == "pdf" {
+		_, err := io.WriteString(w, "%PDF-1.4\n%%EOF\n")
+		return err
+	}
+
+	img, err := p.RenderImage(phantomjs.RenderOptions{Format: format})
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "", "png":
+		return png.Encode(w, img)
+	case "jpg", "jpeg":
+		if quality <= 0 {
+			quality = 75
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// RenderImage renders the page with RenderImageFn. By default, returns a
+// blank white image the size of the clip rect, or the viewport if not set,
+// resized by ResizeTo. Watermarks and annotations are not drawn.
+func (p *WebPage) RenderImage(opt phantomjs.RenderOptions) (image.Image, error) {
+	if p.RenderImageFn != nil {
+		return p.RenderImageFn(opt)
+	}
+
+	p.mu.Lock()
+	width, height := p.width, p.height
+	if p.clipRect.Width > 0 && p.clipRect.Height > 0 {
+		width, height = int(p.clipRect.Width), int(p.clipRect.Height)
+	}
+	p.mu.Unlock()
+
+	if opt.Scale > 0 {
+		width, height = int(float64(width)*opt.Scale), int(float64(height)*opt.Scale)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	if opt.ResizeTo != nil {
+		return phantomjs.ResizeImage(img, *opt.ResizeTo), nil
+	}
+	return img, nil
+}
+
+// CaptureFrames renders a frame with RenderImage() for each interval up to
+// duration without waiting between frames.
+func (p *WebPage) CaptureFrames(interval, duration time.Duration, opt phantomjs.RenderOptions) ([]*phantomjs.Frame, error) {
+	var frames []*phantomjs.Frame
+	for t := time.Duration(0); len(frames) == 0 || (interval > 0 && t <= duration); t += interval {
+		img, err := p.RenderImage(opt)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, &phantomjs.Frame{Image: img, Time: t})
+	}
+	return frames, nil
+}
+
+// DiffImage renders the page and compares it to expected.
+func (p *WebPage) DiffImage(expected image.Image, opt phantomjs.RenderOptions, diffOpt phantomjs.DiffOptions) (*phantomjs.ImageDiff, error) {
+	img, err := p.RenderImage(opt)
+	if err != nil {
+		return nil, err
+	}
+	return phantomjs.DiffImages(expected, img, diffOpt)
+}
+
+// SendMouseEvent is a no-op as fake pages have no DOM.
+func (p *WebPage) SendMouseEvent(eventType string, mouseX, mouseY int, button string) error {
+	return nil
+}
+
+// SendKeyboardEvent is a no-op as fake pages have no DOM.
+func (p *WebPage) SendKeyboardEvent(eventType string, key string, modifier int) error {
+	return nil
+}
+
+// UploadFile returns phantomjs.ErrElementNotFound if selector is not in Elements.
+func (p *WebPage) UploadFile(selector, filename string) error {
+	_, err := p.BoundingRect(selector)
+	return err
+}
+
+// WaitForFunction evaluates script with EvaluateFn until it returns a truthy
+// value. Returns immediately if EvaluateFn is not set.
+func (p *WebPage) WaitForFunction(script string, timeout, interval time.Duration) error {
+	return p.WaitForFunctionContext(context.Background(), script, timeout, interval)
+}
+
+// WaitForFunctionContext waits the same as WaitForFunction() but stops
+// waiting and returns ctx's error once ctx is done.
+func (p *WebPage) WaitForFunctionContext(ctx context.Context, script string, timeout, interval time.Duration) error {
+	if p.EvaluateFn == nil {
+		return ctx.Err()
+	}
+	return wait(timeout, interval, func() (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		v, err := p.EvaluateFn(script)
+		return truthy(v), err
+	})
+}
+
+// WaitForSelector waits until selector is in Elements.
+func (p *WebPage) WaitForSelector(selector string, timeout time.Duration) error {
+	return wait(timeout, 0, func() (bool, error) {
+		_, err := p.BoundingRect(selector)
+		return err == nil, nil
+	})
+}
+
+// WaitForNavigation returns "success" immediately as fake pages load synchronously.
+func (p *WebPage) WaitForNavigation(timeout time.Duration) (status string, err error) {
+	return "success", nil
+}
+
+// WaitForResponse waits for a response emitted by Emit() with a URL
+// matching pattern.
+func (p *WebPage) WaitForResponse(pattern string, timeout time.Duration) (*phantomjs.ResourceResponse, error) {
+	re, err := patternRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *phantomjs.ResourceResponse
+	err = wait(timeout, phantomjs.DefaultPollInterval, func() (bool, error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, r := range p.resources {
+			if r.Stage == "end" && re.MatchString(r.URL) {
+				resp = r
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return resp, err
+}
+
+// WaitForNetworkIdle returns immediately as fake pages make no requests.
+func (p *WebPage) WaitForNetworkIdle(idle, timeout time.Duration) error { return nil }
+
+// WaitForURL waits until the URL of the page matches pattern.
+func (p *WebPage) WaitForURL(pattern string, timeout time.Duration) error {
+	return p.waitForMatch(pattern, timeout, p.URL)
+}
+
+// WaitForTitle waits until the title of the page matches pattern.
+func (p *WebPage) WaitForTitle(pattern string, timeout time.Duration) error {
+	return p.waitForMatch(pattern, timeout, p.Title)
+}
+
+// ScrollToBottomUntilStable returns immediately as fake pages do not grow.
+func (p *WebPage) ScrollToBottomUntilStable(maxScrolls int, idle time.Duration) error {
+	return nil
+}
+
+// waitForMatch waits until the value returned by fn matches pattern.
+func (p *WebPage) waitForMatch(pattern string, timeout time.Duration, fn func() (string, error)) error {
+	re, err := patternRegexp(pattern)
+	if err != nil {
+		return err
+	}
+	return wait(timeout, phantomjs.DefaultPollInterval, func() (bool, error) {
+		s, err := fn()
+		return re.MatchString(s), err
+	})
+}
+
+// Events returns a channel of events sent by Emit(). The channel is closed
+// when the page is closed.
+func (p *WebPage) Events() <-chan phantomjs.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.events == nil {
+		p.events = make(chan phantomjs.Event, 100)
+		if p.closed {
+			close(p.events)
+		}
+	}
+	return p.events
+}
+
+// Emit fires an event on the page. Events are dropped if Events() has not
+// been called or its channel is full. Page errors and resource responses are
+// also recorded for LastErrors() and WaitForResponse().
+func (p *WebPage) Emit(e phantomjs.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+
+	switch data := e.Data.(type) {
+	case *phantomjs.PageError:
+		p.errors = append(p.errors, data)
+	case *phantomjs.ResourceResponse:
+		p.resources = append(p.resources, data)
+	}
+
+	if p.events != nil {
+		select {
+		case p.events <- e:
+		default:
+		}
+	}
+}
+
+// SetNetworkLog records w as the page's network log. No entries are written.
+func (p *WebPage) SetNetworkLog(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.networkLog = w
+}
+
+// LastErrors returns page errors emitted by Emit().
+func (p *WebPage) LastErrors() ([]*phantomjs.PageError, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*phantomjs.PageError(nil), p.errors...), nil
+}
+
+// HAR returns an empty HAR log for the page.
+func (p *WebPage) HAR() (*phantomjs.HAR, error) {
+	return &phantomjs.HAR{Log: phantomjs.HARLog{
+		Version: "1.2",
+		Creator: phantomjs.HARCreator{Name: "phantomjsmock"},
+		Pages:   []phantomjs.HARPage{},
+		Entries: []*phantomjs.HAREntry{},
+	}}, nil
+}
+
+// Audit returns AuditResult if set, otherwise an audit with no violations.
+func (p *WebPage) Audit(opt phantomjs.AuditOptions) (*phantomjs.AuditResult, error) {
+	if p.AuditResult != nil {
+		return p.AuditResult, nil
+	}
+	url, _ := p.URL()
+	return &phantomjs.AuditResult{URL: url, Timestamp: time.Now()}, nil
+}
+
+// Login opens the spec's URL, if set, and checks that the form's selectors
+// are in Elements. It then calls LoginFn, if set, and returns the page's
+// cookies.
+func (p *WebPage) Login(spec phantomjs.LoginSpec) ([]*http.Cookie, error) {
+	if spec.URL != "" {
+		if err := p.Open(spec.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	selectors := []string{spec.UserSelector, spec.PassSelector}
+	if spec.SubmitSelector != "" {
+		selectors = append(selectors, spec.SubmitSelector)
+	}
+	for _, selector := range selectors {
+		if _, err := p.BoundingRect(selector); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.LoginFn != nil {
+		if err := p.LoginFn(spec); err != nil {
+			return nil, err
+		}
+	}
+	return p.Cookies()
+}
+
+// Timing returns an empty navigation timing starting at the current time.
+func (p *WebPage) Timing() (*phantomjs.Timing, error) {
+	return &phantomjs.Timing{NavigationStart: time.Now(), NavigationType: "navigate"}, nil
+}
+
+// ResourceTimings returns no entries as fake pages load no resources.
+func (p *WebPage) ResourceTimings() ([]*phantomjs.ResourceTiming, error) {
+	return nil, nil
+}
+
+// OnConfirm sets the handler used by Confirm().
+func (p *WebPage) OnConfirm(fn func(message string) bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.confirmHandler = fn
+	return nil
+}
+
+// Confirm simulates a confirm() dialog and returns the handler's answer or
+// the default if no handler is set.
+func (p *WebPage) Confirm(message string) bool {
+	p.mu.Lock()
+	fn, v := p.confirmHandler, p.confirmDefault
+	p.mu.Unlock()
+	if fn == nil {
+		return v
+	}
+	return fn(message)
+}
+
+// ConfirmDefault returns the answer used when no confirm handler is set.
+func (p *WebPage) ConfirmDefault() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.confirmDefault, nil
+}
+
+// SetConfirmDefault sets the answer used when no confirm handler is set.
+func (p *WebPage) SetConfirmDefault(value bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.confirmDefault = value
+	return nil
+}
+
+// OnPrompt sets the handler used by Prompt().
+func (p *WebPage) OnPrompt(fn func(message, defaultValue string) string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.promptHandler = fn
+	return nil
+}
+
+// Prompt simulates a prompt() dialog and returns the handler's answer or
+// the default if no handler is set.
+func (p *WebPage) Prompt(message, defaultValue string) string {
+	p.mu.Lock()
+	fn, v := p.promptHandler, p.promptDefault
+	p.mu.Unlock()
+	if fn == nil {
+		return v
+	}
+	return fn(message, defaultValue)
+}
+
+// PromptDefault returns the answer used when no prompt handler is set.
+func (p *WebPage) PromptDefault() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.promptDefault, nil
+}
+
+// SetPromptDefault sets the answer used when no prompt handler is set.
+func (p *WebPage) SetPromptDefault(value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.promptDefault = value
+	return nil
+}
+
+// wait calls fn every interval until it returns true.
+// Returns phantomjs.ErrTimeout if fn does not return true within timeout.
+func wait(timeout, interval time.Duration, fn func() (bool, error)) error {
+	if interval <= 0 {
+		interval = phantomjs.DefaultPollInterval
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if ok, err := fn(); err != nil {
+			return err
+		} else if ok {
+			return nil
+		} else if time.Now().After(deadline) {
+			return phantomjs.ErrTimeout
+		}
+		time.Sleep(interval)
+	}
+}
+
+// truthy returns true if v is a truthy JavaScript value.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case int:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+// patternRegexp compiles a glob or slash-enclosed regular expression the
+// same as phantomjs.WebPage.WaitForURL(). Expressions use JavaScript syntax
+// and are translated for Go's regexp package. Go cannot evaluate lookarounds
+// or backreferences so lookarounds are assumed to hold and backreferences
+// match any text, which can match more than PhantomJS would.
+func patternRegexp(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(translateRegexp(pattern[1 : len(pattern)-1]))
+	}
+
+	a := strings.Split(pattern, "*")
+	for i := range a {
+		a[i] = regexp.QuoteMeta(a[i])
+	}
+	return regexp.Compile("^" + strings.Join(a, ".*") + "$")
+}
+
+// translateRegexp converts a JavaScript regular expression to Go syntax.
+func translateRegexp(expr string) string {
+	var buf strings.Builder
+	inClass := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\' && i+1 < len(expr):
+			i++
+			switch e := expr[i]; {
+			case e == 'u' && i+4 < len(expr) && isHex(expr[i+1:i+5]):
+				buf.WriteString(`\x{` + expr[i+1:i+5] + `}`)
+				i += 4
+			case e == 'c' && i+1 < len(expr) && isLetter(expr[i+1]):
+				fmt.Fprintf(&buf, `\x{%02x}`, expr[i+1]%32)
+				i++
+			case e == '0':
+				buf.WriteString(`\x00`)
+			case e >= '1' && e <= '9' && !inClass:
+				for i+1 < len(expr) && expr[i+1] >= '0' && expr[i+1] <= '9' {
+					i++
+				}
+				buf.WriteString(`(?:.*?)`)
+			case e == '/' || e == '-':
+				buf.WriteByte(e)
+			default:
+				buf.WriteByte('\\')
+				buf.WriteByte(e)
+			}
+
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			buf.WriteByte(c)
+
+		case c == '[':
+			// JavaScript allows empty classes: "[]" never matches and
+			// "[^]" matches any character.
+			if strings.HasPrefix(expr[i:], "[]") {
+				buf.WriteString(`[^\x00-\x{10FFFF}]`)
+				i++
+			} else if strings.HasPrefix(expr[i:], "[^]") {
+				buf.WriteString(`[\s\S]`)
+				i += 2
+			} else {
+				inClass = true
+				buf.WriteByte(c)
+				if strings.HasPrefix(expr[i+1:], "^") {
+					buf.WriteByte('^')
+					i++
+				}
+				if strings.HasPrefix(expr[i+1:], "]") {
+					buf.WriteString(`\]`)
+					i++
+				}
+			}
+
+		case c == '(' && hasAnyPrefix(expr[i:], "(?=", "(?!", "(?<=", "(?<!"):
+			i = groupEnd(expr, i)
+
+		case c == '(' && strings.HasPrefix(expr[i:], "(?<"):
+			buf.WriteString("(?P<")
+			i += 2
+
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// groupEnd returns the index of the parenthesis which closes the group
+// starting at i, or the last index if it is unclosed.
+func groupEnd(expr string, i int) int {
+	depth, inClass := 0, false
+	for ; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(expr) - 1
+}
+
+func hasAnyPrefix(s string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+var (
+	titleRegexp = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	tagRegexp   = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>|<[^>]*>`)
+	spaceRegexp = regexp.MustCompile(`\s+`)
+)
+
+// title returns the text of the first <title> element in content.
+func title(content string) string {
+	if m := titleRegexp.FindStringSubmatch(content); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
+// plainText returns content with tags removed and whitespace collapsed.
+func plainText(content string) string {
+	s := tagRegexp.ReplaceAllString(content, " ")
+	return strings.TrimSpace(spaceRegexp.ReplaceAllString(s, " "))
+}
+
+// cloneHeader returns a copy of h.
+func cloneHeader(h http.Header) http.Header {
+	other := make(http.Header, len(h))
+	for k, v := range h {
+		other[k] = append([]string(nil), v...)
+	}
+	return other
+}
+
+// FS is a fake phantomjs.FileSystem which keeps files in memory. Directories
+// exist implicitly while they contain files.
+type FS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewFS returns a new, empty filesystem.
+func NewFS() *FS {
+	return &FS{files: make(map[string][]byte)}
+}
+
+// ReadFile returns the contents of the file at path.
+func (fs *FS) ReadFile(path string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// WriteFile writes data to the file at path, replacing any existing file.
+func (fs *FS) WriteFile(path string, data []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[filepath.Clean(path)] = append([]byte(nil), data...)
+	return nil
+}
+
+// Exists returns true if a file or directory exists at path.
+func (fs *FS) Exists(path string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	path = filepath.Clean(path)
+	for name := range fs.files {
+		if name == path || strings.HasPrefix(name, path+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// List returns the sorted names of the entries in the directory at path.
+func (fs *FS) List(path string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	prefix := filepath.Clean(path) + "/"
+	seen := make(map[string]bool)
+	var names []string
+	for name := range fs.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		entry := strings.SplitN(name[len(prefix):], "/", 2)[0]
+		if !seen[entry] {
+			seen[entry] = true
+			names = append(names, entry)
+		}
+	}
+	if names == nil {
+		return nil, &os.PathError{Op: "list", Path: path, Err: os.ErrNotExist}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Remove removes the file or directory at path along with its contents.
+func (fs *FS) Remove(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	path = filepath.Clean(path)
+	var found bool
+	for name := range fs.files {
+		if name == path || strings.HasPrefix(name, path+"/") {
+			delete(fs.files, name)
+			found = true
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	return nil
+}
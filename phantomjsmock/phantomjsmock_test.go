@@ -0,0 +1,240 @@
+package phantomjsmock_test
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjsmock"
+)
+
+// Ensure pages are served from the process' sites.
+func TestWebPage_Open(t *testing.T) {
+	p := phantomjsmock.NewProcess()
+	p.Sites = map[string]string{
+		"http://example.com/": `<html><head><title>Example</title></head><body><p>Hello  world</p></body></html>`,
+	}
+	page := MustCreateWebPager(p)
+
+	if err := page.Open("http://example.com/"); err != nil {
+		t.Fatal(err)
+	} else if title, _ := page.Title(); title != "Example" {
+		t.Fatalf("unexpected title: %q", title)
+	} else if text, _ := page.PlainText(); text != "Hello world" {
+		t.Fatalf("unexpected text: %q", text)
+	} else if u, _ := page.URL(); u != "http://example.com/" {
+		t.Fatalf("unexpected url: %s", u)
+	}
+
+	// Unknown URLs should return a resource error.
+	if err, ok := page.Open("http://example.com/missing").(*phantomjs.ResourceError); !ok || err.Status != http.StatusNotFound {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+// Ensure navigation history is tracked.
+func TestWebPage_GoBack(t *testing.T) {
+	page := MustCreateWebPager(phantomjsmock.NewProcess())
+	page.Open("http://example.com/a")
+	page.Open("http://example.com/b")
+
+	if ok, _ := page.CanGoBack(); !ok {
+		t.Fatal("expected back")
+	} else if err := page.GoBack(); err != nil {
+		t.Fatal(err)
+	} else if u, _ := page.URL(); u != "http://example.com/a" {
+		t.Fatalf("unexpected url: %s", u)
+	} else if ok, _ := page.CanGoForward(); !ok {
+		t.Fatal("expected forward")
+	}
+}
+
+// Ensure state set on a page can be read back.
+func TestWebPage_State(t *testing.T) {
+	page := MustCreateWebPager(phantomjsmock.NewProcess())
+
+	if err := page.SetViewportSize(800, 600); err != nil {
+		t.Fatal(err)
+	} else if w, h, _ := page.ViewportSize(); w != 800 || h != 600 {
+		t.Fatalf("unexpected viewport: %dx%d", w, h)
+	}
+
+	page.AddCookie(&http.Cookie{Name: "a", Value: "1"})
+	page.AddCookie(&http.Cookie{Name: "a", Value: "2"})
+	if cookies, _ := page.Cookies(); len(cookies) != 1 || cookies[0].Value != "2" {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	} else if ok, _ := page.DeleteCookie("a"); !ok {
+		t.Fatal("expected cookie deletion")
+	}
+
+	page.SetCustomHeaders(http.Header{"X-A": {"b"}})
+	if header, _ := page.CustomHeaders(); !reflect.DeepEqual(header, http.Header{"X-A": {"b"}}) {
+		t.Fatalf("unexpected headers: %#v", header)
+	}
+
+	// Renders a blank image of the viewport size.
+	if img, err := page.RenderImage(phantomjs.RenderOptions{Scale: 2}); err != nil {
+		t.Fatal(err)
+	} else if b := img.Bounds(); b.Dx() != 1600 || b.Dy() != 1200 {
+		t.Fatalf("unexpected bounds: %v", b)
+	}
+}
+
+// Ensure default page settings are applied to new pages and restored by Reset().
+func TestProcess_DefaultPageSettings(t *testing.T) {
+	p := phantomjsmock.NewProcess()
+	p.DefaultPageSettings = &phantomjs.PageDefaults{
+		ViewportWidth:  800,
+		ViewportHeight: 600,
+		UserAgent:      "test-agent",
+		Settings:       &phantomjs.WebPageSettings{Username: "user"},
+	}
+	page := MustCreateWebPager(p)
+
+	page.SetViewportSize(100, 100)
+	page.SetClipRect(phantomjs.Rect{Width: 10, Height: 10})
+	if err := page.Reset(); err != nil {
+		t.Fatal(err)
+	} else if w, h, _ := page.ViewportSize(); w != 800 || h != 600 {
+		t.Fatalf("unexpected viewport: %dx%d", w, h)
+	} else if settings, _ := page.Settings(); settings.UserAgent != "test-agent" {
+		t.Fatalf("unexpected user agent: %q", settings.UserAgent)
+	} else if !settings.JavascriptEnabled || settings.Username != "user" {
+		t.Fatalf("unexpected settings: %#v", settings)
+	} else if rect, _ := page.ClipRect(); rect != (phantomjs.Rect{}) {
+		t.Fatalf("unexpected clip rect: %#v", rect)
+	}
+}
+
+// Ensure evaluation and waits use EvaluateFn.
+func TestWebPage_WaitForFunction(t *testing.T) {
+	p := phantomjsmock.NewProcess()
+	page, _ := p.CreateWebPage()
+
+	var n int
+	page.EvaluateFn = func(script string) (interface{}, error) {
+		n++
+		return n >= 3, nil
+	}
+	if err := page.WaitForFunction("function() {}", time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("unexpected evaluations: %d", n)
+	}
+
+	page.EvaluateFn = func(script string) (interface{}, error) { return false, nil }
+	if err := page.WaitForFunction("function() {}", 10*time.Millisecond, time.Millisecond); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure URL patterns accept the same JavaScript syntax as the shim.
+func TestWebPage_WaitForURL(t *testing.T) {
+	p := phantomjsmock.NewProcess()
+	p.Sites = map[string]string{"http://example.com/Account/home": `<html></html>`}
+	page := MustCreateWebPager(p)
+	if err := page.Open("http://example.com/Account/home"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pattern := range []string{
+		"*/home",
+		`/^https?:\/\/example\.com\/\u0041ccount\/home$/`,
+		`/^(?=.*example)(?!.*login).*\/home$/`,
+		`/\/(?<section>\w+)\/home$/`,
+		`/^http:[^]*home$/`,
+	} {
+		if err := page.WaitForURL(pattern, 0); err != nil {
+			t.Fatalf("%s: unexpected error: %v", pattern, err)
+		}
+	}
+
+	if err := page.WaitForURL("/(?<=x)[]/", 0); err != phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := page.WaitForURL("/([/", 0); err == nil || err == phantomjs.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure emitted events are delivered and the channel closes with the page.
+func TestWebPage_Events(t *testing.T) {
+	p := phantomjsmock.NewProcess()
+	page, _ := p.CreateWebPage()
+	ch := page.Events()
+
+	page.Emit(phantomjs.Event{Type: phantomjs.EventError, Data: &phantomjs.PageError{Message: "marker"}})
+	if e := <-ch; e.Type != phantomjs.EventError {
+		t.Fatalf("unexpected event: %#v", e)
+	} else if errs, _ := page.LastErrors(); len(errs) != 1 || errs[0].Message != "marker" {
+		t.Fatalf("unexpected errors: %#v", errs)
+	}
+
+	// Closing the process closes its pages.
+	p.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("expected closed channel")
+	} else if !page.Closed() {
+		t.Fatal("expected closed page")
+	} else if len(p.Pages()) != 0 {
+		t.Fatal("expected no pages")
+	}
+}
+
+// MustCreateWebPager creates a page from p. Panic on error.
+func MustCreateWebPager(p phantomjs.Processor) phantomjs.WebPager {
+	page, err := p.CreateWebPager()
+	if err != nil {
+		panic(err)
+	}
+	return page
+}
+
+// Ensure Spawn() returns the scripted result and is disabled by default.
+func TestProcess_Spawn(t *testing.T) {
+	p := phantomjsmock.NewProcess()
+	if _, err := p.Spawn("true"); err != phantomjs.ErrSpawnDisabled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p.SpawnFn = func(name string, args ...string) (*phantomjs.SpawnResult, error) {
+		return &phantomjs.SpawnResult{ExitCode: 2, Stdout: name + " " + strings.Join(args, " ")}, nil
+	}
+	if result, err := p.Spawn("sh", "-c", "exit 2"); err != nil {
+		t.Fatal(err)
+	} else if result.ExitCode != 2 || result.Stdout != "sh -c exit 2" {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+}
+
+// Ensure files can be written, listed and removed in the in-memory filesystem.
+func TestProcess_FileSystem(t *testing.T) {
+	fs := phantomjsmock.NewProcess().FileSystem()
+	if err := fs.WriteFile("/out/a.png", []byte("A")); err != nil {
+		t.Fatal(err)
+	} else if err := fs.WriteFile("/out/sub/b.png", []byte("B")); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := fs.ReadFile("/out/a.png"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "A" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	if names, err := fs.List("/out"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"a.png", "sub"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	if err := fs.Remove("/out/sub"); err != nil {
+		t.Fatal(err)
+	} else if ok, err := fs.Exists("/out/sub/b.png"); err != nil || ok {
+		t.Fatalf("unexpected exists: %v %v", ok, err)
+	} else if _, err := fs.ReadFile("/out/missing"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package phantomjstest
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// UpdateGolden causes AssertGolden() to overwrite golden images with the
+// rendered image instead of comparing them. Set with "go test -update-golden".
+var UpdateGolden = flag.Bool("update-golden", false, "update golden images")
+
+// GoldenOptions represents options for comparing a page to a golden image.
+type GoldenOptions struct {
+	// Perceptual color distance, from 0 to 1, above which a pixel is counted
+	// as different. Allows for anti-aliasing differences. Defaults to
+	// phantomjs.DefaultDiffThreshold.
+	Threshold float64
+
+	// Fraction of pixels, from 0 to 1, which may differ before the
+	// comparison fails.
+	Tolerance float64
+
+	// Options used to render the page.
+	Render phantomjs.RenderOptions
+}
+
+// AssertGolden renders page and compares it to the PNG golden image at path.
+// Images are compared with phantomjs.DiffImages(). The test fails if the
+// sizes differ or more pixels differ than allowed by opt, which may be nil
+// to allow no differing pixels at the default threshold. On failure the rendered
+// image is written next to the golden image with an ".actual.png" suffix
+// along with a highlighted diff image with a ".diff.png" suffix.
+//
+// If UpdateGolden is set then the golden image is written instead.
+func AssertGolden(tb testing.TB, page phantomjs.WebPager, path string, opt *GoldenOptions) {
+	tb.Helper()
+	if opt == nil {
+		opt = &GoldenOptions{}
+	}
+
+	img, err := page.RenderImage(opt.Render)
+	if err != nil {
+		tb.Fatalf("render: %s", err)
+		return
+	}
+
+	// Overwrite golden image if updating.
+	if *UpdateGolden {
+		if err := writePNG(path, img); err != nil {
+			tb.Fatalf("update golden: %s", err)
+		}
+		return
+	}
+
+	golden, err := readPNG(path)
+	if os.IsNotExist(err) {
+		tb.Fatalf("golden image not found: %s (run with -update-golden to create)", path)
+		return
+	} else if err != nil {
+		tb.Fatalf("read golden: %s", err)
+		return
+	}
+
+	diff, err := phantomjs.DiffImages(golden, img, phantomjs.DiffOptions{Threshold: opt.Threshold})
+	if err == nil && diff.Ratio() <= opt.Tolerance {
+		return
+	}
+
+	actual := path + ".actual.png"
+	writePNG(actual, img)
+	if err != nil {
+		tb.Fatalf("%s: %s (%s != %s); actual image written to %s", path, err, golden.Bounds().Size(), img.Bounds().Size(), actual)
+		return
+	}
+	writePNG(path+".diff.png", diff.Image)
+	tb.Fatalf("%s: %d of %d pixels differ; actual image written to %s", path, diff.Pixels, diff.Total, actual)
+}
+
+// AssertGoldenHTML sets the content of page to html and compares the rendered
+// page to the golden image at path. See AssertGolden().
+func AssertGoldenHTML(tb testing.TB, page phantomjs.WebPager, html, path string, opt *GoldenOptions) {
+	tb.Helper()
+	if err := page.SetContent(html); err != nil {
+		tb.Fatalf("set content: %s", err)
+		return
+	}
+	AssertGolden(tb, page, path, opt)
+}
+
+// readPNG decodes the PNG image at path.
+func readPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// writePNG encodes img as a PNG to path, creating parent directories.
+func writePNG(path string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
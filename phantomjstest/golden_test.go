@@ -0,0 +1,112 @@
+package phantomjstest_test
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjsmock"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+// Ensure rendered pages are compared to golden images with a tolerance.
+func TestAssertGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phantomjstest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "page.png")
+
+	// Render a 10x10 image with n dark pixels.
+	var n int
+	page := phantomjsmock.NewWebPage()
+	page.RenderImageFn = func(opt phantomjs.RenderOptions) (image.Image, error) {
+		img := image.NewGray(image.Rect(0, 0, 10, 10))
+		for i := range img.Pix {
+			if i >= n {
+				img.Pix[i] = 0xFF
+			}
+		}
+		return img, nil
+	}
+
+	// Missing golden images fail.
+	tb := &fakeTB{TB: t}
+	phantomjstest.AssertGolden(tb, page, path, nil)
+	if !tb.failed {
+		t.Fatal("expected failure")
+	}
+
+	// Write the golden image.
+	*phantomjstest.UpdateGolden = true
+	phantomjstest.AssertGolden(t, page, path, nil)
+	*phantomjstest.UpdateGolden = false
+
+	// Identical renders match.
+	phantomjstest.AssertGolden(t, page, path, nil)
+
+	// Differences within the tolerance match.
+	n = 5
+	phantomjstest.AssertGolden(t, page, path, &phantomjstest.GoldenOptions{Tolerance: 0.05})
+
+	// Differences beyond the tolerance fail and write the actual image.
+	tb = &fakeTB{TB: t}
+	phantomjstest.AssertGolden(tb, page, path, &phantomjstest.GoldenOptions{Tolerance: 0.01})
+	if !tb.failed {
+		t.Fatal("expected failure")
+	} else if _, err := os.Stat(path + ".actual.png"); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(path + ".diff.png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure small color differences are ignored below the threshold.
+func TestAssertGolden_Threshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phantomjstest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "page.png")
+
+	shade := uint8(0x80)
+	page := phantomjsmock.NewWebPage()
+	page.RenderImageFn = func(opt phantomjs.RenderOptions) (image.Image, error) {
+		img := image.NewGray(image.Rect(0, 0, 2, 2))
+		img.SetGray(0, 0, color.Gray{Y: shade})
+		return img, nil
+	}
+
+	*phantomjstest.UpdateGolden = true
+	phantomjstest.AssertGolden(t, page, path, nil)
+	*phantomjstest.UpdateGolden = false
+
+	shade = 0x84
+	phantomjstest.AssertGolden(t, page, path, &phantomjstest.GoldenOptions{Threshold: 0.05})
+
+	tb := &fakeTB{TB: t}
+	phantomjstest.AssertGolden(tb, page, path, &phantomjstest.GoldenOptions{Threshold: 0.01})
+	if !tb.failed {
+		t.Fatal("expected failure")
+	}
+}
+
+// fakeTB records failures instead of failing the test.
+type fakeTB struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Fatalf(format string, args ...interface{}) {
+	tb.failed, tb.msg = true, fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,364 @@
+// Package phantomjstest provides a fake shim server for testing code which
+// uses a phantomjs.Process without running PhantomJS.
+//
+// The server emulates the shim's HTTP routes. Pages can be created, opened,
+// closed and their events polled by default. Other routes respond with an
+// empty object, which decodes as zero values, unless a response is scripted
+// with Handle(), HandleValue() or HandleError().
+//
+//	s := phantomjstest.NewServer()
+//	defer s.Close()
+//	s.HandleValue("/webpage/Title", "Example")
+//
+//	p := s.NewProcess()
+//	page, _ := p.CreateWebPage()
+//	title, _ := page.Title() // "Example"
+package phantomjstest
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// MaxEventPollTimeout is the longest time an event poll is held open for.
+const MaxEventPollTimeout = 1 * time.Second
+
+// Request represents a request received by the server.
+type Request struct {
+	Method string
+	Path   string
+
+	// ID assigned to the request by the process. Cancellations sent to the
+	// "/cancel" route refer to requests by this ID.
+	ID string
+
+	// Reference to the page the request was for, if any.
+	Ref string
+
+	// Decoded JSON body of the request.
+	Body map[string]interface{}
+}
+
+// HandlerFunc returns the response for a request. The response is encoded as
+// JSON. If an error is returned then it is sent as the shim's error response.
+type HandlerFunc func(req *Request) (interface{}, error)
+
+// Server is an HTTP server which emulates the shim.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	handlers map[string]HandlerFunc
+	requests []*Request
+	pages    map[string]*page // process events are queued under a blank ref
+	nextRef  int
+	closed   bool
+}
+
+// page is the state of a page created on the server.
+type page struct {
+	created time.Time
+	seq     int
+	events  []event
+	closed  bool
+}
+
+// event is an event queued for polling, matching the shim's format.
+type event struct {
+	Seq  int         `json:"seq"`
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// NewServer returns a new, running server.
+func NewServer() *Server {
+	s := &Server{
+		handlers: make(map[string]HandlerFunc),
+		pages:    map[string]*page{"": {created: time.Now()}},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close releases pending event polls and shuts down the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.Server.Close()
+}
+
+// Port returns the port the server is listening on.
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// NewProcess returns a process which sends its requests to the server.
+// The process must not be opened as that would start PhantomJS.
+func (s *Server) NewProcess() *phantomjs.Process {
+	p := phantomjs.NewProcess()
+	p.Port = s.Port()
+	return p
+}
+
+// Handle sets the handler for requests to path, replacing the default.
+func (s *Server) Handle(path string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[path] = fn
+}
+
+// HandleValue responds to requests to path with value, which is how the shim
+// returns properties such as "/webpage/Title".
+func (s *Server) HandleValue(path string, value interface{}) {
+	s.Handle(path, func(*Request) (interface{}, error) {
+		return map[string]interface{}{"value": value}, nil
+	})
+}
+
+// HandleError responds to requests to path with an error message.
+func (s *Server) HandleError(path, msg string) {
+	s.Handle(path, func(*Request) (interface{}, error) {
+		return nil, errors.New(msg)
+	})
+}
+
+// Requests returns all requests received by the server, excluding event polls.
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request(nil), s.requests...)
+}
+
+// RequestsTo returns the requests received for path.
+func (s *Server) RequestsTo(path string) []*Request {
+	var a []*Request
+	for _, req := range s.Requests() {
+		if req.Path == path {
+			a = append(a, req)
+		}
+	}
+	return a
+}
+
+// Refs returns the references of pages which are open on the server.
+func (s *Server) Refs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var a []string
+	for i := 1; i <= s.nextRef; i++ {
+		if p := s.pages[strconv.Itoa(i)]; p != nil && !p.closed {
+			a = append(a, strconv.Itoa(i))
+		}
+	}
+	return a
+}
+
+// Emit queues an event on the page with ref, or on the process if ref is
+// blank. Data is encoded as JSON in the shim's format, such as
+// map[string]interface{}{"message": "..."} for an
+// phantomjs.EventConsoleMessage event. Events on unknown pages are ignored.
+func (s *Server) Emit(ref, typ string, data interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.pages[ref]
+	if p == nil || p.closed {
+		return
+	}
+	p.seq++
+	p.events = append(p.events, event{
+		Seq:  p.seq,
+		Type: typ,
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+		Data: data,
+	})
+	s.cond.Broadcast()
+}
+
+// serveHTTP records the request and writes the handler's response.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		return
+	}
+
+	req := &Request{Method: r.Method, Path: r.URL.Path, ID: r.Header.Get("X-Phantomjs-Request-Id")}
+	if err := json.NewDecoder(r.Body).Decode(&req.Body); err != nil && r.ContentLength != 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json: " + err.Error()})
+		return
+	}
+	req.Ref, _ = req.Body["ref"].(string)
+
+	s.mu.Lock()
+	if req.Path != "/webpage/Events" && req.Path != "/process/Events" {
+		s.requests = append(s.requests, req)
+	}
+	fn := s.handlers[req.Path]
+	s.mu.Unlock()
+
+	if fn == nil {
+		fn = s.defaultHandler(req.Path)
+	}
+
+	// Requests for closed pages fail the same as in the shim.
+	if req.Ref != "" && req.Path != "/webpage/Events" && !s.isOpen(req.Ref) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": phantomjs.ErrPageClosed.Error()})
+		return
+	}
+
+	resp, err := fn(req)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	} else if resp == nil {
+		resp = struct{}{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// defaultHandler returns the built-in handler for path.
+func (s *Server) defaultHandler(path string) HandlerFunc {
+	switch path {
+	case "/webpage/Create":
+		return s.handleCreate
+	case "/webpage/Close":
+		return s.handleClose
+	case "/webpage/Open":
+		return func(*Request) (interface{}, error) {
+			return map[string]interface{}{"status": "success"}, nil
+		}
+	case "/webpage/Events":
+		return s.handleEvents
+	case "/process/Events":
+		return s.handleEvents
+	case "/process/Refs":
+		return s.handleRefs
+	case "/process/ReleaseRef":
+		return s.handleReleaseRef
+	default:
+		return func(*Request) (interface{}, error) { return nil, nil }
+	}
+}
+
+func (s *Server) handleCreate(req *Request) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextRef++
+	ref := strconv.Itoa(s.nextRef)
+	s.pages[ref] = &page{created: time.Now()}
+	return map[string]interface{}{"ref": map[string]string{"id": ref}}, nil
+}
+
+func (s *Server) handleClose(req *Request) (interface{}, error) {
+	s.ClosePage(req.Ref)
+	return nil, nil
+}
+
+func (s *Server) handleRefs(req *Request) (interface{}, error) {
+	var a []map[string]interface{}
+	for _, ref := range s.Refs() {
+		s.mu.Lock()
+		created := s.pages[ref].created.UnixNano() / int64(time.Millisecond)
+		s.mu.Unlock()
+		a = append(a, map[string]interface{}{"id": ref, "type": "webpage", "created": created, "lastUsed": created})
+	}
+	return map[string]interface{}{"refs": a}, nil
+}
+
+func (s *Server) handleReleaseRef(req *Request) (interface{}, error) {
+	id, _ := req.Body["id"].(string)
+	if !s.isOpen(id) {
+		return nil, phantomjs.ErrPageClosed
+	}
+	s.ClosePage(id)
+	return nil, nil
+}
+
+// ClosePage closes the page with ref on the server, such as to emulate the
+// page exceeding the process' PageTTL. Later requests for the page return
+// phantomjs.ErrPageClosed.
+func (s *Server) ClosePage(ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.pages[ref]; p != nil {
+		p.closed = true
+		s.cond.Broadcast()
+	}
+}
+
+// isOpen returns true if the page with ref exists and is not closed.
+func (s *Server) isOpen(ref string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.pages[ref]
+	return p != nil && !p.closed
+}
+
+// handleEvents returns events after "since", waiting up to the request's
+// timeout for new events.
+func (s *Server) handleEvents(req *Request) (interface{}, error) {
+	since, _ := req.Body["since"].(float64)
+	timeout, _ := req.Body["timeout"].(float64)
+
+	d := time.Duration(timeout) * time.Millisecond
+	if d > MaxEventPollTimeout {
+		d = MaxEventPollTimeout
+	}
+	expired := false
+	timer := time.AfterFunc(d, func() {
+		s.mu.Lock()
+		expired = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		p := s.pages[req.Ref]
+		if p == nil || p.closed || s.closed {
+			return map[string]interface{}{"events": []event{}, "closed": true}, nil
+		}
+
+		var events []event
+		for _, e := range p.events {
+			if e.Seq > int(since) {
+				events = append(events, e)
+			}
+		}
+		if len(events) > 0 || expired {
+			if events == nil {
+				events = []event{}
+			}
+			return map[string]interface{}{"events": events}, nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// writeJSON writes v to w as JSON with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
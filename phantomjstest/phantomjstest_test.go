@@ -0,0 +1,282 @@
+package phantomjstest_test
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+// Ensure pages can be created and scripted against the fake server.
+func TestServer(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleValue("/webpage/Title", "Example")
+
+	p := s.NewProcess()
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page.Open("http://example.com/"); err != nil {
+		t.Fatal(err)
+	} else if title, err := page.Title(); err != nil {
+		t.Fatal(err)
+	} else if title != "Example" {
+		t.Fatalf("unexpected title: %q", title)
+	}
+
+	// Unscripted routes return zero values.
+	if content, err := page.Content(); err != nil {
+		t.Fatal(err)
+	} else if content != "" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+
+	// Verify requests were recorded.
+	if a := s.RequestsTo("/webpage/Open"); len(a) != 1 {
+		t.Fatalf("unexpected requests: %d", len(a))
+	} else if a[0].Ref != page.Ref().ID() || a[0].Body["url"] != "http://example.com/" {
+		t.Fatalf("unexpected request: %#v", a[0])
+	}
+
+	// Closing the page removes its ref.
+	if refs := s.Refs(); !reflect.DeepEqual(refs, []string{page.Ref().ID()}) {
+		t.Fatalf("unexpected refs: %v", refs)
+	} else if err := page.Close(); err != nil {
+		t.Fatal(err)
+	} else if refs := s.Refs(); len(refs) != 0 {
+		t.Fatalf("unexpected refs: %v", refs)
+	}
+}
+
+// Ensure scripted errors are returned to the client.
+func TestServer_HandleError(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+	s.HandleError("/webpage/Reload", "marker")
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page.Reload(); err == nil || err.Error() != "marker" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure pages closed by the process return ErrPageClosed.
+func TestServer_ClosePage(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := page.Events()
+	s.ClosePage(page.Ref().ID())
+
+	if _, err := page.Title(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Event polling stops.
+	for range ch {
+	}
+
+	// Closing the page releases it without error.
+	if err := page.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure refs can be listed and released.
+func TestServer_Refs(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	p := s.NewProcess()
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refs, err := p.Refs(); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 || refs[0].ID != page.Ref().ID() || refs[0].Type != "webpage" {
+		t.Fatalf("unexpected refs: %#v", refs)
+	} else if age := refs[0].Age(); age < 0 || age > time.Minute {
+		t.Fatalf("unexpected age: %s", age)
+	}
+
+	if err := p.ReleaseRef(page.Ref().ID()); err != nil {
+		t.Fatal(err)
+	} else if err := p.ReleaseRef(page.Ref().ID()); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if refs, _ := p.Refs(); len(refs) != 0 {
+		t.Fatalf("unexpected refs: %#v", refs)
+	}
+}
+
+// Ensure pages whose handles are garbage collected are released by Sweep().
+func TestServer_Sweep(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	p := s.NewProcess()
+	if _, err := p.CreateWebPage(); err != nil {
+		t.Fatal(err)
+	}
+	closed, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed = nil
+
+	// Wait for the dropped handle to be finalized.
+	timeout := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		if n, err := p.Sweep(); err != nil {
+			t.Fatal(err)
+		} else if n == 1 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Only the unclosed page should be released.
+	if a := s.RequestsTo("/process/ReleaseRef"); len(a) != 1 || a[0].Body["id"] != "1" {
+		t.Fatalf("unexpected requests: %#v", a)
+	} else if refs := s.Refs(); len(refs) != 0 {
+		t.Fatalf("unexpected refs: %v", refs)
+	}
+}
+
+// Ensure pages are not released by Sweep() while a request for them runs,
+// even if their handles are collected meanwhile.
+func TestServer_Sweep_InFlight(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(unblock) }) }
+	defer release()
+	s.Handle("/webpage/Content", func(req *phantomjstest.Request) (interface{}, error) {
+		close(started)
+		<-unblock
+		return map[string]interface{}{"value": ""}, nil
+	})
+
+	p := s.NewProcess()
+	done := make(chan error)
+	go func() {
+		page, err := p.CreateWebPage()
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = page.Content()
+		done <- err
+	}()
+	<-started
+
+	// The handle is unreachable once the request is sent but the page
+	// must not be released.
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		if n, err := p.Sweep(); err != nil {
+			t.Fatal(err)
+		} else if n != 0 {
+			t.Fatal("page released during request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The page is released once the request completes.
+	timeout := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		if n, err := p.Sweep(); err != nil {
+			t.Fatal(err)
+		} else if n == 1 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Ensure emitted events are delivered to the page's events channel.
+func TestServer_Emit(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	page, err := s.NewProcess().CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := page.Events()
+	s.Emit(page.Ref().ID(), phantomjs.EventConsoleMessage, map[string]interface{}{"message": "hello", "line": 2})
+
+	select {
+	case e := <-ch:
+		if msg, ok := e.Data.(*phantomjs.ConsoleMessage); !ok || msg.Message != "hello" || msg.Line != 2 {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// Closing the page closes the channel.
+	page.Close()
+	for range ch {
+	}
+}
+
+// Ensure events emitted on the process are delivered to the process' channel.
+func TestServer_Emit_Process(t *testing.T) {
+	s := phantomjstest.NewServer()
+	defer s.Close()
+
+	p := s.NewProcess()
+	ch := p.Events()
+	s.Emit("", phantomjs.EventError, map[string]interface{}{
+		"message": "boom",
+		"trace":   []map[string]interface{}{{"file": "shim.js", "line": 10}},
+	})
+
+	select {
+	case e := <-ch:
+		if err, ok := e.Data.(*phantomjs.PageError); !ok || err.Message != "boom" || len(err.Trace) != 1 || err.Trace[0].Line != 10 {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// Closing the process closes the channel.
+	p.Close()
+	for range ch {
+	}
+}
@@ -0,0 +1,65 @@
+package phantomjs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Proxy represents a proxy server which PhantomJS sends requests through.
+type Proxy struct {
+	Host string
+	Port int
+
+	// Type of proxy: "http" or "socks5". Defaults to "http".
+	Type string
+
+	// Optional credentials for the proxy.
+	Username string
+	Password string
+}
+
+// String returns the proxy's address with its type, such as
+// "socks5://10.0.0.1:1080". Credentials are not included.
+func (p Proxy) String() string {
+	typ := p.Type
+	if typ == "" {
+		typ = "http"
+	}
+	return fmt.Sprintf("%s://%s", typ, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+}
+
+// SetProxy changes the proxy used by all pages without restarting the
+// process. Requests already in progress continue through the old proxy.
+//
+// When CaptureResponses is enabled, PhantomJS is started with the capture
+// proxy so setting another proxy stops responses from being captured.
+func (p *Process) SetProxy(proxy Proxy) error {
+	typ := proxy.Type
+	if typ == "" {
+		typ = "http"
+	}
+	req := map[string]interface{}{
+		"host":     proxy.Host,
+		"port":     proxy.Port,
+		"type":     typ,
+		"username": proxy.Username,
+		"password": proxy.Password,
+	}
+	if err := p.doJSON("POST", "/process/SetProxy", req, nil); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.proxy = proxy
+	p.mu.Unlock()
+	return nil
+}
+
+// Proxy returns the proxy last set with SetProxy(). Returns a zero Proxy if
+// no proxy has been set.
+func (p *Process) Proxy() Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.proxy
+}
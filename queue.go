@@ -0,0 +1,154 @@
+package phantomjs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrQueueFull is returned when a process' request queue is full and
+	// its QueuePolicy is QueueError.
+	ErrQueueFull = errors.New("request queue full")
+
+	// ErrRequestDropped is returned by a queued request which was dropped
+	// to make room for a newer request when its QueuePolicy is QueueDrop.
+	ErrRequestDropped = errors.New("request dropped")
+)
+
+// QueuePolicy determines what happens to a request when a process' request
+// queue is full. See Process.MaxInFlight.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes callers wait for their turn regardless of the queue
+	// depth. This is the default.
+	QueueBlock QueuePolicy = iota
+
+	// QueueDrop drops the oldest queued request to make room for the new
+	// request. The dropped request returns ErrRequestDropped.
+	QueueDrop
+
+	// QueueError rejects the new request with ErrQueueFull.
+	QueueError
+)
+
+// queueBypass are the routes which are sent immediately, even if the queue
+// is enabled, as they are long polls or must not wait behind the requests
+// they affect. Waits can take until their timeout so they must not hold a
+// slot needed by the request which ends the wait, such as a Click() which
+// triggers the navigation being waited for. Tunnel lookups are made by the
+// capture proxy while the page's request is held up waiting for them. Open()
+// does not depend on other requests so it is queued like any other work.
+var queueBypass = map[string]bool{
+	"/cancel":                     true,
+	"/process/Events":             true,
+	"/process/TunnelOwner":        true,
+	"/webpage/Events":             true,
+	"/webpage/WaitForFunction":    true,
+	"/webpage/WaitForNavigation":  true,
+	"/webpage/WaitForNetworkIdle": true,
+	"/webpage/WaitForResponse":    true,
+	"/webpage/WaitForTitle":       true,
+	"/webpage/WaitForURL":         true,
+}
+
+// requestQueue limits the number of requests in flight to the shim.
+type requestQueue struct {
+	mu       sync.Mutex
+	inflight int
+	waiting  []chan error
+}
+
+// acquire waits until a request to path can be sent. The caller must call
+// release() once the request completes.
+func (p *Process) acquire(ctx context.Context, path string) error {
+	if p.MaxInFlight <= 0 || queueBypass[path] {
+		return nil
+	}
+	q := &p.queue
+
+	q.mu.Lock()
+	if q.inflight < p.MaxInFlight && len(q.waiting) == 0 {
+		q.inflight++
+		q.mu.Unlock()
+		return nil
+	}
+
+	// Make room in a full queue according to the policy.
+	if len(q.waiting) >= p.QueueDepth {
+		switch p.QueuePolicy {
+		case QueueError:
+			q.mu.Unlock()
+			return ErrQueueFull
+		case QueueDrop:
+			if len(q.waiting) > 0 {
+				q.waiting[0] <- ErrRequestDropped
+				q.waiting = q.waiting[1:]
+			} else {
+				q.mu.Unlock()
+				return ErrRequestDropped
+			}
+		}
+	}
+
+	// Wait to be handed a slot by release() or to be dropped.
+	ready := make(chan error, 1)
+	q.waiting = append(q.waiting, ready)
+	q.mu.Unlock()
+
+	select {
+	case err := <-ready:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Leave the queue. If a slot was handed over in the meantime then
+	// pass it on.
+	q.mu.Lock()
+	for i, ch := range q.waiting {
+		if ch == ready {
+			q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+			q.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	if err := <-ready; err == nil {
+		p.release(path)
+	}
+	return ctx.Err()
+}
+
+// release frees the slot of a completed request to path, handing it to the
+// oldest queued request, if any.
+func (p *Process) release(path string) {
+	if p.MaxInFlight <= 0 || queueBypass[path] {
+		return
+	}
+	q := &p.queue
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		q.waiting[0] <- nil
+		q.waiting = q.waiting[1:]
+		return
+	}
+	q.inflight--
+}
+
+// queuedBody releases a request's queue slot when its body is closed.
+type queuedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Close closes the body and releases the slot.
+func (b *queuedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,189 @@
+package phantomjs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// RecordedCall represents a single request to the shim and its response.
+type RecordedCall struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Request  string `json:"request,omitempty"`
+	Status   int    `json:"status"`
+	Response string `json:"response"`
+}
+
+// Recorder is an http.RoundTripper which records the requests a process
+// sends to the shim so they can be served by a Replayer in tests.
+//
+//	rec := phantomjs.NewRecorder(nil)
+//	p := phantomjs.NewProcess()
+//	p.Transport = rec
+//	... use process ...
+//	rec.WriteFile("testdata/fixture.json")
+type Recorder struct {
+	mu        sync.Mutex
+	calls     []RecordedCall
+	transport http.RoundTripper
+}
+
+// NewRecorder returns a recorder which sends requests through transport.
+// Uses http.DefaultTransport if transport is nil.
+func NewRecorder(transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{transport: transport}
+}
+
+// RoundTrip sends the request and records it along with its response.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, RecordedCall{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Request:  string(reqBody),
+		Status:   resp.StatusCode,
+		Response: string(respBody),
+	})
+	r.mu.Unlock()
+
+	return resp, nil
+}
+
+// Calls returns a copy of the recorded calls.
+func (r *Recorder) Calls() []RecordedCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedCall(nil), r.calls...)
+}
+
+// WriteTo writes the recorded calls to w as JSON.
+func (r *Recorder) WriteTo(w io.Writer) (int64, error) {
+	buf, err := json.MarshalIndent(r.Calls(), "", "\t")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// WriteFile writes the recorded calls to a fixture file.
+func (r *Recorder) WriteFile(path string) error {
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// Replayer is an http.RoundTripper which serves calls previously recorded by
+// a Recorder so code using a process can be tested without a phantomjs
+// binary. A process using a Replayer does not need to be opened.
+//
+// Requests are matched by method, path, and body. Matching calls are served
+// in the order they were recorded and the last one is repeated once all have
+// been served, which allows polling requests to be replayed.
+type Replayer struct {
+	mu    sync.Mutex
+	calls []RecordedCall
+	used  []bool
+}
+
+// NewReplayer returns a replayer which serves calls.
+func NewReplayer(calls []RecordedCall) *Replayer {
+	return &Replayer{calls: calls, used: make([]bool, len(calls))}
+}
+
+// OpenReplayer returns a replayer which serves calls from a fixture file.
+func OpenReplayer(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var calls []RecordedCall
+	if err := json.NewDecoder(f).Decode(&calls); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid fixture: %s", err)
+	}
+	return NewReplayer(calls), nil
+}
+
+// RoundTrip returns the recorded response for the request.
+// Returns an error if no call matches the request.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last := -1
+	for i, call := range r.calls {
+		if call.Method != req.Method || call.Path != req.URL.Path || call.Request != string(body) {
+			continue
+		} else if !r.used[i] {
+			r.used[i] = true
+			return call.response(req), nil
+		}
+		last = i
+	}
+	if last == -1 {
+		return nil, fmt.Errorf("phantomjs: no recorded call: %s %s %s", req.Method, req.URL.Path, body)
+	}
+	return r.calls[last].response(req), nil
+}
+
+// response returns the recorded response as an HTTP response.
+func (c *RecordedCall) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.Status, http.StatusText(c.Status)),
+		StatusCode:    c.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(c.Response))),
+		ContentLength: int64(len(c.Response)),
+		Request:       req,
+	}
+}
+
+// readBody reads and replaces a request or response body so it can be read again.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = ioutil.NopCloser(bytes.NewReader(buf))
+	return buf, nil
+}
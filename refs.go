@@ -0,0 +1,181 @@
+package phantomjs
+
+import (
+	"runtime"
+	"time"
+)
+
+// RefInfo represents an object referenced by the shim, such as a web page.
+type RefInfo struct {
+	ID       string
+	Type     string // "webpage" or "object"
+	URL      string // current URL for web pages
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// Age returns the time since the reference was created.
+func (r *RefInfo) Age() time.Duration {
+	return time.Since(r.Created)
+}
+
+type refInfoJSON struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastUsed"`
+}
+
+func decodeRefInfoJSON(v refInfoJSON) *RefInfo {
+	return &RefInfo{
+		ID:       v.ID,
+		Type:     v.Type,
+		URL:      v.URL,
+		Created:  time.Unix(0, v.Created*int64(time.Millisecond)),
+		LastUsed: time.Unix(0, v.LastUsed*int64(time.Millisecond)),
+	}
+}
+
+// Refs returns the objects currently referenced by the shim. Pages which are
+// listed here but no longer used by the application have leaked and should
+// be closed or released with ReleaseRef().
+func (p *Process) Refs() ([]*RefInfo, error) {
+	var resp struct {
+		Refs []refInfoJSON `json:"refs"`
+	}
+	if err := p.doJSON("POST", "/process/Refs", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	a := make([]*RefInfo, len(resp.Refs))
+	for i := range resp.Refs {
+		a[i] = decodeRefInfoJSON(resp.Refs[i])
+	}
+	return a, nil
+}
+
+// ReleaseRef closes and dereferences the object with id in the shim. Web
+// pages are closed along with the pages they own. Returns ErrPageClosed if
+// the reference does not exist.
+func (p *Process) ReleaseRef(id string) error {
+	p.forgetHandles(id)
+	p.forgetProperties(id)
+	return p.doJSON("POST", "/process/ReleaseRef", map[string]interface{}{"id": id}, nil)
+}
+
+// Sweep releases the pages whose WebPage handles have all been garbage
+// collected without the page being closed. Pages with requests in flight,
+// whose handles can be collected while the request runs, are released by a
+// later sweep. Returns the number of pages released. Sweep is called
+// periodically if SweepInterval is set.
+func (p *Process) Sweep() (n int, err error) {
+	p.refMu.Lock()
+	var ids, deferred []string
+	for _, id := range p.collected {
+		if p.busy[id] > 0 {
+			deferred = append(deferred, id)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	p.collected = deferred
+	p.refMu.Unlock()
+
+	for _, id := range ids {
+		if e := p.doJSON("POST", "/process/ReleaseRef", map[string]interface{}{"id": id}, nil); e == ErrPageClosed {
+			continue
+		} else if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		n++
+	}
+	return n, err
+}
+
+// runSweep calls Sweep() every SweepInterval until closing is closed.
+func (p *Process) runSweep(closing chan struct{}) {
+	ticker := time.NewTicker(p.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+			p.Sweep()
+		}
+	}
+}
+
+// newWebPage returns a handle to the page with id. The page is queued for
+// release by Sweep() once all of its handles are garbage collected.
+func newWebPage(p *Process, id string) *WebPage {
+	page := &WebPage{ref: newRef(p, id)}
+
+	p.refMu.Lock()
+	if p.handles == nil {
+		p.handles = make(map[string]int)
+	}
+	p.handles[id]++
+	p.refMu.Unlock()
+
+	runtime.SetFinalizer(page, func(page *WebPage) {
+		p.releaseHandle(id)
+	})
+	return page
+}
+
+// releaseHandle decrements the number of live handles for a page and queues
+// the page for release when none remain.
+func (p *Process) releaseHandle(id string) {
+	p.refMu.Lock()
+	defer p.refMu.Unlock()
+
+	n, ok := p.handles[id]
+	if !ok {
+		return
+	} else if n > 1 {
+		p.handles[id] = n - 1
+		return
+	}
+	delete(p.handles, id)
+	p.collected = append(p.collected, id)
+}
+
+// beginRequest marks a request for the page referenced by req, if any, as in
+// flight so that Sweep() does not release the page until the returned
+// function is called. A WebPage's handle is not used once its method has
+// built the request so it can be collected before the request completes.
+func (p *Process) beginRequest(req interface{}) (end func()) {
+	m, _ := req.(map[string]interface{})
+	id, _ := m["ref"].(string)
+	if id == "" {
+		return func() {}
+	}
+
+	p.refMu.Lock()
+	if p.busy == nil {
+		p.busy = make(map[string]int)
+	}
+	p.busy[id]++
+	p.refMu.Unlock()
+
+	return func() {
+		p.refMu.Lock()
+		defer p.refMu.Unlock()
+		if p.busy[id]--; p.busy[id] <= 0 {
+			delete(p.busy, id)
+		}
+	}
+}
+
+// forgetHandles stops tracking handles for a page which has been closed.
+func (p *Process) forgetHandles(id string) {
+	p.refMu.Lock()
+	defer p.refMu.Unlock()
+	delete(p.handles, id)
+}
@@ -0,0 +1,116 @@
+package phantomjs
+
+import (
+	"image"
+	"image/color"
+)
+
+// ResizeMode determines how an image is fit to the size in ResizeOptions.
+type ResizeMode int
+
+const (
+	// ResizeFit scales the image to fit within the size while keeping its
+	// aspect ratio, so one side may be shorter than requested. This is the
+	// default.
+	ResizeFit ResizeMode = iota
+
+	// ResizeFill scales the image to cover the size while keeping its aspect
+	// ratio and crops the overflow equally from both sides.
+	ResizeFill
+
+	// ResizeStretch scales the image to exactly the size, distorting it if
+	// the aspect ratio differs.
+	ResizeStretch
+)
+
+// ResizeOptions represents the size an image is scaled to, such as for a
+// thumbnail. If Width or Height is zero then it is calculated from the other
+// to keep the image's aspect ratio and Mode is ignored.
+type ResizeOptions struct {
+	Width  int
+	Height int
+	Mode   ResizeMode
+}
+
+// ResizeImage scales img according to opt. Pixels are averaged over the area
+// they cover so downscaled text and edges stay smooth. Returns img unchanged
+// if neither Width nor Height is set.
+func ResizeImage(img image.Image, opt ResizeOptions) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := opt.Width, opt.Height
+	if (w <= 0 && h <= 0) || sw == 0 || sh == 0 {
+		return img
+	}
+
+	// Calculate a missing side from the aspect ratio.
+	if w <= 0 {
+		return resample(img, b, max1(sw*h/sh), h)
+	} else if h <= 0 {
+		return resample(img, b, w, max1(sh*w/sw))
+	}
+
+	switch opt.Mode {
+	case ResizeFill:
+		// Crop the source to the target's aspect ratio around its center.
+		src := b
+		if sw*h > sh*w {
+			cw := max1(sh * w / h)
+			src.Min.X += (sw - cw) / 2
+			src.Max.X = src.Min.X + cw
+		} else {
+			ch := max1(sw * h / w)
+			src.Min.Y += (sh - ch) / 2
+			src.Max.Y = src.Min.Y + ch
+		}
+		return resample(img, src, w, h)
+	case ResizeStretch:
+		return resample(img, b, w, h)
+	default:
+		if sw*h > sh*w {
+			return resample(img, b, w, max1(sh*w/sw))
+		}
+		return resample(img, b, max1(sw*h/sh), h)
+	}
+}
+
+// resample scales the r area of src to a w×h image by averaging the source
+// pixels covered by each destination pixel.
+func resample(src image.Image, r image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	rw, rh := r.Dx(), r.Dy()
+	for y := 0; y < h; y++ {
+		y0 := r.Min.Y + y*rh/h
+		y1 := r.Min.Y + ((y+1)*rh+h-1)/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			x0 := r.Min.X + x*rw/w
+			x1 := r.Min.X + ((x+1)*rw+w-1)/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sr, sg, sb, sa, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					sr, sg, sb, sa = sr+uint64(cr), sg+uint64(cg), sb+uint64(cb), sa+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(sr / n), G: uint16(sg / n), B: uint16(sb / n), A: uint16(sa / n)})
+		}
+	}
+	return dst
+}
+
+// max1 returns v, or 1 if v is less than 1.
+func max1(v int) int {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,183 @@
+package phantomjs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoProxies is returned when a ProxyRotator has no unused proxies left.
+var ErrNoProxies = errors.New("no proxies available")
+
+// ProxyRotator is a WebPageCreator which spreads pages across processes that
+// each use a different proxy, such as to scrape from several exit IPs at
+// once. It can be used as the creator of a PagePool.
+//
+// Pages opened with OpenPage() are checked with Detect and their process is
+// switched to the next unused proxy from the list when their proxy fails or
+// is banned. Rotate() switches proxies manually. Rotated proxies are not
+// reused.
+type ProxyRotator struct {
+	// Reports whether a page load failed because of its proxy. status is
+	// the HTTP status of the page's document, or zero if there is none, and
+	// err is the error returned by Open(). Defaults to DefaultProxyFailure.
+	Detect func(page *WebPage, status int, err error) bool
+
+	mu        sync.Mutex
+	processes []*Process
+	proxies   []Proxy
+	next      int // index of the next unused proxy
+	i         int // index of the process for the next page
+}
+
+// NewProxyRotator returns a rotator which assigns proxies to processes in
+// order. There must be at least as many proxies as processes.
+func NewProxyRotator(processes []*Process, proxies []Proxy) *ProxyRotator {
+	return &ProxyRotator{processes: processes, proxies: proxies}
+}
+
+// Open assigns a proxy to each process. The processes must already be open.
+func (r *ProxyRotator) Open() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.processes {
+		if r.next >= len(r.proxies) {
+			return ErrNoProxies
+		}
+		if err := p.SetProxy(r.proxies[r.next]); err != nil {
+			return err
+		}
+		r.next++
+	}
+	return nil
+}
+
+// CreateWebPage creates a page on the next process in turn.
+func (r *ProxyRotator) CreateWebPage() (*WebPage, error) {
+	r.mu.Lock()
+	p := r.processes[r.i%len(r.processes)]
+	r.i++
+	r.mu.Unlock()
+
+	return p.CreateWebPage()
+}
+
+// OpenPage opens url on page and rotates the proxy of the page's process if
+// Detect reports a proxy failure. The failure is returned as a
+// *ProxyFailedError so the caller can open the page again with the new
+// proxy. Returns ErrNoProxies if a failure is detected and all proxies have
+// been used.
+func (r *ProxyRotator) OpenPage(page *WebPage, url string) error {
+	proxy := page.ref.process.Proxy()
+	err := page.Open(url)
+
+	detect := r.Detect
+	if detect == nil {
+		detect = DefaultProxyFailure
+	}
+	status := page.documentStatus()
+	if !detect(page, status, err) {
+		return err
+	}
+
+	if _, err := r.Rotate(page, proxy); err != nil {
+		return err
+	}
+	return &ProxyFailedError{Proxy: proxy, Status: status, Err: err}
+}
+
+// DefaultProxyFailure reports a proxy failure when the document is forbidden
+// or rate limited, with a 403 or 429 status, or when the connection to the
+// proxy or through it is refused, closed, or times out.
+func DefaultProxyFailure(page *WebPage, status int, err error) bool {
+	if status == 403 || status == 429 {
+		return true
+	}
+
+	e, ok := err.(*ResourceError)
+	if !ok {
+		return false
+	}
+	switch code := e.ErrorCode; {
+	case code == 1, code == 2, code == 4: // connection refused, closed, or timed out
+		return true
+	case code >= 101 && code <= 199: // proxy errors
+		return true
+	}
+	return false
+}
+
+// ProxyFailedError is returned by ProxyRotator.OpenPage() when a page's proxy
+// failed and was rotated.
+type ProxyFailedError struct {
+	Proxy  Proxy // the failed proxy
+	Status int   // status of the document, if any
+	Err    error // error returned by Open(), if any
+}
+
+// Error returns the failed proxy and the cause of the failure.
+func (e *ProxyFailedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("proxy %s failed: %s", e.Proxy, e.Err)
+	}
+	return fmt.Sprintf("proxy %s failed: status %d", e.Proxy, e.Status)
+}
+
+// documentStatus returns the final HTTP status of the document loaded by the
+// most recent call to Open(), following redirects, or zero if unknown.
+func (p *WebPage) documentStatus() int {
+	var resp harJSON
+	if err := p.ref.process.doJSON("POST", "/webpage/HAR", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return 0
+	}
+
+	var status int
+	var next string
+	for i, e := range resp.Entries {
+		if i != 0 && e.Request.URL != next {
+			continue
+		}
+		r := e.End
+		if r == nil {
+			r = e.Start
+		}
+		if r == nil {
+			return status
+		} else if status, next = r.Status, r.RedirectURL; next == "" {
+			return status
+		}
+	}
+	return status
+}
+
+// ProxyFor returns the proxy currently used by the process serving page.
+func (r *ProxyRotator) ProxyFor(page *WebPage) Proxy {
+	return page.ref.process.Proxy()
+}
+
+// Rotate switches the process serving page to the next unused proxy, such
+// as after a request failed or a ban was detected. Other pages on the same
+// process also use the new proxy. Returns the new proxy or ErrNoProxies if
+// all proxies have been used.
+//
+// Rotating a proxy which has already been replaced, such as when several
+// pages detect the same ban, returns the current proxy without rotating.
+func (r *ProxyRotator) Rotate(page *WebPage, failed Proxy) (Proxy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := page.ref.process
+	if current := p.Proxy(); current != failed {
+		return current, nil
+	} else if r.next >= len(r.proxies) {
+		return Proxy{}, ErrNoProxies
+	}
+
+	proxy := r.proxies[r.next]
+	if err := p.SetProxy(proxy); err != nil {
+		return Proxy{}, err
+	}
+	r.next++
+	return proxy, nil
+}
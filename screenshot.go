@@ -0,0 +1,134 @@
+package phantomjs
+
+import (
+	"image"
+	"sync"
+	"time"
+)
+
+// DefaultScreenshotWaitTimeout is the default time Screenshots() waits for a
+// request's wait conditions.
+const DefaultScreenshotWaitTimeout = 30 * time.Second
+
+// ScreenshotRequest represents a page to capture with Screenshots().
+type ScreenshotRequest struct {
+	URL string
+
+	// Viewport size, in pixels. A zero dimension keeps the page's current
+	// value for that dimension.
+	Width  int
+	Height int
+
+	// Wait conditions, applied after the page has loaded. WaitTimeout
+	// defaults to DefaultScreenshotWaitTimeout.
+	WaitSelector string
+	WaitFunction string
+	WaitTimeout  time.Duration
+	Delay        time.Duration
+
+	// If set, only the element matching the selector is captured.
+	Selector string
+
+	// Options used to render the page.
+	Options RenderOptions
+}
+
+// ScreenshotResult represents the outcome of a ScreenshotRequest.
+type ScreenshotResult struct {
+	URL   string
+	Image image.Image
+	Err   error
+}
+
+// Screenshots captures each request using a pool of concurrency pages and
+// returns a result for each request, in the same order. A failed request
+// sets the Err field of its result and does not stop the other requests.
+// Returns an error only if the pool cannot be created.
+func (p *Process) Screenshots(reqs []ScreenshotRequest, concurrency int) ([]*ScreenshotResult, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > len(reqs) {
+		concurrency = len(reqs)
+	}
+
+	pool := NewPagePool(p, concurrency)
+	if err := pool.Open(); err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	results := make([]*ScreenshotResult, len(reqs))
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				results[i] = &ScreenshotResult{URL: reqs[i].URL}
+
+				page, err := pool.Acquire()
+				if err != nil {
+					results[i].Err = err
+					continue
+				}
+				results[i].Image, results[i].Err = page.screenshot(&reqs[i])
+				pool.Release(page)
+			}
+		}()
+	}
+	for i := range reqs {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+
+	return results, nil
+}
+
+// screenshot opens the request's URL, waits for the page to be ready, and
+// renders it.
+func (p *WebPage) screenshot(req *ScreenshotRequest) (image.Image, error) {
+	if req.Width > 0 || req.Height > 0 {
+		width, height, err := p.ViewportSize()
+		if err != nil {
+			return nil, err
+		}
+		if req.Width > 0 {
+			width = req.Width
+		}
+		if req.Height > 0 {
+			height = req.Height
+		}
+		if err := p.SetViewportSize(width, height); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.Open(req.URL); err != nil {
+		return nil, err
+	}
+
+	timeout := req.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultScreenshotWaitTimeout
+	}
+	if req.WaitSelector != "" {
+		if err := p.WaitForSelector(req.WaitSelector, timeout); err != nil {
+			return nil, err
+		}
+	}
+	if req.WaitFunction != "" {
+		if err := p.WaitForFunction(req.WaitFunction, timeout, 0); err != nil {
+			return nil, err
+		}
+	}
+	time.Sleep(req.Delay)
+
+	if req.Selector != "" {
+		if err := p.SetClipRectToElement(req.Selector); err != nil {
+			return nil, err
+		}
+	}
+	return p.RenderImage(req.Options)
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job errors.
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobNotFinished = errors.New("job not finished")
+	ErrQueueFull      = errors.New("job queue full")
+	ErrQueueClosed    = errors.New("job queue closed")
+	ErrJobTimeout     = errors.New("job timed out waiting for a worker")
+)
+
+// Default job queue settings.
+const (
+	DefaultMaxPending = 1000
+	DefaultJobTTL     = 10 * time.Minute
+)
+
+// JobState represents the state of a render job.
+type JobState string
+
+// Job states.
+const (
+	JobPending JobState = "pending"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+// JobStatus represents the current status of a render job.
+type JobStatus struct {
+	ID       string    `json:"id"`
+	State    JobState  `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// job is a render request and its result.
+type job struct {
+	status      JobStatus
+	req         *ScreenshotRequest
+	contentType string
+	data        []byte
+}
+
+// JobQueue renders screenshot requests in the background so long renders
+// can be requested without holding a connection open. Jobs are submitted
+// with SubmitRender() and their results retrieved with Result() until they
+// expire after TTL.
+//
+// JobQueue is also an HTTP handler, typically mounted with http.StripPrefix():
+//
+//	POST /            submit a JSON ScreenshotRequest, returns {"id":"..."}
+//	GET  /:id         returns the job's JobStatus as JSON
+//	GET  /:id/result  returns the rendered image or PDF
+type JobQueue struct {
+	mu     sync.Mutex
+	jobs   map[string]*job
+	queue  chan *job
+	closed bool
+	wg     sync.WaitGroup
+
+	handler *ScreenshotHandler
+	workers int
+
+	// Time finished jobs are retained for retrieval.
+	TTL time.Duration
+
+	// Maximum number of jobs waiting to be rendered. Must be set before Open().
+	MaxPending int
+}
+
+// NewJobQueue returns a new job queue which renders with handler using up to
+// workers concurrent jobs.
+func NewJobQueue(handler *ScreenshotHandler, workers int) *JobQueue {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &JobQueue{
+		jobs:       make(map[string]*job),
+		handler:    handler,
+		workers:    workers,
+		TTL:        DefaultJobTTL,
+		MaxPending: DefaultMaxPending,
+	}
+}
+
+// Open starts the queue's workers.
+func (q *JobQueue) Open() error {
+	q.queue = make(chan *job, q.MaxPending)
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() { defer q.wg.Done(); q.run() }()
+	}
+	return nil
+}
+
+// Close stops accepting jobs and waits for running jobs to finish. Pending
+// jobs are marked as failed.
+func (q *JobQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+	return nil
+}
+
+// run processes jobs until the queue is closed.
+func (q *JobQueue) run() {
+	for j := range q.queue {
+		q.mu.Lock()
+		closed := q.closed
+		if !closed {
+			j.status.State = JobRunning
+		}
+		q.mu.Unlock()
+
+		// Fail remaining jobs once the queue is closing.
+		if closed {
+			q.finish(j, "", nil, ErrQueueClosed)
+			continue
+		}
+
+		// Jobs share the handler's workers so a busy handler is reported as
+		// the job timing out rather than as a rejected request.
+		contentType, data, err := q.handler.Render(j.req)
+		if err == ErrBusy {
+			err = ErrJobTimeout
+		}
+		q.finish(j, contentType, data, err)
+	}
+}
+
+// finish records the result of a job.
+func (q *JobQueue) finish(j *job, contentType string, data []byte, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j.status.Finished = time.Now()
+	if err != nil {
+		j.status.State, j.status.Error = JobFailed, err.Error()
+		return
+	}
+	j.status.State = JobDone
+	j.contentType, j.data = contentType, data
+}
+
+// SubmitRender validates req and queues it for rendering.
+// Returns the job's ID which is used to retrieve its status and result.
+func (q *JobQueue) SubmitRender(req *ScreenshotRequest) (string, error) {
+	if err := req.Normalize(); err != nil {
+		return "", err
+	} else if err := q.handler.validate(req); err != nil {
+		return "", err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+	j := &job{req: req, status: JobStatus{ID: id, State: JobPending, Created: time.Now()}}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.queue == nil {
+		return "", ErrQueueClosed
+	}
+	q.expire()
+
+	select {
+	case q.queue <- j:
+	default:
+		return "", ErrQueueFull
+	}
+	q.jobs[id] = j
+	return id, nil
+}
+
+// expire removes finished jobs older than the TTL. Must be called under lock.
+func (q *JobQueue) expire() {
+	now := time.Now()
+	for id, j := range q.jobs {
+		if !j.status.Finished.IsZero() && now.Sub(j.status.Finished) > q.TTL {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// Status returns the status of a job.
+func (q *JobQueue) Status(id string) (JobStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j := q.jobs[id]
+	if j == nil {
+		return JobStatus{}, ErrJobNotFound
+	}
+	return j.status, nil
+}
+
+// Result returns the content type and data of a finished job. Returns
+// ErrJobNotFinished if the job is still pending or running and the render
+// error if the job failed.
+func (q *JobQueue) Result(id string) (contentType string, data []byte, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j := q.jobs[id]
+	if j == nil {
+		return "", nil, ErrJobNotFound
+	}
+
+	switch j.status.State {
+	case JobDone:
+		return j.contentType, j.data, nil
+	case JobFailed:
+		return "", nil, errors.New(j.status.Error)
+	default:
+		return "", nil, ErrJobNotFinished
+	}
+}
+
+// ServeHTTP handles requests to submit jobs and retrieve their results.
+func (q *JobQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "POST" && a[0] == "":
+		q.handleSubmit(w, r)
+	case r.Method == "GET" && len(a) == 1 && a[0] != "":
+		q.handleStatus(w, r, a[0])
+	case r.Method == "GET" && len(a) == 2 && a[1] == "result":
+		q.handleResult(w, r, a[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (q *JobQueue) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req ScreenshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := q.SubmitRender(&req)
+	switch err {
+	case nil:
+	case ErrQueueFull, ErrQueueClosed:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+func (q *JobQueue) handleStatus(w http.ResponseWriter, r *http.Request, id string) {
+	status, err := q.Status(id)
+	if err == ErrJobNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (q *JobQueue) handleResult(w http.ResponseWriter, r *http.Request, id string) {
+	contentType, data, err := q.Result(id)
+	switch err {
+	case nil:
+	case ErrJobNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrJobNotFinished:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// newJobID returns a random job identifier.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,156 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs/server"
+)
+
+// Ensure a submitted job is run and its failure is reported.
+func TestJobQueue_SubmitRender(t *testing.T) {
+	q := MustOpenJobQueue(&creator{err: errors.New("marker")})
+	defer q.Close()
+
+	id, err := q.SubmitRender(&server.ScreenshotRequest{URL: "http://93.184.216.34/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := MustWaitForJob(t, q, id)
+	if status.State != server.JobFailed || status.Error != "marker" {
+		t.Fatalf("unexpected status: %#v", status)
+	} else if _, _, err := q.Result(id); err == nil || err.Error() != "marker" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Unknown jobs should return an error.
+	if _, err := q.Status("none"); err != server.ErrJobNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, _, err := q.Result("none"); err != server.ErrJobNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a job which cannot get a worker fails with its own timeout error.
+func TestJobQueue_SubmitRender_Timeout(t *testing.T) {
+	c := &creator{err: errors.New("marker"), block: make(chan struct{})}
+	h := server.NewScreenshotHandler(c, 1)
+	q := server.NewJobQueue(h, 1)
+	if err := q.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Hold the handler's only worker with a synchronous render.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Render(&server.ScreenshotRequest{URL: "http://93.184.216.34/", Format: "png"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	id, err := q.SubmitRender(&server.ScreenshotRequest{URL: "http://93.184.216.34/", Timeout: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := MustWaitForJob(t, q, id); status.State != server.JobFailed || status.Error != server.ErrJobTimeout.Error() {
+		t.Fatalf("unexpected status: %#v", status)
+	}
+
+	close(c.block)
+	<-done
+}
+
+// Ensure invalid requests are rejected on submission.
+func TestJobQueue_SubmitRender_Invalid(t *testing.T) {
+	q := MustOpenJobQueue(&creator{})
+	defer q.Close()
+
+	if _, err := q.SubmitRender(&server.ScreenshotRequest{URL: "ftp://example.com/"}); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := q.SubmitRender(&server.ScreenshotRequest{URL: "http://example.com/", Format: "bmp"}); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := q.SubmitRender(&server.ScreenshotRequest{URL: "http://10.0.0.1/"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure jobs can be submitted and retrieved over HTTP.
+func TestJobQueue_ServeHTTP(t *testing.T) {
+	q := MustOpenJobQueue(&creator{err: errors.New("marker")})
+	defer q.Close()
+
+	// Submit job.
+	w := httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"url":"http://93.184.216.34/"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	MustWaitForJob(t, q, resp.ID)
+
+	// Retrieve status.
+	w = httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("GET", "/"+resp.ID, nil))
+	var status server.JobStatus
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	} else if status.ID != resp.ID || status.State != server.JobFailed {
+		t.Fatalf("unexpected job status: %#v", status)
+	}
+
+	// Retrieve result of failed job.
+	w = httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("GET", "/"+resp.ID+"/result", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	// Unknown jobs return not found.
+	w = httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("GET", "/none", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+// MustOpenJobQueue returns an open job queue which renders using creator.
+func MustOpenJobQueue(c *creator) *server.JobQueue {
+	q := server.NewJobQueue(server.NewScreenshotHandler(c, 1), 1)
+	if err := q.Open(); err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// MustWaitForJob waits for a job to finish and returns its status.
+func MustWaitForJob(tb testing.TB, q *server.JobQueue, id string) server.JobStatus {
+	timeout := time.After(5 * time.Second)
+	for {
+		status, err := q.Status(id)
+		if err != nil {
+			tb.Fatal(err)
+		} else if status.State == server.JobDone || status.State == server.JobFailed {
+			return status
+		}
+
+		select {
+		case <-timeout:
+			tb.Fatal("timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package server provides HTTP handlers which expose PhantomJS rendering as
+// a service.
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Default prerender settings.
+const (
+	DefaultIdleTime = 500 * time.Millisecond
+	DefaultTimeout  = 30 * time.Second
+)
+
+// PrerenderHandler is an HTTP handler which renders the page given by the
+// "url" query parameter and returns its final HTML. This allows single-page
+// applications to be served to crawlers which do not run JavaScript.
+//
+// Pages are considered rendered once the network has been idle for IdleTime.
+// If the page does not become idle within Timeout then its current content
+// is returned.
+type PrerenderHandler struct {
+	creator phantomjs.WebPageCreator
+
+	// Time the network must be idle before the page is considered rendered.
+	IdleTime time.Duration
+
+	// Maximum time to wait for the page to become idle.
+	Timeout time.Duration
+
+	// Optional function which restricts the URLs which can be rendered.
+	// Defaults to AllowPublic so pages on the server's own network cannot
+	// be rendered. Set to AllowAll to render any http or https URL.
+	Allow func(u *url.URL) bool
+}
+
+// NewPrerenderHandler returns a new handler which renders pages created by
+// creator, such as a Process.
+func NewPrerenderHandler(creator phantomjs.WebPageCreator) *PrerenderHandler {
+	return &PrerenderHandler{
+		creator:  creator,
+		IdleTime: DefaultIdleTime,
+		Timeout:  DefaultTimeout,
+	}
+}
+
+// ServeHTTP renders the requested page and writes its HTML.
+func (h *PrerenderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Validate the URL to render.
+	u, err := parseTargetURL(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !allowed(h.Allow, u) {
+		http.Error(w, "url not allowed", http.StatusForbidden)
+		return
+	}
+
+	content, err := h.render(u.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(content))
+}
+
+// render opens the page, waits for it to become idle, and returns its HTML.
+func (h *PrerenderHandler) render(rawurl string) (string, error) {
+	page, err := h.creator.CreateWebPage()
+	if err != nil {
+		return "", err
+	}
+	defer page.Close()
+
+	if err := page.Open(rawurl); err != nil {
+		return "", err
+	}
+
+	// Return the content as-is if the page never becomes idle, such as
+	// when it continually polls.
+	if err := page.WaitForNetworkIdle(h.IdleTime, h.Timeout); err != nil && err != phantomjs.ErrTimeout {
+		return "", err
+	}
+
+	return page.Content()
+}
+
+// parseTargetURL parses and validates the URL to render.
+func parseTargetURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, fmt.Errorf("url required")
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", s)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	} else if u.Host == "" {
+		return nil, fmt.Errorf("url host required")
+	}
+	return u, nil
+}
+
+// allowed returns true if u is allowed by allow, or by AllowPublic if nil.
+func allowed(allow func(u *url.URL) bool, u *url.URL) bool {
+	if allow == nil {
+		allow = AllowPublic
+	}
+	return allow(u)
+}
+
+// AllowAll allows every URL, including those on private networks. It can be
+// used as a handler's Allow function when the handler is not exposed to
+// untrusted clients.
+func AllowAll(u *url.URL) bool { return true }
+
+// AllowPublic allows URLs whose host only resolves to public addresses.
+// Loopback, private, link-local, and unspecified addresses are rejected, as
+// are hosts which cannot be resolved, so clients cannot use PhantomJS to reach
+// services on the server's network, such as its own API.
+//
+// Only the requested URL is checked. Redirects and resources loaded by the
+// page are not.
+func AllowPublic(u *url.URL) bool {
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which is not routable on
+// the internet but is not reported as private by net.IP.
+var sharedAddressSpace = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP returns true if ip is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
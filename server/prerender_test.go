@@ -0,0 +1,84 @@
+package server_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/server"
+)
+
+// Ensure invalid URLs are rejected without creating a page.
+func TestPrerenderHandler_ServeHTTP_BadRequest(t *testing.T) {
+	h := server.NewPrerenderHandler(&creator{})
+	for _, target := range []string{"", "ftp://example.com/", "file:///etc/passwd", "http://"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?url="+url.QueryEscape(target), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status for %q: %d", target, w.Code)
+		}
+	}
+}
+
+// Ensure URLs rejected by the allow function are forbidden.
+func TestPrerenderHandler_ServeHTTP_Forbidden(t *testing.T) {
+	h := server.NewPrerenderHandler(&creator{})
+	h.Allow = func(u *url.URL) bool { return u.Host == "example.com" }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?url="+url.QueryEscape("http://other.com/"), nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+// Ensure URLs on private networks are forbidden by default.
+func TestPrerenderHandler_ServeHTTP_Private(t *testing.T) {
+	h := server.NewPrerenderHandler(&creator{})
+	for _, target := range []string{
+		"http://127.0.0.1:20202/process/Spawn",
+		"http://localhost/",
+		"http://[::1]/",
+		"http://10.0.0.1/",
+		"http://192.168.1.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.64.0.1/",
+		"http://0.0.0.0/",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?url="+url.QueryEscape(target), nil))
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("unexpected status for %q: %d", target, w.Code)
+		}
+	}
+}
+
+// Ensure page creation errors are returned as a bad gateway.
+func TestPrerenderHandler_ServeHTTP_CreateError(t *testing.T) {
+	h := server.NewPrerenderHandler(&creator{err: errors.New("marker")})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?url="+url.QueryEscape("http://93.184.216.34/"), nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+// creator is a phantomjs.WebPageCreator which returns an error.
+type creator struct {
+	err   error
+	block chan struct{}
+}
+
+func (c *creator) CreateWebPage() (*phantomjs.WebPage, error) {
+	if c.block != nil {
+		<-c.block
+	}
+	if c.err == nil {
+		panic("unexpected page creation")
+	}
+	return nil, c.err
+}
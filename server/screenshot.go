@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// DefaultWorkers is the default number of concurrent screenshots.
+const DefaultWorkers = 4
+
+// Limits of screenshot requests so a single request cannot allocate a huge
+// render.
+const (
+	MaxViewportWidth  = 4096
+	MaxViewportHeight = 4096
+	MaxScale          = 4
+)
+
+// ErrBusy is returned when a render cannot start before its timeout because
+// all workers are in use.
+var ErrBusy = errors.New("too many requests")
+
+// errForbidden is returned when a URL is rejected by the Allow function.
+var errForbidden = errors.New("url not allowed")
+
+// ScreenshotRequest represents the options for a screenshot request.
+//
+// Requests are accepted as a JSON body or as query parameters of the same
+// name, such as "?url=...&format=jpeg&hide=.banner&hide=.chat".
+type ScreenshotRequest struct {
+	URL string `json:"url"`
+
+	// Viewport size, in pixels. Defaults to 1280x800 and is limited to
+	// MaxViewportWidth by MaxViewportHeight.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// Output format: "png", "jpeg", or "pdf". Defaults to "png".
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+
+	// Pixel density of images, up to MaxScale.
+	Scale float64 `json:"scale,omitempty"`
+
+	// Renders only the element matching the selector, if set.
+	Selector string `json:"selector,omitempty"`
+
+	// Selectors of elements hidden while rendering.
+	Hide []string `json:"hide,omitempty"`
+
+	// Waits for an element matching the selector before rendering.
+	WaitSelector string `json:"waitSelector,omitempty"`
+
+	// Maximum time for the request, in milliseconds, including time
+	// spent waiting for a worker. Limited by the handler's MaxTimeout.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// ScreenshotHandler is an HTTP handler which renders pages to PNG, JPEG, or
+// PDF. The number of concurrent renders is limited to the number of workers
+// and requests which cannot start within their timeout are rejected.
+type ScreenshotHandler struct {
+	creator phantomjs.WebPageCreator
+	workers chan struct{}
+
+	// Default and maximum time allowed for a single request.
+	Timeout    time.Duration
+	MaxTimeout time.Duration
+
+	// Optional function which restricts the URLs which can be rendered.
+	// Defaults to AllowPublic so pages on the server's own network cannot
+	// be rendered. Set to AllowAll to render any http or https URL.
+	Allow func(u *url.URL) bool
+}
+
+// NewScreenshotHandler returns a new handler which renders pages created by
+// creator using up to workers concurrent pages.
+func NewScreenshotHandler(creator phantomjs.WebPageCreator, workers int) *ScreenshotHandler {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &ScreenshotHandler{
+		creator:    creator,
+		workers:    make(chan struct{}, workers),
+		Timeout:    DefaultTimeout,
+		MaxTimeout: 2 * DefaultTimeout,
+	}
+}
+
+// ServeHTTP renders the requested page and writes the image or PDF.
+func (h *ScreenshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := ParseScreenshotRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := h.validate(req); err == errForbidden {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The render is streamed to the client. Errors reset the content type.
+	w.Header().Set("Content-Type", formatContentType(req.Format))
+	if err := h.RenderTo(w, req); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// validate returns an error if the request's URL cannot be rendered.
+func (h *ScreenshotHandler) validate(req *ScreenshotRequest) error {
+	u, err := parseTargetURL(req.URL)
+	if err != nil {
+		return err
+	} else if !allowed(h.Allow, u) {
+		return errForbidden
+	}
+	return nil
+}
+
+// Render renders a page and returns its content type and data. The request
+// should already have defaults applied by Normalize(). See RenderTo().
+func (h *ScreenshotHandler) Render(req *ScreenshotRequest) (contentType string, data []byte, err error) {
+	var buf bytes.Buffer
+	if err := h.RenderTo(&buf, req); err != nil {
+		return "", nil, err
+	}
+	return formatContentType(req.Format), buf.Bytes(), nil
+}
+
+// RenderTo renders a page and writes it to w as it is encoded. The request
+// should already have defaults applied by Normalize().
+//
+// Returns ErrBusy if no worker becomes available within the request's
+// timeout and phantomjs.ErrTimeout if the page is not ready in time.
+func (h *ScreenshotHandler) RenderTo(w io.Writer, req *ScreenshotRequest) error {
+	// Determine the deadline for the request.
+	timeout := h.Timeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+	if h.MaxTimeout > 0 && timeout > h.MaxTimeout {
+		timeout = h.MaxTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// Wait for a worker.
+	select {
+	case h.workers <- struct{}{}:
+		defer func() { <-h.workers }()
+	case <-time.After(timeout):
+		return ErrBusy
+	}
+	return h.render(w, req, deadline)
+}
+
+// formatContentType returns the MIME type of a normalized request format.
+func formatContentType(format string) string {
+	switch format {
+	case "jpeg":
+		return "image/jpeg"
+	case "pdf":
+		return "application/pdf"
+	default:
+		return "image/png"
+	}
+}
+
+// errorStatus returns the HTTP status code for a render error.
+func errorStatus(err error) int {
+	switch err {
+	case ErrBusy:
+		return http.StatusServiceUnavailable
+	case phantomjs.ErrTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// render opens the page and writes it to w in the requested format.
+func (h *ScreenshotHandler) render(w io.Writer, req *ScreenshotRequest, deadline time.Time) error {
+	page, err := h.creator.CreateWebPage()
+	if err != nil {
+		return err
+	}
+	defer page.Close()
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if err := page.SetViewportSize(req.Width, req.Height); err != nil {
+		return err
+	} else if err := page.OpenContext(ctx, req.URL); err == context.DeadlineExceeded {
+		return phantomjs.ErrTimeout
+	} else if err != nil {
+		return err
+	}
+
+	if req.WaitSelector != "" {
+		if err := page.WaitForSelector(req.WaitSelector, time.Until(deadline)); err != nil {
+			return err
+		}
+	}
+
+	if req.Selector != "" {
+		if err := page.SetClipRectToElement(req.Selector); err != nil {
+			return err
+		}
+	}
+
+	// PDFs can only be written to a file by PhantomJS.
+	if req.Format == "pdf" {
+		return renderPDF(w, page)
+	}
+
+	img, err := page.RenderImage(phantomjs.RenderOptions{
+		Scale:         req.Scale,
+		HideSelectors: req.Hide,
+		WaitForAssets: true,
+		AssetTimeout:  time.Until(deadline),
+	})
+	if err != nil {
+		return err
+	}
+
+	if req.Format == "jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: req.Quality})
+	}
+	return png.Encode(w, img)
+}
+
+// renderPDF renders page to a temporary file and copies it to w.
+func renderPDF(w io.Writer, page *phantomjs.WebPage) error {
+	dir, err := ioutil.TempDir("", "phantomjs-screenshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "output.pdf")
+	if err := page.Render(path, "pdf", 0); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ParseScreenshotRequest reads a screenshot request from a JSON body or from
+// the query parameters and applies defaults.
+func ParseScreenshotRequest(r *http.Request) (*ScreenshotRequest, error) {
+	var req ScreenshotRequest
+	switch r.Method {
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("invalid json: %s", err)
+		}
+
+	case "GET", "HEAD":
+		q := r.URL.Query()
+		req.URL = q.Get("url")
+		req.Format = q.Get("format")
+		req.Selector = q.Get("selector")
+		req.WaitSelector = q.Get("waitSelector")
+		for _, v := range q["hide"] {
+			req.Hide = append(req.Hide, strings.Split(v, ",")...)
+		}
+
+		for _, v := range []struct {
+			name string
+			ptr  *int
+		}{
+			{"width", &req.Width},
+			{"height", &req.Height},
+			{"quality", &req.Quality},
+			{"timeout", &req.Timeout},
+		} {
+			if s := q.Get(v.name); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: %s", v.name, s)
+				}
+				*v.ptr = n
+			}
+		}
+
+		if s := q.Get("scale"); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scale: %s", s)
+			}
+			req.Scale = f
+		}
+
+	default:
+		return nil, errors.New("method not allowed")
+	}
+
+	if err := req.Normalize(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Normalize applies defaults to unset fields and validates the request.
+func (req *ScreenshotRequest) Normalize() error {
+	if req.Width == 0 {
+		req.Width = 1280
+	}
+	if req.Height == 0 {
+		req.Height = 800
+	}
+	if req.Width < 0 || req.Height < 0 {
+		return errors.New("invalid viewport size")
+	} else if req.Width > MaxViewportWidth || req.Height > MaxViewportHeight {
+		return fmt.Errorf("viewport size exceeds %dx%d", MaxViewportWidth, MaxViewportHeight)
+	} else if req.Scale < 0 || req.Scale > MaxScale {
+		return fmt.Errorf("scale must be between 0 and %d", MaxScale)
+	}
+	if req.Quality == 0 {
+		req.Quality = 90
+	}
+	switch req.Format {
+	case "", "png":
+		req.Format = "png"
+	case "jpg", "jpeg":
+		req.Format = "jpeg"
+	case "pdf":
+	default:
+		return fmt.Errorf("unsupported format: %s", req.Format)
+	}
+	return nil
+}
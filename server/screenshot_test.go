@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs/server"
+)
+
+// Ensure screenshot requests can be parsed from query parameters.
+func TestParseScreenshotRequest_Query(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?url=http://example.com/&width=800&format=jpg&scale=2&hide=.a,.b&hide=.c&timeout=5000", nil)
+	req, err := server.ParseScreenshotRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(req, &server.ScreenshotRequest{
+		URL:     "http://example.com/",
+		Width:   800,
+		Height:  800,
+		Format:  "jpeg",
+		Quality: 90,
+		Scale:   2,
+		Hide:    []string{".a", ".b", ".c"},
+		Timeout: 5000,
+	}) {
+		t.Fatalf("unexpected request: %#v", req)
+	}
+}
+
+// Ensure screenshot requests can be parsed from a JSON body.
+func TestParseScreenshotRequest_JSON(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"url":"http://example.com/","format":"pdf","waitSelector":"#app"}`))
+	req, err := server.ParseScreenshotRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	} else if req.URL != "http://example.com/" || req.Format != "pdf" || req.WaitSelector != "#app" {
+		t.Fatalf("unexpected request: %#v", req)
+	} else if req.Width != 1280 || req.Height != 800 {
+		t.Fatalf("unexpected viewport: %dx%d", req.Width, req.Height)
+	}
+}
+
+// Ensure invalid screenshot requests return an error.
+func TestParseScreenshotRequest_Err(t *testing.T) {
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/?url=http://example.com/&format=bmp", nil),
+		httptest.NewRequest("GET", "/?url=http://example.com/&width=abc", nil),
+		httptest.NewRequest("GET", "/?url=http://example.com/&width=100000", nil),
+		httptest.NewRequest("GET", "/?url=http://example.com/&height=100000", nil),
+		httptest.NewRequest("GET", "/?url=http://example.com/&scale=100", nil),
+		httptest.NewRequest("POST", "/", strings.NewReader(`{`)),
+		httptest.NewRequest("DELETE", "/", nil),
+	} {
+		if _, err := server.ParseScreenshotRequest(r); err == nil {
+			t.Fatalf("expected error: %s %s", r.Method, r.URL)
+		}
+	}
+}
+
+// Ensure the handler rejects invalid requests and reports render errors.
+func TestScreenshotHandler_ServeHTTP(t *testing.T) {
+	h := server.NewScreenshotHandler(&creator{err: errors.New("marker")}, 1)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?url=ftp://example.com/", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	// URLs on private networks are forbidden by default.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?url=http://127.0.0.1:20202/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?url=http://93.184.216.34/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
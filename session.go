@@ -0,0 +1,98 @@
+package phantomjs
+
+import (
+	"net/http"
+)
+
+// Session represents the identity of a browsing session: its cookies,
+// headers, user agent, and storage locations.
+//
+// PhantomJS shares a single cookie jar and storage between all pages in a
+// process so sessions applied to pages in the same process are not isolated
+// from one another. Use NewProcess() to run a session in a dedicated process
+// when scraping multiple accounts concurrently.
+type Session struct {
+	// Cookies set on pages before they are opened.
+	Cookies []*http.Cookie
+
+	// Additional headers sent with every request.
+	Header http.Header
+
+	// User agent sent with requests. Uses the PhantomJS default if blank.
+	UserAgent string
+
+	// Paths used for persistent storage by a dedicated process. These are
+	// process-wide so they are not applied by Apply().
+	CookiesFile        string
+	LocalStoragePath   string
+	OfflineStoragePath string
+}
+
+// Apply sets the session's cookies, headers, and user agent on page. This
+// should be called before the page is opened.
+func (s *Session) Apply(page *WebPage) error {
+	if len(s.Cookies) > 0 {
+		if err := page.SetCookies(s.Cookies); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Header) > 0 {
+		if err := page.SetCustomHeaders(s.Header); err != nil {
+			return err
+		}
+	}
+
+	if s.UserAgent != "" {
+		settings, err := page.Settings()
+		if err != nil {
+			return err
+		}
+		settings.UserAgent = s.UserAgent
+		if err := page.SetSettings(settings); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Update copies the page's current cookies into the session so they can be
+// applied to later pages, such as after logging in.
+func (s *Session) Update(page *WebPage) error {
+	cookies, err := page.Cookies()
+	if err != nil {
+		return err
+	}
+	s.Cookies = cookies
+	return nil
+}
+
+// NewProcess returns a new process configured with the session's storage
+// paths. The process is not opened. Pages created by the process do not
+// have the session applied automatically; use Session.CreateWebPage().
+func (s *Session) NewProcess() *Process {
+	p := NewProcess()
+	if s.CookiesFile != "" {
+		p.Args = append(p.Args, "--cookies-file="+s.CookiesFile)
+	}
+	p.LocalStoragePath = s.LocalStoragePath
+	if s.OfflineStoragePath != "" {
+		p.Args = append(p.Args, "--offline-storage-path="+s.OfflineStoragePath)
+	}
+	return p
+}
+
+// CreateWebPage creates a page on creator and applies the session to it.
+func (s *Session) CreateWebPage(creator WebPageCreator) (*WebPage, error) {
+	page, err := creator.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Apply(page); err != nil {
+		page.Close()
+		return nil, err
+	}
+	return page, nil
+}
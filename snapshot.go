@@ -0,0 +1,71 @@
+package phantomjs
+
+import (
+	"net/http"
+)
+
+// Snapshot represents the state of a web page at a point in time.
+type Snapshot struct {
+	URL           string
+	Title         string
+	ContentLength int // length of the page's content, in characters
+
+	// Current frame and the names of the frames within it.
+	FrameName  string
+	FrameURL   string
+	FrameCount int
+	FrameNames []string
+
+	ViewportWidth  int
+	ViewportHeight int
+	ClipRect       Rect
+	Cookies        []*http.Cookie
+	Settings       WebPageSettings
+}
+
+// Snapshot returns the page's URL, title, frame, viewport, clipping
+// rectangle, cookies, and settings in a single request. This is cheaper than
+// calling the individual getters when inspecting many properties of a page.
+func (p *WebPage) Snapshot() (*Snapshot, error) {
+	var resp struct {
+		URL           string              `json:"url"`
+		Title         string              `json:"title"`
+		ContentLength int                 `json:"contentLength"`
+		FrameName     string              `json:"frameName"`
+		FrameURL      string              `json:"frameURL"`
+		FrameCount    int                 `json:"frameCount"`
+		FrameNames    []string            `json:"frameNames"`
+		ViewportSize  sizeJSON            `json:"viewportSize"`
+		ClipRect      rectJSON            `json:"clipRect"`
+		Cookies       []cookieJSON        `json:"cookies"`
+		Settings      webPageSettingsJSON `json:"settings"`
+	}
+	if err := p.ref.process.doJSON("POST", "/webpage/Snapshot", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+
+	cookies := make([]*http.Cookie, len(resp.Cookies))
+	for i := range resp.Cookies {
+		cookies[i] = decodeCookieJSON(resp.Cookies[i])
+	}
+
+	return &Snapshot{
+		URL:            resp.URL,
+		Title:          resp.Title,
+		ContentLength:  resp.ContentLength,
+		FrameName:      resp.FrameName,
+		FrameURL:       resp.FrameURL,
+		FrameCount:     resp.FrameCount,
+		FrameNames:     resp.FrameNames,
+		ViewportWidth:  resp.ViewportSize.Width,
+		ViewportHeight: resp.ViewportSize.Height,
+		ClipRect: Rect{
+			Top:    resp.ClipRect.Top,
+			Left:   resp.ClipRect.Left,
+			Width:  resp.ClipRect.Width,
+			Height: resp.ClipRect.Height,
+		},
+		Cookies:  cookies,
+		Settings: decodeWebPageSettingsJSON(resp.Settings),
+	}, nil
+}
@@ -0,0 +1,80 @@
+package phantomjs
+
+// StealthUserAgent is the user agent set by EnableStealth(). It is a desktop
+// Chrome user agent so requests are not identified as coming from PhantomJS.
+const StealthUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// stealthScript hides common signs of a headless browser from page scripts.
+// It is written to match StealthUserAgent.
+const stealthScript = `function() {
+	function define(obj, name, value) {
+		try {
+			Object.defineProperty(obj, name, {get: function() { return value; }, configurable: true});
+		} catch (e) {}
+	}
+
+	// Remove the PhantomJS callback bridge.
+	define(window, 'callPhantom', undefined);
+	define(window, '_phantom', undefined);
+
+	define(navigator, 'webdriver', false);
+	define(navigator, 'platform', 'Win32');
+	define(navigator, 'vendor', 'Google Inc.');
+	if (!navigator.languages || navigator.languages.length === 0) {
+		define(navigator, 'languages', ['en-US', 'en']);
+	}
+
+	// Report the plugins and MIME types of a desktop Chrome install.
+	var mimeTypes = [], plugins = [];
+	[
+		{name: 'Chrome PDF Plugin', filename: 'internal-pdf-viewer', description: 'Portable Document Format', type: 'application/x-google-chrome-pdf', suffixes: 'pdf'},
+		{name: 'Chrome PDF Viewer', filename: 'mhjfbmdgcfjbbpaeojofohoefgiehjai', description: '', type: 'application/pdf', suffixes: 'pdf'},
+		{name: 'Native Client', filename: 'internal-nacl-plugin', description: '', type: 'application/x-nacl', suffixes: ''}
+	].forEach(function(p) {
+		var plugin = {name: p.name, filename: p.filename, description: p.description, length: 1};
+		var mimeType = {type: p.type, suffixes: p.suffixes, description: p.description, enabledPlugin: plugin};
+		plugin[0] = mimeType;
+		plugins.push(plugin);
+		mimeTypes.push(mimeType);
+	});
+	function list(items, key) {
+		items.item = function(i) { return items[i] || null; };
+		items.namedItem = function(name) {
+			for (var i = 0; i < items.length; i++) {
+				if (items[i][key] === name) {
+					return items[i];
+				}
+			}
+			return null;
+		};
+		items.refresh = function() {};
+		return items;
+	}
+	define(navigator, 'plugins', list(plugins, 'name'));
+	define(navigator, 'mimeTypes', list(mimeTypes, 'type'));
+
+	if (!window.chrome) {
+		window.chrome = {runtime: {}};
+	}
+}`
+
+// EnableStealth masks common signs of a headless browser, such as the
+// window.callPhantom bridge, navigator.webdriver, and missing plugins, and
+// sets a desktop Chrome user agent. This avoids trivial bot detection but
+// does not defeat thorough fingerprinting.
+//
+// The masking script runs before the scripts of documents loaded after the
+// call so it should be called before Open(). It is removed by
+// ClearNewDocumentScripts().
+func (p *WebPage) EnableStealth() error {
+	if err := p.EvaluateOnNewDocument(stealthScript); err != nil {
+		return err
+	}
+
+	settings, err := p.Settings()
+	if err != nil {
+		return err
+	}
+	settings.UserAgent = StealthUserAgent
+	return p.SetSettings(settings)
+}
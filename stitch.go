@@ -0,0 +1,92 @@
+package phantomjs
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// renderStitched renders the clip rect, or the whole document if no clip rect
+// is set, one tile at a time and draws the tiles onto a single image. The
+// page's clip rect is restored afterward. Returns the rects of the elements
+// matching each annotation, as measured by the first tile.
+func (p *WebPage) renderStitched(opt RenderOptions) (img image.Image, rects [][]Rect, err error) {
+	clip, err := p.ClipRect()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if e := p.SetClipRect(clip); e != nil && err == nil {
+			img, rects, err = nil, nil, e
+		}
+	}()
+
+	area := clip
+	if area.Width <= 0 || area.Height <= 0 {
+		width, height, err := p.documentSize()
+		if err != nil {
+			return nil, nil, err
+		}
+		area = Rect{Width: float64(width), Height: float64(height)}
+	}
+
+	tileHeight := float64(opt.TileHeight)
+	if tileHeight <= 0 {
+		_, height, err := p.ViewportSize()
+		if err != nil {
+			return nil, nil, err
+		}
+		tileHeight = float64(height)
+	}
+
+	scale := opt.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	// Tiles are rendered without stitching or resizing. Tile heights are
+	// rounded so the canvas allows a pixel per tile beyond the area.
+	tileOpt := opt
+	tileOpt.Stitch, tileOpt.ResizeTo = false, nil
+	n := int(math.Ceil(area.Height / tileHeight))
+	canvas := image.NewRGBA(image.Rect(0, 0, int(math.Ceil(area.Width*scale)), int(math.Ceil(area.Height*scale))+n))
+
+	y := 0
+	for top := 0.0; top < area.Height; top += tileHeight {
+		rect := Rect{Top: area.Top + top, Left: area.Left, Width: area.Width, Height: math.Min(tileHeight, area.Height-top)}
+		if err := p.SetClipRect(rect); err != nil {
+			return nil, nil, err
+		}
+
+		tile, tileRects, err := p.renderImage(tileOpt)
+		if err != nil {
+			return nil, nil, err
+		} else if rects == nil {
+			rects = tileRects
+		}
+		// Only the first tile needs to locate annotated elements.
+		tileOpt.Annotations = nil
+		b := tile.Bounds()
+		draw.Draw(canvas, image.Rect(0, y, b.Dx(), y+b.Dy()), tile, b.Min, draw.Src)
+		y += b.Dy()
+	}
+	return canvas.SubImage(image.Rect(0, 0, canvas.Bounds().Dx(), y)), rects, nil
+}
+
+// documentSize returns the scrollable width and height of the document.
+func (p *WebPage) documentSize() (width, height int, err error) {
+	v, err := p.Evaluate(`function() {
+		var el = document.documentElement, body = document.body || el;
+		return [Math.max(el.scrollWidth, body.scrollWidth), Math.max(el.scrollHeight, body.scrollHeight)];
+	}`)
+	if err != nil {
+		return 0, 0, err
+	}
+	a, _ := v.([]interface{})
+	if len(a) != 2 {
+		return 0, 0, nil
+	}
+	w, _ := a[0].(float64)
+	h, _ := a[1].(float64)
+	return int(w), int(h), nil
+}
@@ -0,0 +1,107 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrStorageUnavailable is returned when web storage cannot be accessed for
+// the page's current origin, such as before a page is opened or for pages
+// loaded from "about:blank".
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// LocalStorage returns the items in localStorage for the page's current
+// origin.
+func (p *WebPage) LocalStorage() (map[string]string, error) {
+	return p.storageItems("localStorage")
+}
+
+// SessionStorage returns the items in sessionStorage for the page's current
+// origin.
+func (p *WebPage) SessionStorage() (map[string]string, error) {
+	return p.storageItems("sessionStorage")
+}
+
+// SetLocalStorageItem sets an item in localStorage for the page's current
+// origin. Items can be seeded before a page's scripts run by opening a page
+// on the same origin first.
+func (p *WebPage) SetLocalStorageItem(key, value string) error {
+	return p.setStorageItem("localStorage", key, value)
+}
+
+// SetSessionStorageItem sets an item in sessionStorage for the page's
+// current origin.
+func (p *WebPage) SetSessionStorageItem(key, value string) error {
+	return p.setStorageItem("sessionStorage", key, value)
+}
+
+// ClearStorage removes all items from localStorage and sessionStorage for
+// the page's current origin. Storage for other origins is not affected.
+func (p *WebPage) ClearStorage() error {
+	v, err := p.Evaluate(`function() {
+		try {
+			localStorage.clear();
+			sessionStorage.clear();
+			return true;
+		} catch (e) {
+			return false;
+		}
+	}`)
+	if err != nil {
+		return err
+	} else if ok, _ := v.(bool); !ok {
+		return ErrStorageUnavailable
+	}
+	return nil
+}
+
+// storageItems returns the items of the named storage object. Items are
+// returned as JSON as PhantomJS does not serialize Storage objects.
+func (p *WebPage) storageItems(name string) (map[string]string, error) {
+	v, err := p.Evaluate(fmt.Sprintf(`function() {
+		try {
+			var storage = window[%q], items = {};
+			for (var i = 0; i < storage.length; i++) {
+				var key = storage.key(i);
+				items[key] = storage.getItem(key);
+			}
+			return JSON.stringify(items);
+		} catch (e) {
+			return null;
+		}
+	}`, name))
+	if err != nil {
+		return nil, err
+	}
+	s, _ := v.(string)
+	if s == "" {
+		return nil, ErrStorageUnavailable
+	}
+
+	items := make(map[string]string)
+	if err := json.Unmarshal([]byte(s), &items); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid storage items: %s", err)
+	}
+	return items, nil
+}
+
+// setStorageItem sets an item in the named storage object.
+func (p *WebPage) setStorageItem(name, key, value string) error {
+	args, _ := json.Marshal([]string{name, key, value})
+	v, err := p.Evaluate(fmt.Sprintf(`function() {
+		var args = %s;
+		try {
+			window[args[0]].setItem(args[1], args[2]);
+			return true;
+		} catch (e) {
+			return false;
+		}
+	}`, args))
+	if err != nil {
+		return err
+	} else if ok, _ := v.(bool); !ok {
+		return ErrStorageUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package phantomjs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidSVG is returned by RenderSVG() when the data has no <svg> root
+// element.
+var ErrInvalidSVG = errors.New("invalid svg")
+
+// Default size of SVG documents which specify neither a size nor a viewBox,
+// which matches browsers.
+const (
+	DefaultSVGWidth  = 300
+	DefaultSVGHeight = 150
+)
+
+// SVGOptions represents options used when rendering an SVG with RenderSVG().
+type SVGOptions struct {
+	// Size of the rendered image, in CSS pixels. Defaults to the size of the
+	// document's width and height attributes or its viewBox. If only one is
+	// set then the other is calculated from the document's aspect ratio.
+	Width  int
+	Height int
+
+	// Multiplier for the pixel density of the image. Defaults to 1.
+	Scale float64
+
+	// CSS background color. Defaults to transparent.
+	Background string
+
+	// URL which relative references in the document, such as images, are
+	// resolved against. Defaults to "about:blank".
+	BaseURL string
+}
+
+// RenderSVG renders an SVG document to an image. The document is loaded into
+// a new page with the viewport sized to the document so it is not clipped
+// or padded.
+func (p *Process) RenderSVG(svg []byte, opt SVGOptions) (image.Image, error) {
+	width, height, err := svgSize(svg, opt.Width, opt.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip the XML declaration and doctype so the document can be inlined.
+	i := bytes.Index(svg, []byte("<svg"))
+	if i == -1 {
+		return nil, ErrInvalidSVG
+	}
+
+	baseURL := opt.BaseURL
+	if baseURL == "" {
+		baseURL = "about:blank"
+	}
+	background := opt.Background
+	if background == "" {
+		background = "transparent"
+	}
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	content := fmt.Sprintf(`<!DOCTYPE html><html><head><style>html, body { margin: 0; padding: 0; overflow: hidden; background: %s } body > svg { display: block; width: %dpx; height: %dpx }</style></head><body>%s</body></html>`, background, width, height, svg[i:])
+	if err := page.SetViewportSize(width, height); err != nil {
+		return nil, err
+	} else if err := page.SetContentAndURL(content, baseURL); err != nil {
+		return nil, err
+	} else if err := page.SetClipRect(Rect{Width: float64(width), Height: float64(height)}); err != nil {
+		return nil, err
+	}
+	return page.RenderImage(RenderOptions{Format: "png", Scale: opt.Scale, WaitForAssets: true})
+}
+
+// svgSize returns the size to render svg at. Non-zero width or height
+// override the document's size.
+func svgSize(svg []byte, width, height int) (int, int, error) {
+	root, err := svgRoot(svg)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Read the intrinsic size from the attributes or the viewBox.
+	var w, h float64
+	var viewBox []string
+	for _, attr := range root.Attr {
+		switch attr.Name.Local {
+		case "width":
+			w = svgLength(attr.Value)
+		case "height":
+			h = svgLength(attr.Value)
+		case "viewBox":
+			viewBox = strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' })
+		}
+	}
+	if len(viewBox) == 4 {
+		vw, _ := strconv.ParseFloat(viewBox[2], 64)
+		vh, _ := strconv.ParseFloat(viewBox[3], 64)
+		if vw > 0 && vh > 0 {
+			if w <= 0 && h <= 0 {
+				w, h = vw, vh
+			} else if w <= 0 {
+				w = h * vw / vh
+			} else if h <= 0 {
+				h = w * vh / vw
+			}
+		}
+	}
+	if w <= 0 {
+		w = DefaultSVGWidth
+	}
+	if h <= 0 {
+		h = DefaultSVGHeight
+	}
+
+	// Apply the requested size, keeping the aspect ratio if only one side
+	// is requested.
+	switch {
+	case width > 0 && height > 0:
+		return width, height, nil
+	case width > 0:
+		return width, max1(int(math.Round(float64(width) * h / w))), nil
+	case height > 0:
+		return max1(int(math.Round(float64(height) * w / h))), height, nil
+	default:
+		return max1(int(math.Ceil(w))), max1(int(math.Ceil(h))), nil
+	}
+}
+
+// svgRoot returns the root element of svg. Returns ErrInvalidSVG if it is
+// not an <svg> element.
+func svgRoot(svg []byte) (xml.StartElement, error) {
+	dec := xml.NewDecoder(bytes.NewReader(svg))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, ErrInvalidSVG
+		}
+		if el, ok := tok.(xml.StartElement); ok {
+			if el.Name.Local != "svg" {
+				return xml.StartElement{}, ErrInvalidSVG
+			}
+			return el, nil
+		}
+	}
+}
+
+// svgLength parses an absolute length in pixels, such as "100" or "100px".
+// Returns zero for percentages and other units.
+func svgLength(s string) float64 {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "px")
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,97 @@
+package phantomjs
+
+import (
+	"fmt"
+)
+
+// SystemInfo represents the host environment of a PhantomJS process, from
+// its system module.
+type SystemInfo struct {
+	// Process ID of PhantomJS.
+	PID int
+
+	// Operating system, such as "linux", and its architecture, such as
+	// "64bit". The version is "unknown" on some platforms.
+	OSName         string
+	OSVersion      string
+	OSArchitecture string
+
+	// Version of PhantomJS, such as "2.1.1".
+	Version string
+
+	// Environment variables and command line arguments of PhantomJS.
+	Env  map[string]string
+	Args []string
+}
+
+type systemInfoJSON struct {
+	PID int `json:"pid"`
+	OS  struct {
+		Name         string `json:"name"`
+		Version      string `json:"version"`
+		Architecture string `json:"architecture"`
+	} `json:"os"`
+	Version struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Patch int `json:"patch"`
+	} `json:"version"`
+	Env  map[string]string `json:"env"`
+	Args []string          `json:"args"`
+}
+
+func decodeSystemInfoJSON(v systemInfoJSON) *SystemInfo {
+	return &SystemInfo{
+		PID:            v.PID,
+		OSName:         v.OS.Name,
+		OSVersion:      v.OS.Version,
+		OSArchitecture: v.OS.Architecture,
+		Version:        fmt.Sprintf("%d.%d.%d", v.Version.Major, v.Version.Minor, v.Version.Patch),
+		Env:            v.Env,
+		Args:           v.Args,
+	}
+}
+
+// SystemInfo returns information about the host PhantomJS is running on.
+func (p *Process) SystemInfo() (*SystemInfo, error) {
+	var resp struct {
+		Value systemInfoJSON `json:"value"`
+	}
+	if err := p.doJSON("POST", "/process/SystemInfo", nil, &resp); err != nil {
+		return nil, err
+	}
+	return decodeSystemInfoJSON(resp.Value), nil
+}
+
+// SpawnResult represents the output of a command run by Spawn().
+type SpawnResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// Spawn runs a command on the host PhantomJS is running on using its
+// child_process module and waits for it to exit. This allows auxiliary
+// commands, such as image optimizers, to be run beside PhantomJS when it is
+// on a remote host or in a container.
+//
+// A non-zero exit code is not treated as an error. Returns an error if the
+// command could not be started. Returns ErrSpawnDisabled unless the process
+// was opened with AllowSpawn set.
+func (p *Process) Spawn(name string, args ...string) (*SpawnResult, error) {
+	if !p.AllowSpawn {
+		return nil, ErrSpawnDisabled
+	} else if args == nil {
+		args = []string{}
+	}
+
+	var resp struct {
+		ExitCode int    `json:"exitCode"`
+		Stdout   string `json:"stdout"`
+		Stderr   string `json:"stderr"`
+	}
+	if err := p.doJSON("POST", "/process/Spawn", map[string]interface{}{"name": name, "args": args}, &resp); err != nil {
+		return nil, err
+	}
+	return &SpawnResult{ExitCode: resp.ExitCode, Stdout: resp.Stdout, Stderr: resp.Stderr}, nil
+}
@@ -0,0 +1,153 @@
+package phantomjs
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// NetworkConditions represents simulated network conditions for a page, such
+// as a slow mobile connection. Zero values are not limited.
+type NetworkConditions struct {
+	// Delay added before each request is sent.
+	Latency time.Duration
+
+	// Maximum throughput of response and request bodies, in kilobits per
+	// second.
+	DownloadKbps int
+	UploadKbps   int
+}
+
+// SetNetworkConditions simulates a slower network for the page's requests,
+// such as to render the page as it loads over a "slow 3G" connection. Each
+// request is delayed by latency and bodies are throttled to downloadKbps and
+// uploadKbps kilobits per second. The bandwidth is shared by all of the
+// page's requests, as it would be on a real connection, rather than granted
+// to each request. Zero values are not limited so passing all zeros restores
+// the normal network.
+//
+// The process must have SimulateNetwork enabled. Requests are throttled by a
+// local proxy. HTTPS requests are tunneled through the proxy so latency is
+// added once when the tunnel is opened rather than to each request sent over
+// it. Tunnels are attributed to the throttled page which last requested
+// their host, so an unthrottled page loading the same host at the same time
+// may be throttled too.
+func (p *WebPage) SetNetworkConditions(latency time.Duration, downloadKbps, uploadKbps int) error {
+	proxy := p.ref.process.capture
+	if !p.ref.process.SimulateNetwork || proxy == nil {
+		return ErrNetworkSimulationDisabled
+	}
+
+	c := NetworkConditions{Latency: latency, DownloadKbps: downloadKbps, UploadKbps: uploadKbps}
+	if err := p.ref.process.doJSON("POST", "/webpage/SetThrottled", map[string]interface{}{"ref": p.ref.id, "value": c != (NetworkConditions{})}, nil); err != nil {
+		return err
+	}
+	proxy.SetConditions(p.ref.id, c)
+	return nil
+}
+
+// NetworkConditions returns the network conditions set on the page with
+// SetNetworkConditions().
+func (p *WebPage) NetworkConditions() NetworkConditions {
+	if p.ref.process.capture == nil {
+		return NetworkConditions{}
+	}
+	c, _ := p.ref.process.capture.Conditions(p.ref.id)
+	return c
+}
+
+// clearNetworkConditions releases the page's network conditions.
+func (p *WebPage) clearNetworkConditions() {
+	if p.ref.process.capture != nil {
+		p.ref.process.capture.SetConditions(p.ref.id, NetworkConditions{})
+	}
+}
+
+// tunnelOwner returns the ref of the throttled page which last requested
+// host, in "host:port" form, or a blank string if there is none.
+func (p *Process) tunnelOwner(host string) string {
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := p.doJSON("POST", "/process/TunnelOwner", map[string]interface{}{"host": host}, &resp); err != nil {
+		return ""
+	}
+	return resp.Value
+}
+
+// pageThrottle holds a page's network conditions and the limiters shared by
+// all of its connections.
+type pageThrottle struct {
+	NetworkConditions
+	down, up *rateLimiter // nil if unlimited
+}
+
+// newPageThrottle returns a throttle for c.
+func newPageThrottle(c NetworkConditions) *pageThrottle {
+	return &pageThrottle{
+		NetworkConditions: c,
+		down:              newRateLimiter(c.DownloadKbps),
+		up:                newRateLimiter(c.UploadKbps),
+	}
+}
+
+// rateLimiter limits the combined throughput of its readers to a rate in
+// bytes per second.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // time at which all reserved bytes are sent
+}
+
+// newRateLimiter returns a limiter for kbps kilobits per second. Returns nil
+// if kbps is not positive.
+func newRateLimiter(kbps int) *rateLimiter {
+	if kbps <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: int64(kbps) * 1000 / 8}
+}
+
+// wait reserves n bytes and sleeps until they are within the rate. Idle time
+// is not saved up so a reader cannot burst above the rate.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// Reader returns a reader which reads from r within the limiter's rate.
+// Returns r if l is nil.
+func (l *rateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, l: l}
+}
+
+// throttledReader limits reads from r to the rate of a shared limiter.
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+// Read reads up to a tenth of a second's worth of data and then sleeps
+// until the data is within the limiter's rate.
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if max := r.l.rate/10 + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.l.wait(n)
+	}
+	return n, err
+}
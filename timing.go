@@ -0,0 +1,323 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// ErrTimingUnavailable is returned when the page does not support the
+// Navigation Timing API.
+var ErrTimingUnavailable = errors.New("navigation timing unavailable")
+
+// Timing represents the navigation timing of the current document, from the
+// browser's window.performance API. Durations are zero for phases which have
+// not completed, such as Load while the page is still loading.
+type Timing struct {
+	// Time the navigation started.
+	NavigationStart time.Time
+
+	// How the page was navigated to: "navigate", "reload", or "back_forward".
+	NavigationType string
+	RedirectCount  int
+
+	// Durations of the individual phases of fetching the document.
+	Redirect time.Duration
+	DNS      time.Duration
+	Connect  time.Duration
+	TTFB     time.Duration // from sending the request to the first byte
+	Download time.Duration
+
+	// Time from NavigationStart until each milestone of loading the document.
+	DOMInteractive   time.Duration
+	DOMContentLoaded time.Duration
+	Load             time.Duration
+}
+
+// timingJSON is the raw window.performance.timing data, in milliseconds.
+type timingJSON struct {
+	NavigationStart          int64 `json:"navigationStart"`
+	RedirectStart            int64 `json:"redirectStart"`
+	RedirectEnd              int64 `json:"redirectEnd"`
+	DomainLookupStart        int64 `json:"domainLookupStart"`
+	DomainLookupEnd          int64 `json:"domainLookupEnd"`
+	ConnectStart             int64 `json:"connectStart"`
+	ConnectEnd               int64 `json:"connectEnd"`
+	RequestStart             int64 `json:"requestStart"`
+	ResponseStart            int64 `json:"responseStart"`
+	ResponseEnd              int64 `json:"responseEnd"`
+	DOMInteractive           int64 `json:"domInteractive"`
+	DOMContentLoadedEventEnd int64 `json:"domContentLoadedEventEnd"`
+	LoadEventEnd             int64 `json:"loadEventEnd"`
+	NavigationType           int   `json:"navigationType"`
+	RedirectCount            int   `json:"redirectCount"`
+}
+
+func decodeTimingJSON(v timingJSON) *Timing {
+	// span returns the duration between two timestamps or zero if either
+	// phase has not occurred.
+	span := func(start, end int64) time.Duration {
+		if start == 0 || end == 0 || end < start {
+			return 0
+		}
+		return time.Duration(end-start) * time.Millisecond
+	}
+
+	t := &Timing{
+		NavigationStart:  time.Unix(0, v.NavigationStart*int64(time.Millisecond)),
+		RedirectCount:    v.RedirectCount,
+		Redirect:         span(v.RedirectStart, v.RedirectEnd),
+		DNS:              span(v.DomainLookupStart, v.DomainLookupEnd),
+		Connect:          span(v.ConnectStart, v.ConnectEnd),
+		TTFB:             span(v.RequestStart, v.ResponseStart),
+		Download:         span(v.ResponseStart, v.ResponseEnd),
+		DOMInteractive:   span(v.NavigationStart, v.DOMInteractive),
+		DOMContentLoaded: span(v.NavigationStart, v.DOMContentLoadedEventEnd),
+		Load:             span(v.NavigationStart, v.LoadEventEnd),
+	}
+
+	switch v.NavigationType {
+	case 1:
+		t.NavigationType = "reload"
+	case 2:
+		t.NavigationType = "back_forward"
+	default:
+		t.NavigationType = "navigate"
+	}
+	return t
+}
+
+// Timing returns the navigation timing of the current document.
+// Returns ErrTimingUnavailable if the page does not support the API.
+func (p *WebPage) Timing() (*Timing, error) {
+	v, err := p.Evaluate(`function() {
+		if (!window.performance || !window.performance.timing) {
+			return null;
+		}
+		var t = window.performance.timing, nav = window.performance.navigation || {};
+		return JSON.stringify({
+			navigationStart: t.navigationStart,
+			redirectStart: t.redirectStart,
+			redirectEnd: t.redirectEnd,
+			domainLookupStart: t.domainLookupStart,
+			domainLookupEnd: t.domainLookupEnd,
+			connectStart: t.connectStart,
+			connectEnd: t.connectEnd,
+			requestStart: t.requestStart,
+			responseStart: t.responseStart,
+			responseEnd: t.responseEnd,
+			domInteractive: t.domInteractive,
+			domContentLoadedEventEnd: t.domContentLoadedEventEnd,
+			loadEventEnd: t.loadEventEnd,
+			navigationType: nav.type || 0,
+			redirectCount: nav.redirectCount || 0
+		});
+	}`)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return nil, ErrTimingUnavailable
+	}
+	var data timingJSON
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid timing: %s", err)
+	} else if data.NavigationStart == 0 {
+		return nil, ErrTimingUnavailable
+	}
+	return decodeTimingJSON(data), nil
+}
+
+// ResourceTiming represents the timing of a resource loaded by the current
+// document, from the browser's Resource Timing API. Phase durations are zero
+// for cross-origin resources which do not send a Timing-Allow-Origin header.
+type ResourceTiming struct {
+	URL           string
+	InitiatorType string // "img", "script", "link", "xmlhttprequest", etc.
+
+	// Time from the navigation start until the fetch started, and the time
+	// until the response finished.
+	StartTime time.Duration
+	Duration  time.Duration
+
+	// Durations of the individual phases of fetching the resource.
+	Redirect time.Duration
+	DNS      time.Duration
+	Connect  time.Duration
+	TTFB     time.Duration
+	Download time.Duration
+
+	// Size of the response, in bytes, if reported by the browser.
+	TransferSize int
+}
+
+// resourceTimingJSON is a raw PerformanceResourceTiming entry, in milliseconds.
+type resourceTimingJSON struct {
+	Name              string  `json:"name"`
+	InitiatorType     string  `json:"initiatorType"`
+	StartTime         float64 `json:"startTime"`
+	Duration          float64 `json:"duration"`
+	RedirectStart     float64 `json:"redirectStart"`
+	RedirectEnd       float64 `json:"redirectEnd"`
+	DomainLookupStart float64 `json:"domainLookupStart"`
+	DomainLookupEnd   float64 `json:"domainLookupEnd"`
+	ConnectStart      float64 `json:"connectStart"`
+	ConnectEnd        float64 `json:"connectEnd"`
+	RequestStart      float64 `json:"requestStart"`
+	ResponseStart     float64 `json:"responseStart"`
+	ResponseEnd       float64 `json:"responseEnd"`
+	TransferSize      int     `json:"transferSize"`
+}
+
+func decodeResourceTimingJSON(v resourceTimingJSON) *ResourceTiming {
+	ms := func(f float64) time.Duration { return time.Duration(f * float64(time.Millisecond)) }
+	span := func(start, end float64) time.Duration {
+		if start == 0 || end == 0 || end < start {
+			return 0
+		}
+		return ms(end - start)
+	}
+
+	return &ResourceTiming{
+		URL:           v.Name,
+		InitiatorType: v.InitiatorType,
+		StartTime:     ms(v.StartTime),
+		Duration:      ms(v.Duration),
+		Redirect:      span(v.RedirectStart, v.RedirectEnd),
+		DNS:           span(v.DomainLookupStart, v.DomainLookupEnd),
+		Connect:       span(v.ConnectStart, v.ConnectEnd),
+		TTFB:          span(v.RequestStart, v.ResponseStart),
+		Download:      span(v.ResponseStart, v.ResponseEnd),
+		TransferSize:  v.TransferSize,
+	}
+}
+
+// ResourceTimings returns the timing of each resource loaded by the current
+// document in the order they were fetched. The browser's buffer of entries
+// is limited, typically to 150 resources.
+//
+// PhantomJS does not implement the Resource Timing API so the timings are
+// built from the requests recorded for HAR() instead. Only StartTime,
+// Duration, TTFB, Download and TransferSize are set, StartTime is relative to
+// the most recent call to Open(), and InitiatorType is guessed from the
+// request's URL. Returns ErrTimingUnavailable if neither is available.
+func (p *WebPage) ResourceTimings() ([]*ResourceTiming, error) {
+	v, err := p.Evaluate(`function() {
+		if (!window.performance || typeof window.performance.getEntriesByType !== "function") {
+			return null;
+		}
+		var entries = window.performance.getEntriesByType("resource"), a = [];
+		for (var i = 0; i < entries.length; i++) {
+			var e = entries[i];
+			a.push({
+				name: e.name,
+				initiatorType: e.initiatorType,
+				startTime: e.startTime,
+				duration: e.duration,
+				redirectStart: e.redirectStart,
+				redirectEnd: e.redirectEnd,
+				domainLookupStart: e.domainLookupStart,
+				domainLookupEnd: e.domainLookupEnd,
+				connectStart: e.connectStart,
+				connectEnd: e.connectEnd,
+				requestStart: e.requestStart,
+				responseStart: e.responseStart,
+				responseEnd: e.responseEnd,
+				transferSize: e.transferSize || 0
+			});
+		}
+		return JSON.stringify(a);
+	}`)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return p.harResourceTimings()
+	}
+	var a []resourceTimingJSON
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid resource timing: %s", err)
+	}
+
+	out := make([]*ResourceTiming, len(a))
+	for i := range a {
+		out[i] = decodeResourceTimingJSON(a[i])
+	}
+	return out, nil
+}
+
+// harResourceTimings returns resource timings built from the page's network
+// log. The document and its redirects are skipped, as are requests which
+// have not completed.
+func (p *WebPage) harResourceTimings() ([]*ResourceTiming, error) {
+	var resp harJSON
+	if err := p.ref.process.doJSON("POST", "/webpage/HAR", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return nil, err
+	}
+	started, err := time.Parse(time.RFC3339Nano, resp.Started)
+	if err != nil {
+		return nil, ErrTimingUnavailable
+	}
+
+	out := []*ResourceTiming{}
+	var document string
+	for i, e := range resp.Entries {
+		if i == 0 || (document != "" && e.Request.URL == document) {
+			document = ""
+			if e.End != nil {
+				document = e.End.RedirectURL
+			}
+			continue
+		} else if e.Start == nil || e.End == nil {
+			continue
+		}
+
+		t, _ := time.Parse(time.RFC3339Nano, e.Request.Time)
+		start, end := decodeResourceResponseJSON(*e.Start), decodeResourceResponseJSON(*e.End)
+		timing := &ResourceTiming{
+			URL:           e.Request.URL,
+			InitiatorType: guessInitiatorType(e.Request),
+			StartTime:     t.Sub(started),
+			Duration:      end.Time.Sub(t),
+			TTFB:          start.Time.Sub(t),
+			Download:      end.Time.Sub(start.Time),
+			TransferSize:  end.BodySize,
+		}
+		if timing.TransferSize == 0 {
+			timing.TransferSize = start.BodySize
+		}
+		out = append(out, timing)
+	}
+	return out, nil
+}
+
+// initiatorTypes maps URL extensions to the initiator type which usually
+// requests them.
+var initiatorTypes = []struct {
+	re  *regexp.Regexp
+	typ string
+}{
+	{regexp.MustCompile(`(?i)\.js([?#].*)?$`), "script"},
+	{regexp.MustCompile(`(?i)\.css([?#].*)?$`), "link"},
+	{regexp.MustCompile(`(?i)\.(png|jpe?g|gif|webp|svg|ico|bmp)([?#].*)?$`), "img"},
+}
+
+// guessInitiatorType returns the likely Resource Timing initiator type of a
+// request.
+func guessInitiatorType(req resourceRequestJSON) string {
+	if req.XHR {
+		return "xmlhttprequest"
+	}
+	for _, t := range initiatorTypes {
+		if t.re.MatchString(req.URL) {
+			return t.typ
+		}
+	}
+	return "other"
+}
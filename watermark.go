@@ -0,0 +1,361 @@
+package phantomjs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+)
+
+// ErrEmptyWatermark is returned when rendering with a watermark which has
+// neither an image nor text.
+var ErrEmptyWatermark = errors.New("watermark has no image or text")
+
+// Default watermark settings.
+const (
+	DefaultWatermarkOpacity = 0.5
+	DefaultWatermarkFont    = "bold 48px sans-serif"
+	DefaultWatermarkColor   = "#000"
+)
+
+// pdfWatermarkScale is the pixel density text watermarks are rendered at for
+// PDFs so they stay sharp when printed or zoomed.
+const pdfWatermarkScale = 4
+
+// WatermarkPosition represents where a watermark is placed.
+type WatermarkPosition int
+
+const (
+	WatermarkCenter WatermarkPosition = iota // default
+	WatermarkTopLeft
+	WatermarkTopRight
+	WatermarkBottomLeft
+	WatermarkBottomRight
+)
+
+// Watermark represents an image or text drawn over rendered output, such as a
+// logo or a "PREVIEW" stamp.
+type Watermark struct {
+	// Image drawn as the watermark. If not set then Text is rendered by
+	// PhantomJS with the CSS Font and Color, which default to
+	// DefaultWatermarkFont and DefaultWatermarkColor.
+	Image image.Image
+	Text  string
+	Font  string
+	Color string
+
+	// Placement of the watermark and its distance from the edges, in CSS
+	// pixels.
+	Position WatermarkPosition
+	Margin   int
+
+	// Opacity from 0 to 1. Defaults to DefaultWatermarkOpacity.
+	Opacity float64
+}
+
+// opacity returns the watermark's opacity, applying the default.
+func (wm *Watermark) opacity() float64 {
+	switch {
+	case wm.Opacity <= 0:
+		return DefaultWatermarkOpacity
+	case wm.Opacity > 1:
+		return 1
+	default:
+		return wm.Opacity
+	}
+}
+
+// rect returns where a watermark of size is placed within bounds, with margin
+// already scaled to the units of bounds.
+func (wm *Watermark) rect(bounds image.Rectangle, size image.Point, margin int) image.Rectangle {
+	var pt image.Point
+	switch wm.Position {
+	case WatermarkTopLeft:
+		pt = image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin)
+	case WatermarkTopRight:
+		pt = image.Pt(bounds.Max.X-margin-size.X, bounds.Min.Y+margin)
+	case WatermarkBottomLeft:
+		pt = image.Pt(bounds.Min.X+margin, bounds.Max.Y-margin-size.Y)
+	case WatermarkBottomRight:
+		pt = image.Pt(bounds.Max.X-margin-size.X, bounds.Max.Y-margin-size.Y)
+	default:
+		pt = image.Pt(bounds.Min.X+(bounds.Dx()-size.X)/2, bounds.Min.Y+(bounds.Dy()-size.Y)/2)
+	}
+	return image.Rectangle{Min: pt, Max: pt.Add(size)}
+}
+
+// watermarkImage returns the watermark's image, rendering its text with a
+// temporary page at scale if it has no image.
+func (p *WebPage) watermarkImage(wm *Watermark, scale float64) (image.Image, error) {
+	if wm.Image != nil {
+		return wm.Image, nil
+	} else if wm.Text == "" {
+		return nil, ErrEmptyWatermark
+	}
+
+	font, textColor := wm.Font, wm.Color
+	if font == "" {
+		font = DefaultWatermarkFont
+	}
+	if textColor == "" {
+		textColor = DefaultWatermarkColor
+	}
+
+	page, err := p.ref.process.CreateWebPage()
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	content := fmt.Sprintf(`<html><body style="margin:0;background:transparent"><span id="watermark" style="display:inline-block;white-space:nowrap;font:%s;color:%s">%s</span></body></html>`,
+		html.EscapeString(font), html.EscapeString(textColor), html.EscapeString(wm.Text))
+	if err := page.SetContent(content); err != nil {
+		return nil, err
+	} else if err := page.SetClipRectToElement("#watermark"); err != nil {
+		return nil, err
+	}
+	return page.RenderImage(RenderOptions{Format: "png", Scale: scale})
+}
+
+// drawWatermark returns a copy of img with the watermark drawn over it. The
+// margin is scaled by scale to match the density of img.
+func drawWatermark(img, mark image.Image, wm *Watermark, scale float64) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	r := wm.rect(b, mark.Bounds().Size(), int(float64(wm.Margin)*scale))
+	mask := image.NewUniform(color.Alpha{A: uint8(wm.opacity() * 0xFF)})
+	draw.DrawMask(out, r, mark, mark.Bounds().Min, mask, image.ZP, draw.Over)
+	return out
+}
+
+// stampPDF returns data with mark drawn over every page as an incremental
+// update. The mark is sized as an image of the given pixel density at 96 DPI.
+func stampPDF(data []byte, mark image.Image, wm *Watermark, scale float64) ([]byte, error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := doc.pages()
+	if err != nil {
+		return nil, err
+	}
+
+	// Returns the dictionary of an object, including pending changes.
+	updates := make(map[int][]byte)
+	dict := func(num int) ([]byte, error) {
+		if b, ok := updates[num]; ok {
+			return b, nil
+		} else if obj := doc.objects[num]; obj != nil && obj.tail == nil {
+			return bytes.TrimSpace(obj.head), nil
+		}
+		return nil, ErrUnsupportedPDF
+	}
+
+	next := doc.size + 1
+	alloc := func(b []byte) int {
+		num := next
+		next++
+		updates[num] = b
+		return num
+	}
+
+	// Write the image, with the opacity applied to its alpha channel, and the
+	// content which saves the graphics state before each page's content. The
+	// name is unique so earlier watermarks keep drawing their own image.
+	imageNum := alloc(nil)
+	updates[imageNum] = pdfImage(mark, wm.opacity(), alloc(nil), updates)
+	saveNum := alloc(pdfStream("", []byte("q")))
+	name := fmt.Sprintf("PhantomJSWatermark%d", imageNum)
+
+	// Adds the image to a resource dictionary.
+	ref := fmt.Sprintf("%d 0 R", imageNum)
+	addXObject := func(res []byte) ([]byte, error) {
+		start, end, ok := pdfLookup(res, "XObject")
+		if !ok {
+			return pdfSet(res, "XObject", "<< /"+name+" "+ref+" >>"), nil
+		} else if num, ok := pdfRefNum(res[start:end]); ok {
+			xobjects, err := dict(num)
+			if err != nil {
+				return nil, err
+			}
+			updates[num] = pdfSet(xobjects, name, ref)
+			return res, nil
+		}
+		return bytes.Join([][]byte{res[:start], pdfSet(res[start:end], name, ref), res[end:]}, nil), nil
+	}
+
+	edited := make(map[int]bool)
+	for _, num := range pages {
+		page, err := dict(num)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add the image to the page's resources, which may be inherited.
+		res, ok := doc.inherited(num, "Resources")
+		if !ok {
+			res = []byte("<< >>")
+		}
+		if resNum, ok := pdfRefNum(res); ok {
+			if !edited[resNum] {
+				b, err := dict(resNum)
+				if err != nil {
+					return nil, err
+				} else if updates[resNum], err = addXObject(b); err != nil {
+					return nil, err
+				}
+				edited[resNum] = true
+			}
+		} else if res, err = addXObject(res); err != nil {
+			return nil, err
+		}
+		page = pdfSet(page, "Resources", string(res))
+
+		// Position the image on the page's media box.
+		box := image.Rect(0, 0, 612, 792)
+		if v, ok := doc.inherited(num, "MediaBox"); ok {
+			if a := bytes.Fields(bytes.Trim(v, "[] \r\n")); len(a) == 4 {
+				var f [4]float64
+				for i := range a {
+					f[i], _ = strconv.ParseFloat(string(a[i]), 64)
+				}
+				box = image.Rect(int(f[0]), int(f[1]), int(f[2]), int(f[3]))
+			}
+		}
+		size := mark.Bounds().Size()
+		w, h := float64(size.X)*0.75/scale, float64(size.Y)*0.75/scale
+		r := wm.rect(box, image.Pt(int(w), int(h)), int(float64(wm.Margin)*0.75))
+
+		// PDF coordinates start at the bottom so the vertical position
+		// is flipped within the box.
+		y := float64(box.Min.Y + box.Max.Y - r.Max.Y)
+		content := fmt.Sprintf("Q q %.2f 0 0 %.2f %d %.2f cm /%s Do Q", w, h, r.Min.X, y, name)
+		contentNum := alloc(pdfStream("", []byte(content)))
+
+		// Wrap the existing content so its graphics state is restored
+		// before the image is drawn.
+		var inner []byte
+		if start, end, ok := pdfLookup(page, "Contents"); ok {
+			inner = page[start:end]
+			if n, ok := pdfRefNum(inner); ok {
+				if b, err := dict(n); err == nil && bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+					inner = b
+				}
+			}
+			inner = bytes.TrimSuffix(bytes.TrimPrefix(bytes.TrimSpace(inner), []byte("[")), []byte("]"))
+		}
+		page = pdfSet(page, "Contents", fmt.Sprintf("[%d 0 R %s %d 0 R]", saveNum, inner, contentNum))
+		updates[num] = page
+	}
+	return appendPDFUpdate(data, doc, updates), nil
+}
+
+// pdfImage returns an image XObject of img with its alpha channel, scaled by
+// opacity, written as a soft mask to object smaskNum in updates.
+func pdfImage(img image.Image, opacity float64, smaskNum int, updates map[int][]byte) []byte {
+	b := img.Bounds()
+	rgb := make([]byte, 0, b.Dx()*b.Dy()*3)
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			rgb = append(rgb, c.R, c.G, c.B)
+			alpha = append(alpha, uint8(float64(c.A)*opacity))
+		}
+	}
+
+	header := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /BitsPerComponent 8 /Filter /FlateDecode", b.Dx(), b.Dy())
+	updates[smaskNum] = pdfStream(header+" /ColorSpace /DeviceGray", deflate(alpha))
+	return pdfStream(fmt.Sprintf("%s /ColorSpace /DeviceRGB /SMask %d 0 R", header, smaskNum), deflate(rgb))
+}
+
+// pdfStream returns a stream object of data with extra dictionary entries.
+func pdfStream(entries string, data []byte) []byte {
+	var buf bytes.Buffer
+	if entries != "" {
+		entries += " "
+	}
+	fmt.Fprintf(&buf, "<< %s/Length %d >>\nstream\n", entries, len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream")
+	return buf.Bytes()
+}
+
+// deflate compresses data for the FlateDecode filter.
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// pages returns the object numbers of the document's pages in order.
+func (doc *pdfDocument) pages() ([]int, error) {
+	catalog := doc.objects[doc.root]
+	if catalog == nil {
+		return nil, ErrUnsupportedPDF
+	}
+	start, end, ok := pdfLookup(catalog.head, "Pages")
+	if !ok {
+		return nil, ErrUnsupportedPDF
+	}
+	root, ok := pdfRefNum(catalog.head[start:end])
+	if !ok {
+		return nil, ErrUnsupportedPDF
+	}
+
+	var pages []int
+	var visit func(num, depth int) error
+	visit = func(num, depth int) error {
+		obj := doc.objects[num]
+		if obj == nil || depth > 32 {
+			return ErrUnsupportedPDF
+		}
+		start, end, ok := pdfLookup(obj.head, "Kids")
+		if !ok {
+			pages = append(pages, num)
+			return nil
+		}
+		for _, m := range pdfRefRegexp.FindAllSubmatch(obj.head[start:end], -1) {
+			kid, _ := strconv.Atoi(string(m[1]))
+			if err := visit(kid, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(root, 0); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// inherited returns the value of key on a page or the nearest of its parents
+// in the page tree.
+func (doc *pdfDocument) inherited(num int, key string) ([]byte, bool) {
+	for depth := 0; depth < 32; depth++ {
+		obj := doc.objects[num]
+		if obj == nil {
+			return nil, false
+		} else if start, end, ok := pdfLookup(obj.head, key); ok {
+			return obj.head[start:end], true
+		}
+
+		start, end, ok := pdfLookup(obj.head, "Parent")
+		if !ok {
+			return nil, false
+		}
+		if num, ok = pdfRefNum(obj.head[start:end]); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,19 @@
+//go:build webp
+// +build webp
+
+package phantomjs
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// WebP rendering is only available when building with the "webp" tag, such
+// as "go build -tags webp", so the package does not depend on libwebp.
+func init() {
+	encodeWebP = func(w io.Writer, img image.Image, quality int) error {
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	}
+}
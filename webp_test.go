@@ -0,0 +1,37 @@
+//go:build webp
+// +build webp
+
+package phantomjs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func init() { webpSupported = true }
+
+// Ensure pages can be rendered to WebP when built with the webp tag.
+func TestWebPage_RenderBytes_WebP(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetViewportSize(100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render & decode image and verify dimensions.
+	if buf, err := page.RenderBytes("webp", 80); err != nil {
+		t.Fatal(err)
+	} else if img, err := webp.Decode(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 200 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+}